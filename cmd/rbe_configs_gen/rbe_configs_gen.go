@@ -14,6 +14,11 @@
 //
 // Binary rbe_configs_gen provides the ability to generate toolchain targets along with a default
 // platform target to configure Bazel to run actions remotely.
+//
+// Running "rbe_configs_gen verify <flags>" instead checks whether the configs previously generated
+// into --output_src_root with the same flags are up to date, e.g., in CI. It regenerates the
+// configs into a temporary directory, prints a unified diff of the differences with the existing
+// configs & manifest and exits with a non-zero status if there are any.
 package main
 
 import (
@@ -22,38 +27,68 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/bazelbuild/bazel-toolchains/pkg/monitoring"
 	"github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen"
 )
 
+const (
+	// verifyCmd is the subcommand verifying previously generated configs are up to date.
+	verifyCmd = "verify"
+)
+
 var (
 	// Mandatory input arguments.
 	toolchainContainer = flag.String("toolchain_container", "", "Repository path to toolchain image to generate configs for. E.g., l.gcr.io/google/rbe-ubuntu16-04:latest")
 	execOS             = flag.String("exec_os", "", "The OS (linux|windows) of the toolchain container image a.k.a, the execution platform in Bazel.")
 	targetOS           = flag.String("target_os", "", "The OS (linux|windows) artifacts built will target a.k.a, the target platform in Bazel.")
+	execArch           = flag.String("exec_arch", "", "(Optional) The CPU architecture (x86_64|aarch64) of the toolchain container image a.k.a, the execution platform in Bazel. Defaults to x86_64. If specified, --docker_platform defaults to the matching platform, e.g., linux/arm64 for aarch64.")
+	targetArch         = flag.String("target_arch", "", "(Optional) The CPU architecture (x86_64|aarch64) artifacts built will target a.k.a, the target platform in Bazel. Must be the same as --exec_arch when generating C++ configs. Defaults to --exec_arch.")
 	dockerPlatform     = flag.String("docker_platform", "", "(Optional) Set platform when creating container, if given the Docker server is multi-platform capable.")
+	containerRuntime   = flag.String("container_runtime", "", "(Optional) The container runtime (docker|podman|nerdctl|docker-api|rootfs) used to run the toolchain container. docker-api talks to the docker daemon directly over its unix socket instead of using the docker CLI and forwards the registry credentials configured for the docker CLI, including credential helpers, when pulling. rootfs unpacks the image specified by --image_archive and runs commands in it using bubblewrap without a container daemon. Defaults to rootfs if --image_archive is specified and docker otherwise.")
+	imageArchive       = flag.String("image_archive", "", "(Optional) Path to an OCI image layout directory or tarball or a 'docker save' tarball containing the toolchain container image. Configs are generated by unpacking the image without needing a container daemon. --toolchain_container is still required to reference the image in the generated platform and should reference the image by digest for 'docker save' tarballs.")
+
+	// Optional platform customization arguments.
+	platformParent        = flag.String("platform_parent", "", "(Optional) Label of the parent of the generated platform. Defaults to @local_config_platform//:host.")
+	extraConstraintValues = flag.String("extra_constraint_values", "", "(Optional) Comma separated list of constraint values to add to the generated platform in addition to the exec OS & CPU constraints. E.g., //constraints:sandboxed.")
+	execProperties        = flag.String("exec_properties", "", "(Optional) Comma separated list of key=value exec properties to add to the generated platform in addition to the container image & OS family. E.g., dockerNetwork=standard,Pool=default,label:team=infra. Values of exec properties known to RBE are validated.")
 
 	// Optional input arguments.
 	bazelVersion = flag.String("bazel_version", "", "(Optional) Bazel release version to generate configs for. E.g., 4.0.0. If unspecified, the latest available Bazel release is picked.")
 	bazelPath    = flag.String("bazel_path", "", "(Optional) Path to preinstalled Bazel within the container. If unspecified, Bazelisk will be downloaded and installed.")
+	configFile   = flag.String("config_file", "", "(Optional) YAML or JSON config file describing the toolchain container to generate configs for or several toolchain containers to generate a single configs bundle for under 'configs'. In a bundle, each container's configs are written to a subpackage named after it alongside a top level BUILD file with aliases to all platforms & toolchains. Container specific flags are ignored, --bazel_version is used for containers that don't specify one and the output, --temp_work_dir & --cleanup flags override the values in the file.")
 
 	// Arguments affecting output generation not specific to either C++ or Java Configs.
 	outputTarball    = flag.String("output_tarball", "", "(Optional) Path where a tarball with the generated configs will be created.")
+	outputFormat     = flag.String("output_format", "", "(Optional) Format (tar|tar.gz|tar.zst|zip) of the archive specified to --output_tarball. Defaults to the format matching the extension of --output_tarball, e.g., tar.zst for configs.tar.zst, or to tar.")
 	outputSrcRoot    = flag.String("output_src_root", "", "(Optional) Path to root directory of Bazel repository where generated configs should be copied to. Configs aren't copied if this is blank. Use '.' to specify the current directory.")
 	outputConfigPath = flag.String("output_config_path", "", "(Optional) Path relative to what was specified to --output_src_root where configs will be extracted. Defaults to root if unspecified. --output_src_root is mandatory if this argument is specified.")
+	configsRepoName  = flag.String("configs_repo_name", "", "(Optional) Name of the external repository the configs tarball will be extracted into. Determines the labels used in the generated configs.bazelrc when configs aren't copied into --output_src_root. Defaults to rbe_default.")
+	outputMode       = flag.String("output_mode", "", "(Optional) How the generated configs will be consumed (workspace|bzlmod). workspace lays out the configs for a WORKSPACE repository rule like http_archive or for use from --output_src_root. bzlmod additionally generates a MODULE.bazel registering the platforms & toolchains so the configs can be consumed as a module named after --configs_repo_name using a local_path_override or archive_override. bzlmod requires Bazel 6.0.0 or newer. Defaults to workspace.")
 	outputManifest   = flag.String("output_manifest", "", "(Optional) Generate a JSON file with details about the generated configs.")
 
-	// Optional input arguments that affect config generation for either C++ or Java configs.
+	// Optional input arguments that affect config generation for the configs of a language.
 	genCppConfigs       = flag.Bool("generate_cpp_configs", true, "(Optional) Generate C++ configs. Defaults to true.")
 	cppEnvJSON          = flag.String("cpp_env_json", "", "(Optional) JSON file containing a str -> str dict of environment variables to be set when generating C++ configs inside the toolchain container. This replaces any exec OS specific defaults that would usually be applied.")
-	cppToolchainTarget  = flag.String("cpp_toolchain_target", "", "(Optional) Set the CPP toolchain target. When exec_os is linux, the default is cc-compiler-k8. When exec_os is windows, the default is cc-compiler-x64_windows.")
+	cppConfigMode       = flag.String("cpp_config_mode", "", "(Optional) How C++ configs are generated (bazel|static). bazel runs Bazel's C++ toolchain autodetection inside the toolchain container. static inspects the compiler, include directories & libc installed in the image without running Bazel and requires --container_runtime=rootfs. Defaults to bazel.")
+	cppSymlinkMode      = flag.String("cpp_symlink_mode", "", "(Optional) How symlinks in the C++ configs generated by Bazel are written to the output (preserve|inline). preserve re-creates them as relative symlinks. inline replaces them with copies of the files they point to. Symlinks may not be supported by Windows checkouts or some artifact stores. Defaults to inline.")
+	cppToolchainTarget  = flag.String("cpp_toolchain_target", "", "(Optional) Set the CPP toolchain target. When exec_os is linux, the default is cc-compiler-k8 or cc-compiler-aarch64 if exec_arch is aarch64. When exec_os is windows, the default is cc-compiler-x64_windows.")
 	genJavaConfigs      = flag.Bool("generate_java_configs", true, "(Optional) Generate Java configs. Defaults to true.")
 	javaUseLocalRuntime = flag.Bool("java_use_local_runtime", false, "(Optional) Make the generated java toolchain use the new local_java_runtime rule instead of java_runtime. Otherwise, the Bazel version will be used to infer which rule to use.")
+	genJavaToolchains   = flag.Bool("generate_java_toolchains", false, "(Optional) Generate a Java toolchain compiling with each JDK found in the toolchain container & register it for the exec & target constraints of the generated platform instead of relying on the Java toolchains of Bazel that download a remote JDK. Ignored for Bazel versions older than 5.0.0, which keep using @bazel_tools//tools/jdk:toolchain_hostjdk8, unless --java_use_local_runtime is specified.")
+	javaHomeGlobs       = flag.String("java_home_globs", "", "(Optional) Comma separated list of glob patterns of JDK installation directories in the toolchain container, e.g., /usr/lib/jvm/*. A Java runtime named after its major version, e.g., rbe_jdk_17, is generated for every matching directory with a bin/java executable in addition to the JDK in JAVA_HOME. Defaults to only using the JDK in JAVA_HOME.")
+	javaDefaultVersion  = flag.String("java_default_version", "", "(Optional) Java major version of the JDK the generated jdk alias points to, e.g., 17. Defaults to the JDK in JAVA_HOME or to the newest JDK if JAVA_HOME isn't set.")
+	genPythonConfigs    = flag.Bool("generate_python_configs", false, "(Optional) Generate Python configs, i.e., a py_runtime for every python3 interpreter found in the toolchain container & a Python toolchain using the python3 in the PATH of the container. Only supported when exec_os is linux. Defaults to false.")
+	genGoConfigs        = flag.Bool("generate_go_configs", false, "(Optional) Generate Go configs, i.e., a go/sdk.bzl file declaring the Go SDK found in the toolchain container with rules_go to be loaded from the WORKSPACE file. Bazel has to run where the SDK is installed at the same path, e.g., in the toolchain container. Only supported when exec_os is linux. Defaults to false.")
+	genRustConfigs      = flag.Bool("generate_rust_configs", false, "(Optional) Generate Rust configs, i.e., a rust/toolchain.bzl file declaring a rules_rust toolchain for the sysroot of the rustc found in the toolchain container to be loaded from the WORKSPACE file. Bazel has to run where the sysroot is installed at the same path, e.g., in the toolchain container. Only supported when exec_os is linux. Defaults to false.")
+	templateDir         = flag.String("template_dir", "", "(Optional) Directory with templates overriding the built-in templates of the generated BUILD files, e.g., to use a custom license header or load internal rules. config/BUILD.tmpl overrides the crosstool top/platform BUILD file, java/BUILD.tmpl overrides the Java toolchain BUILD file and python/BUILD.tmpl overrides the Python toolchain BUILD file. The templates use the Go text/template syntax and are checked for references to unknown fields before configs are generated.")
 
 	// Other misc arguments.
 	tempWorkDir = flag.String("temp_work_dir", "", "(Optional) Temporary directory to use to store intermediate files. Defaults to a temporary directory automatically allocated by the OS. The temporary working directory is deleted at the end unless --cleanup=false is specified.")
 	cleanup     = flag.Bool("cleanup", true, "(Optional) Stop running container & delete intermediate files. Defaults to true. Set to false for debugging.")
+	dryRun      = flag.Bool("dry_run", false, "(Optional) Generate configs but only log the files that would be added, updated & removed in --output_src_root instead of writing them. Neither --output_tarball nor --output_manifest are written. Defaults to false.")
 
 	// Google Cloud Monitoring options. Used by internal automation only.
 	enableMonitoring      = flag.Bool("enable_monitoring", false, "(Optional) Enables reporting reporting results to Google Cloud Monitoring. Defaults to false.")
@@ -63,8 +98,12 @@ var (
 
 // printFlag prints flag values with the intent of allowing easy copy paste of flags to rerun this
 // binary. Printing defaults are skipped as much as possible to avoid cluttering the output.
-func printFlags() {
-	log.Println("rbe_configs_gen.go \\")
+func printFlags(verify bool) {
+	if verify {
+		log.Printf("rbe_configs_gen.go %s \\", verifyCmd)
+	} else {
+		log.Println("rbe_configs_gen.go \\")
+	}
 	log.Printf("--toolchain_container=%q \\", *toolchainContainer)
 	log.Printf("--exec_os=%q \\", *execOS)
 	log.Printf("--target_os=%q \\", *targetOS)
@@ -72,15 +111,51 @@ func printFlags() {
 	if len(*bazelPath) != 0 {
 		log.Printf("--bazel_path=%q \\", *bazelPath)
 	}
+	if len(*configFile) != 0 {
+		log.Printf("--config_file=%q \\", *configFile)
+	}
+	if len(*execArch) != 0 {
+		log.Printf("--exec_arch=%q \\", *execArch)
+	}
+	if len(*targetArch) != 0 {
+		log.Printf("--target_arch=%q \\", *targetArch)
+	}
+	if len(*dockerPlatform) != 0 {
+		log.Printf("--docker_platform=%q \\", *dockerPlatform)
+	}
+	if len(*containerRuntime) != 0 {
+		log.Printf("--container_runtime=%q \\", *containerRuntime)
+	}
+	if len(*imageArchive) != 0 {
+		log.Printf("--image_archive=%q \\", *imageArchive)
+	}
+	if len(*platformParent) != 0 {
+		log.Printf("--platform_parent=%q \\", *platformParent)
+	}
+	if len(*extraConstraintValues) != 0 {
+		log.Printf("--extra_constraint_values=%q \\", *extraConstraintValues)
+	}
+	if len(*execProperties) != 0 {
+		log.Printf("--exec_properties=%q \\", *execProperties)
+	}
 	if len(*outputTarball) != 0 {
 		log.Printf("--output_tarball=%q \\", *outputTarball)
 	}
+	if len(*outputFormat) != 0 {
+		log.Printf("--output_format=%q \\", *outputFormat)
+	}
 	if len(*outputSrcRoot) != 0 {
 		log.Printf("--output_src_root=%q \\", *outputSrcRoot)
 	}
 	if len(*outputConfigPath) != 0 {
 		log.Printf("--output_config_path=%q \\", *outputConfigPath)
 	}
+	if len(*configsRepoName) != 0 {
+		log.Printf("--configs_repo_name=%q \\", *configsRepoName)
+	}
+	if len(*outputMode) != 0 {
+		log.Printf("--output_mode=%q \\", *outputMode)
+	}
 	if len(*outputManifest) != 0 {
 		log.Printf("--output_manifest=%q \\", *outputManifest)
 	}
@@ -90,18 +165,48 @@ func printFlags() {
 	if len(*cppEnvJSON) != 0 {
 		log.Printf("--cpp_env_json=%q \\", *cppEnvJSON)
 	}
+	if len(*cppConfigMode) != 0 {
+		log.Printf("--cpp_config_mode=%q \\", *cppConfigMode)
+	}
+	if len(*cppSymlinkMode) != 0 {
+		log.Printf("--cpp_symlink_mode=%q \\", *cppSymlinkMode)
+	}
 	if !(*genJavaConfigs) {
 		log.Printf("--generate_java_configs=%v \\", *genJavaConfigs)
 	}
 	if *javaUseLocalRuntime {
 		log.Printf("--java_use_local_runtime=%v \\", *javaUseLocalRuntime)
 	}
+	if *genJavaToolchains {
+		log.Printf("--generate_java_toolchains=%v \\", *genJavaToolchains)
+	}
+	if len(*javaHomeGlobs) != 0 {
+		log.Printf("--java_home_globs=%q \\", *javaHomeGlobs)
+	}
+	if len(*javaDefaultVersion) != 0 {
+		log.Printf("--java_default_version=%q \\", *javaDefaultVersion)
+	}
+	if *genPythonConfigs {
+		log.Printf("--generate_python_configs=%v \\", *genPythonConfigs)
+	}
+	if *genGoConfigs {
+		log.Printf("--generate_go_configs=%v \\", *genGoConfigs)
+	}
+	if *genRustConfigs {
+		log.Printf("--generate_rust_configs=%v \\", *genRustConfigs)
+	}
+	if len(*templateDir) != 0 {
+		log.Printf("--template_dir=%q \\", *templateDir)
+	}
 	if len(*tempWorkDir) != 0 {
 		log.Printf("--temp_work_dir=%q \\", *tempWorkDir)
 	}
 	if !(*cleanup) {
 		log.Printf("--cleanup=%v \\", *cleanup)
 	}
+	if *dryRun {
+		log.Printf("--dry_run=%v \\", *dryRun)
+	}
 	if *enableMonitoring {
 		log.Printf("--enable_monitoring=%v \\", *enableMonitoring)
 	}
@@ -130,24 +235,172 @@ func initMonitoringClient(ctx context.Context) (*monitoring.Client, error) {
 	return c, nil
 }
 
+// parseExecProperties parses the given comma separated list of key=value exec properties.
+func parseExecProperties(s string) (map[string]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]string)
+	for _, p := range strings.Split(s, ",") {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("exec property %q wasn't of the form key=value", p)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
+
 // genConfigs is just a wrapper for the config generation code so that the caller can report
-// results if monitoring is enabled before exiting.
-func genConfigs(o rbeconfigsgen.Options) error {
+// results if monitoring is enabled before exiting. If verify is true, the configs are verified
+// instead of generated.
+func genConfigs(o rbeconfigsgen.Options, verify bool) error {
 	if err := o.ApplyDefaults(o.ExecOS); err != nil {
 		return fmt.Errorf("failed to apply default options for OS name %q specified to --exec_os: %w", *execOS, err)
 	}
+	props, err := parseExecProperties(*execProperties)
+	if err != nil {
+		return fmt.Errorf("invalid value for --exec_properties: %w", err)
+	}
+	o.PlatformParams.Parent = *platformParent
+	o.PlatformParams.ExecProperties = props
+	if len(*extraConstraintValues) != 0 {
+		o.PlatformParams.ExtraConstraints = strings.Split(*extraConstraintValues, ",")
+	}
+	if len(*javaHomeGlobs) != 0 {
+		o.JavaHomeGlobs = strings.Split(*javaHomeGlobs, ",")
+	}
 	if err := o.Validate(); err != nil {
 		return fmt.Errorf("Failed to validate command line arguments: %v", err)
 	}
+	if verify {
+		return verifyConfigs(o)
+	}
 	if err := rbeconfigsgen.Run(o); err != nil {
 		return fmt.Errorf("Config generation failed: %v", err)
 	}
 	return nil
 }
 
+// isFlagSet returns whether the flag with the given name was explicitly specified on the command
+// line.
+func isFlagSet(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// overrideFromFlags overrides the given settings read from a config file with the values of the
+// corresponding flags that were explicitly specified on the command line.
+func overrideFromFlags(tarball, format, srcRoot, configPath, repoName, mode, manifest, workDir *string, cleanupWorkDir, dryRunOutput *bool) {
+	if len(*outputTarball) != 0 {
+		*tarball = *outputTarball
+	}
+	if len(*outputFormat) != 0 {
+		*format = *outputFormat
+	}
+	if len(*outputSrcRoot) != 0 {
+		*srcRoot = *outputSrcRoot
+	}
+	if len(*outputConfigPath) != 0 {
+		*configPath = *outputConfigPath
+	}
+	if len(*configsRepoName) != 0 {
+		*repoName = *configsRepoName
+	}
+	if len(*outputMode) != 0 {
+		*mode = *outputMode
+	}
+	if len(*outputManifest) != 0 {
+		*manifest = *outputManifest
+	}
+	if len(*tempWorkDir) != 0 {
+		*workDir = *tempWorkDir
+	}
+	if isFlagSet("cleanup") {
+		*cleanupWorkDir = *cleanup
+	}
+	// Dry runs can only be requested on the command line.
+	*dryRunOutput = *dryRun
+}
+
+// genFromConfigFile generates configs for the toolchain container or the configs bundle described
+// in the given config file. If verify is true, the configs for the toolchain container are
+// verified instead of generated.
+func genFromConfigFile(configFile string, verify bool) error {
+	c, err := rbeconfigsgen.ConfigFromFile(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read --config_file: %w", err)
+	}
+	if c.Bundle != nil {
+		if verify {
+			return fmt.Errorf("verifying configs bundles isn't supported but config file %q describes a bundle", configFile)
+		}
+		return genBundle(configFile, c.Bundle)
+	}
+	o := c.Options
+	overrideFromFlags(&o.OutputTarball, &o.OutputFormat, &o.OutputSourceRoot, &o.OutputConfigPath, &o.ConfigsRepoName, &o.OutputMode, &o.OutputManifest, &o.TempWorkDir, &o.Cleanup, &o.DryRun)
+	if o.BazelVersion == "" {
+		o.BazelVersion = *bazelVersion
+	}
+	if err := o.Validate(); err != nil {
+		return fmt.Errorf("Failed to validate config file %q: %v", configFile, err)
+	}
+	if verify {
+		return verifyConfigs(*o)
+	}
+	if err := rbeconfigsgen.Run(*o); err != nil {
+		return fmt.Errorf("Config generation failed: %v", err)
+	}
+	return nil
+}
+
+// genBundle generates a configs bundle for the toolchain containers described in the given bundle
+// options read from the given config file.
+func genBundle(configFile string, b *rbeconfigsgen.BundleOptions) error {
+	overrideFromFlags(&b.OutputTarball, &b.OutputFormat, &b.OutputSourceRoot, &b.OutputConfigPath, &b.ConfigsRepoName, &b.OutputMode, &b.OutputManifest, &b.TempWorkDir, &b.Cleanup, &b.DryRun)
+	for i := range b.Entries {
+		if b.Entries[i].Options.BazelVersion == "" {
+			b.Entries[i].Options.BazelVersion = *bazelVersion
+		}
+	}
+	if err := b.Validate(); err != nil {
+		return fmt.Errorf("Failed to validate config file %q: %v", configFile, err)
+	}
+	if err := rbeconfigsgen.RunMulti(*b); err != nil {
+		return fmt.Errorf("Config generation failed: %v", err)
+	}
+	return nil
+}
+
+// verifyConfigs regenerates the configs for the given options & prints a unified diff of the
+// differences with the configs previously generated into the output directory to stdout. Returns
+// an error if the configs are out of date.
+func verifyConfigs(o rbeconfigsgen.Options) error {
+	upToDate, err := rbeconfigsgen.Verify(o, os.Stdout)
+	if err != nil {
+		return fmt.Errorf("Config verification failed: %v", err)
+	}
+	if !upToDate {
+		return fmt.Errorf("configs in %q are out of date, rerun without %q to regenerate them", path.Join(o.OutputSourceRoot, o.OutputConfigPath), verifyCmd)
+	}
+	return nil
+}
+
 func main() {
-	flag.Parse()
-	printFlags()
+	// The verify subcommand precedes the flags.
+	args := os.Args[1:]
+	verify := len(args) != 0 && args[0] == verifyCmd
+	if verify {
+		args = args[1:]
+	}
+	// Exits on errors.
+	flag.CommandLine.Parse(args)
+	printFlags(verify)
 
 	ctx := context.Background()
 	mc, err := initMonitoringClient(ctx)
@@ -160,30 +413,57 @@ func main() {
 		BazelPath:              *bazelPath,
 		ToolchainContainer:     *toolchainContainer,
 		DockerPlatform:         *dockerPlatform,
+		ContainerRuntime:       *containerRuntime,
+		ImageArchive:           *imageArchive,
 		ExecOS:                 *execOS,
 		TargetOS:               *targetOS,
+		ExecArch:               *execArch,
+		TargetArch:             *targetArch,
 		OutputTarball:          *outputTarball,
+		OutputFormat:           *outputFormat,
 		OutputSourceRoot:       *outputSrcRoot,
 		OutputConfigPath:       *outputConfigPath,
+		ConfigsRepoName:        *configsRepoName,
+		OutputMode:             *outputMode,
 		OutputManifest:         *outputManifest,
 		GenCPPConfigs:          *genCppConfigs,
 		CppGenEnvJSON:          *cppEnvJSON,
 		CPPToolchainTargetName: *cppToolchainTarget,
+		CppConfigMode:          *cppConfigMode,
+		CppSymlinkMode:         *cppSymlinkMode,
 		GenJavaConfigs:         *genJavaConfigs,
 		JavaUseLocalRuntime:    *javaUseLocalRuntime,
+		GenJavaToolchains:      *genJavaToolchains,
+		JavaDefaultVersion:     *javaDefaultVersion,
+		GenPythonConfigs:       *genPythonConfigs,
+		GenGoConfigs:           *genGoConfigs,
+		GenRustConfigs:         *genRustConfigs,
+		TemplateDir:            *templateDir,
 		TempWorkDir:            *tempWorkDir,
 		Cleanup:                *cleanup,
+		DryRun:                 *dryRun,
 	}
 
 	result := true
-	if err := genConfigs(o); err != nil {
+	gen := func() error { return genConfigs(o, verify) }
+	if len(*configFile) != 0 {
+		gen = func() error { return genFromConfigFile(*configFile, verify) }
+	}
+	if err := gen(); err != nil {
 		result = false
-		log.Printf("Config generation failed: %v", err)
+		if verify {
+			log.Printf("Config verification failed: %v", err)
+		} else {
+			log.Printf("Config generation failed: %v", err)
+		}
+	} else if verify {
+		log.Printf("Configs are up to date.")
 	} else {
 		log.Printf("Config generation was successful.")
 	}
-	// Monitoring is optional and used for internal alerting by the owners of this repo only.
-	if mc != nil {
+	// Monitoring is optional and used for internal alerting by the owners of this repo only. Only
+	// config generation is reported.
+	if mc != nil && !verify {
 		if err := mc.ReportToolchainConfigsGeneration(ctx, *monitoringDockerImage, result); err != nil {
 			log.Fatalf("Failed to report config result to monitoring: %v", err)
 		}
@@ -10,5 +10,7 @@ require (
 	github.com/golang/protobuf v1.4.1
 	github.com/google/go-containerregistry v0.4.0
 	github.com/googleapis/gax-go/v2 v2.0.5
+	github.com/klauspost/compress v1.15.9
 	google.golang.org/genproto v0.0.0-20200527145253-8367513e4ece
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,285 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// OutputFormatTar is an uncompressed tarball.
+	OutputFormatTar = "tar"
+	// OutputFormatTarGz is a gzip compressed tarball.
+	OutputFormatTarGz = "tar.gz"
+	// OutputFormatTarZst is a zstd compressed tarball.
+	OutputFormatTarZst = "tar.zst"
+	// OutputFormatZip is a zip archive.
+	OutputFormatZip = "zip"
+)
+
+var (
+	// validOutputFormats are the formats the output tarball can be generated in.
+	validOutputFormats = []string{
+		OutputFormatTar,
+		OutputFormatTarGz,
+		OutputFormatTarZst,
+		OutputFormatZip,
+	}
+
+	// outputFormatExtensions maps the file extensions recognized by outputFormatForPath to the
+	// corresponding output format.
+	outputFormatExtensions = []struct {
+		ext    string
+		format string
+	}{
+		{".tar.gz", OutputFormatTarGz},
+		{".tgz", OutputFormatTarGz},
+		{".tar.zst", OutputFormatTarZst},
+		{".tzst", OutputFormatTarZst},
+		{".zip", OutputFormatZip},
+	}
+
+	// zipModTime is the modification time of every entry in generated zip archives. Zip archives
+	// use MS-DOS timestamps which can't represent times before 1980.
+	zipModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// outputFormatForPath returns the output format matching the extension of the given path or
+// OutputFormatTar if the extension isn't recognized.
+func outputFormatForPath(p string) string {
+	for _, e := range outputFormatExtensions {
+		if strings.HasSuffix(strings.ToLower(p), e.ext) {
+			return e.format
+		}
+	}
+	return OutputFormatTar
+}
+
+// resolveOutputFormat validates the given output format of the given output tarball, defaulting
+// it to the format matching the extension of the output tarball if unspecified.
+func resolveOutputFormat(tarball string, format *string) error {
+	if tarball == "" {
+		if *format != "" {
+			return fmt.Errorf("OutputTarball is required because OutputFormat was specified")
+		}
+		return nil
+	}
+	if *format == "" {
+		*format = outputFormatForPath(tarball)
+	}
+	if !strListContains(validOutputFormats, *format) {
+		return fmt.Errorf("invalid OutputFormat, got %q, want one of %s", *format, strings.Join(validOutputFormats, ", "))
+	}
+	return nil
+}
+
+// archiveEntry is a file or directory in a generated archive.
+type archiveEntry struct {
+	// name is the name of the entry. Directory names end with a slash.
+	name string
+	dir  bool
+	// g is the file represented by the entry if it isn't a directory.
+	g generatedFile
+}
+
+// archiveEntries returns the entries of an archive with the given files, i.e., an entry for every
+// file & every directory containing them, sorted by name.
+func archiveEntries(files []generatedFile) []archiveEntry {
+	var entries []archiveEntry
+	dirs := make(map[string]bool)
+	for _, g := range files {
+		entries = append(entries, archiveEntry{name: g.name, g: g})
+		for d := path.Dir(g.name); d != "." && d != "/" && !dirs[d]; d = path.Dir(d) {
+			dirs[d] = true
+			entries = append(entries, archiveEntry{name: d + "/", dir: true})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries
+}
+
+// writeGeneratedFileToTarball writes the given generatedFile 'g' to the given output tarball
+// 'outTar' with a normalized header, i.e., a fixed owner & modification time, a 0644 or 0755 mode
+// depending on whether the file is executable & in the USTAR format to avoid PAX headers.
+// Symlinks are written as symlink entries.
+func writeGeneratedFileToTarball(g generatedFile, outTar *tar.Writer) error {
+	if g.symlink {
+		if err := outTar.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     g.name,
+			Linkname: string(g.contents),
+			Mode:     0777,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatUSTAR,
+		}); err != nil {
+			return fmt.Errorf("failed to write tar header for symlink %q: %w", g.name, err)
+		}
+		return nil
+	}
+	if err := outTar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     g.name,
+		Size:     int64(len(g.contents)),
+		Mode:     int64(g.mode().Perm()),
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatUSTAR,
+	}); err != nil {
+		return fmt.Errorf("failed to write tar header for %q: %w", g.name, err)
+	}
+	if _, err := io.Copy(outTar, bytes.NewBuffer(g.contents)); err != nil {
+		return fmt.Errorf("failed to copy the contents of %q to the output tarball: %w", g.name, err)
+	}
+	return nil
+}
+
+// writeDirToTarball writes an entry for the directory with the given name to the given output
+// tarball 'outTar' with a normalized header like writeGeneratedFileToTarball.
+func writeDirToTarball(name string, outTar *tar.Writer) error {
+	if err := outTar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatUSTAR,
+	}); err != nil {
+		return fmt.Errorf("failed to write tar header for directory %q: %w", name, err)
+	}
+	return nil
+}
+
+// writeTar writes the given files as a reproducible tarball to 'w', i.e., the tarball only
+// depends on the names, contents, executable bits & symlinks of the given files: every entry has a
+// normalized header, every directory has an explicit entry & entries are sorted by name.
+func writeTar(w io.Writer, files []generatedFile) error {
+	outTar := tar.NewWriter(w)
+	for _, e := range archiveEntries(files) {
+		var err error
+		if e.dir {
+			err = writeDirToTarball(e.name, outTar)
+		} else {
+			err = writeGeneratedFileToTarball(e.g, outTar)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Can't ignore failures when closing the tarball because it writes metadata without which the
+	// tarball is invalid.
+	if err := outTar.Close(); err != nil {
+		return fmt.Errorf("error trying to finish writing the tarball: %w", err)
+	}
+	return nil
+}
+
+// writeZip writes the given files as a reproducible zip archive to 'w' like writeTar. Entries are
+// compressed with the best compression level & have a fixed modification time. Symlinks are
+// stored as entries with the symlink mode whose contents are the path they point to.
+func writeZip(w io.Writer, files []generatedFile) error {
+	outZip := zip.NewWriter(w)
+	outZip.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.BestCompression)
+	})
+	for _, e := range archiveEntries(files) {
+		h := &zip.FileHeader{
+			Name:     e.name,
+			Method:   zip.Deflate,
+			Modified: zipModTime,
+		}
+		if e.dir {
+			h.Method = zip.Store
+			h.SetMode(os.ModeDir | 0755)
+		} else {
+			h.SetMode(e.g.mode())
+		}
+		fw, err := outZip.CreateHeader(h)
+		if err != nil {
+			return fmt.Errorf("failed to write zip header for %q: %w", e.name, err)
+		}
+		if e.dir {
+			continue
+		}
+		if _, err := fw.Write(e.g.contents); err != nil {
+			return fmt.Errorf("failed to write the contents of %q to the zip archive: %w", e.name, err)
+		}
+	}
+	if err := outZip.Close(); err != nil {
+		return fmt.Errorf("error trying to finish writing the zip archive: %w", err)
+	}
+	return nil
+}
+
+// writeArchive writes the given files to a new reproducible archive in the given output format at
+// 'archivePath'. Compressed tarballs use fixed compression settings, e.g., a single zstd encoder
+// goroutine, such that the same files always produce the same archive.
+func writeArchive(archivePath, format string, files []generatedFile) error {
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return fmt.Errorf("unable to open %q for writing: %w", archivePath, err)
+	}
+	defer out.Close()
+
+	switch format {
+	case OutputFormatTar:
+		err = writeTar(out, files)
+	case OutputFormatTarGz:
+		var gw *gzip.Writer
+		// The gzip header doesn't record a file name or modification time by default.
+		if gw, err = gzip.NewWriterLevel(out, gzip.BestCompression); err != nil {
+			break
+		}
+		if err = writeTar(gw, files); err == nil {
+			err = gw.Close()
+		}
+	case OutputFormatTarZst:
+		var zw *zstd.Encoder
+		if zw, err = zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.SpeedBetterCompression), zstd.WithEncoderConcurrency(1)); err != nil {
+			break
+		}
+		if err = writeTar(zw, files); err == nil {
+			err = zw.Close()
+		}
+	case OutputFormatZip:
+		err = writeZip(out, files)
+	default:
+		err = fmt.Errorf("unknown output format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write %q: %w", archivePath, err)
+	}
+	// Can't ignore failures when closing the archive because buffered contents may not have been
+	// written yet.
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error trying to finish writing %q: %w", archivePath, err)
+	}
+	return nil
+}
+
+// writeTarball writes the given files to a new uncompressed reproducible tarball at 'tarPath'.
+func writeTarball(tarPath string, files []generatedFile) error {
+	return writeArchive(tarPath, OutputFormatTar, files)
+}
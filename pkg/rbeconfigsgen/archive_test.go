@@ -0,0 +1,354 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestOutputFormatForPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "configs.tar", want: OutputFormatTar},
+		{path: "configs", want: OutputFormatTar},
+		{path: "configs.tar.gz", want: OutputFormatTarGz},
+		{path: "configs.tgz", want: OutputFormatTarGz},
+		{path: "configs.tar.zst", want: OutputFormatTarZst},
+		{path: "configs.TZST", want: OutputFormatTarZst},
+		{path: "/tmp/configs.zip", want: OutputFormatZip},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+			if got := outputFormatForPath(tc.path); got != tc.want {
+				t.Errorf("outputFormatForPath(%q)=%q, want %q", tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveOutputFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		tarball string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "FromExtension",
+			tarball: "configs.tar.zst",
+			want:    OutputFormatTarZst,
+		},
+		{
+			name:    "Explicit",
+			tarball: "configs.bin",
+			format:  OutputFormatZip,
+			want:    OutputFormatZip,
+		},
+		{
+			name: "NoTarball",
+		},
+		{
+			name:    "FormatWithoutTarball",
+			format:  OutputFormatTarGz,
+			wantErr: true,
+		},
+		{
+			name:    "InvalidFormat",
+			tarball: "configs.tar",
+			format:  "rar",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got := tc.format
+			err := resolveOutputFormat(tc.tarball, &got)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("resolveOutputFormat(%q, %q) succeeded, want error", tc.tarball, tc.format)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveOutputFormat(%q, %q) failed: %v", tc.tarball, tc.format, err)
+			}
+			if got != tc.want {
+				t.Errorf("resolveOutputFormat(%q, %q) resolved format %q, want %q", tc.tarball, tc.format, got, tc.want)
+			}
+		})
+	}
+}
+
+// archiveTestEntry is an entry read from an archive written in a test.
+type archiveTestEntry struct {
+	name string
+	mode int64
+}
+
+// readTarEntries returns the entries of the given tarball failing the test if any header wasn't
+// normalized.
+func readTarEntries(t *testing.T, r io.Reader) []archiveTestEntry {
+	t.Helper()
+	var result []archiveTestEntry
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read the written tarball: %v", err)
+		}
+		if h.Uid != 0 || h.Gid != 0 || h.Uname != "" || h.Gname != "" || !h.ModTime.Equal(time.Unix(0, 0)) || len(h.PAXRecords) != 0 {
+			t.Errorf("Tarball entry %q has a header that wasn't normalized: %+v", h.Name, h)
+		}
+		result = append(result, archiveTestEntry{h.Name, h.Mode})
+	}
+	return result
+}
+
+// readArchiveEntries returns the entries of the given archive in the given format.
+func readArchiveEntries(t *testing.T, format string, blob []byte) []archiveTestEntry {
+	t.Helper()
+	switch format {
+	case OutputFormatTar:
+		return readTarEntries(t, bytes.NewReader(blob))
+	case OutputFormatTarGz:
+		r, err := gzip.NewReader(bytes.NewReader(blob))
+		if err != nil {
+			t.Fatalf("Failed to read the written gzip stream: %v", err)
+		}
+		return readTarEntries(t, r)
+	case OutputFormatTarZst:
+		r, err := zstd.NewReader(bytes.NewReader(blob))
+		if err != nil {
+			t.Fatalf("Failed to read the written zstd stream: %v", err)
+		}
+		defer r.Close()
+		return readTarEntries(t, r)
+	case OutputFormatZip:
+		r, err := zip.NewReader(bytes.NewReader(blob), int64(len(blob)))
+		if err != nil {
+			t.Fatalf("Failed to read the written zip archive: %v", err)
+		}
+		var result []archiveTestEntry
+		for _, f := range r.File {
+			result = append(result, archiveTestEntry{f.Name, int64(f.Mode().Perm())})
+		}
+		return result
+	}
+	t.Fatalf("Unknown format %q", format)
+	return nil
+}
+
+func TestWriteArchive(t *testing.T) {
+	files := []generatedFile{
+		{name: "java/BUILD", contents: []byte("java_runtime()\n")},
+		{name: "LICENSE", contents: []byte("license\n")},
+		{name: "cc/cc_wrapper.sh", contents: []byte("#!/bin/bash\n"), executable: true},
+		{name: "config/BUILD", contents: []byte("platform()\n")},
+		{name: "cc/BUILD", contents: []byte("cc_toolchain()\n")},
+	}
+	// The same files in a different order.
+	reordered := []generatedFile{files[4], files[2], files[0], files[3], files[1]}
+	wantEntries := []archiveTestEntry{
+		{"LICENSE", 0644},
+		{"cc/", 0755},
+		{"cc/BUILD", 0644},
+		{"cc/cc_wrapper.sh", 0755},
+		{"config/", 0755},
+		{"config/BUILD", 0644},
+		{"java/", 0755},
+		{"java/BUILD", 0644},
+	}
+	tests := []struct {
+		format string
+		// wantDigest is the sha256 digest of the archive written for the above files. It must only
+		// change if the format of the generated archives is intentionally changed.
+		wantDigest string
+	}{
+		{
+			format:     OutputFormatTar,
+			wantDigest: "ae0f9947109c53cc4eca1bd5a6b2c201e3241522d295746b287387fc6bbfdc37",
+		},
+		{
+			format:     OutputFormatTarGz,
+			wantDigest: "fcf0d2821b0f47aa19ea7d4a59af1acfe9e2052822d8121eb4a8307d41adbd8c",
+		},
+		{
+			format:     OutputFormatTarZst,
+			wantDigest: "84772180b34367fd49b7b27b3c0b765a0ceb5e122d08b8d31a3fd25acb66644d",
+		},
+		{
+			format:     OutputFormatZip,
+			wantDigest: "4dbdd651e43d3287f8de6f18b0b836d8c9981960b85664155ab26531e9632b1f",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.format, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			for i, fs := range [][]generatedFile{files, reordered} {
+				archivePath := path.Join(dir, fmt.Sprintf("%d.%s", i, tc.format))
+				if err := writeArchive(archivePath, tc.format, fs); err != nil {
+					t.Fatalf("writeArchive failed: %v", err)
+				}
+				blob, err := ioutil.ReadFile(archivePath)
+				if err != nil {
+					t.Fatalf("Unable to read the written archive: %v", err)
+				}
+				d := sha256.Sum256(blob)
+				if got := hex.EncodeToString(d[:]); got != tc.wantDigest {
+					t.Errorf("writeArchive(%d) wrote archive with digest %s, want %s", i, got, tc.wantDigest)
+				}
+				if got := readArchiveEntries(t, tc.format, blob); !reflect.DeepEqual(got, wantEntries) {
+					t.Errorf("writeArchive(%d) wrote entries %v, want %v", i, got, wantEntries)
+				}
+			}
+		})
+	}
+}
+
+func TestRunWithCompressedOutput(t *testing.T) {
+	dir := t.TempDir()
+	rt := &fakeRuntime{
+		image: "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:   []string{"PATH=/bin"},
+		goSDK: []string{"/usr/local/go/bin/go", "/usr/local/go", "go1.21.5", "linux", "amd64"},
+	}
+	o := Options{
+		BazelVersion:       "6.0.0",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      path.Join(dir, "configs.tar.zst"),
+		OutputManifest:     path.Join(dir, "manifest.json"),
+		GenGoConfigs:       true,
+		TempWorkDir:        t.TempDir(),
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	blob, err := ioutil.ReadFile(o.OutputTarball)
+	if err != nil {
+		t.Fatalf("Unable to read the output tarball: %v", err)
+	}
+	var got []string
+	for _, e := range readArchiveEntries(t, OutputFormatTarZst, blob) {
+		got = append(got, e.name)
+	}
+	want := []string{"LICENSE", "config/", "config/BUILD", "configs.bazelrc", "go/", "go/BUILD", "go/sdk.bzl"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Output tarball got entries %v, want %v", got, want)
+	}
+	m, err := ManifestFromJSONFile(o.OutputManifest)
+	if err != nil {
+		t.Fatalf("ManifestFromJSONFile failed: %v", err)
+	}
+	if m.ConfigsTarballFormat != OutputFormatTarZst {
+		t.Errorf("Manifest got configs tarball format %q, want %q", m.ConfigsTarballFormat, OutputFormatTarZst)
+	}
+	d := sha256.Sum256(blob)
+	if want := hex.EncodeToString(d[:]); m.ConfigsTarballDigest != want {
+		t.Errorf("Manifest got configs tarball digest %q, want %q", m.ConfigsTarballDigest, want)
+	}
+}
+
+func TestWriteArchiveSymlinks(t *testing.T) {
+	// Sorted by name like the entries of written archives.
+	files := []generatedFile{
+		{name: "cc/cc_wrapper.sh", contents: []byte("#!/bin/bash\n"), executable: true},
+		{name: "cc/tools/cc_wrapper.sh", contents: []byte("../cc_wrapper.sh"), symlink: true},
+	}
+	dir := t.TempDir()
+
+	tarPath := path.Join(dir, "configs.tar")
+	if err := writeArchive(tarPath, OutputFormatTar, files); err != nil {
+		t.Fatalf("writeArchive failed: %v", err)
+	}
+	got, err := readCppConfigsTarball(tarPath, "", CppSymlinkModePreserve)
+	if err != nil {
+		t.Fatalf("Unable to read the written tarball: %v", err)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("writeArchive wrote tarball with files %+v, want %+v", got, files)
+	}
+
+	zipPath := path.Join(dir, "configs.zip")
+	if err := writeArchive(zipPath, OutputFormatZip, files); err != nil {
+		t.Fatalf("writeArchive failed: %v", err)
+	}
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatalf("Unable to read the written zip archive: %v", err)
+	}
+	defer r.Close()
+	found := false
+	for _, f := range r.File {
+		if f.Name != "cc/tools/cc_wrapper.sh" {
+			continue
+		}
+		found = true
+		if f.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("writeArchive wrote zip entry %q with mode %v, want a symlink", f.Name, f.Mode())
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Unable to open zip entry %q: %v", f.Name, err)
+		}
+		target, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Unable to read zip entry %q: %v", f.Name, err)
+		}
+		if string(target) != "../cc_wrapper.sh" {
+			t.Errorf("writeArchive wrote zip symlink %q pointing to %q, want ../cc_wrapper.sh", f.Name, target)
+		}
+	}
+	if !found {
+		t.Errorf("writeArchive didn't write the symlink cc/tools/cc_wrapper.sh to the zip archive")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+const (
+	// bazelrcFileName is the name of the .bazelrc fragment generated at the root of the configs.
+	bazelrcFileName = "configs.bazelrc"
+)
+
+var (
+	// bazelrcTemplate is the template for the .bazelrc fragment with the flags needed to use the
+	// generated configs.
+	bazelrcTemplate = template.Must(template.New("bazelrc").Parse(`# This file is auto-generated by github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen
+# and should not be modified directly.
+#
+# Flags to use the toolchain configs generated for Bazel {{ .BazelVersion }} & toolchain container
+# {{ .ToolchainContainer }}.
+# Import this file from your .bazelrc with:
+#   try-import %workspace%/{{ .ImportPath }}
+# and build with --config=remote.
+
+# Platform configuration.
+{{ if .ExecutionPlatforms }}build:remote --extra_execution_platforms={{ .ExecutionPlatforms }}
+{{ end }}build:remote --host_platform={{ .Platform }}
+build:remote --platforms={{ .Platform }}
+{{ range .Languages }}
+# {{ .Title }}.
+{{ range .Flags }}build:remote {{ . }}
+{{ end }}{{ end }}`))
+)
+
+// bazelrcTemplateParams is used as the input to the .bazelrc fragment template.
+type bazelrcTemplateParams struct {
+	BazelVersion       string
+	ToolchainContainer string
+	ImportPath         string
+	ExecutionPlatforms string
+	Platform           string
+	// Languages are the sections with the flags needed to use the configs of every language.
+	Languages []*bazelrcSection
+}
+
+// Bazelrc returns the contents of a .bazelrc fragment with the flags needed to use the configs
+// generated for the given options under the 'remote' config. The flags reference the configs
+// using the labels they'll have once copied into the source repository at OutputConfigPath or
+// extracted into an external repository named ConfigsRepoName otherwise. The flags to use the
+// configs of every language are determined by its languageGenerator, e.g., the flags to use Java
+// toolchains depend on the targeted Bazel version like the generated Java configs. In the Bzlmod
+// output mode, the platforms & toolchains are registered by the generated module instead.
+func Bazelrc(o *Options) (string, error) {
+	p := bazelrcTemplateParams{
+		BazelVersion:       o.BazelVersion,
+		ToolchainContainer: o.ToolchainContainer,
+		ImportPath:         path.Join(strings.ReplaceAll(o.OutputConfigPath, "\\", "/"), bazelrcFileName),
+		Platform:           configLabel(o, "config", "platform"),
+	}
+	if o.OutputMode != OutputModeBzlmod {
+		p.ExecutionPlatforms = strings.Join(platformLabels(o), ",")
+	}
+	if o.OutputSourceRoot == "" {
+		p.ImportPath = fmt.Sprintf("<path to %s extracted from the configs of @%s>", bazelrcFileName, configsRepoName(o))
+	}
+	languages, err := languageBazelrcSections(o)
+	if err != nil {
+		return "", err
+	}
+	p.Languages = languages
+	t, err := bazelrcTemplates.lookup(o.BazelVersion)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := t.Execute(buf, p); err != nil {
+		return "", fmt.Errorf("failed to generate the .bazelrc fragment: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// genBazelrc generates the .bazelrc fragment with the flags needed to use the configs generated
+// for the given options.
+func genBazelrc(o *Options) (generatedFile, error) {
+	contents, err := Bazelrc(o)
+	if err != nil {
+		return generatedFile{}, err
+	}
+	return generatedFile{
+		name:     bazelrcFileName,
+		contents: []byte(contents),
+	}, nil
+}
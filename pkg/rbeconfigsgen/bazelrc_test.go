@@ -0,0 +1,139 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBazelrc(t *testing.T) {
+	tests := []struct {
+		name      string
+		opt       *Options
+		wantFlags []string
+		// wantNoFlags are substrings of flags that shouldn't be in the generated .bazelrc.
+		wantNoFlags []string
+	}{
+		{
+			name: "Bazel4Tarball",
+			opt: &Options{
+				BazelVersion:   "4.0.0",
+				GenCPPConfigs:  true,
+				GenJavaConfigs: true,
+				PlatformParams: &PlatformToolchainsTemplateParams{},
+			},
+			wantFlags: []string{
+				"--crosstool_top=@rbe_default//cc:toolchain",
+				"--action_env=BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN=1",
+				"--extra_toolchains=@rbe_default//config:cc-toolchain",
+				"--extra_execution_platforms=@rbe_default//config:platform",
+				"--host_platform=@rbe_default//config:platform",
+				"--platforms=@rbe_default//config:platform",
+				"--host_javabase=@rbe_default//java:jdk",
+				"--javabase=@rbe_default//java:jdk",
+				"--java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8",
+			},
+			wantNoFlags: []string{"--java_runtime_version"},
+		},
+		{
+			name: "Bazel6SourceRootWithVariants",
+			opt: &Options{
+				BazelVersion:     "6.0.0",
+				OutputSourceRoot: "/src",
+				OutputConfigPath: "configs\\linux",
+				GenCPPConfigs:    true,
+				GenJavaConfigs:   true,
+				PlatformParams: &PlatformToolchainsTemplateParams{
+					Variants: []PlatformVariant{{Name: "large"}},
+				},
+			},
+			wantFlags: []string{
+				"try-import %workspace%/configs/linux/configs.bazelrc",
+				"--crosstool_top=//configs/linux/cc:toolchain",
+				"--extra_execution_platforms=//configs/linux/config:platform,//configs/linux/config:large",
+				"--platforms=//configs/linux/config:platform",
+				"--java_runtime_version=rbe_jdk",
+				"--tool_java_runtime_version=rbe_jdk",
+				"--extra_toolchains=//configs/linux/java:all",
+			},
+			wantNoFlags: []string{"--javabase", "@rbe_default"},
+		},
+		{
+			name: "Bazel7CustomRepoName",
+			opt: &Options{
+				BazelVersion:    "7.0.0-pre.20230530.3",
+				ConfigsRepoName: "rbe_ubuntu",
+				GenCPPConfigs:   true,
+				GenJavaConfigs:  true,
+				PlatformParams:  &PlatformToolchainsTemplateParams{},
+			},
+			wantFlags: []string{
+				"--extra_toolchains=@rbe_ubuntu//config:cc-toolchain",
+				"--platforms=@rbe_ubuntu//config:platform",
+				"--extra_toolchains=@rbe_ubuntu//java:all",
+			},
+			wantNoFlags: []string{"--crosstool_top"},
+		},
+		{
+			name: "JavaOnlyLocalRuntime",
+			opt: &Options{
+				BazelVersion:        "4.0.0",
+				GenJavaConfigs:      true,
+				JavaUseLocalRuntime: true,
+				PlatformParams:      &PlatformToolchainsTemplateParams{},
+			},
+			wantFlags: []string{
+				"--platforms=@rbe_default//config:platform",
+				"--extra_toolchains=@rbe_default//java:all",
+			},
+			wantNoFlags: []string{"--crosstool_top", "cc-toolchain", "BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN", "--javabase"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := Bazelrc(tc.opt)
+			if err != nil {
+				t.Fatalf("Bazelrc failed: %v", err)
+			}
+			for _, f := range tc.wantFlags {
+				if !strings.HasPrefix(f, "try-import") {
+					f = "build:remote " + f
+				}
+				if !strings.Contains(got, f+"\n") {
+					t.Errorf("Generated .bazelrc did not contain %q, got:\n%s", f, got)
+				}
+			}
+			for _, f := range tc.wantNoFlags {
+				if strings.Contains(got, f) {
+					t.Errorf("Generated .bazelrc unexpectedly contained %q, got:\n%s", f, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBazelrcInvalidBazelVersion(t *testing.T) {
+	o := &Options{
+		BazelVersion:   "latest",
+		GenCPPConfigs:  true,
+		PlatformParams: &PlatformToolchainsTemplateParams{},
+	}
+	if _, err := Bazelrc(o); err == nil {
+		t.Errorf("Bazelrc succeeded for Bazel version %q, want error", o.BazelVersion)
+	}
+}
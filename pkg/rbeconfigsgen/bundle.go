@@ -0,0 +1,486 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"text/template"
+)
+
+var (
+	// bundleBuildTemplate is the template for the top level BUILD file of a configs bundle exposing
+	// the platform & toolchains generated for every toolchain container in the bundle.
+	bundleBuildTemplate = template.Must(template.New("bundleBuild").Parse(buildHeader + `
+package(default_visibility = ["//visibility:public"])
+{{ range . }}
+alias(
+    name = "{{ .Name }}_platform",
+    actual = "{{ .Package }}/config:platform",
+)
+{{ if .CppToolchain }}
+alias(
+    name = "{{ .Name }}_cc_toolchain",
+    actual = "{{ .Package }}/config:cc-toolchain",
+)
+{{ end }}{{ if .JavaToolchain }}
+alias(
+    name = "{{ .Name }}_jdk",
+    actual = "{{ .Package }}/java:jdk",
+)
+{{ end }}{{ if .PythonToolchain }}
+alias(
+    name = "{{ .Name }}_py_toolchain",
+    actual = "{{ .Package }}/python:py_toolchain",
+)
+{{ end }}{{ end }}`))
+
+	// bundleEntryNameRegexp matches valid names of entries in a configs bundle. The name is used as
+	// a Bazel package name & as a prefix of target names.
+	bundleEntryNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+)
+
+// BundleEntry describes the configs to generate for one toolchain container in a configs bundle.
+type BundleEntry struct {
+	// Name is the name of the subpackage in the bundle the configs of this entry will be written to,
+	// i.e., <Name>/cc, <Name>/java, <Name>/python & <Name>/config.
+	Name string
+	// Options are the options to generate configs for this entry. The output options (i.e.,
+	// OutputTarball, OutputFormat, OutputSourceRoot, OutputConfigPath, ConfigsRepoName, OutputMode & OutputManifest) as well as TempWorkDir &
+	// Cleanup are ignored and determined by the BundleOptions instead.
+	Options Options
+}
+
+// BundleOptions are the options to generate a single configs bundle covering several toolchain
+// containers.
+type BundleOptions struct {
+	// Entries are the toolchain containers to generate configs for.
+	Entries []BundleEntry
+	// OutputTarball is the path at which a tarball will be generated containing the configs bundle.
+	OutputTarball string
+	// OutputFormat is the format (tar|tar.gz|tar.zst|zip) of OutputTarball. Defaults to the format
+	// matching the extension of OutputTarball or tar.
+	OutputFormat string
+	// OutputSourceRoot is the path where the root of the source repository where the configs bundle
+	// should be copied to.
+	OutputSourceRoot string
+	// OutputConfigPath is the path relative to OutputSourceRoot where the configs bundle will be
+	// copied to.
+	OutputConfigPath string
+	// ConfigsRepoName is the name of the external repository the configs bundle is expected to be
+	// extracted into when it isn't copied into a source repository. Defaults to rbe_default.
+	ConfigsRepoName string
+	// OutputMode determines how the configs bundle is expected to be consumed (workspace|bzlmod). In
+	// the bzlmod mode, a single MODULE.bazel registering the platforms & toolchains of every entry is
+	// generated at the root of the bundle. Defaults to workspace.
+	OutputMode string
+	// OutputManifest is a path where a JSON file with details about the configs generated for
+	// every entry will be written to.
+	OutputManifest string
+	// TempWorkDir is a temporary directory that will be used to store intermediate files. If
+	// unspecified, a temporary directory will be requested from the OS.
+	TempWorkDir string
+	// Cleanup determines whether the running containers & intermediate files will be deleted once
+	// config generation is done.
+	Cleanup bool
+	// DryRun determines whether the changes to the output directory are only logged instead of
+	// made. Neither the output tarball nor the manifest are written either.
+	DryRun bool
+}
+
+// Validate verifies the bundle options & the options of every entry. Default values for the
+// ExecOS of each entry are applied to entries whose PlatformParams weren't initialized.
+func (b *BundleOptions) Validate() error {
+	if len(b.Entries) == 0 {
+		return fmt.Errorf("no toolchain containers were specified to generate configs for")
+	}
+	if b.OutputTarball == "" && b.OutputSourceRoot == "" {
+		return fmt.Errorf("atleast one of OutputTarball or OutputSourceRoot must be specified or this tool won't generate any output")
+	}
+	if err := resolveOutputFormat(b.OutputTarball, &b.OutputFormat); err != nil {
+		return err
+	}
+	if b.OutputSourceRoot == "" && b.OutputConfigPath != "" {
+		return fmt.Errorf("OutputSourceRoot is required because OutputConfigPath was specified")
+	}
+	if path.IsAbs(b.OutputConfigPath) {
+		return fmt.Errorf("OutputConfigPath should be a relative path")
+	}
+	if b.ConfigsRepoName != "" && !repoNameRegexp.MatchString(b.ConfigsRepoName) {
+		return fmt.Errorf("invalid ConfigsRepoName %q, repository names must match %s", b.ConfigsRepoName, repoNameRegexp)
+	}
+	names := make(map[string]bool)
+	for i := range b.Entries {
+		e := &b.Entries[i]
+		if !bundleEntryNameRegexp.MatchString(e.Name) {
+			return fmt.Errorf("invalid name %q for entry %d, names must match %s", e.Name, i, bundleEntryNameRegexp)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("got multiple entries named %q, names must be unique", e.Name)
+		}
+		names[e.Name] = true
+
+		if e.Options.PlatformParams == nil {
+			if err := e.Options.ApplyDefaults(e.Options.ExecOS); err != nil {
+				return fmt.Errorf("failed to apply default options to entry %q: %w", e.Name, err)
+			}
+		}
+		e.Options.OutputTarball = b.OutputTarball
+		e.Options.OutputFormat = b.OutputFormat
+		e.Options.OutputSourceRoot = b.OutputSourceRoot
+		e.Options.OutputConfigPath = b.OutputConfigPath
+		e.Options.ConfigsRepoName = b.ConfigsRepoName
+		e.Options.OutputMode = b.OutputMode
+		e.Options.OutputManifest = ""
+		e.Options.TempWorkDir = ""
+		e.Options.Cleanup = b.Cleanup
+		e.Options.DryRun = b.DryRun
+		if err := e.Options.Validate(); err != nil {
+			return fmt.Errorf("invalid options for entry %q: %w", e.Name, err)
+		}
+		// The configs of each entry live in their own subpackage which determines the labels in the
+		// generated BUILD files.
+		e.Options.OutputConfigPath = path.Join(b.OutputConfigPath, e.Name)
+		e.Options.modulePath = e.Name
+	}
+	return nil
+}
+
+// bundleEntryConfigs are the configs generated for an entry in a configs bundle.
+type bundleEntryConfigs struct {
+	// name is the name of the entry.
+	name string
+	// o are the fully resolved options used to generate the configs.
+	o *Options
+	// oc are the generated configs.
+	oc outputConfigs
+}
+
+// bundleBuildTemplateParams is used as the input for each entry to the top level bundle BUILD
+// file template.
+type bundleBuildTemplateParams struct {
+	Name            string
+	Package         string
+	CppToolchain    bool
+	JavaToolchain   bool
+	PythonToolchain bool
+}
+
+// genBundleBuild generates the top level BUILD file of the configs bundle with aliases to the
+// platform & toolchains of each entry.
+func genBundleBuild(entries []bundleEntryConfigs) (generatedFile, error) {
+	var params []bundleBuildTemplateParams
+	for _, e := range entries {
+		params = append(params, bundleBuildTemplateParams{
+			Name:            e.name,
+			Package:         "//" + configsPackagePath(e.o),
+			CppToolchain:    e.o.GenCPPConfigs,
+			JavaToolchain:   e.o.GenJavaConfigs,
+			PythonToolchain: e.o.GenPythonConfigs,
+		})
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := bundleBuildTemplate.Execute(buf, params); err != nil {
+		return generatedFile{}, fmt.Errorf("failed to generate the top level bundle BUILD file: %w", err)
+	}
+	return generatedFile{
+		name:     "BUILD",
+		contents: buf.Bytes(),
+	}, nil
+}
+
+// assembleBundleTarball writes the configs of every entry & the given top level files into the
+// output tarball of the bundle.
+func assembleBundleTarball(b *BundleOptions, topLevel []generatedFile, entries []bundleEntryConfigs) error {
+	// The output format is only resolved by Validate.
+	if b.OutputFormat == "" {
+		b.OutputFormat = outputFormatForPath(b.OutputTarball)
+	}
+	files := append([]generatedFile(nil), topLevel...)
+	for _, e := range entries {
+		for _, g := range e.oc.configFiles() {
+			files = append(files, withPrefix(g, e.name))
+		}
+	}
+	if err := writeArchive(b.OutputTarball, b.OutputFormat, files); err != nil {
+		return fmt.Errorf("unable to write the configs bundle to the output tarball: %w", err)
+	}
+	log.Printf("Generated Bazel toolchain configs bundle output %s archive %q.", b.OutputFormat, b.OutputTarball)
+	return nil
+}
+
+// copyBundleToOutputDir writes the configs of every entry & the given top level files to the output
+// directory of the bundle. Configs listed in the previous bundle manifest that are no longer
+// generated are deleted. See writeOutputDir.
+func copyBundleToOutputDir(b *BundleOptions, topLevel []generatedFile, entries []bundleEntryConfigs) error {
+	configsRootDir := path.Join(b.OutputSourceRoot, b.OutputConfigPath)
+	files := append([]generatedFile(nil), topLevel...)
+	for _, e := range entries {
+		for _, g := range e.oc.configFiles() {
+			files = append(files, withPrefix(g, e.name))
+		}
+	}
+	previous := previousBundleManifestFiles(b.OutputManifest, b.OutputConfigPath)
+	// The output directory is only replaced as a whole if it's a subdirectory of the source root.
+	replaceDir := path.Clean(b.OutputConfigPath) != "."
+	if err := writeOutputDir(configsRootDir, files, previous, replaceDir, b.DryRun); err != nil {
+		return err
+	}
+	if !b.DryRun {
+		log.Printf("Copied generated configs bundle to directory %q.", configsRootDir)
+	}
+	return nil
+}
+
+// BundleManifestEntry contains metadata about the configs generated for an entry in a configs
+// bundle.
+type BundleManifestEntry struct {
+	Name string `json:"name"`
+	Manifest
+}
+
+// BundleManifest contains metadata about a configs bundle generated by RunMulti.
+type BundleManifest struct {
+	// SchemaVersion is the version of the manifest format. See ManifestSchemaVersion.
+	SchemaVersion        int    `json:"schema_version,omitempty"`
+	ConfigsTarballDigest string `json:"configs_tarball_digest"`
+	// ConfigsTarballFormat is the format of the output tarball. See Manifest.
+	ConfigsTarballFormat string `json:"configs_tarball_format,omitempty"`
+	// Files are the sha256 digests of the top level files of the bundle. The files of each entry
+	// are listed in the manifest of the entry relative to the directory of the entry.
+	Files   []ManifestFile        `json:"files,omitempty"`
+	Configs []BundleManifestEntry `json:"configs"`
+}
+
+// createBundleManifest writes the combined JSON manifest for all entries in the bundle if the given
+// bundle options specified a manifest file.
+func createBundleManifest(b *BundleOptions, topLevel []generatedFile, entries []bundleEntryConfigs) error {
+	if b.OutputManifest == "" {
+		return nil
+	}
+	if b.DryRun {
+		log.Printf("Dry run: Not writing manifest %q.", b.OutputManifest)
+		return nil
+	}
+	m := BundleManifest{
+		SchemaVersion: ManifestSchemaVersion,
+		Files:         manifestFiles(topLevel),
+	}
+	for _, e := range entries {
+		em, err := newManifest(e.o, e.oc)
+		if err != nil {
+			return fmt.Errorf("unable to create the manifest for %q: %w", e.name, err)
+		}
+		m.Configs = append(m.Configs, BundleManifestEntry{Name: e.name, Manifest: *em})
+	}
+	if b.OutputTarball != "" {
+		d, err := digestFile(b.OutputTarball)
+		if err != nil {
+			return fmt.Errorf("unable to compute the sha256 digest of the output tarball file for the output manifest: %w", err)
+		}
+		m.ConfigsTarballDigest = d
+		m.ConfigsTarballFormat = b.OutputFormat
+	}
+	blob, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return fmt.Errorf("unable to generate JSON for the bundle manifest: %w", err)
+	}
+	if err := ioutil.WriteFile(b.OutputManifest, blob, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to write the bundle manifest as JSON to %q: %w", b.OutputManifest, err)
+	}
+	log.Printf("Wrote JSON manifest to %q.", b.OutputManifest)
+	return nil
+}
+
+// RunMulti generates a single configs bundle for all the toolchain containers in the given bundle
+// options. The bundle options are expected to have been validated. The file structure of the
+// generated bundle will be as follows:
+// <config root>
+// |
+//  - BUILD- Aliases to the platform & toolchains of every entry.
+//  - MODULE.bazel- Module registering the platforms & toolchains of every entry (only in the Bzlmod
+//    output mode).
+//  - <name>- The configs generated for the entry <name> with the same layout as Run.
+func RunMulti(b BundleOptions) error {
+	return runMulti(b, containerRuntimeForOptions)
+}
+
+// runMulti generates a configs bundle using the given function to create the container runtime
+// for each entry.
+func runMulti(b BundleOptions, newRuntime func(*Options) (ContainerRuntime, error)) error {
+	dir, err := initTempDir(b.TempWorkDir)
+	if err != nil {
+		return fmt.Errorf("unable to initialize a local temporary working directory to store intermediate files: %w", err)
+	}
+	b.TempWorkDir = dir
+
+	var entries []bundleEntryConfigs
+	for _, e := range b.Entries {
+		o := e.Options
+		o.PlatformParams = new(PlatformToolchainsTemplateParams)
+		*o.PlatformParams = *e.Options.PlatformParams
+		o.TempWorkDir = filepath.Join(b.TempWorkDir, e.Name)
+		if err := os.MkdirAll(o.TempWorkDir, os.ModePerm); err != nil {
+			return fmt.Errorf("unable to create temporary working directory %q for %q: %w", o.TempWorkDir, e.Name, err)
+		}
+		rt, err := newRuntime(&o)
+		if err != nil {
+			return fmt.Errorf("unable to initialize the container runtime for %q: %w", e.Name, err)
+		}
+		log.Printf("Generating configs for %q using toolchain container %q.", e.Name, o.ToolchainContainer)
+		oc, err := generateConfigs(&o, rt)
+		if err != nil {
+			return fmt.Errorf("failed to generate configs for %q: %w", e.Name, err)
+		}
+		entries = append(entries, bundleEntryConfigs{name: e.Name, o: &o, oc: oc})
+	}
+	for _, e := range entries {
+		logPlatformsUsage(e.o)
+	}
+
+	license := generatedFile{
+		name:     "LICENSE",
+		contents: licenseBlob,
+	}
+	build, err := genBundleBuild(entries)
+	if err != nil {
+		return err
+	}
+	topLevel := []generatedFile{license, build}
+	if b.OutputMode == OutputModeBzlmod {
+		var opts []*Options
+		for _, e := range entries {
+			opts = append(opts, e.o)
+		}
+		module, err := genModuleFile(configsRepoName(opts[0]), opts)
+		if err != nil {
+			return fmt.Errorf("unable to generate the module file of the configs bundle: %w", err)
+		}
+		topLevel = append(topLevel, module)
+	}
+	if b.OutputTarball != "" && b.DryRun {
+		log.Printf("Dry run: Not generating output tarball %q.", b.OutputTarball)
+	} else if b.OutputTarball != "" {
+		if err := assembleBundleTarball(&b, topLevel, entries); err != nil {
+			return fmt.Errorf("failed to assemble the configs bundle into a tarball: %w", err)
+		}
+	}
+	if b.OutputSourceRoot != "" {
+		if err := copyBundleToOutputDir(&b, topLevel, entries); err != nil {
+			return fmt.Errorf("failed to write the configs bundle to directory %q: %w", b.OutputSourceRoot, err)
+		}
+	}
+	if err := createBundleManifest(&b, topLevel, entries); err != nil {
+		return fmt.Errorf("unable to create the manifest file: %w", err)
+	}
+
+	if b.Cleanup {
+		if err := os.RemoveAll(b.TempWorkDir); err != nil {
+			log.Printf("Warning: Unable to delete temporary working directory %q: %v", b.TempWorkDir, err)
+		}
+	}
+	return nil
+}
+
+// bundleFile is the JSON representation of a configs bundle config file without a version, i.e.,
+// version 0 of the config file schema.
+type bundleFile struct {
+	OutputTarball    string            `json:"output_tarball"`
+	OutputSourceRoot string            `json:"output_src_root"`
+	OutputConfigPath string            `json:"output_config_path"`
+	OutputManifest   string            `json:"output_manifest"`
+	Configs          []bundleFileEntry `json:"configs"`
+}
+
+// bundleFileEntry is the JSON representation of an entry in a configs bundle config file. The
+// keys match the names of the corresponding command line flags of rbe_configs_gen.
+type bundleFileEntry struct {
+	Name                string `json:"name"`
+	ToolchainContainer  string `json:"toolchain_container"`
+	ExecOS              string `json:"exec_os"`
+	TargetOS            string `json:"target_os"`
+	ExecArch            string `json:"exec_arch"`
+	TargetArch          string `json:"target_arch"`
+	BazelVersion        string `json:"bazel_version"`
+	BazelPath           string `json:"bazel_path"`
+	DockerPlatform      string `json:"docker_platform"`
+	ContainerRuntime    string `json:"container_runtime"`
+	ImageArchive        string `json:"image_archive"`
+	GenCPPConfigs       *bool  `json:"generate_cpp_configs"`
+	CppEnvJSON          string `json:"cpp_env_json"`
+	CppToolchainTarget  string `json:"cpp_toolchain_target"`
+	CppConfigMode       string `json:"cpp_config_mode"`
+	GenJavaConfigs      *bool  `json:"generate_java_configs"`
+	JavaUseLocalRuntime bool   `json:"java_use_local_runtime"`
+}
+
+// BundleOptionsFromJSONFile reads the bundle options from the version 0 JSON config file at the
+// given path, i.e., a config file without a version. C++ & Java config generation are enabled for
+// each entry unless explicitly disabled. Relative paths to files referenced by entries are resolved
+// relative to the directory of the config file. Use ConfigFromFile to read config files of any
+// version.
+func BundleOptionsFromJSONFile(filePath string) (*BundleOptions, error) {
+	blob, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file %q: %w", filePath, err)
+	}
+	f := bundleFile{}
+	d := json.NewDecoder(bytes.NewReader(blob))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&f); err != nil {
+		return nil, fmt.Errorf("unable to parse the contents of %q as a JSON config file: %w", filePath, err)
+	}
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(filepath.Dir(filePath), p)
+	}
+	b := &BundleOptions{
+		OutputTarball:    f.OutputTarball,
+		OutputSourceRoot: f.OutputSourceRoot,
+		OutputConfigPath: f.OutputConfigPath,
+		OutputManifest:   f.OutputManifest,
+	}
+	for _, c := range f.Configs {
+		o := Options{
+			BazelVersion:           c.BazelVersion,
+			BazelPath:              c.BazelPath,
+			ToolchainContainer:     c.ToolchainContainer,
+			DockerPlatform:         c.DockerPlatform,
+			ContainerRuntime:       c.ContainerRuntime,
+			ImageArchive:           resolve(c.ImageArchive),
+			ExecOS:                 c.ExecOS,
+			TargetOS:               c.TargetOS,
+			ExecArch:               c.ExecArch,
+			TargetArch:             c.TargetArch,
+			GenCPPConfigs:          c.GenCPPConfigs == nil || *c.GenCPPConfigs,
+			CppGenEnvJSON:          resolve(c.CppEnvJSON),
+			CPPToolchainTargetName: c.CppToolchainTarget,
+			CppConfigMode:          c.CppConfigMode,
+			GenJavaConfigs:         c.GenJavaConfigs == nil || *c.GenJavaConfigs,
+			JavaUseLocalRuntime:    c.JavaUseLocalRuntime,
+		}
+		b.Entries = append(b.Entries, BundleEntry{Name: c.Name, Options: o})
+	}
+	return b, nil
+}
@@ -0,0 +1,292 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunMultiWithFakeRuntime(t *testing.T) {
+	dir := t.TempDir()
+	srcRoot := t.TempDir()
+	images := map[string]string{
+		"gcr.io/foo/ubuntu:latest": "gcr.io/foo/ubuntu@sha256:" + strings.Repeat("a", 64),
+		"gcr.io/foo/debian:latest": "gcr.io/foo/debian@sha256:" + strings.Repeat("b", 64),
+	}
+	b := BundleOptions{
+		Entries: []BundleEntry{
+			{
+				Name: "ubuntu",
+				Options: Options{
+					BazelVersion:       "6.0.0",
+					BazelPath:          "/usr/bin/bazel",
+					ToolchainContainer: "gcr.io/foo/ubuntu:latest",
+					ExecOS:             OSLinux,
+					TargetOS:           OSLinux,
+					GenJavaConfigs:     true,
+				},
+			},
+			{
+				Name: "debian",
+				Options: Options{
+					BazelVersion:       "6.0.0",
+					BazelPath:          "/usr/bin/bazel",
+					ToolchainContainer: "gcr.io/foo/debian:latest",
+					ExecOS:             OSLinux,
+					TargetOS:           OSLinux,
+					ExecArch:           ArchAarch64,
+					GenJavaConfigs:     true,
+				},
+			},
+		},
+		OutputTarball:    path.Join(dir, "configs.tar"),
+		OutputSourceRoot: srcRoot,
+		OutputConfigPath: "configs",
+		OutputManifest:   path.Join(dir, "manifest.json"),
+		TempWorkDir:      t.TempDir(),
+		Cleanup:          true,
+	}
+	if err := b.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	newRuntime := func(o *Options) (ContainerRuntime, error) {
+		return &fakeRuntime{
+			image:       images[o.ToolchainContainer],
+			env:         []string{"JAVA_HOME=/jdk"},
+			javaVersion: "11.0.10",
+		}, nil
+	}
+	if err := runMulti(b, newRuntime); err != nil {
+		t.Fatalf("runMulti failed: %v", err)
+	}
+
+	files := readTarball(t, b.OutputTarball)
+	for _, f := range []string{"LICENSE", "BUILD", "ubuntu/java/BUILD", "ubuntu/config/BUILD", "ubuntu/configs.bazelrc", "debian/java/BUILD", "debian/config/BUILD", "debian/configs.bazelrc"} {
+		if _, ok := files[f]; !ok {
+			t.Errorf("Output tarball did not contain %q, got files %v", f, files)
+		}
+	}
+	for _, want := range []string{
+		`name = "ubuntu_platform"`,
+		`actual = "//configs/ubuntu/config:platform"`,
+		`actual = "//configs/debian/java:jdk"`,
+	} {
+		if !strings.Contains(files["BUILD"], want) {
+			t.Errorf("Top level BUILD file did not contain %q, got:\n%s", want, files["BUILD"])
+		}
+	}
+	if strings.Contains(files["BUILD"], "cc_toolchain") {
+		t.Errorf("Top level BUILD file had a C++ toolchain alias even though C++ configs weren't generated, got:\n%s", files["BUILD"])
+	}
+	if want := `"@platforms//cpu:aarch64"`; !strings.Contains(files["debian/config/BUILD"], want) {
+		t.Errorf("debian/config/BUILD did not contain %q, got:\n%s", want, files["debian/config/BUILD"])
+	}
+	if want := "docker://" + images["gcr.io/foo/debian:latest"]; !strings.Contains(files["debian/config/BUILD"], want) {
+		t.Errorf("debian/config/BUILD did not contain %q, got:\n%s", want, files["debian/config/BUILD"])
+	}
+	if want := "build:remote --platforms=//configs/debian/config:platform\n"; !strings.Contains(files["debian/configs.bazelrc"], want) {
+		t.Errorf("debian/configs.bazelrc did not contain %q, got:\n%s", want, files["debian/configs.bazelrc"])
+	}
+
+	for _, f := range []string{"LICENSE", "BUILD", "ubuntu/java/BUILD", "debian/config/BUILD"} {
+		if _, err := ioutil.ReadFile(filepath.Join(srcRoot, "configs", f)); err != nil {
+			t.Errorf("Failed to read %q from the output directory: %v", f, err)
+		}
+	}
+
+	blob, err := ioutil.ReadFile(b.OutputManifest)
+	if err != nil {
+		t.Fatalf("Failed to read the output manifest: %v", err)
+	}
+	m := BundleManifest{}
+	if err := json.Unmarshal(blob, &m); err != nil {
+		t.Fatalf("Failed to parse the output manifest: %v", err)
+	}
+	if len(m.Configs) != 2 || m.Configs[0].Name != "ubuntu" || m.Configs[1].ImageDigest != strings.Repeat("b", 64) {
+		t.Errorf("Unexpected bundle manifest, got %+v", m)
+	}
+	if d, err := digestFile(b.OutputTarball); err != nil || m.ConfigsTarballDigest != d {
+		t.Errorf("Bundle manifest had tarball digest %q, want %q (err=%v)", m.ConfigsTarballDigest, d, err)
+	}
+}
+
+func TestRunMultiRemovesStaleEntries(t *testing.T) {
+	srcRoot := t.TempDir()
+	newBundle := func(names ...string) BundleOptions {
+		b := BundleOptions{
+			OutputSourceRoot: srcRoot,
+			OutputConfigPath: "configs",
+			OutputManifest:   path.Join(srcRoot, "manifest.json"),
+			TempWorkDir:      t.TempDir(),
+			Cleanup:          true,
+		}
+		for _, name := range names {
+			b.Entries = append(b.Entries, BundleEntry{
+				Name: name,
+				Options: Options{
+					BazelVersion:       "6.0.0",
+					BazelPath:          "/usr/bin/bazel",
+					ToolchainContainer: "gcr.io/foo/bar:latest",
+					ExecOS:             OSLinux,
+					TargetOS:           OSLinux,
+					GenJavaConfigs:     true,
+				},
+			})
+		}
+		if err := b.Validate(); err != nil {
+			t.Fatalf("Validate failed: %v", err)
+		}
+		return b
+	}
+	newRuntime := func(o *Options) (ContainerRuntime, error) {
+		return &fakeRuntime{
+			image:       "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+			env:         []string{"JAVA_HOME=/jdk"},
+			javaVersion: "11.0.10",
+		}, nil
+	}
+	if err := runMulti(newBundle("a", "b"), newRuntime); err != nil {
+		t.Fatalf("runMulti failed: %v", err)
+	}
+	// A file not generated by rbe_configs_gen prevents replacing the configs directory as a whole
+	// so that only the previously generated files that are no longer generated are deleted.
+	writeTestFiles(t, path.Join(srcRoot, "configs"), map[string]string{"custom.bzl": "custom"})
+
+	if err := runMulti(newBundle("a"), newRuntime); err != nil {
+		t.Fatalf("runMulti failed: %v", err)
+	}
+	for _, f := range []string{"BUILD", "a/java/BUILD", "custom.bzl"} {
+		if _, err := os.Stat(filepath.Join(srcRoot, "configs", f)); err != nil {
+			t.Errorf("Expected %q to exist in the output directory: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(srcRoot, "configs", "b")); !os.IsNotExist(err) {
+		t.Errorf("Expected the configs of the removed entry b to be deleted, got err=%v", err)
+	}
+}
+
+func TestBundleValidate(t *testing.T) {
+	entry := func(name string) BundleEntry {
+		return BundleEntry{
+			Name: name,
+			Options: Options{
+				BazelVersion:       "6.0.0",
+				ToolchainContainer: "gcr.io/foo/bar:latest",
+				ExecOS:             OSLinux,
+				TargetOS:           OSLinux,
+				GenJavaConfigs:     true,
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		b       BundleOptions
+		wantErr bool
+	}{
+		{
+			name: "Valid",
+			b:    BundleOptions{Entries: []BundleEntry{entry("a"), entry("b")}, OutputTarball: "out.tar"},
+		},
+		{
+			name:    "No entries",
+			b:       BundleOptions{OutputTarball: "out.tar"},
+			wantErr: true,
+		},
+		{
+			name:    "Duplicate names",
+			b:       BundleOptions{Entries: []BundleEntry{entry("a"), entry("a")}, OutputTarball: "out.tar"},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid name",
+			b:       BundleOptions{Entries: []BundleEntry{entry("../a")}, OutputTarball: "out.tar"},
+			wantErr: true,
+		},
+		{
+			name:    "No output",
+			b:       BundleOptions{Entries: []BundleEntry{entry("a")}},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			err := tc.b.Validate()
+			if tc.wantErr && err == nil {
+				t.Errorf("Validate succeeded, want error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("Validate failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestBundleOptionsFromJSONFile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "bundle.json")
+	if err := ioutil.WriteFile(configFile, []byte(`{
+  "output_tarball": "configs.tar",
+  "configs": [
+    {
+      "name": "ubuntu",
+      "toolchain_container": "gcr.io/foo/ubuntu:latest",
+      "exec_os": "linux",
+      "target_os": "linux",
+      "image_archive": "images/ubuntu.tar"
+    },
+    {
+      "name": "windows",
+      "toolchain_container": "gcr.io/foo/windows:latest",
+      "exec_os": "windows",
+      "target_os": "windows",
+      "generate_java_configs": false
+    }
+  ]
+}`), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	b, err := BundleOptionsFromJSONFile(configFile)
+	if err != nil {
+		t.Fatalf("BundleOptionsFromJSONFile failed: %v", err)
+	}
+	if b.OutputTarball != "configs.tar" || len(b.Entries) != 2 {
+		t.Fatalf("BundleOptionsFromJSONFile got %+v, want 2 entries with output tarball configs.tar", b)
+	}
+	u := b.Entries[0].Options
+	if !u.GenCPPConfigs || !u.GenJavaConfigs {
+		t.Errorf("Config generation wasn't enabled by default for %q, got C++=%v, Java=%v", b.Entries[0].Name, u.GenCPPConfigs, u.GenJavaConfigs)
+	}
+	if want := filepath.Join(dir, "images/ubuntu.tar"); u.ImageArchive != want {
+		t.Errorf("Got image archive %q, want %q", u.ImageArchive, want)
+	}
+	if b.Entries[1].Options.GenJavaConfigs {
+		t.Errorf("Java config generation was enabled for %q even though it was disabled in the config file", b.Entries[1].Name)
+	}
+
+	if err := ioutil.WriteFile(configFile, []byte(`{"configs": [{"name": "a", "toolchain": "typo"}]}`), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := BundleOptionsFromJSONFile(configFile); err == nil {
+		t.Errorf("BundleOptionsFromJSONFile succeeded with an unknown field, want error")
+	}
+}
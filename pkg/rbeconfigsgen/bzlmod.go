@@ -0,0 +1,199 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"text/template"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+const (
+	// OutputModeWorkspace lays out the generated configs to be consumed as a repository declared in
+	// a WORKSPACE file, e.g., using http_archive, or copied into the source repository.
+	OutputModeWorkspace = "workspace"
+	// OutputModeBzlmod additionally generates a MODULE.bazel file at the root of the configs to
+	// consume them as a Bazel module using a local_path_override or an archive_override. The
+	// platforms & toolchains are registered by the module.
+	OutputModeBzlmod = "bzlmod"
+
+	// moduleFileName is the name of the module file generated at the root of the configs in the
+	// Bzlmod output mode.
+	moduleFileName = "MODULE.bazel"
+	// bzlmodPlatformParent is the parent of the generated platform in the Bzlmod output mode for
+	// Bazel 7 and newer where @local_config_platform is deprecated in favor of @platforms//host.
+	bzlmodPlatformParent = "@platforms//host"
+)
+
+var (
+	validOutputModes = []string{
+		OutputModeWorkspace,
+		OutputModeBzlmod,
+	}
+
+	// moduleNameRegexp matches valid Bazel module names.
+	moduleNameRegexp = regexp.MustCompile(`^[a-z]([a-z0-9._-]*[a-z0-9])?$`)
+
+	// moduleDeps are the versions of the modules the generated MODULE.bazel depends on for each
+	// range of supported Bazel versions.
+	moduleDeps = []moduleDepVersions{
+		{Versions: versionRange{Min: "6.0.0", Max: "7.0.0"}, Platforms: "0.0.7", RulesCC: "0.0.9", RulesJava: "6.5.2"},
+		{Versions: versionRange{Min: "7.0.0", Max: "8.0.0"}, Platforms: "0.0.10", RulesCC: "0.0.9", RulesJava: "7.6.1"},
+		{Versions: versionRange{Min: "8.0.0"}, Platforms: "0.0.10", RulesCC: "0.1.1", RulesJava: "8.6.1"},
+	}
+
+	// moduleTemplate is the template for the MODULE.bazel file generated in the Bzlmod output mode.
+	moduleTemplate = template.Must(template.New("module").Parse(`# This file is auto-generated by github.com/bazelbuild/bazel-toolchains/pkg/rbeconfigsgen
+# and should not be modified directly.
+#
+# Use these configs from your MODULE.bazel with:
+#   bazel_dep(name = "{{ .Name }}")
+# along with a local_path_override or an archive_override for module "{{ .Name }}".
+module(name = "{{ .Name }}")
+
+bazel_dep(name = "platforms", version = "{{ .Deps.Platforms }}")
+{{ if .CppToolchains }}bazel_dep(name = "rules_cc", version = "{{ .Deps.RulesCC }}")
+{{ end }}{{ if .JavaToolchains }}bazel_dep(name = "rules_java", version = "{{ .Deps.RulesJava }}")
+{{ end }}
+register_execution_platforms(
+{{ range .Platforms }}    "{{ . }}",
+{{ end }})
+{{ if or .CppToolchains .JavaToolchains .PythonToolchains }}
+register_toolchains(
+{{ range .CppToolchains }}    "{{ . }}",
+{{ end }}{{ range .JavaToolchains }}    "{{ . }}",
+{{ end }}{{ range .PythonToolchains }}    "{{ . }}",
+{{ end }})
+{{ end }}`))
+)
+
+// moduleDepVersions are the versions of the modules the generated MODULE.bazel depends on for a
+// range of Bazel versions.
+type moduleDepVersions struct {
+	Versions  versionRange
+	Platforms string
+	RulesCC   string
+	RulesJava string
+}
+
+// moduleTemplateParams is used as the input to the MODULE.bazel template.
+type moduleTemplateParams struct {
+	Name             string
+	Deps             moduleDepVersions
+	Platforms        []string
+	CppToolchains    []string
+	JavaToolchains   []string
+	PythonToolchains []string
+}
+
+// validateBzlmod verifies the given options can be used to generate configs in the Bzlmod output
+// mode.
+func validateBzlmod(o *Options) error {
+	ok, err := bzlmodVersions.contains(o.BazelVersion)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("OutputMode %q requires Bazel %v, got BazelVersion %q", OutputModeBzlmod, bzlmodVersions, o.BazelVersion)
+	}
+	if !moduleNameRegexp.MatchString(configsRepoName(o)) {
+		return fmt.Errorf("OutputMode %q requires ConfigsRepoName to be a valid module name matching %s, got %q", OutputModeBzlmod, moduleNameRegexp, configsRepoName(o))
+	}
+	if o.OutputSourceRoot != "" && o.OutputConfigPath == "" {
+		// The generated MODULE.bazel would replace the MODULE.bazel of the source repository.
+		return fmt.Errorf("OutputMode %q requires OutputConfigPath when OutputSourceRoot is specified", OutputModeBzlmod)
+	}
+	return nil
+}
+
+// moduleDepsForBazel returns the versions of the modules the generated MODULE.bazel should depend
+// on for the given Bazel version.
+func moduleDepsForBazel(bazelVersion string) (moduleDepVersions, error) {
+	for _, d := range moduleDeps {
+		ok, err := d.Versions.contains(bazelVersion)
+		if err != nil {
+			return moduleDepVersions{}, err
+		}
+		if ok {
+			return d, nil
+		}
+	}
+	return moduleDepVersions{}, fmt.Errorf("no module dependencies are known for Bazel %q", bazelVersion)
+}
+
+// platformParentForOptions returns the parent of the generated platform if none was specified.
+func platformParentForOptions(o *Options) string {
+	if o.OutputMode != OutputModeBzlmod {
+		return defaultPlatformParent
+	}
+	if ok, err := hostPlatformModuleVersions.contains(o.BazelVersion); err == nil && ok {
+		return bzlmodPlatformParent
+	}
+	return defaultPlatformParent
+}
+
+// genModuleFile generates the MODULE.bazel file of a module with the given name registering the
+// platforms & toolchains of the configs generated for each of the given options. The module
+// dependencies are picked for the oldest Bazel version among the given options.
+func genModuleFile(name string, opts []*Options) (generatedFile, error) {
+	p := moduleTemplateParams{Name: name}
+	var minVersion string
+	var min *semver.Version
+	for _, o := range opts {
+		// An unspecified Bazel version is the latest version.
+		if o.BazelVersion != "" {
+			bv, err := parseBazelVersion(o.BazelVersion)
+			if err != nil {
+				return generatedFile{}, err
+			}
+			if min == nil || bv.LessThan(*min) {
+				min, minVersion = bv, o.BazelVersion
+			}
+		}
+		p.Platforms = append(p.Platforms, packageLabel(o, "config", "platform"))
+		for _, v := range o.PlatformParams.Variants {
+			p.Platforms = append(p.Platforms, packageLabel(o, "config", v.Name))
+		}
+		if o.GenCPPConfigs {
+			p.CppToolchains = append(p.CppToolchains, packageLabel(o, "config", "cc-toolchain"))
+		}
+		if o.GenJavaConfigs {
+			p.JavaToolchains = append(p.JavaToolchains, packageLabel(o, "java", "all"))
+		}
+		if o.GenPythonConfigs {
+			p.PythonToolchains = append(p.PythonToolchains, packageLabel(o, "python", "py_toolchain"))
+		}
+	}
+	deps, err := moduleDepsForBazel(minVersion)
+	if err != nil {
+		return generatedFile{}, err
+	}
+	p.Deps = deps
+	t, err := moduleTemplates.lookup(minVersion)
+	if err != nil {
+		return generatedFile{}, err
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := t.Execute(buf, p); err != nil {
+		return generatedFile{}, fmt.Errorf("failed to generate the %s file: %w", moduleFileName, err)
+	}
+	return generatedFile{
+		name:     moduleFileName,
+		contents: buf.Bytes(),
+	}, nil
+}
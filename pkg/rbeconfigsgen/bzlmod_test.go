@@ -0,0 +1,174 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunBzlmodWithFakeRuntime(t *testing.T) {
+	dir := t.TempDir()
+	srcRoot := t.TempDir()
+	rt := &fakeRuntime{
+		image:       "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:         []string{"JAVA_HOME=/jdk"},
+		javaVersion: "11.0.10",
+	}
+	o := Options{
+		BazelVersion:       "7.1.0",
+		BazelPath:          "/usr/bin/bazel",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      path.Join(dir, "configs.tar"),
+		OutputSourceRoot:   srcRoot,
+		OutputConfigPath:   "configs/rbe",
+		ConfigsRepoName:    "rbe_ubuntu",
+		OutputMode:         OutputModeBzlmod,
+		GenJavaConfigs:     true,
+		TempWorkDir:        t.TempDir(),
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	o.PlatformParams.Variants = []PlatformVariant{{Name: "large"}}
+	if err := validateBzlmod(&o); err != nil {
+		t.Fatalf("validateBzlmod failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	files := readTarball(t, o.OutputTarball)
+	for _, want := range []string{
+		`module(name = "rbe_ubuntu")`,
+		`bazel_dep(name = "platforms", version = "0.0.10")`,
+		`bazel_dep(name = "rules_java", version = "7.6.1")`,
+		`    "//config:platform",
+    "//config:large",
+`,
+		`    "//java:all",`,
+	} {
+		if !strings.Contains(files["MODULE.bazel"], want) {
+			t.Errorf("MODULE.bazel did not contain %q, got:\n%s", want, files["MODULE.bazel"])
+		}
+	}
+	if strings.Contains(files["MODULE.bazel"], "rules_cc") {
+		t.Errorf("MODULE.bazel depended on rules_cc even though C++ configs weren't generated, got:\n%s", files["MODULE.bazel"])
+	}
+	if want := `parents = ["@platforms//host"]`; !strings.Contains(files["config/BUILD"], want) {
+		t.Errorf("config/BUILD did not contain %q, got:\n%s", want, files["config/BUILD"])
+	}
+	if want := "build:remote --platforms=@rbe_ubuntu//config:platform\n"; !strings.Contains(files["configs.bazelrc"], want) {
+		t.Errorf("configs.bazelrc did not contain %q, got:\n%s", want, files["configs.bazelrc"])
+	}
+	for _, f := range []string{"--extra_execution_platforms", "--extra_toolchains"} {
+		if strings.Contains(files["configs.bazelrc"], f) {
+			t.Errorf("configs.bazelrc contained %q even though the module registers the platforms & toolchains, got:\n%s", f, files["configs.bazelrc"])
+		}
+	}
+
+	blob, err := ioutil.ReadFile(filepath.Join(srcRoot, "configs", "rbe", "MODULE.bazel"))
+	if err != nil {
+		t.Fatalf("Failed to read MODULE.bazel from the output directory: %v", err)
+	}
+	if string(blob) != files["MODULE.bazel"] {
+		t.Errorf("MODULE.bazel in the output directory differed from the output tarball, got:\n%s\nwant:\n%s", blob, files["MODULE.bazel"])
+	}
+}
+
+func TestGenModuleFileBundle(t *testing.T) {
+	opts := []*Options{
+		{
+			BazelVersion:   "7.0.0",
+			OutputMode:     OutputModeBzlmod,
+			GenCPPConfigs:  true,
+			PlatformParams: &PlatformToolchainsTemplateParams{},
+			modulePath:     "ubuntu",
+		},
+		{
+			BazelVersion:   "6.4.0",
+			OutputMode:     OutputModeBzlmod,
+			GenJavaConfigs: true,
+			PlatformParams: &PlatformToolchainsTemplateParams{},
+			modulePath:     "debian",
+		},
+	}
+	g, err := genModuleFile("rbe_bundle", opts)
+	if err != nil {
+		t.Fatalf("genModuleFile failed: %v", err)
+	}
+	got := string(g.contents)
+	for _, want := range []string{
+		// The dependencies are picked for the oldest Bazel version.
+		`bazel_dep(name = "platforms", version = "0.0.7")`,
+		`bazel_dep(name = "rules_cc", version = "0.0.9")`,
+		`bazel_dep(name = "rules_java", version = "6.5.2")`,
+		`    "//ubuntu/config:platform",
+    "//debian/config:platform",
+`,
+		`    "//ubuntu/config:cc-toolchain",
+    "//debian/java:all",
+`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("MODULE.bazel did not contain %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestValidateBzlmod(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     *Options
+		wantErr bool
+	}{
+		{
+			name: "Valid",
+			opt:  &Options{BazelVersion: "6.0.0", OutputSourceRoot: "/src", OutputConfigPath: "configs"},
+		},
+		{
+			name:    "OldBazel",
+			opt:     &Options{BazelVersion: "5.4.0"},
+			wantErr: true,
+		},
+		{
+			name:    "InvalidModuleName",
+			opt:     &Options{BazelVersion: "7.0.0", ConfigsRepoName: "RBE"},
+			wantErr: true,
+		},
+		{
+			name:    "SourceRootWithoutConfigPath",
+			opt:     &Options{BazelVersion: "7.0.0", OutputSourceRoot: "/src"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			tc.opt.OutputMode = OutputModeBzlmod
+			err := validateBzlmod(tc.opt)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("validateBzlmod got error %v, want error=%v", err, tc.wantErr)
+			}
+		})
+	}
+}
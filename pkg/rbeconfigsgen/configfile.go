@@ -0,0 +1,536 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ConfigFileVersion is the latest version of the config file schema.
+	ConfigFileVersion = 1
+)
+
+var (
+	validCppBazelCmds = []string{
+		"build",
+		"query",
+	}
+
+	validCppConfigModes = []string{
+		CppConfigModeBazel,
+		CppConfigModeStatic,
+	}
+
+	validCppSymlinkModes = []string{
+		CppSymlinkModePreserve,
+		CppSymlinkModeInline,
+	}
+)
+
+// configFile is the schema of a config file. Config files are YAML and since YAML is a superset of
+// JSON, config files can also be written in JSON.
+type configFile struct {
+	// Version is the version of the schema of the config file.
+	Version          int    `yaml:"version"`
+	OutputTarball    string `yaml:"output_tarball"`
+	OutputFormat     string `yaml:"output_format"`
+	OutputSourceRoot string `yaml:"output_src_root"`
+	OutputConfigPath string `yaml:"output_config_path"`
+	ConfigsRepoName  string `yaml:"configs_repo_name"`
+	OutputMode       string `yaml:"output_mode"`
+	OutputManifest   string `yaml:"output_manifest"`
+	TempWorkDir      string `yaml:"temp_work_dir"`
+	Cleanup          *bool  `yaml:"cleanup"`
+	// The toolchain settings at the top level describe the single toolchain container to generate
+	// configs for if Configs is empty or the defaults for every entry in Configs otherwise.
+	configFileToolchain `yaml:",inline"`
+	// Configs are the toolchain containers to generate a configs bundle for.
+	Configs []configFileEntry `yaml:"configs"`
+}
+
+// configFileToolchain are the settings describing how to generate configs for a toolchain container
+// in a config file. The keys match the names of the corresponding command line flags of
+// rbe_configs_gen where available.
+type configFileToolchain struct {
+	ToolchainContainer  string              `yaml:"toolchain_container"`
+	ExecOS              string              `yaml:"exec_os"`
+	TargetOS            string              `yaml:"target_os"`
+	ExecArch            string              `yaml:"exec_arch"`
+	TargetArch          string              `yaml:"target_arch"`
+	BazelVersion        string              `yaml:"bazel_version"`
+	BazelPath           string              `yaml:"bazel_path"`
+	DockerPlatform      string              `yaml:"docker_platform"`
+	ContainerRuntime    string              `yaml:"container_runtime"`
+	ImageArchive        string              `yaml:"image_archive"`
+	ExecConstraints     []string            `yaml:"exec_constraints"`
+	TargetConstraints   []string            `yaml:"target_constraints"`
+	OSFamily            string              `yaml:"os_family"`
+	PlatformParent      string              `yaml:"platform_parent"`
+	ExtraConstraints    []string            `yaml:"extra_constraint_values"`
+	ExecProperties      map[string]string   `yaml:"exec_properties"`
+	PlatformVariants    []configFileVariant `yaml:"platform_variants"`
+	GenCPPConfigs       *bool               `yaml:"generate_cpp_configs"`
+	CppEnv              map[string]string   `yaml:"cpp_env"`
+	CppEnvJSON          string              `yaml:"cpp_env_json"`
+	CppToolchainTarget  string              `yaml:"cpp_toolchain_target"`
+	CppConfigMode       string              `yaml:"cpp_config_mode"`
+	CppSymlinkMode      string              `yaml:"cpp_symlink_mode"`
+	CppConfigTargets    []string            `yaml:"cpp_config_targets"`
+	CppConfigRepo       string              `yaml:"cpp_config_repo"`
+	CppBazelCmd         string              `yaml:"cpp_bazel_cmd"`
+	GenJavaConfigs      *bool               `yaml:"generate_java_configs"`
+	JavaUseLocalRuntime bool                `yaml:"java_use_local_runtime"`
+	GenJavaToolchains   bool                `yaml:"generate_java_toolchains"`
+	JavaHomeGlobs       []string            `yaml:"java_home_globs"`
+	JavaDefaultVersion  string              `yaml:"java_default_version"`
+	GenPythonConfigs    bool                `yaml:"generate_python_configs"`
+	GenGoConfigs        bool                `yaml:"generate_go_configs"`
+	GenRustConfigs      bool                `yaml:"generate_rust_configs"`
+	TemplateDir         string              `yaml:"template_dir"`
+}
+
+// configFileVariant is a platform variant in a config file.
+type configFileVariant struct {
+	Name           string            `yaml:"name"`
+	ExecProperties map[string]string `yaml:"exec_properties"`
+}
+
+// configFileEntry is an entry in the configs of a config file.
+type configFileEntry struct {
+	Name                string `yaml:"name"`
+	configFileToolchain `yaml:",inline"`
+}
+
+// ConfigFileError is an error about a field in a config file.
+type ConfigFileError struct {
+	// File is the path to the config file.
+	File string
+	// Line is the line in the config file the error refers to or 0 if unknown.
+	Line int
+	// Field is the path to the field in the config file the error refers to, e.g., configs[1].exec_os.
+	Field string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ConfigFileError) Error() string {
+	loc := e.File
+	if e.Line != 0 {
+		loc = fmt.Sprintf("%s:%d", loc, e.Line)
+	}
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %v", loc, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", loc, e.Field, e.Err)
+}
+
+func (e *ConfigFileError) Unwrap() error {
+	return e.Err
+}
+
+// Config is the parsed contents of a config file. Exactly one of Options or Bundle is set.
+type Config struct {
+	// Options are the options to generate configs for a single toolchain container. Set if the
+	// config file didn't specify any configs.
+	Options *Options
+	// Bundle are the options to generate a configs bundle. Set if the config file specified configs.
+	Bundle *BundleOptions
+}
+
+// configLoader converts a parsed config file into options while reporting errors with the line of
+// the offending field.
+type configLoader struct {
+	// filePath is the path to the config file.
+	filePath string
+	// root is the root mapping of the YAML document in the config file.
+	root *yaml.Node
+}
+
+// fieldNode returns the node for the value at the given field path or the node of the closest
+// parent that exists. Each element of the path is either a mapping key or a sequence index.
+func fieldNode(n *yaml.Node, field []string) *yaml.Node {
+	for _, f := range field {
+		var next *yaml.Node
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == f {
+					next = n.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(f); err == nil && i >= 0 && i < len(n.Content) {
+				next = n.Content[i]
+			}
+		}
+		if next == nil {
+			return n
+		}
+		n = next
+	}
+	return n
+}
+
+// hasKey returns whether the given mapping node has the given key.
+func hasKey(n *yaml.Node, key string) bool {
+	if n.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldString renders the given field path, e.g., configs[1].exec_os.
+func fieldString(field []string) string {
+	var sb strings.Builder
+	for _, f := range field {
+		if _, err := strconv.Atoi(f); err == nil {
+			sb.WriteString("[" + f + "]")
+			continue
+		}
+		if sb.Len() != 0 {
+			sb.WriteString(".")
+		}
+		sb.WriteString(f)
+	}
+	return sb.String()
+}
+
+// errorf returns an error about the field at the given path in the config file.
+func (l *configLoader) errorf(field []string, format string, args ...interface{}) error {
+	return &ConfigFileError{
+		File:  l.filePath,
+		Line:  fieldNode(l.root, field).Line,
+		Field: fieldString(field),
+		Err:   fmt.Errorf(format, args...),
+	}
+}
+
+// subField returns a copy of the given field path with the given elements appended.
+func subField(field []string, elems ...string) []string {
+	result := append([]string{}, field...)
+	return append(result, elems...)
+}
+
+// resolvePath resolves the given path relative to the directory of the config file.
+func (l *configLoader) resolvePath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(filepath.Dir(l.filePath), p)
+}
+
+// checkOneOf verifies the value of the field at the given path is one of the given values if it
+// was specified.
+func (l *configLoader) checkOneOf(field []string, value string, valid []string) error {
+	if value == "" || strListContains(valid, value) {
+		return nil
+	}
+	return l.errorf(field, "got %q, want one of %s", value, strings.Join(valid, ", "))
+}
+
+// checkLabels verifies the values of the list field at the given path are absolute Bazel labels.
+func (l *configLoader) checkLabels(field []string, labels []string) error {
+	for i, c := range labels {
+		if !isAbsoluteLabel(c) {
+			return l.errorf(subField(field, strconv.Itoa(i)), "got %q, want an absolute Bazel label", c)
+		}
+	}
+	return nil
+}
+
+// checkExecProperties verifies the exec properties of the map field at the given path.
+func (l *configLoader) checkExecProperties(field []string, props map[string]string) error {
+	var keys []string
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := validateExecProperty(k, props[k]); err != nil {
+			return l.errorf(subField(field, k), "%v", err)
+		}
+	}
+	return nil
+}
+
+// toolchainOptions converts the given toolchain settings found at the given field path into
+// options with the platform specific defaults applied.
+func (l *configLoader) toolchainOptions(tc *configFileToolchain, field []string) (*Options, error) {
+	if tc.ToolchainContainer == "" {
+		return nil, l.errorf(subField(field, "toolchain_container"), "required field was not specified")
+	}
+	if tc.ExecOS == "" {
+		return nil, l.errorf(subField(field, "exec_os"), "required field was not specified")
+	}
+	if tc.TargetOS == "" {
+		return nil, l.errorf(subField(field, "target_os"), "required field was not specified")
+	}
+	checks := []struct {
+		name  string
+		value string
+		valid []string
+	}{
+		{"exec_os", tc.ExecOS, validOS},
+		{"target_os", tc.TargetOS, validOS},
+		{"exec_arch", tc.ExecArch, validArchs},
+		{"target_arch", tc.TargetArch, validArchs},
+		{"container_runtime", tc.ContainerRuntime, validRuntimes},
+		{"cpp_config_mode", tc.CppConfigMode, validCppConfigModes},
+		{"cpp_symlink_mode", tc.CppSymlinkMode, validCppSymlinkModes},
+		{"cpp_bazel_cmd", tc.CppBazelCmd, validCppBazelCmds},
+		{"os_family", tc.OSFamily, validOSFamilies},
+	}
+	for _, c := range checks {
+		if err := l.checkOneOf(subField(field, c.name), c.value, c.valid); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.checkLabels(subField(field, "exec_constraints"), tc.ExecConstraints); err != nil {
+		return nil, err
+	}
+	if err := l.checkLabels(subField(field, "target_constraints"), tc.TargetConstraints); err != nil {
+		return nil, err
+	}
+	if err := l.checkLabels(subField(field, "extra_constraint_values"), tc.ExtraConstraints); err != nil {
+		return nil, err
+	}
+	if err := l.checkLabels(subField(field, "cpp_config_targets"), tc.CppConfigTargets); err != nil {
+		return nil, err
+	}
+	if tc.PlatformParent != "" && !isAbsoluteLabel(tc.PlatformParent) {
+		return nil, l.errorf(subField(field, "platform_parent"), "got %q, want an absolute Bazel label", tc.PlatformParent)
+	}
+	if err := l.checkExecProperties(subField(field, "exec_properties"), tc.ExecProperties); err != nil {
+		return nil, err
+	}
+	var variants []PlatformVariant
+	names := make(map[string]bool)
+	for i, v := range tc.PlatformVariants {
+		vField := subField(field, "platform_variants", strconv.Itoa(i))
+		if err := validatePlatformVariantName(v.Name); err != nil {
+			return nil, l.errorf(subField(vField, "name"), "%v", err)
+		}
+		if names[v.Name] {
+			return nil, l.errorf(subField(vField, "name"), "got multiple platform variants named %q, names must be unique", v.Name)
+		}
+		names[v.Name] = true
+		if err := l.checkExecProperties(subField(vField, "exec_properties"), v.ExecProperties); err != nil {
+			return nil, err
+		}
+		variants = append(variants, PlatformVariant{Name: v.Name, ExecProperties: v.ExecProperties})
+	}
+	for i, g := range tc.JavaHomeGlobs {
+		if err := validateJavaHomeGlob(g); err != nil {
+			return nil, l.errorf(subField(field, "java_home_globs", strconv.Itoa(i)), "%v", err)
+		}
+	}
+	if len(tc.CppEnv) != 0 && tc.CppEnvJSON != "" {
+		return nil, l.errorf(subField(field, "cpp_env"), "only one of cpp_env or cpp_env_json can be specified")
+	}
+
+	o := &Options{
+		BazelVersion:           tc.BazelVersion,
+		BazelPath:              tc.BazelPath,
+		ToolchainContainer:     tc.ToolchainContainer,
+		DockerPlatform:         tc.DockerPlatform,
+		ContainerRuntime:       tc.ContainerRuntime,
+		ImageArchive:           l.resolvePath(tc.ImageArchive),
+		ExecOS:                 tc.ExecOS,
+		TargetOS:               tc.TargetOS,
+		ExecArch:               tc.ExecArch,
+		TargetArch:             tc.TargetArch,
+		GenCPPConfigs:          tc.GenCPPConfigs == nil || *tc.GenCPPConfigs,
+		CppGenEnv:              tc.CppEnv,
+		CppGenEnvJSON:          l.resolvePath(tc.CppEnvJSON),
+		CPPToolchainTargetName: tc.CppToolchainTarget,
+		CppConfigMode:          tc.CppConfigMode,
+		CppSymlinkMode:         tc.CppSymlinkMode,
+		GenJavaConfigs:         tc.GenJavaConfigs == nil || *tc.GenJavaConfigs,
+		JavaUseLocalRuntime:    tc.JavaUseLocalRuntime,
+		GenJavaToolchains:      tc.GenJavaToolchains,
+		JavaHomeGlobs:          tc.JavaHomeGlobs,
+		JavaDefaultVersion:     tc.JavaDefaultVersion,
+		GenPythonConfigs:       tc.GenPythonConfigs,
+		GenGoConfigs:           tc.GenGoConfigs,
+		GenRustConfigs:         tc.GenRustConfigs,
+		TemplateDir:            l.resolvePath(tc.TemplateDir),
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		return nil, l.errorf(subField(field, "exec_os"), "%v", err)
+	}
+	if tc.ExecConstraints != nil {
+		o.PlatformParams.ExecConstraints = tc.ExecConstraints
+	}
+	if tc.TargetConstraints != nil {
+		o.PlatformParams.TargetConstraints = tc.TargetConstraints
+	}
+	if tc.OSFamily != "" {
+		o.PlatformParams.OSFamily = tc.OSFamily
+	}
+	o.PlatformParams.Parent = tc.PlatformParent
+	o.PlatformParams.ExtraConstraints = tc.ExtraConstraints
+	o.PlatformParams.ExecProperties = tc.ExecProperties
+	o.PlatformParams.Variants = variants
+	if tc.CppConfigTargets != nil {
+		o.CPPConfigTargets = tc.CppConfigTargets
+	}
+	if tc.CppConfigRepo != "" {
+		o.CPPConfigRepo = tc.CppConfigRepo
+	}
+	if tc.CppBazelCmd != "" {
+		o.CppBazelCmd = tc.CppBazelCmd
+	}
+	return o, nil
+}
+
+// ConfigFromFile reads the YAML or JSON config file at the given path. The config file must specify
+// the version of its schema and unknown fields are rejected. Config files without a version are
+// read as version 0 configs bundle JSON files with BundleOptionsFromJSONFile. Platform specific defaults are applied
+// to the options of every toolchain container before the settings in the config file. C++ & Java
+// config generation are enabled unless explicitly disabled and cleanup is enabled unless explicitly
+// disabled. Relative paths to files read by config generation are resolved relative to the
+// directory of the config file. The returned options are expected to be validated by the caller.
+func ConfigFromFile(filePath string) (*Config, error) {
+	blob, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file %q: %w", filePath, err)
+	}
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(blob, &doc); err != nil {
+		return nil, &ConfigFileError{File: filePath, Err: err}
+	}
+	if len(doc.Content) == 0 {
+		return nil, &ConfigFileError{File: filePath, Err: fmt.Errorf("config file was empty")}
+	}
+	l := &configLoader{filePath: filePath, root: doc.Content[0]}
+	if l.root.Kind != yaml.MappingNode {
+		return nil, l.errorf(nil, "expected a mapping at the top level of the config file")
+	}
+
+	// Check the version before the rest of the schema to report a useful error for config files
+	// written for a different version.
+	v := struct {
+		Version int `yaml:"version"`
+	}{}
+	if err := l.root.Decode(&v); err != nil {
+		return nil, l.errorf([]string{"version"}, "%v", err)
+	}
+	if v.Version == 0 && !hasKey(l.root, "version") {
+		// Config files predating the versioned schema only described configs bundles in JSON.
+		b, err := BundleOptionsFromJSONFile(filePath)
+		if err != nil {
+			return nil, l.errorf([]string{"version"}, "required field was not specified, the latest version is %d, and the config file isn't a version 0 configs bundle: %v", ConfigFileVersion, err)
+		}
+		log.Printf("Warning: Config file %q doesn't specify a version and was read as a version 0 configs bundle. Specify \"version\": %d to use the latest schema.", filePath, ConfigFileVersion)
+		b.Cleanup = true
+		return &Config{Bundle: b}, nil
+	}
+	if v.Version != ConfigFileVersion {
+		return nil, l.errorf([]string{"version"}, "unsupported version %d, want %d", v.Version, ConfigFileVersion)
+	}
+
+	f := configFile{}
+	d := yaml.NewDecoder(bytes.NewReader(blob))
+	d.KnownFields(true)
+	if err := d.Decode(&f); err != nil {
+		return nil, &ConfigFileError{File: filePath, Err: err}
+	}
+	if err := l.checkOneOf([]string{"output_mode"}, f.OutputMode, validOutputModes); err != nil {
+		return nil, err
+	}
+	if err := l.checkOneOf([]string{"output_format"}, f.OutputFormat, validOutputFormats); err != nil {
+		return nil, err
+	}
+	cleanup := f.Cleanup == nil || *f.Cleanup
+
+	if len(f.Configs) == 0 {
+		o, err := l.toolchainOptions(&f.configFileToolchain, nil)
+		if err != nil {
+			return nil, err
+		}
+		o.OutputTarball = f.OutputTarball
+		o.OutputFormat = f.OutputFormat
+		o.OutputSourceRoot = f.OutputSourceRoot
+		o.OutputConfigPath = f.OutputConfigPath
+		o.ConfigsRepoName = f.ConfigsRepoName
+		o.OutputMode = f.OutputMode
+		o.OutputManifest = f.OutputManifest
+		o.TempWorkDir = f.TempWorkDir
+		o.Cleanup = cleanup
+		return &Config{Options: o}, nil
+	}
+
+	b := &BundleOptions{
+		OutputTarball:    f.OutputTarball,
+		OutputFormat:     f.OutputFormat,
+		OutputSourceRoot: f.OutputSourceRoot,
+		OutputConfigPath: f.OutputConfigPath,
+		ConfigsRepoName:  f.ConfigsRepoName,
+		OutputMode:       f.OutputMode,
+		OutputManifest:   f.OutputManifest,
+		TempWorkDir:      f.TempWorkDir,
+		Cleanup:          cleanup,
+	}
+	configsNode := fieldNode(l.root, []string{"configs"})
+	names := make(map[string]bool)
+	for i := range f.Configs {
+		field := []string{"configs", strconv.Itoa(i)}
+		// Decode the entry again on top of the top level settings so that the entry only overrides
+		// the settings it specifies. The config file was already checked for unknown fields.
+		e := configFileEntry{configFileToolchain: f.configFileToolchain}
+		n := configsNode.Content[i]
+		// Maps are replaced as a whole instead of merging the entries into the maps shared with the
+		// top level settings.
+		if hasKey(n, "cpp_env") || hasKey(n, "cpp_env_json") {
+			e.CppEnv = nil
+			e.CppEnvJSON = ""
+		}
+		if hasKey(n, "exec_properties") {
+			e.ExecProperties = nil
+		}
+		if err := n.Decode(&e); err != nil {
+			return nil, l.errorf(field, "%v", err)
+		}
+		if !bundleEntryNameRegexp.MatchString(e.Name) {
+			return nil, l.errorf(subField(field, "name"), "invalid name %q, names must match %s", e.Name, bundleEntryNameRegexp)
+		}
+		if names[e.Name] {
+			return nil, l.errorf(subField(field, "name"), "got multiple configs named %q, names must be unique", e.Name)
+		}
+		names[e.Name] = true
+		o, err := l.toolchainOptions(&e.configFileToolchain, field)
+		if err != nil {
+			return nil, err
+		}
+		b.Entries = append(b.Entries, BundleEntry{Name: e.Name, Options: *o})
+	}
+	return &Config{Bundle: b}, nil
+}
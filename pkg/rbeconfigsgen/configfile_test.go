@@ -0,0 +1,320 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes a config file with the given contents & name to a temporary directory and
+// returns its path.
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return p
+}
+
+func TestConfigFromFileYAML(t *testing.T) {
+	t.Parallel()
+	p := writeConfigFile(t, "config.yaml", `
+version: 1
+toolchain_container: gcr.io/foo/bar:latest
+exec_os: linux
+target_os: linux
+output_tarball: configs.tar
+cleanup: false
+exec_constraints:
+  - "@platforms//os:linux"
+  - "@platforms//cpu:x86_64"
+  - "//constraints:sandboxed"
+os_family: Linux
+cpp_env:
+  CC: gcc
+cpp_bazel_cmd: query
+cpp_config_targets: ["@local_config_cc//:toolchain"]
+generate_java_configs: false
+platform_variants:
+  - name: large
+    exec_properties:
+      Pool: large
+`)
+	c, err := ConfigFromFile(p)
+	if err != nil {
+		t.Fatalf("ConfigFromFile failed: %v", err)
+	}
+	if c.Bundle != nil || c.Options == nil {
+		t.Fatalf("ConfigFromFile got %+v, want options for a single toolchain container", c)
+	}
+	o := c.Options
+	if o.OutputTarball != "configs.tar" || o.Cleanup {
+		t.Errorf("Got output tarball %q & cleanup %v, want configs.tar & false", o.OutputTarball, o.Cleanup)
+	}
+	wantExec := []string{"@platforms//os:linux", "@platforms//cpu:x86_64", "//constraints:sandboxed"}
+	if !reflect.DeepEqual(o.PlatformParams.ExecConstraints, wantExec) {
+		t.Errorf("Got exec constraints %v, want %v", o.PlatformParams.ExecConstraints, wantExec)
+	}
+	// Target constraints weren't specified so the defaults apply.
+	if !reflect.DeepEqual(o.PlatformParams.TargetConstraints, DefaultExecOptions[OSLinux].PlatformParams.TargetConstraints) {
+		t.Errorf("Got target constraints %v, want the defaults", o.PlatformParams.TargetConstraints)
+	}
+	if !reflect.DeepEqual(o.CppGenEnv, map[string]string{"CC": "gcc"}) {
+		t.Errorf("Got C++ env %v, want only CC=gcc", o.CppGenEnv)
+	}
+	if o.CppBazelCmd != "query" || !reflect.DeepEqual(o.CPPConfigTargets, []string{"@local_config_cc//:toolchain"}) {
+		t.Errorf("Got C++ Bazel command %q on targets %v, want query on @local_config_cc//:toolchain", o.CppBazelCmd, o.CPPConfigTargets)
+	}
+	if o.CPPToolchainTargetName != "cc-compiler-k8" {
+		t.Errorf("Got C++ toolchain target %q, want the default cc-compiler-k8", o.CPPToolchainTargetName)
+	}
+	wantVariants := []PlatformVariant{{Name: "large", ExecProperties: map[string]string{"Pool": "large"}}}
+	if !reflect.DeepEqual(o.PlatformParams.Variants, wantVariants) {
+		t.Errorf("Got platform variants %+v, want %+v", o.PlatformParams.Variants, wantVariants)
+	}
+	if !o.GenCPPConfigs || o.GenJavaConfigs {
+		t.Errorf("Got C++=%v, Java=%v, want C++ configs only", o.GenCPPConfigs, o.GenJavaConfigs)
+	}
+}
+
+func TestConfigFromFileJSONBundle(t *testing.T) {
+	t.Parallel()
+	p := writeConfigFile(t, "bundle.json", `{
+  "version": 1,
+  "output_tarball": "configs.tar",
+  "bazel_version": "6.0.0",
+  "configs": [
+    {
+      "name": "ubuntu",
+      "toolchain_container": "gcr.io/foo/ubuntu:latest",
+      "exec_os": "linux",
+      "target_os": "linux",
+      "image_archive": "images/ubuntu.tar"
+    },
+    {
+      "name": "windows",
+      "toolchain_container": "gcr.io/foo/windows:latest",
+      "exec_os": "windows",
+      "target_os": "windows",
+      "bazel_version": "5.0.0",
+      "generate_java_configs": false
+    }
+  ]
+}`)
+	c, err := ConfigFromFile(p)
+	if err != nil {
+		t.Fatalf("ConfigFromFile failed: %v", err)
+	}
+	b := c.Bundle
+	if b == nil || c.Options != nil {
+		t.Fatalf("ConfigFromFile got %+v, want a bundle", c)
+	}
+	if b.OutputTarball != "configs.tar" || len(b.Entries) != 2 || !b.Cleanup {
+		t.Fatalf("ConfigFromFile got %+v, want 2 entries with output tarball configs.tar & cleanup enabled", b)
+	}
+	u := b.Entries[0].Options
+	if !u.GenCPPConfigs || !u.GenJavaConfigs {
+		t.Errorf("Config generation wasn't enabled by default for %q, got C++=%v, Java=%v", b.Entries[0].Name, u.GenCPPConfigs, u.GenJavaConfigs)
+	}
+	if want := filepath.Join(filepath.Dir(p), "images/ubuntu.tar"); u.ImageArchive != want {
+		t.Errorf("Got image archive %q, want %q", u.ImageArchive, want)
+	}
+	w := b.Entries[1].Options
+	if w.GenJavaConfigs {
+		t.Errorf("Java config generation was enabled for %q even though it was disabled in the config file", b.Entries[1].Name)
+	}
+	if u.BazelVersion != "6.0.0" || w.BazelVersion != "5.0.0" {
+		t.Errorf("Got Bazel versions %q & %q, want the top level 6.0.0 & the overridden 5.0.0", u.BazelVersion, w.BazelVersion)
+	}
+	if w.PlatformParams.OSFamily != "Windows" {
+		t.Errorf("Got OS family %q for %q, want Windows", w.PlatformParams.OSFamily, b.Entries[1].Name)
+	}
+}
+
+func TestConfigFromFileVersion0Bundle(t *testing.T) {
+	t.Parallel()
+	p := writeConfigFile(t, "bundle.json", `{
+  "output_tarball": "configs.tar",
+  "configs": [
+    {
+      "name": "ubuntu",
+      "toolchain_container": "gcr.io/foo/ubuntu:latest",
+      "exec_os": "linux",
+      "target_os": "linux",
+      "bazel_version": "6.0.0",
+      "image_archive": "images/ubuntu.tar"
+    }
+  ]
+}`)
+	c, err := ConfigFromFile(p)
+	if err != nil {
+		t.Fatalf("ConfigFromFile failed: %v", err)
+	}
+	b := c.Bundle
+	if b == nil || c.Options != nil {
+		t.Fatalf("ConfigFromFile got %+v, want a bundle", c)
+	}
+	if b.OutputTarball != "configs.tar" || len(b.Entries) != 1 || !b.Cleanup {
+		t.Fatalf("ConfigFromFile got %+v, want 1 entry with output tarball configs.tar & cleanup enabled", b)
+	}
+	if want := filepath.Join(filepath.Dir(p), "images/ubuntu.tar"); b.Entries[0].Options.ImageArchive != want {
+		t.Errorf("Got image archive %q, want %q", b.Entries[0].Options.ImageArchive, want)
+	}
+	if err := b.Validate(); err != nil {
+		t.Errorf("Validate failed for the bundle read from a version 0 config file: %v", err)
+	}
+}
+
+func TestConfigFromFileErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		contents  string
+		wantLine  int
+		wantField string
+		wantErr   string
+	}{
+		{
+			name:      "MissingVersion",
+			contents:  "toolchain_container: foo\n",
+			wantLine:  1,
+			wantField: "version",
+			wantErr:   "required",
+		},
+		{
+			name:      "Version0",
+			contents:  "version: 0\ntoolchain_container: foo\n",
+			wantLine:  1,
+			wantField: "version",
+			wantErr:   "unsupported version 0",
+		},
+		{
+			name:      "UnsupportedVersion",
+			contents:  "toolchain_container: foo\nversion: 2\n",
+			wantLine:  2,
+			wantField: "version",
+			wantErr:   "unsupported version 2",
+		},
+		{
+			name:     "UnknownField",
+			contents: "version: 1\ntoolchain_container: foo\ntoolchain: typo\n",
+			wantLine: 3,
+			wantErr:  "field toolchain not found",
+		},
+		{
+			name:     "WrongType",
+			contents: "version: 1\nexec_constraints: foo\n",
+			wantLine: 2,
+			wantErr:  "cannot unmarshal",
+		},
+		{
+			name:      "InvalidOS",
+			contents:  "version: 1\ntoolchain_container: foo\nexec_os: linux\ntarget_os: macos\n",
+			wantLine:  4,
+			wantField: "target_os",
+			wantErr:   `got "macos"`,
+		},
+		{
+			name:      "InvalidConstraint",
+			contents:  "version: 1\ntoolchain_container: foo\nexec_os: linux\ntarget_os: linux\ntarget_constraints:\n  - \"@platforms//os:linux\"\n  - cpu:x86_64\n",
+			wantLine:  7,
+			wantField: "target_constraints[1]",
+			wantErr:   "absolute Bazel label",
+		},
+		{
+			name:      "MissingFieldInEntry",
+			contents:  "version: 1\nexec_os: linux\ntarget_os: linux\nconfigs:\n  - name: a\n    toolchain_container: foo\n  - name: b\n",
+			wantLine:  7,
+			wantField: "configs[1].toolchain_container",
+			wantErr:   "required",
+		},
+		{
+			name:      "DuplicateEntry",
+			contents:  "version: 1\ntoolchain_container: foo\nexec_os: linux\ntarget_os: linux\nconfigs:\n  - name: a\n  - name: a\n",
+			wantLine:  7,
+			wantField: "configs[1].name",
+			wantErr:   "unique",
+		},
+		{
+			name:      "InvalidExecProperty",
+			contents:  "version: 1\ntoolchain_container: foo\nexec_os: linux\ntarget_os: linux\nexec_properties:\n  Pool: default\n  dockerNetwork: on\n",
+			wantLine:  7,
+			wantField: "exec_properties.dockerNetwork",
+			wantErr:   "want one of standard, off",
+		},
+		{
+			name:      "ReservedVariantName",
+			contents:  "version: 1\ntoolchain_container: foo\nexec_os: linux\ntarget_os: linux\nplatform_variants:\n  - name: large\n  - name: platform\n",
+			wantLine:  7,
+			wantField: "platform_variants[1].name",
+			wantErr:   "reserved",
+		},
+		{
+			name:      "InvalidOutputFormat",
+			contents:  "version: 1\ntoolchain_container: foo\nexec_os: linux\ntarget_os: linux\noutput_tarball: configs.rar\noutput_format: rar\n",
+			wantLine:  6,
+			wantField: "output_format",
+			wantErr:   `got "rar"`,
+		},
+		{
+			name:      "InvalidCppSymlinkMode",
+			contents:  "version: 1\ntoolchain_container: foo\nexec_os: linux\ntarget_os: linux\ncpp_symlink_mode: copy\n",
+			wantLine:  5,
+			wantField: "cpp_symlink_mode",
+			wantErr:   `got "copy"`,
+		},
+		{
+			name:      "ConflictingCppEnv",
+			contents:  "version: 1\ntoolchain_container: foo\nexec_os: linux\ntarget_os: linux\ncpp_env_json: env.json\ncpp_env:\n  CC: gcc\n",
+			wantLine:  7,
+			wantField: "cpp_env",
+			wantErr:   "only one of",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := writeConfigFile(t, "config.yaml", tc.contents)
+			_, err := ConfigFromFile(p)
+			if err == nil {
+				t.Fatalf("ConfigFromFile succeeded, want error")
+			}
+			var cfe *ConfigFileError
+			if !errors.As(err, &cfe) {
+				t.Fatalf("ConfigFromFile returned error %v, want a ConfigFileError", err)
+			}
+			if tc.wantField != "" && cfe.Field != tc.wantField {
+				t.Errorf("Got error for field %q, want %q (error=%v)", cfe.Field, tc.wantField, err)
+			}
+			if tc.wantField != "" && cfe.Line != tc.wantLine {
+				t.Errorf("Got error on line %d, want %d (error=%v)", cfe.Line, tc.wantLine, err)
+			}
+			if tc.wantField == "" && !strings.Contains(err.Error(), fmt.Sprintf("line %d:", tc.wantLine)) {
+				t.Errorf("Error %q didn't mention line %d", err, tc.wantLine)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Error %q didn't contain %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// cppCompilerProbeScript prints the path of the C++ compiler picked by Bazel's C++ toolchain
+	// autoconfiguration on Linux, i.e., the one in the CC environment variable or gcc, followed by
+	// the first line of its version information, e.g., "gcc (Debian 12.2.0-14) 12.2.0".
+	cppCompilerProbeScript = `cc="${CC:-gcc}"; command -v "$cc" && "$cc" --version | head -n 1`
+)
+
+// cppGenerator generates the C++ configs in the cc directory, either by running Bazel's C++
+// toolchain autoconfiguration inside the toolchain container or by statically inspecting its
+// rootfs depending on the CppConfigMode.
+type cppGenerator struct{}
+
+func (cppGenerator) name() string {
+	return "cpp"
+}
+
+func (cppGenerator) enabled(o *Options) bool {
+	return o.GenCPPConfigs
+}
+
+func (cppGenerator) generate(d *dockerRunner, o *Options) (*languageConfigs, error) {
+	manifest := map[string]string{
+		"config_mode": o.CppConfigMode,
+	}
+	var cppConfigsTarball string
+	// hostPaths are the host-specific paths the C++ configs generated by Bazel may reference.
+	// Static C++ configs never reference any.
+	var hostPaths cppHostPaths
+	if o.CppConfigMode == CppConfigModeStatic {
+		// Static C++ config generation doesn't run Bazel and the toolchain image may not even
+		// have a shell or network access to run Bazelisk.
+		t, info, err := genCppConfigsStatic(d, o)
+		if err != nil {
+			return nil, err
+		}
+		cppConfigsTarball = t
+		manifest["compiler"] = info.Compiler
+		manifest["compiler_path"] = info.CompilerPath
+		if info.CompilerVersion != "" {
+			manifest["compiler_version"] = info.CompilerVersion
+		}
+	} else {
+		bazelPath := o.BazelPath
+		if bazelPath == "" {
+			p, err := installBazelisk(d, o.TempWorkDir, o.ExecOS, o.ExecArch)
+			if err != nil {
+				return nil, fmt.Errorf("failed to install Bazelisk into the toolchain container: %w", err)
+			}
+			bazelPath = p
+			manifest["bazelisk_version"] = bazeliskVersion
+		}
+		t, h, err := genCppConfigs(d, o, bazelPath)
+		if err != nil {
+			return nil, err
+		}
+		cppConfigsTarball = t
+		hostPaths = h
+		for k, v := range probeCppCompiler(d, o) {
+			manifest[k] = v
+		}
+	}
+	files, err := readCppConfigsTarball(cppConfigsTarball, "cc", o.CppSymlinkMode)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the C++ configs from the C++ config tarball %q: %w", cppConfigsTarball, err)
+	}
+	files = relocateCppConfigs(o, hostPaths, files)
+	return &languageConfigs{
+		files:    files,
+		manifest: manifest,
+	}, nil
+}
+
+func (cppGenerator) bazelrc(o *Options) (*bazelrcSection, error) {
+	s := &bazelrcSection{Title: "C++ toolchain configuration"}
+	r, err := cppToolchainResolutionVersions.contains(o.BazelVersion)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine whether Bazel %q uses C++ toolchain resolution: %w", o.BazelVersion, err)
+	}
+	if !r {
+		s.Flags = append(s.Flags, "--crosstool_top="+configLabel(o, "cc", "toolchain"))
+	}
+	s.Flags = append(s.Flags, "--action_env=BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN=1")
+	if o.OutputMode != OutputModeBzlmod {
+		s.Flags = append(s.Flags, "--extra_toolchains="+configLabel(o, "config", "cc-toolchain"))
+	}
+	return s, nil
+}
+
+// probeCppCompiler returns the manifest entries describing the C++ compiler Bazel's C++ toolchain
+// autoconfiguration picks in the running toolchain container, i.e., the compiler in the CC
+// environment variable or gcc, or nil if it couldn't be determined. Only Linux toolchain
+// containers are supported.
+func probeCppCompiler(d *dockerRunner, o *Options) map[string]string {
+	if o.ExecOS != OSLinux {
+		return nil
+	}
+	oldEnv := d.env
+	defer func() {
+		d.env = oldEnv
+	}()
+	env, err := appendCppEnv(nil, o)
+	if err != nil {
+		log.Printf("Warning: Unable to determine the version of the C++ compiler: %v", err)
+		return nil
+	}
+	d.env = env
+	out, err := d.execCmd("sh", "-c", cppCompilerProbeScript)
+	if err != nil {
+		log.Printf("Warning: Unable to determine the version of the C++ compiler: %v", err)
+		return nil
+	}
+	return parseCppCompiler(out)
+}
+
+// parseCppCompiler returns the manifest entries describing the C++ compiler in the given output of
+// cppCompilerProbeScript or nil if no compiler was found.
+func parseCppCompiler(out string) map[string]string {
+	lines := strings.SplitN(strings.TrimSpace(out), "\n", 2)
+	if len(lines) != 2 || lines[0] == "" {
+		return nil
+	}
+	version := strings.TrimSpace(lines[1])
+	compiler := "gcc"
+	if strings.Contains(version, "clang") {
+		compiler = "clang"
+	}
+	return map[string]string{
+		"compiler":         compiler,
+		"compiler_path":    strings.TrimSpace(lines[0]),
+		"compiler_version": version,
+	}
+}
+
+// readCppConfigsTarball returns the C++ configs in the tarball at 'inTarPath' produced by
+// genCppConfigs as generated files in the directory 'pathPrefix'. The WORKSPACE file of the
+// C++ configs repository generated by Bazel is skipped. Executable bits are preserved. Symlinks are
+// replaced by copies of the files they point to unless 'symlinkMode' is CppSymlinkModePreserve, in
+// which case they're preserved as relative symlinks. See readTarballContents for the entries that
+// are rejected.
+func readCppConfigsTarball(inTarPath, pathPrefix, symlinkMode string) ([]generatedFile, error) {
+	t, err := readTarballContents(inTarPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := t.generatedFiles(pathPrefix, symlinkMode != CppSymlinkModePreserve)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the C++ configs from %q: %w", inTarPath, err)
+	}
+	var result []generatedFile
+	for _, f := range files {
+		if strings.HasSuffix(f.name, "WORKSPACE") {
+			continue
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// appendCppEnv appends environment variables set in the C++ environment map as well as variables
+// specified in the C++ environment JSON file to the given environment as "key=value".
+func appendCppEnv(env []string, o *Options) ([]string, error) {
+	for k, v := range o.CppGenEnv {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	if len(o.CppGenEnvJSON) == 0 {
+		return env, nil
+	}
+
+	blob, err := ioutil.ReadFile(o.CppGenEnvJSON)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read JSON file %q to read C++ config generation environment variables from: %w", o.CppGenEnvJSON, err)
+	}
+
+	e := map[string]string{}
+	if err := json.Unmarshal(blob, &e); err != nil {
+		return nil, fmt.Errorf("unable to parse file %q as a JSON string -> string dictionary: %w", o.CppGenEnvJSON, err)
+	}
+
+	for k, v := range e {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	return env, nil
+}
+
+// genCppConfigs generates C++ configs inside the running toolchain container represented by the
+// given docker runner according to the given options. bazelPath is the path to the Bazel
+// binary inside the running toolchain container.
+// The return values are the path to the C++ configs tarball copied out of the toolchain container
+// & the host-specific paths the C++ configs may reference. See relocateCppConfigs.
+func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, cppHostPaths, error) {
+	// Change the working directory to a dedicated empty directory for C++ configs for each
+	// command we run in this function.
+	cppProjDir := path.Join(d.workdir, "cpp_configs_project")
+	if _, err := d.execCmd("mkdir", cppProjDir); err != nil {
+		return "", cppHostPaths{}, fmt.Errorf("failed to create empty directory %q inside the toolchain container: %w", cppProjDir, err)
+	}
+	oldWorkDir := d.workdir
+	d.workdir = cppProjDir
+	defer func() {
+		d.workdir = oldWorkDir
+	}()
+
+	if _, err := d.execCmd("touch", "WORKSPACE", "BUILD.bazel"); err != nil {
+		return "", cppHostPaths{}, fmt.Errorf("failed to create empty build & workspace files in the container to initialize a blank Bazel repository: %w", err)
+	}
+
+	// Backup the current environment & restore it before returning.
+	oldEnv := d.env
+	defer func() {
+		d.env = oldEnv
+	}()
+
+	// Create a new environment for bazelisk commands used to specify the Bazel version to use to
+	// Bazelisk.
+	bazeliskEnv := []string{fmt.Sprintf("USE_BAZEL_VERSION=%s", o.BazelVersion)}
+	// Add the environment variables needed for the generation only and remove them immediately
+	// because they aren't necessary for the config extraction and add unnecessary noise to the
+	// logs.
+	generationEnv, err := appendCppEnv(bazeliskEnv, o)
+	if err != nil {
+		return "", cppHostPaths{}, fmt.Errorf("failed to add additional environment variables to the C++ config generation docker command: %w", err)
+	}
+	d.env = generationEnv
+
+	cmd := []string{
+		bazelPath,
+		o.CppBazelCmd,
+	}
+	cmd = append(cmd, o.CPPConfigTargets...)
+	if _, err := d.execCmd(cmd...); err != nil {
+		return "", cppHostPaths{}, fmt.Errorf("Bazel was unable to build the C++ config generation targets in the toolchain container: %w", err)
+	}
+
+	// Restore the env needed for Bazelisk.
+	d.env = bazeliskEnv
+	bazelOutputRoot, err := d.execCmd(bazelPath, "info", "output_base")
+	if err != nil {
+		return "", cppHostPaths{}, fmt.Errorf("unable to determine the build output directory where Bazel produced C++ configs in the toolchain container: %w", err)
+	}
+	cppConfigDir := path.Join(bazelOutputRoot, "external", o.CPPConfigRepo)
+	log.Printf("Extracting C++ config files generated by Bazel at %q from the toolchain container.", cppConfigDir)
+
+	// Restore the old env now that we're done with Bazelisk commands. This is purely to reduce
+	// noise in the logs.
+	d.env = oldEnv
+
+	// 1. Get a list of symlinks in the config output directory.
+	// 2. Harden each link except relative links to other files in the config output directory on
+	//    Linux, which are preserved or inlined depending on the CppSymlinkMode when the configs are
+	//    read from the tarball. See readCppConfigsTarball.
+	// 3. Archive the contents of the config output directory into a tarball.
+	// 4. Copy the tarball from the container to the local temp directory.
+	var out string
+	if o.ExecOS == "windows" {
+		out, err = d.execCmd("cmd", "/r", "dir", filepath.Clean(cppConfigDir), "/a:l", "/b")
+	} else {
+		out, err = d.execCmd("find", cppConfigDir, "-type", "l")
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("unable to list symlinks in the C++ config generation build output directory: ")
+		// Windows `dir` has a non-zero exit status if no files are found.
+		// Linux just doesn't return any files but has a zero exit.
+		switch o.ExecOS {
+		case "windows":
+			out = ""
+			log.Printf("Ignoring error indicating no symlinks were found in the Bazel output directory: %v", err)
+		default:
+			return "", cppHostPaths{}, fmt.Errorf("%s%w", errMsg, err)
+		}
+	}
+	symlinks := strings.Split(out, "\n")
+	for _, s := range symlinks {
+		if s == "" {
+			continue
+		}
+		resolvedPath, err := d.execCmd("readlink", s)
+		if err != nil {
+			return "", cppHostPaths{}, fmt.Errorf("unable to determine what the symlink %q in %q in the toolchain container points to: %w", s, cppConfigDir, err)
+		}
+		if o.ExecOS != OSWindows && !path.IsAbs(resolvedPath) {
+			resolvedPath = path.Join(path.Dir(s), resolvedPath)
+			if strings.HasPrefix(resolvedPath, cppConfigDir+"/") {
+				continue
+			}
+		}
+		if _, err := d.execCmd("ln", "-f", resolvedPath, s); err != nil {
+			return "", cppHostPaths{}, fmt.Errorf("failed to harden symlink %q in %q pointing to %q: %w", s, cppConfigDir, resolvedPath, err)
+		}
+	}
+
+	// Explicitly use absolute paths to avoid confusion on what's the working directory.
+	outputTarballPath := path.Join(o.TempWorkDir, "cpp_configs.tar")
+	if err := d.archiveDir(cppConfigDir, outputTarballPath); err != nil {
+		return "", cppHostPaths{}, fmt.Errorf("failed to extract the C++ configs out of the toolchain container as a tarball: %w", err)
+	}
+	log.Printf("Generated C++ configs at %s.", outputTarballPath)
+	return outputTarballPath, cppHostPaths{outputBase: bazelOutputRoot, workspace: cppProjDir}, nil
+}
@@ -0,0 +1,531 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// defaultImagePath is the search path for binaries used if the toolchain image doesn't specify
+	// a PATH environment variable.
+	defaultImagePath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	// missingToolPath is used as the path of tools that weren't found in the toolchain image.
+	missingToolPath = "/bin/false"
+)
+
+var (
+	// cppStaticBuildTemplate is the template for the BUILD file with the C++ toolchain detected by
+	// statically inspecting the rootfs of the toolchain image. The generated BUILD file has the
+	// same entrypoints as the one generated by Bazel's C++ toolchain autodetection, i.e., the
+	// ":toolchain" cc_toolchain_suite & the cc_toolchain target.
+	cppStaticBuildTemplate = template.Must(template.New("cppStaticBuild").Funcs(template.FuncMap{
+		"quote": strconv.Quote,
+	}).Parse(buildHeader + `
+load("@bazel_tools//tools/cpp:unix_cc_toolchain_config.bzl", "cc_toolchain_config")
+
+package(default_visibility = ["//visibility:public"])
+
+licenses(["notice"])  # Apache 2.0
+
+filegroup(
+    name = "empty",
+    srcs = [],
+)
+
+cc_toolchain_suite(
+    name = "toolchain",
+    toolchains = {
+        "{{ .CPU }}|{{ .Compiler }}": ":{{ .ToolchainName }}",
+        "{{ .CPU }}": ":{{ .ToolchainName }}",
+    },
+)
+
+cc_toolchain(
+    name = "{{ .ToolchainName }}",
+    all_files = ":empty",
+    ar_files = ":empty",
+    as_files = ":empty",
+    compiler_files = ":empty",
+    dwp_files = ":empty",
+    linker_files = ":empty",
+    objcopy_files = ":empty",
+    strip_files = ":empty",
+    supports_param_files = 1,
+    toolchain_config = ":local",
+    toolchain_identifier = "local",
+)
+
+cc_toolchain_config(
+    name = "local",
+    abi_libc_version = "{{ .ABILibcVersion }}",
+    abi_version = "{{ .ABIVersion }}",
+    compile_flags = [
+{{ range .CompileFlags }}        {{ quote . }},
+{{ end }}    ],
+    compiler = "{{ .Compiler }}",
+    coverage_compile_flags = ["--coverage"],
+    coverage_link_flags = ["--coverage"],
+    cpu = "{{ .CPU }}",
+    cxx_builtin_include_directories = [
+{{ range .IncludeDirs }}        "{{ . }}",
+{{ end }}    ],
+    cxx_flags = ["-std=c++0x"],
+    dbg_compile_flags = ["-g"],
+    host_system_name = "{{ .HostSystem }}",
+    link_flags = [
+{{ range .LinkFlags }}        {{ quote . }},
+{{ end }}    ],
+    link_libs = [
+{{ range .LinkLibs }}        {{ quote . }},
+{{ end }}    ],
+    opt_compile_flags = [
+        "-g0",
+        "-O2",
+        "-D_FORTIFY_SOURCE=1",
+        "-DNDEBUG",
+        "-ffunction-sections",
+        "-fdata-sections",
+    ],
+    opt_link_flags = ["-Wl,--gc-sections"],
+    supports_start_end_lib = False,
+    target_libc = "{{ .TargetLibc }}",
+    target_system_name = "{{ .TargetSystem }}",
+    tool_paths = {
+{{ range .ToolPaths }}        "{{ .Name }}": "{{ .Path }}",
+{{ end }}    },
+    toolchain_identifier = "local",
+    unfiltered_compile_flags = [
+{{ range .UnfilteredCompileFlags }}        {{ quote . }},
+{{ end }}    ],
+)
+`))
+
+	// cpuArchs maps Bazel C++ target CPU names to the architecture used in GNU target triples.
+	cpuArchs = map[string]string{
+		"k8":      "x86_64",
+		"aarch64": "aarch64",
+	}
+
+	// cppTools lists the tools in the tool_paths of the generated C++ toolchain config in the
+	// order they're emitted along with the names of the binaries to look for in the image in order
+	// of preference.
+	cppTools = []struct {
+		name     string
+		binaries []string
+	}{
+		{"ar", []string{"ar", "llvm-ar"}},
+		{"cpp", []string{"cpp"}},
+		{"dwp", []string{"dwp", "llvm-dwp"}},
+		{"gcov", []string{"gcov"}},
+		{"ld", []string{"ld", "ld.lld"}},
+		{"llvm-cov", []string{"llvm-cov"}},
+		{"nm", []string{"nm", "llvm-nm"}},
+		{"objcopy", []string{"objcopy", "llvm-objcopy"}},
+		{"objdump", []string{"objdump", "llvm-objdump"}},
+		{"strip", []string{"strip", "llvm-strip"}},
+	}
+
+	glibcMajorRegexp = regexp.MustCompile(`(?m)^#\s*define\s+__GLIBC__\s+(\d+)`)
+	glibcMinorRegexp = regexp.MustCompile(`(?m)^#\s*define\s+__GLIBC_MINOR__\s+(\d+)`)
+	libcSoRegexp     = regexp.MustCompile(`^libc-(\d+\.\d+)\.so$`)
+)
+
+// cppToolPath is the path to a tool used by the C++ toolchain inside the toolchain image.
+type cppToolPath struct {
+	Name string
+	Path string
+}
+
+// cppToolchainInfo describes the C++ toolchain detected by statically inspecting the rootfs of the
+// toolchain image. It's used as the input to the BUILD file template 'cppStaticBuildTemplate'.
+type cppToolchainInfo struct {
+	ToolchainName string
+	CPU           string
+	Compiler      string
+	CompilerPath  string
+	// CompilerVersion is the version of the compiler determined from its installation directories,
+	// e.g., 12 for /usr/lib/gcc/x86_64-linux-gnu/12, if known.
+	CompilerVersion        string
+	HostSystem             string
+	TargetSystem           string
+	TargetLibc             string
+	ABIVersion             string
+	ABILibcVersion         string
+	IncludeDirs            []string
+	ToolPaths              []cppToolPath
+	CompileFlags           []string
+	UnfilteredCompileFlags []string
+	LinkFlags              []string
+	LinkLibs               []string
+}
+
+// statInRoot returns the FileInfo of the file at the absolute path 'name' inside the rootfs at
+// 'root' following symlinks.
+func statInRoot(root, name string) (os.FileInfo, error) {
+	p, err := resolveInRoot(root, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+// isDirInRoot returns whether the absolute path 'name' is a directory inside the rootfs at 'root'.
+func isDirInRoot(root, name string) bool {
+	s, err := statInRoot(root, name)
+	return err == nil && s.IsDir()
+}
+
+// realPathInRoot returns the absolute path inside the rootfs at 'root' that 'name' points to after
+// resolving all symlinks.
+func realPathInRoot(root, name string) (string, error) {
+	p, err := resolveInRoot(root, name, true)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return "", err
+	}
+	return path.Join("/", filepath.ToSlash(rel)), nil
+}
+
+// globInRoot returns the absolute paths inside the rootfs at 'root' matching the given absolute
+// glob pattern. Unlike filepath.Glob, symlinks are resolved relative to the rootfs.
+func globInRoot(root, pattern string) []string {
+	matches := []string{"/"}
+	for _, seg := range strings.Split(strings.Trim(pattern, "/"), "/") {
+		var next []string
+		for _, m := range matches {
+			if !strings.ContainsAny(seg, "*?[") {
+				if _, err := statInRoot(root, path.Join(m, seg)); err == nil {
+					next = append(next, path.Join(m, seg))
+				}
+				continue
+			}
+			dir, err := resolveInRoot(root, m, true)
+			if err != nil {
+				continue
+			}
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if ok, _ := path.Match(seg, e.Name()); ok {
+					next = append(next, path.Join(m, e.Name()))
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// compareVersions compares dot separated version strings component by component numerically
+// where possible and returns -1, 0 or 1 if a is less than, equal to or greater than b.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil && an < bn:
+			return -1
+		case aErr == nil && bErr == nil && an > bn:
+			return 1
+		case (aErr != nil || bErr != nil) && as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// newestVersionDir returns the directory among the given directories whose base name is the
+// highest version or "" if no directories were given.
+func newestVersionDir(dirs []string) string {
+	result := ""
+	for _, d := range dirs {
+		if result == "" || compareVersions(path.Base(d), path.Base(result)) > 0 {
+			result = d
+		}
+	}
+	return result
+}
+
+// lookPathInRoot searches for an executable named 'name' in the directories of the given search
+// path inside the rootfs at 'root' and returns its absolute path inside the rootfs.
+func lookPathInRoot(root, searchPath, name string) (string, bool) {
+	for _, dir := range strings.Split(searchPath, ":") {
+		if !path.IsAbs(dir) {
+			continue
+		}
+		p := path.Join(dir, name)
+		s, err := statInRoot(root, p)
+		if err != nil || !s.Mode().IsRegular() || s.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		return p, true
+	}
+	return "", false
+}
+
+// detectLibc returns the libc installed in the rootfs at 'root' as a Bazel libc identifier, e.g.,
+// glibc_2.31, or "" if the libc couldn't be determined.
+func detectLibc(root, triple string) string {
+	if p, err := resolveInRoot(root, "/usr/include/features.h", true); err == nil {
+		if blob, err := ioutil.ReadFile(p); err == nil {
+			major := glibcMajorRegexp.FindSubmatch(blob)
+			minor := glibcMinorRegexp.FindSubmatch(blob)
+			if major != nil && minor != nil {
+				return fmt.Sprintf("glibc_%s.%s", major[1], minor[1])
+			}
+		}
+	}
+	// glibc < 2.34 ships the versioned shared library libc-<major>.<minor>.so.
+	for _, dir := range []string{path.Join("/lib", triple), path.Join("/usr/lib", triple), "/lib64", "/lib"} {
+		for _, m := range globInRoot(root, path.Join(dir, "libc-*.so")) {
+			if s := libcSoRegexp.FindStringSubmatch(path.Base(m)); s != nil {
+				return fmt.Sprintf("glibc_%s", s[1])
+			}
+		}
+	}
+	if len(globInRoot(root, "/lib/ld-musl-*.so.1")) != 0 {
+		return "musl"
+	}
+	return ""
+}
+
+// probeCppToolchain detects the C++ compiler, its builtin include directories, the libc & the
+// binutils installed in the rootfs at 'root' without running anything inside the rootfs.
+// imageEnv is the environment of the toolchain image used to determine the search path for
+// binaries. cppEnv are the C++ config generation environment variables honored by Bazel's C++
+// toolchain autodetection. Values detected in the rootfs take precedence over cppEnv except for
+// the compiler which is looked up using CC first.
+func probeCppToolchain(root string, imageEnv, cppEnv map[string]string, toolchainName string) (*cppToolchainInfo, error) {
+	searchPath := imageEnv["PATH"]
+	if searchPath == "" {
+		searchPath = defaultImagePath
+	}
+	envOrDefault := func(key, def string) string {
+		if v := cppEnv[key]; v != "" {
+			return v
+		}
+		return def
+	}
+
+	info := &cppToolchainInfo{
+		ToolchainName: toolchainName,
+		CPU:           envOrDefault("BAZEL_TARGET_CPU", "k8"),
+		HostSystem:    envOrDefault("BAZEL_HOST_SYSTEM", "local"),
+		TargetSystem:  envOrDefault("BAZEL_TARGET_SYSTEM", "local"),
+	}
+
+	var candidates []string
+	if cc := cppEnv["CC"]; cc != "" {
+		candidates = append(candidates, cc)
+	}
+	candidates = append(candidates, "clang", "gcc", "cc")
+	for _, c := range candidates {
+		if path.IsAbs(c) {
+			if s, err := statInRoot(root, c); err == nil && s.Mode().IsRegular() {
+				info.CompilerPath = c
+				break
+			}
+			continue
+		}
+		if p, ok := lookPathInRoot(root, searchPath, c); ok {
+			info.CompilerPath = p
+			break
+		}
+	}
+	if info.CompilerPath == "" {
+		return nil, fmt.Errorf("unable to find any of the C++ compilers %v in search path %q in the toolchain image", candidates, searchPath)
+	}
+	realCompiler, err := realPathInRoot(root, info.CompilerPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve the path to the C++ compiler %q in the toolchain image: %w", info.CompilerPath, err)
+	}
+	info.Compiler = "gcc"
+	if strings.Contains(path.Base(realCompiler), "clang") {
+		info.Compiler = "clang"
+	}
+	// The installation prefix of the compiler, e.g., /usr for /usr/bin/gcc or /usr/lib/llvm-10 for
+	// /usr/lib/llvm-10/bin/clang.
+	prefix := path.Dir(path.Dir(realCompiler))
+	log.Printf("Found %s C++ compiler %q (%q) in the toolchain image.", info.Compiler, info.CompilerPath, realCompiler)
+
+	arch, ok := cpuArchs[info.CPU]
+	if !ok {
+		return nil, fmt.Errorf("unable to statically detect C++ toolchains for target CPU %q, want one of k8, aarch64", info.CPU)
+	}
+	triple := arch + "-linux-gnu"
+	for _, d := range globInRoot(root, "/usr/lib/gcc/*") {
+		if strings.HasPrefix(path.Base(d), arch+"-") && isDirInRoot(root, d) {
+			triple = path.Base(d)
+			break
+		}
+	}
+
+	// Both gcc & clang use the libstdc++ headers of a GCC installation. clang picks the newest one
+	// while gcc uses the one matching its own version.
+	gccInstall := ""
+	if info.Compiler == "gcc" {
+		if i := strings.LastIndex(path.Base(realCompiler), "-"); i >= 0 {
+			d := path.Join("/usr/lib/gcc", triple, path.Base(realCompiler)[i+1:])
+			if isDirInRoot(root, d) {
+				gccInstall = d
+			}
+		}
+	}
+	if gccInstall == "" {
+		gccInstall = newestVersionDir(globInRoot(root, path.Join("/usr/lib/gcc", triple, "*")))
+	}
+	gccVersion := path.Base(gccInstall)
+	if info.Compiler == "gcc" && gccInstall != "" {
+		info.CompilerVersion = gccVersion
+	}
+
+	var includeDirs []string
+	if info.Compiler == "clang" {
+		if d := newestVersionDir(globInRoot(root, path.Join(prefix, "lib/clang/*"))); d != "" {
+			includeDirs = append(includeDirs, path.Join(d, "include"))
+			info.CompilerVersion = path.Base(d)
+		}
+	}
+	if gccInstall != "" {
+		if info.Compiler == "gcc" {
+			includeDirs = append(includeDirs, path.Join(gccInstall, "include"), path.Join(gccInstall, "include-fixed"))
+		}
+		includeDirs = append(includeDirs,
+			path.Join("/usr/include/c++", gccVersion),
+			path.Join("/usr/include", triple, "c++", gccVersion),
+			path.Join("/usr/include/c++", gccVersion, "backward"),
+		)
+	}
+	includeDirs = append(includeDirs, "/usr/local/include", path.Join("/usr/include", triple), "/usr/include")
+	for _, d := range includeDirs {
+		if isDirInRoot(root, d) {
+			info.IncludeDirs = append(info.IncludeDirs, d)
+		}
+	}
+
+	libc := detectLibc(root, triple)
+	if libc == "" {
+		libc = envOrDefault("BAZEL_TARGET_LIBC", "local")
+		log.Printf("Unable to detect the libc installed in the toolchain image, using %q.", libc)
+	}
+	info.TargetLibc = libc
+	info.ABILibcVersion = libc
+	info.ABIVersion = info.Compiler
+
+	// Tools shipped with the compiler are preferred over ones elsewhere in the search path.
+	toolSearchPath := path.Join(prefix, "bin") + ":" + searchPath
+	info.ToolPaths = append(info.ToolPaths, cppToolPath{Name: "gcc", Path: info.CompilerPath})
+	for _, t := range cppTools {
+		p := missingToolPath
+		for _, b := range t.binaries {
+			if found, ok := lookPathInRoot(root, toolSearchPath, b); ok {
+				p = found
+				break
+			}
+		}
+		info.ToolPaths = append(info.ToolPaths, cppToolPath{Name: t.name, Path: p})
+	}
+
+	info.CompileFlags = []string{"-U_FORTIFY_SOURCE", "-fstack-protector", "-Wall"}
+	info.UnfilteredCompileFlags = []string{
+		"-Wno-builtin-macro-redefined",
+		`-D__DATE__="redacted"`,
+		`-D__TIMESTAMP__="redacted"`,
+		`-D__TIME__="redacted"`,
+	}
+	info.LinkFlags = []string{"-Wl,-no-as-needed", "-Wl,-z,relro,-z,now", "-B" + path.Dir(info.CompilerPath)}
+	if info.Compiler == "clang" {
+		info.CompileFlags = append(info.CompileFlags, "-Wthread-safety", "-Wself-assign")
+	} else {
+		info.CompileFlags = append(info.CompileFlags, "-Wunused-but-set-parameter", "-Wno-free-nonheap-object")
+		info.UnfilteredCompileFlags = append([]string{"-fno-canonical-system-headers"}, info.UnfilteredCompileFlags...)
+		info.LinkFlags = append(info.LinkFlags, "-pass-exit-codes")
+	}
+	info.CompileFlags = append(info.CompileFlags, "-fno-omit-frame-pointer")
+	info.LinkLibs = []string{"-lstdc++", "-lm"}
+	return info, nil
+}
+
+// genCppConfigsStatic generates C++ configs by statically inspecting the rootfs of the toolchain
+// container represented by the given docker runner instead of running Bazel inside it. The
+// container runtime must expose the rootfs of the container on the local filesystem.
+// The return values are the path to a tarball with the generated C++ configs in the same layout as
+// the tarball produced by genCppConfigs & the detected C++ toolchain.
+func genCppConfigsStatic(d *dockerRunner, o *Options) (string, *cppToolchainInfo, error) {
+	a, ok := d.runtime.(rootfsAccessor)
+	if !ok {
+		return "", nil, fmt.Errorf("the %s container runtime doesn't expose the rootfs of the toolchain container needed to generate C++ configs statically", d.runtime.Name())
+	}
+	root, err := a.RootfsDir(d.containerID)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to locate the rootfs of the toolchain container: %w", err)
+	}
+	imageEnv, err := d.getEnv()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to get the environment of the toolchain image: %w", err)
+	}
+	envList, err := appendCppEnv(nil, o)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read the C++ config generation environment variables: %w", err)
+	}
+	cppEnv := make(map[string]string)
+	for _, e := range envList {
+		keyVal := strings.SplitN(e, "=", 2)
+		cppEnv[keyVal[0]] = keyVal[1]
+	}
+
+	info, err := probeCppToolchain(root, imageEnv, cppEnv, o.CPPToolchainTargetName)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to detect the C++ toolchain installed in the toolchain image: %w", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := cppStaticBuildTemplate.Execute(buf, info); err != nil {
+		return "", nil, fmt.Errorf("failed to generate the C++ toolchain BUILD file: %w", err)
+	}
+
+	outputTarballPath := path.Join(o.TempWorkDir, "cpp_configs.tar")
+	if err := writeTarball(outputTarballPath, []generatedFile{{name: "BUILD", contents: buf.Bytes()}}); err != nil {
+		return "", nil, err
+	}
+	log.Printf("Generated C++ configs statically at %s.", outputTarballPath)
+	return outputTarballPath, info, nil
+}
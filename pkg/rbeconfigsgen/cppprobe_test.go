@@ -0,0 +1,206 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeRootfs creates a rootfs in a temporary directory where files maps paths inside the rootfs
+// to their contents, dirs lists additional directories and symlinks maps paths inside the rootfs
+// to the symlink target. Files under a 'bin' directory are made executable.
+func fakeRootfs(t *testing.T, files map[string]string, dirs []string, symlinks map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatalf("Failed to create directory %q: %v", d, err)
+		}
+	}
+	for f, contents := range files {
+		p := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create parent directory of %q: %v", f, err)
+		}
+		mode := os.FileMode(0644)
+		if filepath.Base(filepath.Dir(f)) == "bin" {
+			mode = 0755
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), mode); err != nil {
+			t.Fatalf("Failed to write %q: %v", f, err)
+		}
+	}
+	for l, target := range symlinks {
+		p := filepath.Join(root, l)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create parent directory of %q: %v", l, err)
+		}
+		if err := os.Symlink(target, p); err != nil {
+			t.Fatalf("Failed to create symlink %q: %v", l, err)
+		}
+	}
+	return root
+}
+
+func TestProbeCppToolchain(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		files         map[string]string
+		dirs          []string
+		symlinks      map[string]string
+		cppEnv        map[string]string
+		wantCompiler  string
+		wantPath      string
+		wantLibc      string
+		wantIncludes  []string
+		wantToolPaths map[string]string
+	}{
+		{
+			name: "ClangFromLLVMInstall",
+			files: map[string]string{
+				"usr/lib/llvm-10/bin/clang": "",
+				"usr/bin/ar":                "",
+				"usr/bin/ld":                "",
+				"usr/include/features.h":    "#define __GLIBC__ 2\n#define __GLIBC_MINOR__ 31\n",
+			},
+			dirs: []string{
+				"usr/lib/llvm-10/lib/clang/10.0.0/include",
+				"usr/lib/gcc/x86_64-linux-gnu/8",
+				"usr/lib/gcc/x86_64-linux-gnu/10",
+				"usr/include/c++/10",
+				"usr/include/x86_64-linux-gnu/c++/10",
+				"usr/include/x86_64-linux-gnu",
+			},
+			symlinks: map[string]string{
+				"usr/bin/clang":             "../lib/llvm-10/bin/clang",
+				"usr/lib/llvm-10/bin/nm":    "/usr/bin/llvm-nm-10",
+				"usr/bin/llvm-nm-10":        "llvm-nm-10-real",
+				"usr/bin/llvm-nm-10-real":   "/does/not/exist",
+				"usr/lib/llvm-10/bin/strip": "../../../bin/ar",
+			},
+			cppEnv:       map[string]string{"CC": "clang", "BAZEL_TARGET_LIBC": "glibc_2.19"},
+			wantCompiler: "clang",
+			wantPath:     "/usr/bin/clang",
+			wantLibc:     "glibc_2.31",
+			wantIncludes: []string{
+				"/usr/lib/llvm-10/lib/clang/10.0.0/include",
+				"/usr/include/c++/10",
+				"/usr/include/x86_64-linux-gnu/c++/10",
+				"/usr/include/x86_64-linux-gnu",
+				"/usr/include",
+			},
+			wantToolPaths: map[string]string{
+				"gcc":   "/usr/bin/clang",
+				"ar":    "/usr/bin/ar",
+				"ld":    "/usr/bin/ld",
+				"nm":    missingToolPath,
+				"strip": "/usr/lib/llvm-10/bin/strip",
+			},
+		},
+		{
+			name: "VersionedGCCFallback",
+			files: map[string]string{
+				"usr/bin/gcc-9":                        "",
+				"lib/x86_64-linux-gnu/libc-2.27.so":    "",
+				"usr/lib/gcc/x86_64-linux-gnu/9/a.txt": "",
+			},
+			dirs: []string{
+				"usr/lib/gcc/x86_64-linux-gnu/9/include",
+				"usr/lib/gcc/x86_64-linux-gnu/11/include",
+				"usr/include/c++/9/backward",
+			},
+			symlinks: map[string]string{
+				"usr/bin/cc": "gcc-9",
+			},
+			// The compiler specified by CC doesn't exist so the probe falls back to cc.
+			cppEnv:       map[string]string{"CC": "clang"},
+			wantCompiler: "gcc",
+			wantPath:     "/usr/bin/cc",
+			wantLibc:     "glibc_2.27",
+			wantIncludes: []string{
+				"/usr/lib/gcc/x86_64-linux-gnu/9/include",
+				"/usr/include/c++/9",
+				"/usr/include/c++/9/backward",
+				"/usr/include",
+			},
+			wantToolPaths: map[string]string{
+				"gcc": "/usr/bin/cc",
+				"ar":  missingToolPath,
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			root := fakeRootfs(t, tc.files, tc.dirs, tc.symlinks)
+			info, err := probeCppToolchain(root, map[string]string{"PATH": "/usr/bin:/bin"}, tc.cppEnv, "cc-compiler-k8")
+			if err != nil {
+				t.Fatalf("probeCppToolchain failed: %v", err)
+			}
+			if info.Compiler != tc.wantCompiler {
+				t.Errorf("probeCppToolchain got compiler %q, want %q", info.Compiler, tc.wantCompiler)
+			}
+			if info.CompilerPath != tc.wantPath {
+				t.Errorf("probeCppToolchain got compiler path %q, want %q", info.CompilerPath, tc.wantPath)
+			}
+			if info.TargetLibc != tc.wantLibc {
+				t.Errorf("probeCppToolchain got libc %q, want %q", info.TargetLibc, tc.wantLibc)
+			}
+			if !reflect.DeepEqual(info.IncludeDirs, tc.wantIncludes) {
+				t.Errorf("probeCppToolchain got include directories %v, want %v", info.IncludeDirs, tc.wantIncludes)
+			}
+			gotTools := make(map[string]string)
+			for _, tp := range info.ToolPaths {
+				gotTools[tp.Name] = tp.Path
+			}
+			for name, want := range tc.wantToolPaths {
+				if got := gotTools[name]; got != want {
+					t.Errorf("probeCppToolchain got path %q for tool %q, want %q", got, name, want)
+				}
+			}
+
+			buf := bytes.NewBuffer(nil)
+			if err := cppStaticBuildTemplate.Execute(buf, info); err != nil {
+				t.Fatalf("Failed to generate the C++ BUILD file: %v", err)
+			}
+			for _, want := range []string{
+				`name = "cc-compiler-k8"`,
+				`"k8|` + tc.wantCompiler + `": ":cc-compiler-k8"`,
+				`target_libc = "` + tc.wantLibc + `"`,
+				`"-D__DATE__=\"redacted\""`,
+			} {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("Generated C++ BUILD file didn't contain %q, got:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestProbeCppToolchainNoCompiler(t *testing.T) {
+	t.Parallel()
+	root := fakeRootfs(t, map[string]string{"usr/bin/ar": ""}, nil, nil)
+	if _, err := probeCppToolchain(root, nil, nil, "cc-compiler-k8"); err == nil {
+		t.Errorf("probeCppToolchain succeeded in a rootfs without a C++ compiler, want error")
+	}
+}
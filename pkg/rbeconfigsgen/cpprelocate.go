@@ -0,0 +1,274 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// cppHostPaths are the paths specific to the toolchain container & the Bazel server that
+// generated the C++ configs, which Bazel's C++ toolchain autoconfiguration may embed into the
+// generated configs, e.g., in builtin_include_directories or wrapper scripts. Because the output
+// base contains a hash, these paths also differ between runs of the generator.
+type cppHostPaths struct {
+	// outputBase is the output base of the Bazel server that generated the C++ configs, e.g.,
+	// /root/.cache/bazel/_bazel_root/<hash>.
+	outputBase string
+	// workspace is the temporary Bazel workspace the C++ configs were generated in, e.g.,
+	// /workdir/cpp_configs_project.
+	workspace string
+}
+
+const (
+	// pathPartPattern matches a character of a part of a path in the C++ configs, i.e., anything
+	// but separators & characters delimiting paths in BUILD files or shell scripts.
+	pathPartPattern = `[^/\\\s"'<>|;,=(){}\[\]]`
+)
+
+var (
+	// hostPathMarkers are parts of paths that are specific to the machine or Bazel server that
+	// generated the C++ configs.
+	hostPathMarkers = []string{
+		"/_bazel_",
+		"/.cache/bazel/",
+		"/execroot/",
+	}
+
+	// absPathRegexp matches absolute Linux & Windows paths in the C++ configs, e.g., in strings in
+	// BUILD files or arguments in wrapper scripts.
+	absPathRegexp = regexp.MustCompile(`(?:[A-Za-z]:)?[/\\][^\s"'<>|;,=(){}\[\]]+`)
+
+	// separatorsRegexp matches runs of path separators, e.g., escaped backslashes.
+	separatorsRegexp = regexp.MustCompile(`[/\\]+`)
+
+	// includeDirsRegexp matches the list of builtin include directories of a C++ toolchain in the
+	// BUILD file of the C++ configs.
+	includeDirsRegexp = regexp.MustCompile(`cxx_builtin_include_directories\s*=\s*\[[^\]]*\]`)
+)
+
+// hostPathPattern returns a regular expression matching the given slash separated path with any
+// kind of separator, i.e., slashes, backslashes or escaped backslashes used in Windows configs.
+func hostPathPattern(p string) string {
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		parts = append(parts, regexp.QuoteMeta(part))
+	}
+	return strings.Join(parts, `[/\\]+`)
+}
+
+// cppConfigsExecPath returns the path of the generated C++ configs relative to the execution root
+// of builds using the configs generated with the given options, e.g., external/rbe_default/cc, or
+// false if it can't be determined. In the Bzlmod output mode, the configs are part of a repository
+// whose canonical name is chosen by Bazel.
+func cppConfigsExecPath(o *Options) (string, bool) {
+	if o.OutputMode == OutputModeBzlmod {
+		return "", false
+	}
+	if o.OutputSourceRoot != "" {
+		return path.Join(configsPackagePath(o), "cc"), true
+	}
+	return path.Join("external", configsRepoName(o), configsPackagePath(o), "cc"), true
+}
+
+// cppConfigsIncludeDir returns the builtin include directory of a C++ toolchain referring to the
+// given path relative to the C++ configs generated with the given options or false if it can't be
+// determined. Bazel resolves relative builtin include directories against the package of the C++
+// toolchain rather than the execution root, so the directory is relative to the package of the
+// configs in the external repository or to the workspace if the configs are in the source tree.
+func cppConfigsIncludeDir(o *Options, rel string) (string, bool) {
+	if o.OutputMode == OutputModeBzlmod {
+		return "", false
+	}
+	pkg := path.Join(configsPackagePath(o), "cc")
+	if o.OutputSourceRoot != "" {
+		return execRootIncludeDir(path.Join(pkg, rel)), true
+	}
+	dir := fmt.Sprintf("%%package(@%s//%s)%%", configsRepoName(o), pkg)
+	if rel != "." {
+		dir += "/" + rel
+	}
+	return dir, true
+}
+
+// execRootIncludeDir returns the builtin include directory of a C++ toolchain referring to the given
+// path relative to the execution root.
+func execRootIncludeDir(rel string) string {
+	if rel == "." {
+		return "%workspace%"
+	}
+	return "%workspace%/" + rel
+}
+
+// hostPathsRegexp returns a regular expression matching the absolute paths in the C++ configs
+// starting with one of the given host-specific paths or nil if there are no host-specific paths.
+// Paths may start with a longer name, e.g., /workdir/cpp_configs_project2, which relocateHostPath
+// leaves as is.
+func hostPathsRegexp(h cppHostPaths) *regexp.Regexp {
+	var bases []string
+	for _, p := range []string{h.outputBase, h.workspace} {
+		if p == "" {
+			continue
+		}
+		bases = append(bases, hostPathPattern(p))
+	}
+	if len(bases) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?:` + strings.Join(bases, "|") + `)` + pathPartPattern + `*(?:[/\\]+` + pathPartPattern + `+)*`)
+}
+
+// relocateHostPath returns the given absolute path in the C++ configs generated with the given
+// options relative to the execution root, where Bazel runs the actions using the configs, if it's
+// under one of the given host-specific paths. Paths in the C++ configs repository itself point to
+// the generated C++ configs, paths in other external repositories & the execution root of the
+// temporary workspace are relative to the execution root & the temporary workspace is removed,
+// i.e., paths in it are relative to the execution root too. If includeDir is true, the path is a
+// builtin include directory of a C++ toolchain & is returned in the form Bazel resolves relative to
+// the execution root or the package of the configs instead. See cppConfigsIncludeDir. Other paths
+// are returned as is.
+func relocateHostPath(o *Options, h cppHostPaths, p string, includeDir bool) string {
+	normalized := separatorsRegexp.ReplaceAllString(p, "/")
+	// under returns the path of 'normalized' relative to the given directory or false if it isn't
+	// under it.
+	under := func(dir string) (string, bool) {
+		if dir == "" {
+			return "", false
+		}
+		if normalized == dir {
+			return ".", true
+		}
+		if strings.HasPrefix(normalized, dir+"/") {
+			return strings.TrimPrefix(normalized, dir+"/"), true
+		}
+		return "", false
+	}
+	// execPath returns the given path relative to the execution root in the requested form.
+	execPath := func(rel string) string {
+		if includeDir {
+			return execRootIncludeDir(rel)
+		}
+		return rel
+	}
+	if h.outputBase != "" {
+		if rel, ok := under(path.Join(h.outputBase, "external", o.CPPConfigRepo)); ok {
+			if includeDir {
+				if dir, ok := cppConfigsIncludeDir(o, rel); ok {
+					return dir
+				}
+				return p
+			}
+			configsPath, ok := cppConfigsExecPath(o)
+			if !ok {
+				return p
+			}
+			return path.Join(configsPath, rel)
+		}
+		if rel, ok := under(path.Join(h.outputBase, "execroot")); ok && rel != "." {
+			// Strip the name of the workspace, e.g., __main__.
+			parts := strings.SplitN(rel, "/", 2)
+			if len(parts) == 1 {
+				return execPath(".")
+			}
+			return execPath(parts[1])
+		}
+		if rel, ok := under(path.Join(h.outputBase, "external")); ok && rel != "." {
+			return execPath(path.Join("external", rel))
+		}
+	}
+	if rel, ok := under(h.workspace); ok {
+		return execPath(rel)
+	}
+	return p
+}
+
+// relocateCppConfigs returns the given C++ configs with every absolute path under the given
+// host-specific paths relocated by relocateHostPath such that the configs don't depend on the
+// machine & Bazel server that generated them. Paths in the builtin include directories of C++
+// toolchains are relocated in the form Bazel expects for include directories while other paths,
+// e.g., in wrapper scripts, are relative to the execution root. Remaining absolute paths that look
+// host-specific are logged as warnings. Symlinks are already relative & left untouched.
+func relocateCppConfigs(o *Options, h cppHostPaths, files []generatedFile) []generatedFile {
+	re := hostPathsRegexp(h)
+	var result []generatedFile
+	rewritten := 0
+	for _, f := range files {
+		if re != nil && !f.symlink && !bytes.Contains(f.contents, []byte{0}) {
+			contents := includeDirsRegexp.ReplaceAllFunc(f.contents, func(dirs []byte) []byte {
+				return re.ReplaceAllFunc(dirs, func(m []byte) []byte {
+					return []byte(relocateHostPath(o, h, string(m), true))
+				})
+			})
+			contents = re.ReplaceAllFunc(contents, func(m []byte) []byte {
+				return []byte(relocateHostPath(o, h, string(m), false))
+			})
+			if !bytes.Equal(contents, f.contents) {
+				rewritten++
+				f.contents = contents
+			}
+		}
+		result = append(result, f)
+	}
+	if rewritten != 0 {
+		log.Printf("Relocated host-specific paths in %d C++ config files.", rewritten)
+	}
+	for _, p := range findHostPaths(h, result) {
+		log.Printf("Warning: The generated C++ configs still reference the host-specific path %s. The configs may not work on other machines or change every time they're generated.", p)
+	}
+	return result
+}
+
+// findHostPaths returns the absolute paths in the given C++ configs that look specific to the
+// machine or Bazel server that generated the configs, i.e., the given host-specific paths or paths
+// containing one of hostPathMarkers, as "<path> in <file>" sorted by file & path.
+func findHostPaths(h cppHostPaths, files []generatedFile) []string {
+	markers := append([]string(nil), hostPathMarkers...)
+	for _, p := range []string{h.outputBase, h.workspace} {
+		if p != "" {
+			markers = append(markers, p)
+		}
+	}
+	var result []string
+	for _, f := range files {
+		if f.symlink || bytes.Contains(f.contents, []byte{0}) {
+			continue
+		}
+		found := make(map[string]bool)
+		for _, m := range absPathRegexp.FindAll(f.contents, -1) {
+			p := string(m)
+			normalized := separatorsRegexp.ReplaceAllString(p, "/")
+			for _, marker := range markers {
+				if strings.Contains(normalized, marker) {
+					found[p] = true
+					break
+				}
+			}
+		}
+		var paths []string
+		for p := range found {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			result = append(result, fmt.Sprintf("%q in %q", p, f.name))
+		}
+	}
+	return result
+}
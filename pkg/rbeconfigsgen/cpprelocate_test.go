@@ -0,0 +1,164 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	// testOutputBase is the output base of the Bazel server generating C++ configs in tests.
+	testOutputBase = "/root/.cache/bazel/_bazel_root/0123456789abcdef0123456789abcdef"
+	// testCppWorkspace is the temporary workspace C++ configs are generated in in tests.
+	testCppWorkspace = "/workdir/cpp_configs_project"
+)
+
+func TestRelocateCppConfigs(t *testing.T) {
+	hostPaths := cppHostPaths{outputBase: testOutputBase, workspace: testCppWorkspace}
+	build := strings.NewReplacer("OUTPUT_BASE", testOutputBase, "WORKSPACE_DIR", testCppWorkspace).Replace(`cc_toolchain_config(
+    name = "local",
+    cxx_builtin_include_directories = [
+        "/usr/include",
+        "OUTPUT_BASE/external/local_config_cc/include",
+        "OUTPUT_BASE/external/llvm_toolchain/lib/clang/include",
+        "OUTPUT_BASE/execroot/__main__/bazel-out/k8-fastbuild/bin",
+        "OUTPUT_BASE/execroot/__main__",
+        "WORKSPACE_DIR/third_party/include",
+        "WORKSPACE_DIR",
+        "WORKSPACE_DIR2/include",
+    ],
+    tool_paths = {"gcc": "/usr/bin/gcc"},
+)
+`)
+	wrapper := "#!/bin/bash\nexec " + testOutputBase + "/external/local_config_cc/clang -I" + testCppWorkspace + "/include \"$@\"\n"
+	windows := `"C:\\users\\foo\\_bazel_foo\\abcd\\external\\llvm\\include"`
+	files := []generatedFile{
+		{name: "cc/BUILD", contents: []byte(build)},
+		{name: "cc/cc_wrapper.sh", contents: []byte(wrapper), executable: true},
+		{name: "cc/tools/cc_wrapper.sh", contents: []byte("../cc_wrapper.sh"), symlink: true},
+		{name: "cc/windows_include_paths", contents: []byte(windows)},
+	}
+	// Builtin include directories are resolved relative to the package of the C++ toolchain unless
+	// they start with %workspace% or %package(...)%.
+	wantBuild := func(configsDir string) string {
+		return strings.NewReplacer("CONFIGS", configsDir, "WORKSPACE_DIR", testCppWorkspace).Replace(`cc_toolchain_config(
+    name = "local",
+    cxx_builtin_include_directories = [
+        "/usr/include",
+        "CONFIGS/include",
+        "%workspace%/external/llvm_toolchain/lib/clang/include",
+        "%workspace%/bazel-out/k8-fastbuild/bin",
+        "%workspace%",
+        "%workspace%/third_party/include",
+        "%workspace%",
+        "WORKSPACE_DIR2/include",
+    ],
+    tool_paths = {"gcc": "/usr/bin/gcc"},
+)
+`)
+	}
+	tests := []struct {
+		name    string
+		options Options
+		want    []generatedFile
+		// wantHostPaths are the host-specific paths remaining in the relocated configs.
+		wantHostPaths []string
+	}{
+		{
+			name:    "ExternalRepo",
+			options: Options{CPPConfigRepo: "local_config_cc"},
+			want: []generatedFile{
+				{name: "cc/BUILD", contents: []byte(wantBuild("%package(@rbe_default//cc)%"))},
+				{name: "cc/cc_wrapper.sh", contents: []byte("#!/bin/bash\nexec external/rbe_default/cc/clang -Iinclude \"$@\"\n"), executable: true},
+				files[2],
+				files[3],
+			},
+			wantHostPaths: []string{
+				// Not under the temporary workspace but still suspicious.
+				`"/workdir/cpp_configs_project2/include" in "cc/BUILD"`,
+				fmt.Sprintf("%q in %q", windows[1:len(windows)-1], "cc/windows_include_paths"),
+			},
+		},
+		{
+			name:    "SourceRepo",
+			options: Options{CPPConfigRepo: "local_config_cc", OutputSourceRoot: "/src", OutputConfigPath: "configs/rbe", ConfigsRepoName: "unused"},
+			want: []generatedFile{
+				{name: "cc/BUILD", contents: []byte(wantBuild("%workspace%/configs/rbe/cc"))},
+				{name: "cc/cc_wrapper.sh", contents: []byte("#!/bin/bash\nexec configs/rbe/cc/clang -Iinclude \"$@\"\n"), executable: true},
+				files[2],
+				files[3],
+			},
+			wantHostPaths: []string{
+				// Not under the temporary workspace but still suspicious.
+				`"/workdir/cpp_configs_project2/include" in "cc/BUILD"`,
+				fmt.Sprintf("%q in %q", windows[1:len(windows)-1], "cc/windows_include_paths"),
+			},
+		},
+		{
+			// The canonical name of the configs repository isn't known in the Bzlmod output mode
+			// so paths in the C++ configs repository are left as is & reported.
+			name:    "Bzlmod",
+			options: Options{CPPConfigRepo: "local_config_cc", OutputMode: OutputModeBzlmod},
+			want: []generatedFile{
+				{name: "cc/BUILD", contents: []byte(strings.Replace(wantBuild("CONFIGS"), "CONFIGS", testOutputBase+"/external/local_config_cc", 1))},
+				{name: "cc/cc_wrapper.sh", contents: []byte("#!/bin/bash\nexec " + testOutputBase + "/external/local_config_cc/clang -Iinclude \"$@\"\n"), executable: true},
+				files[2],
+				files[3],
+			},
+			wantHostPaths: []string{
+				`"` + testOutputBase + `/external/local_config_cc/include" in "cc/BUILD"`,
+				`"/workdir/cpp_configs_project2/include" in "cc/BUILD"`,
+				`"` + testOutputBase + `/external/local_config_cc/clang" in "cc/cc_wrapper.sh"`,
+				fmt.Sprintf("%q in %q", windows[1:len(windows)-1], "cc/windows_include_paths"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got := relocateCppConfigs(&tc.options, hostPaths, files)
+			if !reflect.DeepEqual(got, tc.want) {
+				for i := range got {
+					if i < len(tc.want) && !reflect.DeepEqual(got[i], tc.want[i]) {
+						t.Errorf("relocateCppConfigs got %q:\n%s\nwant:\n%s", got[i].name, got[i].contents, tc.want[i].contents)
+					}
+				}
+				t.Fatalf("relocateCppConfigs got %d files, want %d", len(got), len(tc.want))
+			}
+			if gotPaths := findHostPaths(hostPaths, got); !reflect.DeepEqual(gotPaths, tc.wantHostPaths) {
+				t.Errorf("findHostPaths got %v, want %v", gotPaths, tc.wantHostPaths)
+			}
+		})
+	}
+}
+
+func TestRelocateCppConfigsIsReproducible(t *testing.T) {
+	o := &Options{CPPConfigRepo: "local_config_cc"}
+	generate := func(outputBase string) []generatedFile {
+		return relocateCppConfigs(o, cppHostPaths{outputBase: outputBase, workspace: testCppWorkspace}, []generatedFile{{
+			name:     "cc/builtin_include_directory_paths",
+			contents: []byte(outputBase + "/external/local_config_cc/include\n" + outputBase + "/execroot/__main__/include\n"),
+		}})
+	}
+	first := generate(testOutputBase)
+	second := generate("/home/user/.cache/bazel/_bazel_user/fedcba9876543210fedcba9876543210")
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("relocateCppConfigs got %q & %q for different output bases, want the same configs", first[0].contents, second[0].contents)
+	}
+}
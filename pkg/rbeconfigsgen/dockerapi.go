@@ -0,0 +1,441 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// dockerAPIVersion is the version of the Docker Engine API used. 1.41 is supported by Docker
+	// Engine 20.10 and newer.
+	dockerAPIVersion = "v1.41"
+	// defaultDockerSocket is the path to the unix socket of the docker daemon used if DOCKER_HOST
+	// doesn't specify a unix socket.
+	defaultDockerSocket = "/var/run/docker.sock"
+)
+
+// dockerAPIRuntime is a ContainerRuntime that talks to the docker daemon using the Docker Engine
+// API over the daemon's unix socket instead of shelling out to the docker CLI. Registry
+// credentials configured for the docker CLI are forwarded to the daemon when pulling images.
+type dockerAPIRuntime struct {
+	// socket is the path to the unix socket of the docker daemon.
+	socket string
+	// configDir is the directory of the docker CLI config file with the registry credentials.
+	configDir string
+	// client is the HTTP client that sends requests over the unix socket.
+	client *http.Client
+}
+
+// dockerSocket returns the path to the unix socket of the docker daemon as specified by the
+// DOCKER_HOST environment variable or the default socket path.
+func dockerSocket() string {
+	if h := os.Getenv("DOCKER_HOST"); strings.HasPrefix(h, "unix://") {
+		return strings.TrimPrefix(h, "unix://")
+	}
+	return defaultDockerSocket
+}
+
+// newDockerAPIRuntime returns a dockerAPIRuntime that talks to the docker daemon listening on the
+// unix socket at the given path.
+func newDockerAPIRuntime(socket string) *dockerAPIRuntime {
+	return &dockerAPIRuntime{
+		socket:    socket,
+		configDir: dockerConfigDir(),
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// dockerAPIError is the body of error responses returned by the Docker Engine API.
+type dockerAPIError struct {
+	Message string `json:"message"`
+}
+
+// do sends a request with the given method to the given Docker Engine API endpoint and returns the
+// response if the API returned a success status code. 'body' is optional and if it isn't a reader,
+// it's encoded as JSON.
+func (r *dockerAPIRuntime) do(method, endpoint string, query url.Values, body interface{}) (*http.Response, error) {
+	return r.doWithHeader(method, endpoint, query, nil, body)
+}
+
+// doWithHeader sends a request like 'do' with the given additional headers.
+func (r *dockerAPIRuntime) doWithHeader(method, endpoint string, query url.Values, header http.Header, body interface{}) (*http.Response, error) {
+	u := fmt.Sprintf("http://docker/%s%s", dockerAPIVersion, endpoint)
+	if len(query) != 0 {
+		u = fmt.Sprintf("%s?%s", u, query.Encode())
+	}
+	var reqBody io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reqBody = b
+		contentType = "application/x-tar"
+	default:
+		blob, err := json.Marshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode the request body for %s %s as JSON: %w", method, endpoint, err)
+		}
+		reqBody = bytes.NewReader(blob)
+		contentType = "application/json"
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request %s %s: %w", method, endpoint, err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request %s %s to the docker daemon at %q failed: %w", method, endpoint, r.socket, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		blob, _ := ioutil.ReadAll(resp.Body)
+		e := dockerAPIError{}
+		if err := json.Unmarshal(blob, &e); err != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(blob))
+		}
+		return nil, fmt.Errorf("request %s %s to the docker daemon failed with status %d: %s", method, endpoint, resp.StatusCode, e.Message)
+	}
+	return resp, nil
+}
+
+// doJSON sends a request like 'do' and decodes the JSON response into 'result' if 'result' isn't
+// nil.
+func (r *dockerAPIRuntime) doJSON(method, endpoint string, query url.Values, body, result interface{}) error {
+	resp, err := r.do(method, endpoint, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("unable to parse the response of %s %s: %w", method, endpoint, err)
+	}
+	return nil
+}
+
+func (r *dockerAPIRuntime) Name() string {
+	return RuntimeDockerAPI
+}
+
+// splitImageTag splits the given image into the repository & the tag or digest, defaulting to the
+// latest tag like 'docker pull'. The daemon pulls every tag of the repository if no tag is given.
+func splitImageTag(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[:i], image[i+1:]
+	}
+	// A ':' before the last '/' is the port of the registry instead of a tag.
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+func (r *dockerAPIRuntime) Pull(image, platform string) error {
+	log.Printf("Pulling %q using the Docker Engine API.", image)
+	repo, tag := splitImageTag(image)
+	q := url.Values{"fromImage": []string{repo}, "tag": []string{tag}}
+	if platform != "" {
+		q.Set("platform", platform)
+	}
+	registry := imageRegistry(repo)
+	header := http.Header{}
+	auth, err := registryAuthFor(r.configDir, registry)
+	if err != nil {
+		log.Printf("Warning: Unable to look up the credentials of registry %q, pulling %q anonymously: %v", registry, image, err)
+	} else if auth != nil {
+		h, err := auth.header()
+		if err != nil {
+			return fmt.Errorf("unable to encode the credentials of registry %q: %w", registry, err)
+		}
+		header.Set("X-Registry-Auth", h)
+	}
+	resp, err := r.doWithHeader("POST", "/images/create", q, header, nil)
+	if err != nil {
+		return r.pullError(image, registry, auth != nil, err)
+	}
+	defer resp.Body.Close()
+	// The daemon streams the pull progress as JSON messages and failures are only reported in the
+	// stream.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		msg := struct {
+			Error string `json:"error"`
+		}{}
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("unable to parse the progress of pulling %q: %w", image, err)
+		}
+		if msg.Error != "" {
+			return r.pullError(image, registry, auth != nil, fmt.Errorf("failed to pull %q: %s", image, msg.Error))
+		}
+	}
+	return nil
+}
+
+// pullError returns the given error of pulling the given image explaining which credentials were
+// used if the registry rejected the pull for lack of authorization.
+func (r *dockerAPIRuntime) pullError(image, registry string, hasAuth bool, err error) error {
+	if !isRegistryAuthError(err.Error()) {
+		return err
+	}
+	if hasAuth {
+		return fmt.Errorf("registry %q rejected the credentials found in the docker config at %q for pulling %q: %w", registry, r.configDir, image, err)
+	}
+	return fmt.Errorf("no credentials for registry %q were found in the docker config at %q to pull %q, run 'docker login %s' or configure a docker credential helper for it: %w", registry, r.configDir, image, registry, err)
+}
+
+// dockerImage is the subset of the image details returned by the Docker Engine API used here.
+type dockerImage struct {
+	RepoDigests []string `json:"RepoDigests"`
+	Config      struct {
+		Env []string `json:"Env"`
+	} `json:"Config"`
+}
+
+func (r *dockerAPIRuntime) inspectImage(image string) (*dockerImage, error) {
+	result := &dockerImage{}
+	if err := r.doJSON("GET", fmt.Sprintf("/images/%s/json", image), nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *dockerAPIRuntime) ResolveImage(image string) (string, error) {
+	i, err := r.inspectImage(image)
+	if err != nil {
+		return "", err
+	}
+	if len(i.RepoDigests) == 0 {
+		return "", fmt.Errorf("image %q has no repo digests", image)
+	}
+	return i.RepoDigests[0], nil
+}
+
+func (r *dockerAPIRuntime) ImageEnv(image string) ([]string, error) {
+	i, err := r.inspectImage(image)
+	if err != nil {
+		return nil, err
+	}
+	return i.Config.Env, nil
+}
+
+func (r *dockerAPIRuntime) Create(image, platform string, cmd ...string) (string, error) {
+	q := url.Values{}
+	if platform != "" {
+		q.Set("platform", platform)
+	}
+	req := struct {
+		Image      string   `json:"Image"`
+		Cmd        []string `json:"Cmd"`
+		HostConfig struct {
+			AutoRemove bool `json:"AutoRemove"`
+		} `json:"HostConfig"`
+	}{
+		Image: image,
+		Cmd:   cmd,
+	}
+	req.HostConfig.AutoRemove = true
+	resp := struct {
+		ID string `json:"Id"`
+	}{}
+	if err := r.doJSON("POST", "/containers/create", q, &req, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (r *dockerAPIRuntime) Start(containerID string) error {
+	return r.doJSON("POST", fmt.Sprintf("/containers/%s/start", containerID), nil, nil, nil)
+}
+
+// demuxStream splits the multiplexed stdout/stderr stream returned by the Docker Engine API when
+// attaching to a process without a TTY. Each frame is an 8 byte header with the stream type in the
+// first byte and the big endian payload size in the last 4 bytes followed by the payload.
+func demuxStream(in io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(in, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to read stream frame header: %w", err)
+		}
+		var out io.Writer
+		switch header[0] {
+		case 0, 1:
+			out = stdout
+		case 2:
+			out = stderr
+		default:
+			return fmt.Errorf("got unknown stream type %d in stream frame header", header[0])
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(out, in, size); err != nil {
+			return fmt.Errorf("unable to read stream frame payload: %w", err)
+		}
+	}
+}
+
+func (r *dockerAPIRuntime) Exec(containerID, workdir string, env []string, args ...string) (ExecResult, error) {
+	log.Printf("Running in container %s: '%s'", containerID, strings.Join(args, " "))
+	create := struct {
+		AttachStdout bool     `json:"AttachStdout"`
+		AttachStderr bool     `json:"AttachStderr"`
+		Cmd          []string `json:"Cmd"`
+		Env          []string `json:"Env,omitempty"`
+		WorkingDir   string   `json:"WorkingDir,omitempty"`
+	}{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          args,
+		Env:          env,
+		WorkingDir:   workdir,
+	}
+	e := struct {
+		ID string `json:"Id"`
+	}{}
+	if err := r.doJSON("POST", fmt.Sprintf("/containers/%s/exec", containerID), nil, &create, &e); err != nil {
+		return ExecResult{}, err
+	}
+	start := struct {
+		Detach bool `json:"Detach"`
+		Tty    bool `json:"Tty"`
+	}{}
+	resp, err := r.do("POST", fmt.Sprintf("/exec/%s/start", e.ID), nil, &start)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	defer resp.Body.Close()
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	if err := demuxStream(resp.Body, stdout, stderr); err != nil {
+		return ExecResult{}, fmt.Errorf("error reading the output of '%s': %w", strings.Join(args, " "), err)
+	}
+	inspect := struct {
+		Running  bool `json:"Running"`
+		ExitCode int  `json:"ExitCode"`
+	}{}
+	if err := r.doJSON("GET", fmt.Sprintf("/exec/%s/json", e.ID), nil, nil, &inspect); err != nil {
+		return ExecResult{}, err
+	}
+	if inspect.Running {
+		return ExecResult{}, fmt.Errorf("'%s' was still running after its output stream was closed", strings.Join(args, " "))
+	}
+	return ExecResult{
+		ExitCode: inspect.ExitCode,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+	}, nil
+}
+
+func (r *dockerAPIRuntime) CopyTo(containerID, src, dst string) error {
+	blob, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("unable to read %q: %w", src, err)
+	}
+	s, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("unable to stat %q: %w", src, err)
+	}
+	buf := bytes.NewBuffer(nil)
+	t := tar.NewWriter(buf)
+	if err := t.WriteHeader(&tar.Header{
+		Name: path.Base(dst),
+		Size: int64(len(blob)),
+		Mode: int64(s.Mode().Perm()),
+	}); err != nil {
+		return fmt.Errorf("failed to write tar header for %q: %w", src, err)
+	}
+	if _, err := t.Write(blob); err != nil {
+		return fmt.Errorf("failed to archive %q: %w", src, err)
+	}
+	if err := t.Close(); err != nil {
+		return fmt.Errorf("failed to archive %q: %w", src, err)
+	}
+	q := url.Values{"path": []string{path.Dir(dst)}}
+	return r.doJSON("PUT", fmt.Sprintf("/containers/%s/archive", containerID), q, buf, nil)
+}
+
+func (r *dockerAPIRuntime) ArchiveFrom(containerID, src string) (io.ReadCloser, error) {
+	resp, err := r.do("GET", fmt.Sprintf("/containers/%s/archive", containerID), url.Values{"path": []string{src}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (r *dockerAPIRuntime) CopyFrom(containerID, src, dst string) error {
+	rc, err := r.ArchiveFrom(containerID, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	t := tar.NewReader(rc)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%q wasn't a regular file in the container", src)
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading the archive of %q: %w", src, err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		o, err := os.Create(dst)
+		if err != nil {
+			return fmt.Errorf("unable to open %q for writing: %w", dst, err)
+		}
+		defer o.Close()
+		if _, err := io.Copy(o, t); err != nil {
+			return fmt.Errorf("error while copying %q from the container to %q: %w", src, dst, err)
+		}
+		return nil
+	}
+}
+
+func (r *dockerAPIRuntime) Stop(containerID string) error {
+	// The container is automatically removed once stopped because it was created with AutoRemove.
+	return r.doJSON("POST", fmt.Sprintf("/containers/%s/stop", containerID), url.Values{"t": []string{"0"}}, nil, nil)
+}
@@ -0,0 +1,303 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// frame returns a multiplexed stream frame for the given stream type & payload.
+func frame(stream byte, payload string) []byte {
+	h := make([]byte, 8)
+	h[0] = stream
+	binary.BigEndian.PutUint32(h[4:], uint32(len(payload)))
+	return append(h, []byte(payload)...)
+}
+
+func TestDockerAPIRuntimeExec(t *testing.T) {
+	socket := path.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket %q: %v", socket, err)
+	}
+	var gotCmd []string
+	var gotWorkdir string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.41/containers/cid/exec", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Cmd        []string
+			WorkingDir string
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to parse exec create request: %v", err)
+		}
+		gotCmd = req.Cmd
+		gotWorkdir = req.WorkingDir
+		w.Write([]byte(`{"Id": "eid"}`))
+	})
+	mux.HandleFunc("/v1.41/exec/eid/start", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(frame(1, "out1\n"))
+		w.Write(frame(2, "err\n"))
+		w.Write(frame(1, "out2\n"))
+	})
+	mux.HandleFunc("/v1.41/exec/eid/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Running": false, "ExitCode": 3}`))
+	})
+	s := &http.Server{Handler: mux}
+	go s.Serve(l)
+	defer s.Close()
+
+	rt := newDockerAPIRuntime(socket)
+	got, err := rt.Exec("cid", "/workdir", nil, "ls", "-l")
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	want := ExecResult{ExitCode: 3, Stdout: "out1\nout2\n", Stderr: "err\n"}
+	if got != want {
+		t.Errorf("Exec returned %+v, want %+v", got, want)
+	}
+	if len(gotCmd) != 2 || gotCmd[0] != "ls" || gotCmd[1] != "-l" {
+		t.Errorf("Exec created exec with command %v, want [ls -l]", gotCmd)
+	}
+	if gotWorkdir != "/workdir" {
+		t.Errorf("Exec created exec with working directory %q, want /workdir", gotWorkdir)
+	}
+}
+
+func TestDockerAPIRuntimePull(t *testing.T) {
+	socket := path.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket %q: %v", socket, err)
+	}
+	var gotQuery url.Values
+	var gotAuth string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.41/images/create", func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query()
+		gotAuth = r.Header.Get("X-Registry-Auth")
+		w.Write([]byte(`{"status": "Pulling from foo/bar"}` + "\n" + `{"status": "Digest: sha256:abc"}` + "\n"))
+	})
+	s := &http.Server{Handler: mux}
+	go s.Serve(l)
+	defer s.Close()
+
+	rt := newDockerAPIRuntime(socket)
+	rt.configDir = writeDockerConfig(t, `{"auths": {"https://gcr.io": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("user:pass"))+`"}}}`)
+	if err := rt.Pull("gcr.io/foo/bar:latest", "linux/arm64"); err != nil {
+		t.Fatalf("Pull failed: %v", err)
+	}
+	if got := gotQuery.Get("fromImage"); got != "gcr.io/foo/bar" {
+		t.Errorf("Pull requested image %q, want gcr.io/foo/bar", got)
+	}
+	if got := gotQuery.Get("tag"); got != "latest" {
+		t.Errorf("Pull requested tag %q, want latest", got)
+	}
+	if got := gotQuery.Get("platform"); got != "linux/arm64" {
+		t.Errorf("Pull requested platform %q, want linux/arm64", got)
+	}
+	blob, err := base64.URLEncoding.DecodeString(gotAuth)
+	if err != nil {
+		t.Fatalf("Failed to decode X-Registry-Auth header %q: %v", gotAuth, err)
+	}
+	got := registryAuth{}
+	if err := json.Unmarshal(blob, &got); err != nil {
+		t.Fatalf("Failed to parse X-Registry-Auth header %q: %v", blob, err)
+	}
+	if want := (registryAuth{Username: "user", Password: "pass", ServerAddress: "gcr.io"}); got != want {
+		t.Errorf("Pull sent credentials %+v, want %+v", got, want)
+	}
+}
+
+func TestDockerAPIRuntimePullUnauthorized(t *testing.T) {
+	socket := path.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket %q: %v", socket, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.41/images/create", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"error": "Head https://gcr.io/v2/foo/bar/manifests/latest: unauthorized: authentication required"}` + "\n"))
+	})
+	s := &http.Server{Handler: mux}
+	go s.Serve(l)
+	defer s.Close()
+
+	rt := newDockerAPIRuntime(socket)
+	rt.configDir = t.TempDir()
+	err = rt.Pull("gcr.io/foo/bar:latest", "")
+	if err == nil {
+		t.Fatalf("Pull succeeded even though the registry rejected it, want error")
+	}
+	if want := "docker login gcr.io"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Pull returned error %q, want it to contain %q", err, want)
+	}
+}
+
+// writeDockerConfig writes a docker CLI config file with the given contents to a new directory &
+// returns the directory.
+func writeDockerConfig(t *testing.T, contents string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, "config.json"), []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write docker config: %v", err)
+	}
+	return dir
+}
+
+func TestRegistryAuthFor(t *testing.T) {
+	// A fake credential helper that only has credentials for helper.example.com.
+	bin := t.TempDir()
+	helper := "#!/bin/sh\nread server\nif [ \"$server\" = helper.example.com ]; then echo '{\"Username\": \"<token>\", \"Secret\": \"tok\"}'; exit 0; fi\necho 'credentials not found in native keychain'\nexit 1\n"
+	if err := ioutil.WriteFile(path.Join(bin, "docker-credential-fake"), []byte(helper), 0755); err != nil {
+		t.Fatalf("Failed to write fake credential helper: %v", err)
+	}
+	oldPath := os.Getenv("PATH")
+	if err := os.Setenv("PATH", bin+string(os.PathListSeparator)+oldPath); err != nil {
+		t.Fatalf("Failed to set PATH: %v", err)
+	}
+	defer os.Setenv("PATH", oldPath)
+
+	userPass := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	tests := []struct {
+		name     string
+		config   string
+		registry string
+		want     *registryAuth
+	}{
+		{
+			name:     "Auths",
+			config:   fmt.Sprintf(`{"auths": {"gcr.io": {"auth": %q}}}`, userPass),
+			registry: "gcr.io",
+			want:     &registryAuth{Username: "user", Password: "pass", ServerAddress: "gcr.io"},
+		},
+		{
+			name:     "DockerHub",
+			config:   fmt.Sprintf(`{"auths": {"https://index.docker.io/v1/": {"auth": %q}}}`, userPass),
+			registry: "docker.io",
+			want:     &registryAuth{Username: "user", Password: "pass", ServerAddress: "https://index.docker.io/v1/"},
+		},
+		{
+			name:     "OtherRegistry",
+			config:   fmt.Sprintf(`{"auths": {"gcr.io": {"auth": %q}}}`, userPass),
+			registry: "quay.io",
+		},
+		{
+			name:     "CredHelper",
+			config:   fmt.Sprintf(`{"auths": {"helper.example.com": {"auth": %q}}, "credHelpers": {"helper.example.com": "fake"}}`, userPass),
+			registry: "helper.example.com",
+			want:     &registryAuth{IdentityToken: "tok", ServerAddress: "helper.example.com"},
+		},
+		{
+			name:     "CredsStoreWithoutCredentials",
+			config:   `{"credsStore": "fake"}`,
+			registry: "gcr.io",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		// Not parallel because the credential helper is found through the PATH set above.
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := registryAuthFor(writeDockerConfig(t, tc.config), tc.registry)
+			if err != nil {
+				t.Fatalf("registryAuthFor failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("registryAuthFor got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	if got, err := registryAuthFor(t.TempDir(), "gcr.io"); err != nil || got != nil {
+		t.Errorf("registryAuthFor got (%+v, %v) without a docker config, want (nil, nil)", got, err)
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	for image, want := range map[string]string{
+		"gcr.io/foo/bar":         "gcr.io",
+		"localhost:5000/foo/bar": "localhost:5000",
+		"localhost/foo":          "localhost",
+		"ubuntu":                 "docker.io",
+		"library/ubuntu":         "docker.io",
+		"index.docker.io/foo":    "docker.io",
+	} {
+		if got := imageRegistry(image); got != want {
+			t.Errorf("imageRegistry(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestSplitImageTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		wantRepo string
+		wantTag  string
+	}{
+		{
+			name:     "Tag",
+			image:    "gcr.io/foo/bar:1.0",
+			wantRepo: "gcr.io/foo/bar",
+			wantTag:  "1.0",
+		},
+		{
+			name:     "Untagged",
+			image:    "gcr.io/foo/bar",
+			wantRepo: "gcr.io/foo/bar",
+			wantTag:  "latest",
+		},
+		{
+			name:     "RegistryPort",
+			image:    "localhost:5000/foo/bar",
+			wantRepo: "localhost:5000/foo/bar",
+			wantTag:  "latest",
+		},
+		{
+			name:     "RegistryPortAndTag",
+			image:    "localhost:5000/foo/bar:1.0",
+			wantRepo: "localhost:5000/foo/bar",
+			wantTag:  "1.0",
+		},
+		{
+			name:     "Digest",
+			image:    "localhost:5000/foo/bar@sha256:abc",
+			wantRepo: "localhost:5000/foo/bar",
+			wantTag:  "sha256:abc",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			repo, tag := splitImageTag(tc.image)
+			if repo != tc.wantRepo || tag != tc.wantTag {
+				t.Errorf("splitImageTag(%q) = (%q, %q), want (%q, %q)", tc.image, repo, tag, tc.wantRepo, tc.wantTag)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// dockerHubRegistry is the registry of images that don't specify one.
+	dockerHubRegistry = "docker.io"
+	// dockerHubServerAddress is the server address the docker CLI stores the credentials of Docker
+	// Hub under.
+	dockerHubServerAddress = "https://index.docker.io/v1/"
+	// credentialHelperTokenUser is the username returned by docker credential helpers when the
+	// secret is an identity token instead of a password.
+	credentialHelperTokenUser = "<token>"
+)
+
+// dockerConfig is the subset of the docker CLI config file describing registry credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		// Auth is the base64 encoded "username:password".
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	// CredsStore is the credential helper used for registries without a helper in CredHelpers.
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// registryAuth are the credentials of a registry sent to the docker daemon in the X-Registry-Auth
+// header.
+type registryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// header returns the value of the X-Registry-Auth header with the credentials.
+func (a *registryAuth) header() (string, error) {
+	blob, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(blob), nil
+}
+
+// dockerConfigDir returns the directory of the docker CLI config file as specified by the
+// DOCKER_CONFIG environment variable or the default ~/.docker.
+func dockerConfigDir() string {
+	if d := os.Getenv("DOCKER_CONFIG"); d != "" {
+		return d
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// imageRegistry returns the host of the registry of the given image. Like the docker CLI, the
+// first component of the image is the registry if it looks like a host name.
+func imageRegistry(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return dockerHubRegistry
+	}
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return dockerHubRegistry
+	}
+	if host == "index.docker.io" {
+		return dockerHubRegistry
+	}
+	return host
+}
+
+// registryHostname strips the scheme & path of the given server address from the docker CLI
+// config file, e.g., https://gcr.io/v1/ is gcr.io.
+func registryHostname(serverAddress string) string {
+	h := serverAddress
+	if i := strings.Index(h, "://"); i >= 0 {
+		h = h[i+3:]
+	}
+	if i := strings.Index(h, "/"); i >= 0 {
+		h = h[:i]
+	}
+	if h == "index.docker.io" {
+		return dockerHubRegistry
+	}
+	return h
+}
+
+// credentialHelperAuth returns the credentials of the given registry stored by the docker
+// credential helper with the given name or nil if the helper has no credentials for it.
+func credentialHelperAuth(helper, serverAddress string) (*registryAuth, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Credential helpers report missing credentials on stdout.
+		if strings.Contains(string(out), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("docker credential helper %q failed: %w, output: %s%s", helper, err, out, stderr)
+	}
+	c := struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}{}
+	if err := json.Unmarshal(out, &c); err != nil {
+		return nil, fmt.Errorf("unable to parse the output of docker credential helper %q: %w", helper, err)
+	}
+	if c.Username == credentialHelperTokenUser {
+		return &registryAuth{IdentityToken: c.Secret, ServerAddress: serverAddress}, nil
+	}
+	return &registryAuth{Username: c.Username, Password: c.Secret, ServerAddress: serverAddress}, nil
+}
+
+// registryAuthFor returns the credentials of the given registry configured in the docker CLI
+// config file in the given directory, either stored in the config file itself or by a credential
+// helper. Returns nil if no credentials are configured for the registry.
+func registryAuthFor(configDir, registry string) (*registryAuth, error) {
+	if configDir == "" {
+		return nil, nil
+	}
+	configPath := filepath.Join(configDir, "config.json")
+	blob, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read the docker config file: %w", err)
+	}
+	c := dockerConfig{}
+	if err := json.Unmarshal(blob, &c); err != nil {
+		return nil, fmt.Errorf("unable to parse the docker config file %q: %w", configPath, err)
+	}
+	serverAddress := registry
+	if registry == dockerHubRegistry {
+		serverAddress = dockerHubServerAddress
+	}
+	helper := c.CredsStore
+	for r, h := range c.CredHelpers {
+		if registryHostname(r) == registry {
+			helper = h
+		}
+	}
+	if helper != "" {
+		return credentialHelperAuth(helper, serverAddress)
+	}
+	for r, a := range c.Auths {
+		if registryHostname(r) != registry {
+			continue
+		}
+		result := &registryAuth{IdentityToken: a.IdentityToken, ServerAddress: serverAddress}
+		if a.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode the credentials of registry %q in %q: %w", r, configPath, err)
+			}
+			userPass := strings.SplitN(string(decoded), ":", 2)
+			if len(userPass) != 2 {
+				return nil, fmt.Errorf("invalid credentials of registry %q in %q, want base64 encoded username:password", r, configPath)
+			}
+			result.Username = userPass[0]
+			result.Password = userPass[1]
+		}
+		return result, nil
+	}
+	return nil, nil
+}
+
+// isRegistryAuthError returns whether the given error message returned by the docker daemon when
+// pulling an image indicates the registry rejected the request for lack of credentials.
+func isRegistryAuthError(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, s := range []string{"status 401", "status 403", "unauthorized", "authentication required", "access denied", "forbidden", "docker login"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
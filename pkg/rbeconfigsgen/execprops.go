@@ -0,0 +1,213 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// ExecPropertyContainerImage is the exec property specifying the toolchain container image.
+	ExecPropertyContainerImage = "container-image"
+	// ExecPropertyOSFamily is the exec property specifying the OS family of the platform.
+	ExecPropertyOSFamily = "OSFamily"
+	// execPropertyLabelPrefix is the prefix of exec properties specifying labels.
+	execPropertyLabelPrefix = "label:"
+	// labelMaxLength is the maximum length of the name & value of a label.
+	labelMaxLength = 63
+	// defaultPlatformParent is the parent of the generated platform if none was specified.
+	defaultPlatformParent = "@local_config_platform//:host"
+)
+
+var (
+	// validOSFamilies are the values accepted for the OSFamily exec property.
+	validOSFamilies = []string{
+		"Linux",
+		"Windows",
+	}
+
+	// platformVariantNameRegexp matches valid names of platform variants.
+	platformVariantNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+	// reservedConfigTargetNames are the names of targets always generated in the config package
+	// which can't be used as names of platform variants.
+	reservedConfigTargetNames = []string{
+		"platform",
+		"cc-toolchain",
+	}
+
+	// dockerShmSizeRegexp matches valid values of the dockerShmSize exec property, i.e., a number
+	// with an optional unit (b|k|m|g) or the empty string.
+	dockerShmSizeRegexp = regexp.MustCompile(`^([0-9]+)[bkmg]?$`)
+
+	// execPropertyVerifiers are functions verifying the values of known exec properties. These
+	// mirror the verifiers in //rules/exec_properties:exec_properties.bzl.
+	execPropertyVerifiers = map[string]func(string) error{
+		"dockerNetwork":           verifyOneOf("standard", "off"),
+		"dockerPrivileged":        verifyBool,
+		"dockerRunAsRoot":         verifyBool,
+		"dockerSiblingContainers": verifyBool,
+		"dockerUseURandom":        verifyBool,
+		"dockerShmSize":           verifyDockerShmSize,
+		ExecPropertyOSFamily:      verifyOneOf(validOSFamilies...),
+	}
+)
+
+// verifyOneOf returns a function verifying a value is one of the given values.
+func verifyOneOf(valid ...string) func(string) error {
+	return func(v string) error {
+		if !strListContains(valid, v) {
+			return fmt.Errorf("got %q, want one of %s", v, strings.Join(valid, ", "))
+		}
+		return nil
+	}
+}
+
+// verifyBool verifies the given value is a boolean as generated by exec_properties.bzl.
+func verifyBool(v string) error {
+	return verifyOneOf("True", "False", "true", "false")(v)
+}
+
+// verifyDockerShmSize verifies the given value is of the format [0-9]*[bkmg]? with a non zero
+// number or empty.
+func verifyDockerShmSize(v string) error {
+	if v == "" {
+		return nil
+	}
+	s := dockerShmSizeRegexp.FindStringSubmatch(v)
+	if s == nil {
+		return fmt.Errorf("got %q, want the format [0-9]*[bkmg]?", v)
+	}
+	if strings.Trim(s[1], "0") == "" {
+		return fmt.Errorf("got %q, want a numeric value greater than 0", v)
+	}
+	return nil
+}
+
+// verifyLabel verifies the given name & value of a label exec property based on the requirements
+// for labels at https://cloud.google.com/resource-manager/docs/creating-managing-labels with the
+// same relaxations as exec_properties.bzl.
+func verifyLabel(name, value string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("label name can't be empty")
+	}
+	if len(name) > labelMaxLength {
+		return fmt.Errorf("label name %q exceeds the %d character length limit", name, labelMaxLength)
+	}
+	if len(value) > labelMaxLength {
+		return fmt.Errorf("value %q of label %q exceeds the %d character length limit", value, name, labelMaxLength)
+	}
+	if name != strings.ToLower(name) {
+		return fmt.Errorf("label name %q must not contain capital letters", name)
+	}
+	if value != strings.ToLower(value) {
+		return fmt.Errorf("value %q of label %q must not contain capital letters", value, name)
+	}
+	if strings.ContainsAny(name[:1], "0123456789-_") {
+		return fmt.Errorf("label name %q must start with a lowercase letter or international character", name)
+	}
+	return nil
+}
+
+// validateExecProperty verifies the given exec property can be added to the generated platform.
+// The container image is always determined by the toolchain container & the OS family by the
+// OSFamily of the platform params so they can't be specified as additional exec properties.
+func validateExecProperty(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("exec property names can't be empty")
+	}
+	if key == ExecPropertyContainerImage || key == ExecPropertyOSFamily {
+		return fmt.Errorf("exec property %q is set by the generated platform and can't be overridden", key)
+	}
+	if strings.HasPrefix(key, execPropertyLabelPrefix) {
+		return verifyLabel(strings.TrimPrefix(key, execPropertyLabelPrefix), value)
+	}
+	if verify, ok := execPropertyVerifiers[key]; ok {
+		if err := verify(value); err != nil {
+			return fmt.Errorf("invalid value for exec property %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// isAbsoluteLabel returns whether the given string looks like an absolute Bazel label.
+func isAbsoluteLabel(l string) bool {
+	return strings.HasPrefix(l, "@") || strings.HasPrefix(l, "//")
+}
+
+// validatePlatformParams verifies the constraints, parent & exec properties of the given platform
+// params.
+func validatePlatformParams(p *PlatformToolchainsTemplateParams) error {
+	if err := execPropertyVerifiers[ExecPropertyOSFamily](p.OSFamily); err != nil {
+		return fmt.Errorf("invalid OSFamily: %w", err)
+	}
+	if p.Parent != "" && !isAbsoluteLabel(p.Parent) {
+		return fmt.Errorf("parent platform %q isn't an absolute Bazel label", p.Parent)
+	}
+	for _, constraints := range [][]string{p.ExecConstraints, p.TargetConstraints, p.ExtraConstraints} {
+		for _, c := range constraints {
+			if !isAbsoluteLabel(c) {
+				return fmt.Errorf("constraint value %q isn't an absolute Bazel label", c)
+			}
+		}
+	}
+	if err := validateExecProperties(p.ExecProperties); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, v := range p.Variants {
+		if err := validatePlatformVariantName(v.Name); err != nil {
+			return err
+		}
+		if names[v.Name] {
+			return fmt.Errorf("got multiple platform variants named %q, names must be unique", v.Name)
+		}
+		names[v.Name] = true
+		if err := validateExecProperties(v.ExecProperties); err != nil {
+			return fmt.Errorf("invalid platform variant %q: %w", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateExecProperties verifies every exec property in the given map in a deterministic order.
+func validateExecProperties(props map[string]string) error {
+	var keys []string
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := validateExecProperty(k, props[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePlatformVariantName verifies the given name can be used as the name of a platform
+// variant target in the config package.
+func validatePlatformVariantName(name string) error {
+	if !platformVariantNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid platform variant name %q, names must match %s", name, platformVariantNameRegexp)
+	}
+	if strListContains(reservedConfigTargetNames, name) {
+		return fmt.Errorf("platform variant name %q is reserved for a generated target", name)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateExecProperty(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{key: "dockerNetwork", value: "standard"},
+		{key: "dockerNetwork", value: "on", wantErr: true},
+		{key: "dockerPrivileged", value: "True"},
+		{key: "dockerPrivileged", value: "yes", wantErr: true},
+		{key: "dockerShmSize", value: "512m"},
+		{key: "dockerShmSize", value: ""},
+		{key: "dockerShmSize", value: "0g", wantErr: true},
+		{key: "dockerShmSize", value: "1t", wantErr: true},
+		{key: "Pool", value: "Any Value"},
+		{key: "label:team", value: "infra_1"},
+		{key: "label:", value: "infra", wantErr: true},
+		{key: "label:Team", value: "infra", wantErr: true},
+		{key: "label:team", value: "Infra", wantErr: true},
+		{key: "label:1team", value: "infra", wantErr: true},
+		{key: "label:" + strings.Repeat("a", 64), value: "infra", wantErr: true},
+		{key: "label:team", value: strings.Repeat("a", 64), wantErr: true},
+		{key: "container-image", value: "docker://foo", wantErr: true},
+		{key: "OSFamily", value: "Linux", wantErr: true},
+		{key: "", value: "foo", wantErr: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.key+"="+tc.value, func(t *testing.T) {
+			t.Parallel()
+			err := validateExecProperty(tc.key, tc.value)
+			if tc.wantErr && err == nil {
+				t.Errorf("validateExecProperty(%q, %q) succeeded, want error", tc.key, tc.value)
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("validateExecProperty(%q, %q) failed: %v", tc.key, tc.value, err)
+			}
+		})
+	}
+}
+
+func TestGenConfigBuildCustomPlatform(t *testing.T) {
+	t.Parallel()
+	o := &Options{
+		ExecOS:        OSLinux,
+		TargetOS:      OSLinux,
+		GenCPPConfigs: true,
+	}
+	if err := o.ApplyDefaults(OSLinux); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	o.PlatformParams.ToolchainContainer = "gcr.io/foo/bar@sha256:abc"
+	o.PlatformParams.Parent = "//platforms:base"
+	o.PlatformParams.ExtraConstraints = []string{"//constraints:sandboxed"}
+	o.PlatformParams.ExecProperties = map[string]string{
+		"label:team":    "infra",
+		"dockerNetwork": "standard",
+	}
+	o.PlatformParams.Variants = []PlatformVariant{
+		{Name: "large", ExecProperties: map[string]string{"Pool": "large", "dockerShmSize": "1g"}},
+		{Name: "no_network", ExecProperties: map[string]string{"dockerNetwork": "off"}},
+	}
+	if err := validatePlatformParams(o.PlatformParams); err != nil {
+		t.Fatalf("validatePlatformParams failed: %v", err)
+	}
+	g, err := genConfigBuild(o)
+	if err != nil {
+		t.Fatalf("genConfigBuild failed: %v", err)
+	}
+	for _, want := range []string{
+		`parents = ["//platforms:base"]`,
+		`"//constraints:sandboxed",`,
+		`"OSFamily": "Linux",
+        "dockerNetwork": "standard",
+        "label:team": "infra",
+    },`,
+		`platform(
+    name = "large",
+    parents = [":platform"],
+    exec_properties = {
+        "Pool": "large",
+        "dockerShmSize": "1g",
+    },
+)`,
+		`name = "no_network"`,
+	} {
+		if !strings.Contains(string(g.contents), want) {
+			t.Errorf("Generated BUILD file did not contain %q, got:\n%s", want, g.contents)
+		}
+	}
+	// The extra constraints only apply to the platform.
+	if n := strings.Count(string(g.contents), "//constraints:sandboxed"); n != 1 {
+		t.Errorf("Generated BUILD file had %d occurrences of the extra constraint, want 1, got:\n%s", n, g.contents)
+	}
+
+	o.OutputSourceRoot = "/src"
+	o.OutputConfigPath = "configs/rbe"
+	wantLabels := []string{"//configs/rbe/config:platform", "//configs/rbe/config:large", "//configs/rbe/config:no_network"}
+	if got := platformLabels(o); !reflect.DeepEqual(got, wantLabels) {
+		t.Errorf("platformLabels got %v, want %v", got, wantLabels)
+	}
+
+	o.PlatformParams.Variants = append(o.PlatformParams.Variants, PlatformVariant{Name: "platform"})
+	if err := validatePlatformParams(o.PlatformParams); err == nil {
+		t.Errorf("validatePlatformParams succeeded with a platform variant named \"platform\", want error")
+	}
+	o.PlatformParams.Variants = nil
+	o.PlatformParams.OSFamily = "linux"
+	if err := validatePlatformParams(o.PlatformParams); err == nil {
+		t.Errorf("validatePlatformParams succeeded with OS family %q, want error", o.PlatformParams.OSFamily)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// tarballContents are the files, symlinks & directories in a tarball read by readTarballContents.
+// Every name is cleaned & relative to the root of the tarball.
+type tarballContents struct {
+	// names are the names of the files & symlinks in the order they appear in the tarball.
+	names []string
+	// files are the regular files by name. Hard links are represented as copies of the files they
+	// link to.
+	files map[string]generatedFile
+	// symlinks map the name of every symlink to the relative path it points to.
+	symlinks map[string]string
+	// dirs are the directories, i.e., the directory entries & the parents of every other entry.
+	dirs map[string]bool
+}
+
+// slashPath returns the given path in a tarball with backslashes, which are path separators on
+// Windows, replaced by slashes.
+func slashPath(p string) string {
+	return strings.ReplaceAll(p, `\`, "/")
+}
+
+// isAbsPath returns whether the given slash separated path is absolute on Linux or Windows, e.g.,
+// "/usr/lib" or "C:/Windows".
+func isAbsPath(p string) bool {
+	return path.IsAbs(p) || (len(p) >= 2 && p[1] == ':')
+}
+
+// cleanTarballPath returns the given name of an entry in a tarball cleaned, slash separated &
+// relative to the root of the tarball, e.g., "./cc/BUILD" is "cc/BUILD". Absolute names & names
+// escaping the root of the tarball, e.g., "../etc/passwd", are rejected such that entries are
+// never extracted outside the output directory (tar-slip).
+func cleanTarballPath(name string) (string, error) {
+	n := slashPath(name)
+	if isAbsPath(n) {
+		return "", fmt.Errorf("%q is an absolute path", name)
+	}
+	n = path.Clean(n)
+	if n == ".." || strings.HasPrefix(n, "../") {
+		return "", fmt.Errorf("%q is outside the root of the tarball", name)
+	}
+	return n, nil
+}
+
+// readTarballContents reads the contents of the tarball at 'inTarPath'. Only directories, regular
+// files, symlinks & hard links to preceding regular files are supported. Entries outside the root
+// of the tarball, symlinks pointing outside the root of the tarball, e.g., to an absolute path,
+// directly or through other symlinks, symlink loops & entries under a symlink are rejected.
+func readTarballContents(inTarPath string) (*tarballContents, error) {
+	in, err := os.Open(inTarPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open input tarball %q for reading: %w", inTarPath, err)
+	}
+	defer in.Close()
+	inTar := tar.NewReader(in)
+
+	t := &tarballContents{
+		files:    make(map[string]generatedFile),
+		symlinks: make(map[string]string),
+		dirs:     make(map[string]bool),
+	}
+	for {
+		h, err := inTar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error while reading input tarball %q: %w", inTarPath, err)
+		}
+		name, err := cleanTarballPath(h.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry in tarball %q: %w", inTarPath, err)
+		}
+		if name == "." {
+			if h.Typeflag == tar.TypeDir {
+				continue
+			}
+			return nil, fmt.Errorf("got unexpected entry with name %q of type %v in tarball %q", h.Name, h.Typeflag, inTarPath)
+		}
+		for d := path.Dir(name); d != "."; d = path.Dir(d) {
+			t.dirs[d] = true
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			t.dirs[name] = true
+			continue
+		case tar.TypeReg:
+			contents, err := ioutil.ReadAll(inTar)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the contents of %q from input tarball %q: %w", h.Name, inTarPath, err)
+			}
+			t.files[name] = generatedFile{name: name, contents: contents, executable: h.Mode&0111 != 0}
+			delete(t.symlinks, name)
+		case tar.TypeLink:
+			target, err := cleanTarballPath(h.Linkname)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hard link %q in tarball %q: %w", h.Name, inTarPath, err)
+			}
+			f, ok := t.files[target]
+			if !ok {
+				return nil, fmt.Errorf("hard link %q in tarball %q points to %q which isn't a preceding regular file", h.Name, inTarPath, h.Linkname)
+			}
+			t.files[name] = generatedFile{name: name, contents: f.contents, executable: f.executable}
+			delete(t.symlinks, name)
+		case tar.TypeSymlink:
+			target := slashPath(h.Linkname)
+			if _, err := cleanTarballPath(path.Join(path.Dir(name), target)); err != nil || isAbsPath(target) {
+				return nil, fmt.Errorf("symlink %q in tarball %q points to %q which is outside the root of the tarball", h.Name, inTarPath, h.Linkname)
+			}
+			t.symlinks[name] = target
+			delete(t.files, name)
+		default:
+			return nil, fmt.Errorf("got unexpected entry with name %q of type %v in tarball %q", h.Name, h.Typeflag, inTarPath)
+		}
+		if !strListContains(t.names, name) {
+			t.names = append(t.names, name)
+		}
+	}
+	// An entry under a symlink would be written through the symlink, which may point anywhere
+	// relative to the real location of the entry, e.g., "a/b" pointing to ".." escapes the root if
+	// "a" points to ".".
+	for _, name := range t.names {
+		for d := path.Dir(name); d != "."; d = path.Dir(d) {
+			if _, ok := t.symlinks[d]; ok {
+				return nil, fmt.Errorf("entry %q in tarball %q is under the symlink %q", name, inTarPath, d)
+			}
+		}
+	}
+	for d := range t.dirs {
+		if _, ok := t.symlinks[d]; ok {
+			return nil, fmt.Errorf("symlink %q in tarball %q is also a directory", d, inTarPath)
+		}
+	}
+	// Symlinks are only checked lexically above. Symlinks pointing through other symlinks may still
+	// escape the root once extracted, e.g., "q" pointing to "b/.." is the parent of the root if "b"
+	// points to ".".
+	for _, name := range t.names {
+		if _, ok := t.symlinks[name]; !ok {
+			continue
+		}
+		hops := 0
+		if _, err := t.resolve(name, &hops); err != nil {
+			return nil, fmt.Errorf("invalid symlink %q in tarball %q: %w", name, inTarPath, err)
+		}
+	}
+	return t, nil
+}
+
+// resolve returns the name of the file or directory the given path in the tarball points to after
+// following every symlink in it. Like the filesystem, ".." refers to the parent of the directory a
+// symlink resolves to rather than the directory containing the symlink. Paths pointing outside the
+// root of the tarball are rejected. 'hops' counts the symlinks followed so far.
+func (t *tarballContents) resolve(p string, hops *int) (string, error) {
+	resolved := "."
+	for _, part := range strings.Split(p, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "." {
+				return "", fmt.Errorf("%q points outside the root of the tarball", p)
+			}
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		target, ok := t.symlinks[next]
+		if !ok {
+			resolved = next
+			continue
+		}
+		*hops++
+		if *hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symlinks while resolving %q", p)
+		}
+		// The target isn't cleaned because ".." must be applied to resolved directories.
+		r, err := t.resolve(resolved+"/"+target, hops)
+		if err != nil {
+			return "", err
+		}
+		resolved = r
+	}
+	return resolved, nil
+}
+
+// inline returns copies named 'name' of the file the given path in the tarball points to or of
+// every file in the directory it points to. 'inlining' are the directories already being inlined,
+// which stops inlining a directory symlink pointing to the directory containing it.
+func (t *tarballContents) inline(name, p string, inlining []string) ([]generatedFile, error) {
+	hops := 0
+	r, err := t.resolve(p, &hops)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := t.files[r]; ok {
+		return []generatedFile{{name: name, contents: f.contents, executable: f.executable}}, nil
+	}
+	// "." is the root of the tarball.
+	if r != "." && !t.dirs[r] {
+		return nil, fmt.Errorf("%q points to %q which doesn't exist in the tarball", p, r)
+	}
+	if strListContains(inlining, r) {
+		return nil, fmt.Errorf("%q points to %q which contains it", p, r)
+	}
+	var result []generatedFile
+	for _, n := range t.names {
+		if r != "." && !strings.HasPrefix(n, r+"/") {
+			continue
+		}
+		fs, err := t.inline(path.Join(name, strings.TrimPrefix(n, r+"/")), n, append(inlining, r))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, fs...)
+	}
+	return result, nil
+}
+
+// generatedFiles returns the files & symlinks in the tarball as generated files in the directory
+// 'pathPrefix' in the order they appear in the tarball. If inlineSymlinks is true, every symlink
+// is replaced by a copy of the file it points to or copies of the files in the directory it points
+// to. Otherwise, symlinks are preserved as relative symlinks.
+func (t *tarballContents) generatedFiles(pathPrefix string, inlineSymlinks bool) ([]generatedFile, error) {
+	var result []generatedFile
+	for _, name := range t.names {
+		if f, ok := t.files[name]; ok {
+			f.name = path.Join(pathPrefix, name)
+			result = append(result, f)
+			continue
+		}
+		if !inlineSymlinks {
+			result = append(result, generatedFile{
+				name:     path.Join(pathPrefix, name),
+				contents: []byte(t.symlinks[name]),
+				symlink:  true,
+			})
+			continue
+		}
+		fs, err := t.inline(name, name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to inline symlink %q: %w", name, err)
+		}
+		for _, f := range fs {
+			f.name = path.Join(pathPrefix, f.name)
+			result = append(result, f)
+		}
+	}
+	return result, nil
+}
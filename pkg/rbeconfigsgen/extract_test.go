@@ -0,0 +1,220 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCppConfigsTarball(t *testing.T) {
+	// entries are the entries of a tarball produced by genCppConfigs with every supported type of
+	// entry.
+	entries := []tarEntry{
+		{name: "./", typeflag: tar.TypeDir},
+		{name: "./WORKSPACE", typeflag: tar.TypeReg, contents: "workspace(name = \"local_config_cc\")"},
+		{name: "./BUILD", typeflag: tar.TypeReg, contents: "cc_toolchain_suite()"},
+		{name: "./cc_wrapper.sh", typeflag: tar.TypeReg, contents: "#!/bin/bash", mode: 0755},
+		{name: "./tools/", typeflag: tar.TypeDir},
+		{name: "./tools/cc_wrapper.sh", typeflag: tar.TypeSymlink, linkname: "../cc_wrapper.sh"},
+		{name: "./include/stdio.h", typeflag: tar.TypeReg, contents: "#include <bits/stdio.h>"},
+		{name: "./sysroot/include", typeflag: tar.TypeSymlink, linkname: "../include"},
+		// Hardened symlinks pointing to the same file are archived as hard links.
+		{name: "./armeabi_cc_toolchain_config.bzl", typeflag: tar.TypeReg, contents: "def cc_toolchain_config(): pass"},
+		{name: "./cc_toolchain_config.bzl", typeflag: tar.TypeLink, linkname: "./armeabi_cc_toolchain_config.bzl"},
+	}
+	tests := []struct {
+		name        string
+		entries     []tarEntry
+		symlinkMode string
+		want        []generatedFile
+		// wantErr is a substring of the expected error or empty if no error is expected.
+		wantErr string
+	}{
+		{
+			name:        "PreserveSymlinks",
+			entries:     entries,
+			symlinkMode: CppSymlinkModePreserve,
+			want: []generatedFile{
+				{name: "cc/BUILD", contents: []byte("cc_toolchain_suite()")},
+				{name: "cc/cc_wrapper.sh", contents: []byte("#!/bin/bash"), executable: true},
+				{name: "cc/tools/cc_wrapper.sh", contents: []byte("../cc_wrapper.sh"), symlink: true},
+				{name: "cc/include/stdio.h", contents: []byte("#include <bits/stdio.h>")},
+				{name: "cc/sysroot/include", contents: []byte("../include"), symlink: true},
+				{name: "cc/armeabi_cc_toolchain_config.bzl", contents: []byte("def cc_toolchain_config(): pass")},
+				{name: "cc/cc_toolchain_config.bzl", contents: []byte("def cc_toolchain_config(): pass")},
+			},
+		},
+		{
+			name:        "InlineSymlinks",
+			entries:     entries,
+			symlinkMode: CppSymlinkModeInline,
+			want: []generatedFile{
+				{name: "cc/BUILD", contents: []byte("cc_toolchain_suite()")},
+				{name: "cc/cc_wrapper.sh", contents: []byte("#!/bin/bash"), executable: true},
+				{name: "cc/tools/cc_wrapper.sh", contents: []byte("#!/bin/bash"), executable: true},
+				{name: "cc/include/stdio.h", contents: []byte("#include <bits/stdio.h>")},
+				{name: "cc/sysroot/include/stdio.h", contents: []byte("#include <bits/stdio.h>")},
+				{name: "cc/armeabi_cc_toolchain_config.bzl", contents: []byte("def cc_toolchain_config(): pass")},
+				{name: "cc/cc_toolchain_config.bzl", contents: []byte("def cc_toolchain_config(): pass")},
+			},
+		},
+		{
+			name: "InlineSymlinkChain",
+			entries: []tarEntry{
+				{name: "lib/libc.so.6", typeflag: tar.TypeReg, contents: "libc", mode: 0755},
+				{name: "lib/libc.so", typeflag: tar.TypeSymlink, linkname: "libc.so.6"},
+				{name: "lib64", typeflag: tar.TypeSymlink, linkname: "lib"},
+				{name: "usr/libc.so", typeflag: tar.TypeSymlink, linkname: "../lib64/libc.so"},
+			},
+			symlinkMode: CppSymlinkModeInline,
+			want: []generatedFile{
+				{name: "cc/lib/libc.so.6", contents: []byte("libc"), executable: true},
+				{name: "cc/lib/libc.so", contents: []byte("libc"), executable: true},
+				{name: "cc/lib64/libc.so.6", contents: []byte("libc"), executable: true},
+				{name: "cc/lib64/libc.so", contents: []byte("libc"), executable: true},
+				{name: "cc/usr/libc.so", contents: []byte("libc"), executable: true},
+			},
+		},
+		{
+			name:    "AbsolutePath",
+			entries: []tarEntry{{name: "/etc/passwd", typeflag: tar.TypeReg, contents: "root"}},
+			wantErr: "absolute path",
+		},
+		{
+			name:    "WindowsAbsolutePath",
+			entries: []tarEntry{{name: `C:\Windows\win.ini`, typeflag: tar.TypeReg, contents: "ini"}},
+			wantErr: "absolute path",
+		},
+		{
+			name:    "EscapingPath",
+			entries: []tarEntry{{name: "../../etc/passwd", typeflag: tar.TypeReg, contents: "root"}},
+			wantErr: "outside the root of the tarball",
+		},
+		{
+			name:    "EscapingCleanedPath",
+			entries: []tarEntry{{name: "cc/../../etc/passwd", typeflag: tar.TypeReg, contents: "root"}},
+			wantErr: "outside the root of the tarball",
+		},
+		{
+			name:    "EscapingWindowsPath",
+			entries: []tarEntry{{name: `cc\..\..\etc\passwd`, typeflag: tar.TypeReg, contents: "root"}},
+			wantErr: "outside the root of the tarball",
+		},
+		{
+			name:    "AbsoluteSymlink",
+			entries: []tarEntry{{name: "cc_wrapper.sh", typeflag: tar.TypeSymlink, linkname: "/usr/bin/gcc"}},
+			wantErr: "outside the root of the tarball",
+		},
+		{
+			name:    "EscapingSymlink",
+			entries: []tarEntry{{name: "tools/gcc", typeflag: tar.TypeSymlink, linkname: "../../usr/bin/gcc"}},
+			wantErr: "outside the root of the tarball",
+		},
+		{
+			name: "EscapingSymlinkThroughSymlink",
+			entries: []tarEntry{
+				{name: "b", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "q", typeflag: tar.TypeSymlink, linkname: "b/.."},
+			},
+			symlinkMode: CppSymlinkModePreserve,
+			wantErr:     "outside the root of the tarball",
+		},
+		{
+			name: "EscapingSymlinkThroughNestedSymlink",
+			entries: []tarEntry{
+				{name: "include/stdio.h", typeflag: tar.TypeReg, contents: "stdio"},
+				{name: "tools/include", typeflag: tar.TypeSymlink, linkname: "../include"},
+				{name: "tools/gcc", typeflag: tar.TypeSymlink, linkname: "include/../../usr/bin/gcc"},
+			},
+			symlinkMode: CppSymlinkModePreserve,
+			wantErr:     "outside the root of the tarball",
+		},
+		{
+			name: "EntryUnderSymlink",
+			entries: []tarEntry{
+				{name: "lib", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "lib/passwd", typeflag: tar.TypeSymlink, linkname: "../etc/passwd"},
+			},
+			wantErr: "under the symlink",
+		},
+		{
+			name:    "EscapingHardLink",
+			entries: []tarEntry{{name: "passwd", typeflag: tar.TypeLink, linkname: "../etc/passwd"}},
+			wantErr: "outside the root of the tarball",
+		},
+		{
+			name:    "UnknownHardLink",
+			entries: []tarEntry{{name: "passwd", typeflag: tar.TypeLink, linkname: "etc/passwd"}},
+			wantErr: "isn't a preceding regular file",
+		},
+		{
+			name:    "UnexpectedType",
+			entries: []tarEntry{{name: "fifo", typeflag: tar.TypeFifo}},
+			wantErr: "unexpected entry",
+		},
+		{
+			name:        "InlineDanglingSymlink",
+			entries:     []tarEntry{{name: "cc_wrapper.sh", typeflag: tar.TypeSymlink, linkname: "missing.sh"}},
+			symlinkMode: CppSymlinkModeInline,
+			wantErr:     "doesn't exist in the tarball",
+		},
+		{
+			name: "InlineSymlinkLoop",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "b"},
+				{name: "b", typeflag: tar.TypeSymlink, linkname: "a"},
+			},
+			symlinkMode: CppSymlinkModeInline,
+			wantErr:     "too many levels of symlinks",
+		},
+		{
+			name: "InlineDirSymlinkLoop",
+			entries: []tarEntry{
+				{name: "include/stdio.h", typeflag: tar.TypeReg, contents: "stdio"},
+				{name: "include/parent", typeflag: tar.TypeSymlink, linkname: ".."},
+			},
+			symlinkMode: CppSymlinkModeInline,
+			wantErr:     "which contains it",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := path.Join(t.TempDir(), "cpp_configs.tar")
+			if err := ioutil.WriteFile(p, makeTarball(t, tc.entries), 0644); err != nil {
+				t.Fatalf("Unable to write the C++ configs tarball: %v", err)
+			}
+			got, err := readCppConfigsTarball(p, "cc", tc.symlinkMode)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("readCppConfigsTarball got error %v, want an error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readCppConfigsTarball failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readCppConfigsTarball got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
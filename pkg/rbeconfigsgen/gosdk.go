@@ -0,0 +1,155 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+)
+
+const (
+	// goProbeScript prints the path of the go binary in the PATH of the toolchain container or in
+	// a well known installation directory followed by the GOROOT, GOVERSION, GOOS & GOARCH it
+	// reports, one per line.
+	goProbeScript = `for g in "$(command -v go)" /usr/local/go/bin/go /usr/lib/go/bin/go; do
+  if [ -x "$g" ]; then
+    echo "$g"
+    "$g" env GOROOT GOVERSION GOOS GOARCH
+    exit 0
+  fi
+done`
+)
+
+var (
+	// goBuildTemplate is the template for the BUILD file of the package with the Go SDK
+	// definition.
+	goBuildTemplate = template.Must(template.New("goBuild").Parse(buildHeader + `
+package(default_visibility = ["//visibility:public"])
+
+exports_files(["sdk.bzl"])
+`))
+
+	// goSDKTemplate is the template for the .bzl file declaring the Go SDK installed in the
+	// toolchain container with rules_go.
+	goSDKTemplate = template.Must(template.New("goSDK").Parse(buildHeader + `
+"""Go SDK {{ .Version }} installed in the toolchain container at {{ .GOROOT }}."""
+
+load("@io_bazel_rules_go//go:deps.bzl", "go_local_sdk", "go_register_toolchains")
+
+GO_SDK_PATH = "{{ .GOROOT }}"
+GO_VERSION = "{{ .Version }}"
+GOOS = "{{ .GOOS }}"
+GOARCH = "{{ .GOARCH }}"
+
+def rbe_go_sdk(name = "go_sdk", **kwargs):
+    """Declares the Go SDK installed in the toolchain container & registers its toolchains.
+
+    rules_go reads the files of the SDK at GO_SDK_PATH on the machine running Bazel & sends them as
+    inputs of remote actions which run them in the toolchain container. Bazel has to run where the
+    SDK of the toolchain container is installed at GO_SDK_PATH, e.g., in the toolchain container.
+
+    Args:
+        name: The name of the Go SDK repository.
+        **kwargs: Additional arguments passed to go_local_sdk.
+    """
+    go_local_sdk(name = name, path = GO_SDK_PATH, **kwargs)
+    go_register_toolchains()
+`))
+)
+
+// goSDK is a Go SDK installed in the toolchain container.
+type goSDK struct {
+	// GoBinary is the path of the go binary of the SDK.
+	GoBinary string
+	GOROOT   string
+	// Version is the Go version of the SDK without the "go" prefix, e.g., 1.21.5.
+	Version string
+	GOOS    string
+	GOARCH  string
+}
+
+// parseGoSDK returns the Go SDK in the given output of goProbeScript.
+func parseGoSDK(out string) (*goSDK, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 5 {
+		return nil, fmt.Errorf("no Go SDK was found in the toolchain container")
+	}
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	sdk := &goSDK{
+		GoBinary: lines[0],
+		GOROOT:   lines[1],
+		Version:  strings.TrimPrefix(lines[2], "go"),
+		GOOS:     lines[3],
+		GOARCH:   lines[4],
+	}
+	if sdk.GOROOT == "" {
+		return nil, fmt.Errorf("%s didn't report its GOROOT", sdk.GoBinary)
+	}
+	if !strings.HasPrefix(lines[2], "go") {
+		return nil, fmt.Errorf("unable to determine the version of the Go SDK at %q from GOVERSION %q, Go 1.16 or newer is required", sdk.GOROOT, lines[2])
+	}
+	return sdk, nil
+}
+
+// goGenerator generates the Go configs in the go directory, i.e., a .bzl file declaring the Go SDK
+// installed in the toolchain container with rules_go along with constants describing the SDK.
+// rules_go declares the Go toolchains in the repository of the SDK, so the SDK has to be declared
+// in the WORKSPACE file instead of being registered with flags.
+type goGenerator struct{}
+
+func (goGenerator) name() string {
+	return "go"
+}
+
+func (goGenerator) enabled(o *Options) bool {
+	return o.GenGoConfigs
+}
+
+func (goGenerator) generate(d *dockerRunner, o *Options) (*languageConfigs, error) {
+	out, err := d.execCmd("sh", "-c", goProbeScript)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look for the Go SDK in the toolchain container: %w", err)
+	}
+	sdk, err := parseGoSDK(out)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Found Go SDK %s at %q.", sdk.Version, sdk.GOROOT)
+	lc := &languageConfigs{
+		manifest: map[string]string{
+			"goroot":  sdk.GOROOT,
+			"version": sdk.Version,
+			"goos":    sdk.GOOS,
+			"goarch":  sdk.GOARCH,
+		},
+	}
+	files, err := executeLanguageTemplates([]languageTemplate{
+		{name: "go/BUILD", tmpl: goBuildTemplate},
+		{name: "go/sdk.bzl", tmpl: goSDKTemplate},
+	}, sdk)
+	if err != nil {
+		return nil, err
+	}
+	lc.files = files
+	return lc, nil
+}
+
+func (goGenerator) bazelrc(o *Options) (*bazelrcSection, error) {
+	return nil, nil
+}
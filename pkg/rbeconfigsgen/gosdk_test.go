@@ -0,0 +1,115 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseGoSDK(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    goSDK
+		wantErr bool
+	}{
+		{
+			name: "Found",
+			out:  "/usr/local/go/bin/go\n/usr/local/go\ngo1.21.5\nlinux\namd64\n",
+			want: goSDK{GoBinary: "/usr/local/go/bin/go", GOROOT: "/usr/local/go", Version: "1.21.5", GOOS: "linux", GOARCH: "amd64"},
+		},
+		{
+			name:    "NotFound",
+			out:     "",
+			wantErr: true,
+		},
+		{
+			name:    "NoGOVERSION",
+			out:     "/usr/lib/go/bin/go\n/usr/lib/go\n\nlinux\namd64",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseGoSDK(tc.out)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseGoSDK(%q)=%+v, want error", tc.out, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseGoSDK(%q) failed: %v", tc.out, err)
+			}
+			if *got != tc.want {
+				t.Errorf("parseGoSDK(%q)=%+v, want %+v", tc.out, *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunWithGoConfigs(t *testing.T) {
+	dir := t.TempDir()
+	rt := &fakeRuntime{
+		image: "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:   []string{"PATH=/bin"},
+		goSDK: []string{"/usr/local/go/bin/go", "/usr/local/go", "go1.21.5", "linux", "amd64"},
+	}
+	o := Options{
+		BazelVersion:       "6.0.0",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      path.Join(dir, "configs.tar"),
+		OutputManifest:     path.Join(dir, "manifest.json"),
+		GenGoConfigs:       true,
+		TempWorkDir:        t.TempDir(),
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	files := readTarball(t, o.OutputTarball)
+	for _, want := range []string{
+		"GO_SDK_PATH = \"/usr/local/go\"\nGO_VERSION = \"1.21.5\"\nGOOS = \"linux\"\nGOARCH = \"amd64\"\n",
+		"    go_local_sdk(name = name, path = GO_SDK_PATH, **kwargs)\n",
+	} {
+		if !strings.Contains(files["go/sdk.bzl"], want) {
+			t.Errorf("go/sdk.bzl did not contain %q, got:\n%s", want, files["go/sdk.bzl"])
+		}
+	}
+	if _, ok := files["go/BUILD"]; !ok {
+		t.Errorf("Output tarball did not contain go/BUILD")
+	}
+	for _, name := range []string{"java/BUILD", "cc/BUILD"} {
+		if _, ok := files[name]; ok {
+			t.Errorf("Output tarball contained %s even though only Go config generation was enabled", name)
+		}
+	}
+	m, err := ManifestFromJSONFile(o.OutputManifest)
+	if err != nil {
+		t.Fatalf("ManifestFromJSONFile failed: %v", err)
+	}
+	if got := m.Toolchains["go"]["version"]; got != "1.21.5" {
+		t.Errorf("Manifest got Go version %q, want 1.21.5", got)
+	}
+}
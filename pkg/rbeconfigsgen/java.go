@@ -0,0 +1,541 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// javaRuntimeName is the name of the Java runtime target generated when a single JDK is
+	// installed in the toolchain container.
+	javaRuntimeName = "rbe_jdk"
+)
+
+var (
+	// legacyJavaBuildTemplate is the Java toolchain config BUILD file template for Bazel versions
+	// <5.0.0 (tentative?). Only the default JDK is used because java_runtime isn't registered as a
+	// toolchain for a specific Java version.
+	legacyJavaBuildTemplate = template.Must(template.New("javaBuild").Parse(buildHeader + `
+package(default_visibility = ["//visibility:public"])
+
+java_runtime(
+    name = "jdk",
+    srcs = [],
+    java_home = "{{ .JavaHome }}",
+)
+`))
+
+	// javaBuildTemplateLt7 is the Java toolchain config BUILD file template for Bazel versions
+	// >=5.0.0 (tentative?) and < 7.0.0.
+	javaBuildTemplateLt7 = template.Must(template.New("javaBuild").Parse(buildHeader + `
+load("@bazel_tools//tools/jdk:local_java_repository.bzl", "local_java_runtime")
+{{ if .Toolchains }}load("@bazel_tools//tools/jdk:default_java_toolchain.bzl", "DEFAULT_TOOLCHAIN_CONFIGURATION", "default_java_toolchain")
+{{ end }}
+package(default_visibility = ["//visibility:public"])
+
+alias(
+    name = "jdk",
+    actual = "{{ .DefaultRuntime }}",
+)
+{{ range .Runtimes }}
+local_java_runtime(
+    name = "{{ .Name }}",
+    java_home = "{{ .JavaHome }}",
+    version = "{{ .JavaVersion }}",
+)
+{{ end }}{{ if .Toolchains }}{{ range .Runtimes }}
+default_java_toolchain(
+    name = "{{ .Name }}_toolchain",
+    configuration = DEFAULT_TOOLCHAIN_CONFIGURATION,
+    java_runtime = ":{{ .Name }}",
+    source_version = "{{ .LanguageVersion }}",
+    target_version = "{{ .LanguageVersion }}",
+    toolchain_definition = False,
+)
+
+config_setting(
+    name = "{{ .Name }}_toolchain_version_setting",
+    values = {"java_language_version": "{{ .LanguageVersion }}"},
+)
+
+toolchain(
+    name = "{{ .Name }}_toolchain_definition",
+    exec_compatible_with = [
+{{ range $.ExecConstraints }}        "{{ . }}",
+{{ end }}    ],
+    target_compatible_with = [
+{{ range $.TargetConstraints }}        "{{ . }}",
+{{ end }}    ],
+    target_settings = [":{{ .Name }}_toolchain_version_setting"],
+    toolchain = ":{{ .Name }}_toolchain",
+    toolchain_type = "@bazel_tools//tools/jdk:toolchain_type",
+)
+{{ end }}{{ end }}`))
+
+	// javaBuildTemplate is the Java toolchain config BUILD file template for Bazel versions
+	// >=7.0.0 (including pre-releases).
+	// The difference between the older template is directly referencing to @rules_java
+	// instead of the indirection via @bazel_tools
+	javaBuildTemplate = template.Must(template.New("javaBuild").Parse(buildHeader + `
+load("@rules_java//toolchains:local_java_repository.bzl", "local_java_runtime")
+{{ if .Toolchains }}load("@rules_java//toolchains:default_java_toolchain.bzl", "DEFAULT_TOOLCHAIN_CONFIGURATION", "default_java_toolchain")
+{{ end }}
+package(default_visibility = ["//visibility:public"])
+
+alias(
+    name = "jdk",
+    actual = "{{ .DefaultRuntime }}",
+)
+{{ range .Runtimes }}
+local_java_runtime(
+    name = "{{ .Name }}",
+    java_home = "{{ .JavaHome }}",
+    version = "{{ .JavaVersion }}",
+)
+{{ end }}{{ if .Toolchains }}{{ range .Runtimes }}
+default_java_toolchain(
+    name = "{{ .Name }}_toolchain",
+    configuration = DEFAULT_TOOLCHAIN_CONFIGURATION,
+    java_runtime = ":{{ .Name }}",
+    source_version = "{{ .LanguageVersion }}",
+    target_version = "{{ .LanguageVersion }}",
+    toolchain_definition = False,
+)
+
+config_setting(
+    name = "{{ .Name }}_toolchain_version_setting",
+    values = {"java_language_version": "{{ .LanguageVersion }}"},
+)
+
+toolchain(
+    name = "{{ .Name }}_toolchain_definition",
+    exec_compatible_with = [
+{{ range $.ExecConstraints }}        "{{ . }}",
+{{ end }}    ],
+    target_compatible_with = [
+{{ range $.TargetConstraints }}        "{{ . }}",
+{{ end }}    ],
+    target_settings = [":{{ .Name }}_toolchain_version_setting"],
+    toolchain = ":{{ .Name }}_toolchain",
+    toolchain_type = "@bazel_tools//tools/jdk:toolchain_type",
+)
+{{ end }}{{ end }}`))
+
+	// javaHomeGlobRegexp matches the glob patterns of JDK installation directories that can be
+	// expanded by a shell in the toolchain container without any quoting.
+	javaHomeGlobRegexp = regexp.MustCompile(`^/[A-Za-z0-9._+/*?\[\]-]*$`)
+	// javaMajorVersionRegexp extracts the major version from a Java version, e.g., 8 from 1.8.0_292
+	// or 17 from 17.0.2.
+	javaMajorVersionRegexp = regexp.MustCompile(`^(?:1\.)?([0-9]+)`)
+)
+
+// javaGenerator generates the Java configs in the java directory, i.e., a Java runtime for every
+// JDK installed in the toolchain container & optionally a Java toolchain for every runtime.
+type javaGenerator struct{}
+
+func (javaGenerator) name() string {
+	return "java"
+}
+
+func (javaGenerator) enabled(o *Options) bool {
+	return o.GenJavaConfigs
+}
+
+func (javaGenerator) generate(d *dockerRunner, o *Options) (*languageConfigs, error) {
+	javaBuild, err := genJavaConfigs(d, o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract information about the installed JDK version in the toolchain container needed to generate Java configs: %w", err)
+	}
+	lc := &languageConfigs{files: []generatedFile{javaBuild}}
+	if r := o.defaultJavaRuntime; r != nil {
+		lc.manifest = map[string]string{
+			"default_runtime": r.Name,
+			"java_home":       r.JavaHome,
+			"java_version":    r.JavaVersion,
+		}
+	}
+	return lc, nil
+}
+
+func (javaGenerator) bazelrc(o *Options) (*bazelrcSection, error) {
+	s := &bazelrcSection{Title: "Java toolchain configuration"}
+	u, err := usesLocalJavaRuntime(o)
+	if err != nil {
+		return nil, err
+	}
+	if !u {
+		javaBase := configLabel(o, "java", "jdk")
+		s.Flags = []string{
+			"--host_javabase=" + javaBase,
+			"--javabase=" + javaBase,
+			"--host_java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8",
+			"--java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8",
+		}
+		return s, nil
+	}
+	runtime := javaRuntimeForOptions(o)
+	s.Flags = []string{
+		"--java_runtime_version=" + runtime,
+		"--tool_java_runtime_version=" + runtime,
+	}
+	if o.GenJavaToolchains && o.defaultJavaRuntime != nil {
+		v := o.defaultJavaRuntime.LanguageVersion
+		s.Flags = append(s.Flags, "--java_language_version="+v, "--tool_java_language_version="+v)
+	}
+	if o.OutputMode != OutputModeBzlmod {
+		s.Flags = append(s.Flags, "--extra_toolchains="+configLabel(o, "java", "all"))
+	}
+	return s, nil
+}
+
+// javaBuildTemplateParams is used as the input to the Java toolchains BUILD file template.
+type javaBuildTemplateParams struct {
+	// JavaHome & JavaVersion are the ones of the default JDK.
+	JavaHome    string
+	JavaVersion string
+	// Runtimes are all the JDKs installed in the toolchain container.
+	Runtimes []javaRuntime
+	// DefaultRuntime is the name of the runtime the jdk alias points to.
+	DefaultRuntime string
+	// Toolchains determines whether a Java toolchain is generated for every runtime. The
+	// toolchains are registered for the given exec & target constraints.
+	Toolchains        bool
+	ExecConstraints   []string
+	TargetConstraints []string
+}
+
+// javaRuntime is a JDK installed in the toolchain container.
+type javaRuntime struct {
+	// Name is the name of the Java runtime target generated for the JDK.
+	Name        string
+	JavaHome    string
+	JavaVersion string
+	// LanguageVersion is the Java major version of the JDK, e.g., 17. It's the source & target
+	// version of the Java toolchain generated for the JDK.
+	LanguageVersion string
+}
+
+// javaRuntimeForOptions returns the name of the default Java runtime generated for the given
+// options, i.e., the runtime selected with --java_runtime_version.
+func javaRuntimeForOptions(o *Options) string {
+	if o.defaultJavaRuntime != nil {
+		return o.defaultJavaRuntime.Name
+	}
+	return javaRuntimeName
+}
+
+// validateJavaHomeGlob verifies the given glob pattern of JDK installation directories is an
+// absolute path without characters that would need to be quoted in a shell.
+func validateJavaHomeGlob(glob string) error {
+	if !javaHomeGlobRegexp.MatchString(glob) {
+		return fmt.Errorf("%q must be an absolute path matching %s", glob, javaHomeGlobRegexp)
+	}
+	return nil
+}
+
+// javaMajorVersion returns the major version of the given Java version.
+func javaMajorVersion(javaVersion string) (int, error) {
+	m := javaMajorVersionRegexp.FindStringSubmatch(javaVersion)
+	if m == nil {
+		return 0, fmt.Errorf("unable to determine the major version of Java version %q", javaVersion)
+	}
+	v, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, fmt.Errorf("unable to determine the major version of Java version %q: %w", javaVersion, err)
+	}
+	return v, nil
+}
+
+// findJavaHomes returns the JDK installation directories in the toolchain container, i.e., the
+// given JAVA_HOME of the toolchain image if it's not blank followed by the directories matching
+// the given glob patterns with a bin/java executable. Directories resolving to the same path as
+// an earlier directory, e.g., symlinks to JAVA_HOME, are skipped.
+func findJavaHomes(d *dockerRunner, javaHome string, globs []string) ([]string, error) {
+	var result []string
+	if javaHome != "" {
+		result = append(result, javaHome)
+	}
+	if len(globs) == 0 {
+		return result, nil
+	}
+	for _, g := range globs {
+		if err := validateJavaHomeGlob(g); err != nil {
+			return nil, err
+		}
+	}
+	// The globs are expanded by the shell in the container. Every directory with a java binary
+	// is printed along with the path it resolves to.
+	script := fmt.Sprintf(`for d in "$@" %s; do if [ -x "$d/bin/java" ]; then printf '%%s\t%%s\n' "$d" "$(readlink -f "$d")"; fi; done`, strings.Join(globs, " "))
+	args := []string{"sh", "-c", script, "sh"}
+	if javaHome != "" {
+		args = append(args, javaHome)
+	}
+	out, err := d.execCmd(args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look for JDKs matching %v in the toolchain container: %w", globs, err)
+	}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "\t", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		dir, resolved := kv[0], kv[1]
+		if seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+		// JAVA_HOME is printed first & is already in the result.
+		if dir == javaHome {
+			continue
+		}
+		result = append(result, dir)
+	}
+	return result, nil
+}
+
+// probeJavaVersion returns the Java version reported by the java binary of the JDK installed at
+// the given directory in the toolchain container.
+func probeJavaVersion(d *dockerRunner, javaHome string) (string, error) {
+	javaBin := path.Join(javaHome, "bin/java")
+	// "-XshowSettings:properties" is actually what makes java output the version string we're
+	// looking for in a more deterministic format. "-version" is just a placeholder so that the
+	// command doesn't error out. Although it will likely print the same version string but with
+	// some non-deterministic prefix.
+	r, err := d.execCmdResult(javaBin, "-XshowSettings:properties", "-version")
+	if err != nil {
+		return "", fmt.Errorf("unable to determine the Java version installed at %q in the toolchain container: %w", javaHome, err)
+	}
+	// Java prints the properties to stderr but we look at both stdout & stderr to be safe.
+	out := r.Stdout + "\n" + r.Stderr
+	javaVersion := ""
+	for _, line := range strings.Split(out, "\n") {
+		// We're looking for a line that looks like `java.version = <version>` and we want to
+		// extract <version>.
+		splitVersion := strings.SplitN(line, "=", 2)
+		if len(splitVersion) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(splitVersion[0])
+		val := strings.TrimSpace(splitVersion[1])
+		if key != "java.version" {
+			continue
+		}
+		javaVersion = val
+	}
+	if len(javaVersion) == 0 {
+		return "", fmt.Errorf("unable to determine the java version installed at %q in the container by running 'java -XshowSettings:properties' in the container because it didn't return a line that looked like java.version = <version>", javaHome)
+	}
+	return javaVersion, nil
+}
+
+// javaBuildParams returns the parameters of the Java toolchain BUILD file template for the given
+// JDKs with their JavaHome & JavaVersion set. A single JDK gets the runtime named rbe_jdk & every
+// JDK is named after its major version otherwise, e.g., rbe_jdk_17. JDKs with the same major
+// version as an earlier JDK are skipped. The jdk alias points to the JDK with the given default
+// major version if specified, to the first JDK if preferFirst is set, e.g., because it's the
+// JAVA_HOME of the toolchain image, or to the newest JDK otherwise.
+func javaBuildParams(jdks []javaRuntime, preferFirst bool, defaultVersion string) (*javaBuildTemplateParams, error) {
+	if len(jdks) == 0 {
+		return nil, fmt.Errorf("no JDKs were found")
+	}
+	var runtimes []javaRuntime
+	var majors []int
+	for _, j := range jdks {
+		major, err := javaMajorVersion(j.JavaVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JDK at %q: %w", j.JavaHome, err)
+		}
+		dup := false
+		for i, m := range majors {
+			if m == major {
+				log.Printf("Skipping JDK %q with Java version %q because JDK %q has the same major version.", j.JavaHome, j.JavaVersion, runtimes[i].JavaHome)
+				dup = true
+			}
+		}
+		if dup {
+			continue
+		}
+		j.Name = fmt.Sprintf("%s_%d", javaRuntimeName, major)
+		j.LanguageVersion = strconv.Itoa(major)
+		runtimes = append(runtimes, j)
+		majors = append(majors, major)
+	}
+	def := -1
+	switch {
+	case defaultVersion != "":
+		want, err := strconv.Atoi(defaultVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default Java major version %q: %w", defaultVersion, err)
+		}
+		for i, m := range majors {
+			if m == want {
+				def = i
+			}
+		}
+		if def == -1 {
+			return nil, fmt.Errorf("no JDK with Java major version %d was found, got major versions %v", want, majors)
+		}
+	case preferFirst:
+		def = 0
+	default:
+		def = 0
+		for i, m := range majors {
+			if m > majors[def] {
+				def = i
+			}
+		}
+	}
+	if len(runtimes) == 1 {
+		runtimes[0].Name = javaRuntimeName
+	}
+	return &javaBuildTemplateParams{
+		JavaHome:       runtimes[def].JavaHome,
+		JavaVersion:    runtimes[def].JavaVersion,
+		Runtimes:       runtimes,
+		DefaultRuntime: runtimes[def].Name,
+	}, nil
+}
+
+// UsesLocalJavaRuntime returns whether the given bazel version string uses the local_java_runtime
+// rule for Java toolchains instead of java_runtime.
+// Bazel is expected to switch to local_java_runtime in Bazel 5.0.0. See:
+// https://github.com/bazelbuild/bazel-toolchains/pull/926.
+func UsesLocalJavaRuntime(bazelVersion string) (bool, error) {
+	return localJavaRuntimeVersions.contains(bazelVersion)
+}
+
+// usesLocalJavaRuntime returns whether the Java configs generated for the given options use the
+// local_java_runtime rule either because it was requested or because of the Bazel version.
+func usesLocalJavaRuntime(o *Options) (bool, error) {
+	if o.JavaUseLocalRuntime {
+		return true, nil
+	}
+	u, err := UsesLocalJavaRuntime(o.BazelVersion)
+	if err != nil {
+		return false, fmt.Errorf("unable to determine what Java toolchain rule to use for Bazel %q: %w", o.BazelVersion, err)
+	}
+	return u, nil
+}
+
+// getJavaTemplate returns the template of the Java toolchain config BUILD file for the given
+// options. The override in TemplateDir is used if there's one and the latest template is used if
+// the Bazel version is unspecified. JavaUseLocalRuntime overrides the template picked for Bazel
+// versions using java_runtime with the oldest template using local_java_runtime.
+func getJavaTemplate(o *Options) (*template.Template, error) {
+	if o.TemplateDir != "" {
+		t, err := loadTemplateOverride(o.TemplateDir, javaBuildTemplates)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			return t, nil
+		}
+	}
+	v := o.BazelVersion
+	if o.JavaUseLocalRuntime {
+		u, err := UsesLocalJavaRuntime(v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine what Java toolchain rule to use for Bazel %q: %w", v, err)
+		}
+		if !u {
+			v = localJavaRuntimeVersions.Min
+		}
+	}
+	return javaBuildTemplates.lookup(v)
+}
+
+// genJavaConfigs returns a BUILD file containing a Java runtime rule definition for every JDK
+// installed in the running toolchain container along with a "jdk" alias to the default one. The
+// JDKs are:
+// 1. The one in the JAVA_HOME environment variable set in the toolchain image if any.
+// 2. The ones in the directories matching JavaHomeGlobs with a bin/java executable.
+// The Java version of each JDK is determined by running its java binary inside the running
+// toolchain container.
+func genJavaConfigs(d *dockerRunner, o *Options) (generatedFile, error) {
+	imageEnv, err := d.getEnv()
+	if err != nil {
+		return generatedFile{}, fmt.Errorf("unable to get the environment of the toolchain image to determine JAVA_HOME: %w", err)
+	}
+	javaHome, ok := imageEnv["JAVA_HOME"]
+	if !ok && len(o.JavaHomeGlobs) == 0 {
+		return generatedFile{}, fmt.Errorf("toolchain image didn't specify environment value JAVA_HOME")
+	}
+	if ok && len(javaHome) == 0 && len(o.JavaHomeGlobs) == 0 {
+		return generatedFile{}, fmt.Errorf("the value of the JAVA_HOME environment variable was blank in the toolchain image")
+	}
+	log.Printf("JAVA_HOME was %q.", javaHome)
+	homes, err := findJavaHomes(d, javaHome, o.JavaHomeGlobs)
+	if err != nil {
+		return generatedFile{}, err
+	}
+	if len(homes) == 0 {
+		return generatedFile{}, fmt.Errorf("toolchain image didn't specify environment value JAVA_HOME and no JDK matching %v was found in the toolchain container", o.JavaHomeGlobs)
+	}
+	var jdks []javaRuntime
+	for _, h := range homes {
+		v, err := probeJavaVersion(d, h)
+		if err != nil {
+			return generatedFile{}, err
+		}
+		log.Printf("Found JDK %q with Java version '%s'.", h, v)
+		jdks = append(jdks, javaRuntime{JavaHome: h, JavaVersion: v})
+	}
+	params, err := javaBuildParams(jdks, javaHome != "", o.JavaDefaultVersion)
+	if err != nil {
+		return generatedFile{}, fmt.Errorf("unable to determine the Java runtimes to generate: %w", err)
+	}
+	log.Printf("Default Java runtime: %s (Java version '%s').", params.DefaultRuntime, params.JavaVersion)
+	for i := range params.Runtimes {
+		if params.Runtimes[i].Name == params.DefaultRuntime {
+			o.defaultJavaRuntime = &params.Runtimes[i]
+		}
+	}
+	if o.GenJavaToolchains {
+		u, err := usesLocalJavaRuntime(o)
+		if err != nil {
+			return generatedFile{}, err
+		}
+		if u {
+			params.Toolchains = true
+			params.ExecConstraints = o.PlatformParams.ExecConstraints
+			params.TargetConstraints = o.PlatformParams.TargetConstraints
+		} else {
+			log.Printf("Warning: Not generating Java toolchains because Bazel %q uses the java_runtime rule & Bazel's toolchain_hostjdk8. Java toolchains are only generated for Bazel %v or with JavaUseLocalRuntime.", o.BazelVersion, localJavaRuntimeVersions)
+		}
+	}
+
+	t, err := getJavaTemplate(o)
+	if err != nil {
+		return generatedFile{}, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := t.Execute(buf, params); err != nil {
+		return generatedFile{}, fmt.Errorf("failed to generate the contents of the BUILD file with the Java toolchain definition: %w", err)
+	}
+	return generatedFile{
+		name:     "java/BUILD",
+		contents: buf.Bytes(),
+	}, nil
+}
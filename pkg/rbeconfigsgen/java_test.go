@@ -0,0 +1,282 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestJavaMajorVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    int
+		wantErr bool
+	}{
+		{version: "1.8.0_292", want: 8},
+		{version: "11.0.10", want: 11},
+		{version: "17", want: 17},
+		{version: "21-ea", want: 21},
+		{version: "", wantErr: true},
+		{version: "openjdk", wantErr: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.version, func(t *testing.T) {
+			t.Parallel()
+			got, err := javaMajorVersion(tc.version)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("javaMajorVersion(%q) got error %v, want error=%v", tc.version, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("javaMajorVersion(%q)=%d, want %d", tc.version, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJavaBuildParams(t *testing.T) {
+	jdk11 := javaRuntime{JavaHome: "/usr/lib/jvm/java-11", JavaVersion: "11.0.2"}
+	jdk17 := javaRuntime{JavaHome: "/usr/lib/jvm/java-17", JavaVersion: "17.0.1"}
+	jdk21 := javaRuntime{JavaHome: "/usr/lib/jvm/java-21", JavaVersion: "21"}
+	tests := []struct {
+		name           string
+		jdks           []javaRuntime
+		preferFirst    bool
+		defaultVersion string
+		wantNames      []string
+		wantDefault    string
+		wantJavaHome   string
+		wantErr        bool
+	}{
+		{
+			name:         "SingleJDK",
+			jdks:         []javaRuntime{jdk11},
+			preferFirst:  true,
+			wantNames:    []string{"rbe_jdk"},
+			wantDefault:  "rbe_jdk",
+			wantJavaHome: jdk11.JavaHome,
+		},
+		{
+			name:         "JavaHomeIsDefault",
+			jdks:         []javaRuntime{jdk17, jdk11, jdk21},
+			preferFirst:  true,
+			wantNames:    []string{"rbe_jdk_17", "rbe_jdk_11", "rbe_jdk_21"},
+			wantDefault:  "rbe_jdk_17",
+			wantJavaHome: jdk17.JavaHome,
+		},
+		{
+			name:         "NewestIsDefault",
+			jdks:         []javaRuntime{jdk11, jdk21, jdk17},
+			wantNames:    []string{"rbe_jdk_11", "rbe_jdk_21", "rbe_jdk_17"},
+			wantDefault:  "rbe_jdk_21",
+			wantJavaHome: jdk21.JavaHome,
+		},
+		{
+			name:           "ExplicitDefault",
+			jdks:           []javaRuntime{jdk17, jdk11, jdk21},
+			preferFirst:    true,
+			defaultVersion: "11",
+			wantNames:      []string{"rbe_jdk_17", "rbe_jdk_11", "rbe_jdk_21"},
+			wantDefault:    "rbe_jdk_11",
+			wantJavaHome:   jdk11.JavaHome,
+		},
+		{
+			name:         "SameMajorVersionSkipped",
+			jdks:         []javaRuntime{jdk11, {JavaHome: "/opt/jdk-11.0.5", JavaVersion: "11.0.5"}},
+			preferFirst:  true,
+			wantNames:    []string{"rbe_jdk"},
+			wantDefault:  "rbe_jdk",
+			wantJavaHome: jdk11.JavaHome,
+		},
+		{
+			name:           "MissingDefault",
+			jdks:           []javaRuntime{jdk11, jdk17},
+			defaultVersion: "8",
+			wantErr:        true,
+		},
+		{
+			name:    "NoJDKs",
+			wantErr: true,
+		},
+		{
+			name:    "InvalidVersion",
+			jdks:    []javaRuntime{{JavaHome: "/jdk", JavaVersion: "unknown"}},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := javaBuildParams(tc.jdks, tc.preferFirst, tc.defaultVersion)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("javaBuildParams(%v) succeeded, want error", tc.jdks)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("javaBuildParams(%v) failed: %v", tc.jdks, err)
+			}
+			var names []string
+			for _, r := range got.Runtimes {
+				names = append(names, r.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tc.wantNames, ",") {
+				t.Errorf("javaBuildParams(%v) got runtimes %v, want %v", tc.jdks, names, tc.wantNames)
+			}
+			if got.DefaultRuntime != tc.wantDefault {
+				t.Errorf("javaBuildParams(%v) got default runtime %q, want %q", tc.jdks, got.DefaultRuntime, tc.wantDefault)
+			}
+			if got.JavaHome != tc.wantJavaHome {
+				t.Errorf("javaBuildParams(%v) got JavaHome %q, want %q", tc.jdks, got.JavaHome, tc.wantJavaHome)
+			}
+		})
+	}
+}
+
+func TestRunWithMultipleJDKs(t *testing.T) {
+	dir := t.TempDir()
+	rt := &fakeRuntime{
+		image:       "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:         []string{"PATH=/bin", "JAVA_HOME=/usr/lib/jvm/java-17"},
+		javaVersion: "17.0.2",
+		javaHomes: map[string]string{
+			"/usr/lib/jvm/java-11": "11.0.14",
+			"/usr/lib/jvm/java-21": "21.0.1",
+		},
+	}
+	o := Options{
+		BazelVersion:       "7.0.0",
+		BazelPath:          "/usr/bin/bazel",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      path.Join(dir, "configs.tar"),
+		GenJavaConfigs:     true,
+		JavaHomeGlobs:      []string{"/usr/lib/jvm/*"},
+		TempWorkDir:        t.TempDir(),
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	files := readTarball(t, o.OutputTarball)
+	got := files["java/BUILD"]
+	for _, want := range []string{
+		"    actual = \"rbe_jdk_17\",\n",
+		"    name = \"rbe_jdk_11\",\n    java_home = \"/usr/lib/jvm/java-11\",\n    version = \"11.0.14\",\n",
+		"    name = \"rbe_jdk_17\",\n    java_home = \"/usr/lib/jvm/java-17\",\n    version = \"17.0.2\",\n",
+		"    name = \"rbe_jdk_21\",\n    java_home = \"/usr/lib/jvm/java-21\",\n    version = \"21.0.1\",\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("java/BUILD did not contain %q, got:\n%s", want, got)
+		}
+	}
+	if want := "build:remote --java_runtime_version=rbe_jdk_17\n"; !strings.Contains(files["configs.bazelrc"], want) {
+		t.Errorf("configs.bazelrc did not contain %q, got:\n%s", want, files["configs.bazelrc"])
+	}
+}
+
+func TestRunWithJavaToolchains(t *testing.T) {
+	dir := t.TempDir()
+	rt := &fakeRuntime{
+		image:       "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:         []string{"PATH=/bin", "JAVA_HOME=/usr/lib/jvm/java-17"},
+		javaVersion: "17.0.2",
+		javaHomes: map[string]string{
+			"/usr/lib/jvm/java-11": "11.0.14",
+		},
+	}
+	o := Options{
+		BazelVersion:       "7.0.0",
+		BazelPath:          "/usr/bin/bazel",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      path.Join(dir, "configs.tar"),
+		GenJavaConfigs:     true,
+		GenJavaToolchains:  true,
+		JavaHomeGlobs:      []string{"/usr/lib/jvm/*"},
+		TempWorkDir:        t.TempDir(),
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	files := readTarball(t, o.OutputTarball)
+	for _, want := range []string{
+		"load(\"@rules_java//toolchains:default_java_toolchain.bzl\", \"DEFAULT_TOOLCHAIN_CONFIGURATION\", \"default_java_toolchain\")\n",
+		"    name = \"rbe_jdk_11_toolchain\",\n    configuration = DEFAULT_TOOLCHAIN_CONFIGURATION,\n    java_runtime = \":rbe_jdk_11\",\n    source_version = \"11\",\n    target_version = \"11\",\n",
+		"    values = {\"java_language_version\": \"17\"},\n",
+		"    exec_compatible_with = [\n        \"@platforms//os:linux\",\n        \"@platforms//cpu:x86_64\",\n        \"@bazel_tools//tools/cpp:clang\",\n    ],\n",
+		"    target_compatible_with = [\n        \"@platforms//os:linux\",\n        \"@platforms//cpu:x86_64\",\n    ],\n",
+		"    toolchain = \":rbe_jdk_17_toolchain\",\n    toolchain_type = \"@bazel_tools//tools/jdk:toolchain_type\",\n",
+	} {
+		if !strings.Contains(files["java/BUILD"], want) {
+			t.Errorf("java/BUILD did not contain %q, got:\n%s", want, files["java/BUILD"])
+		}
+	}
+	if want := "build:remote --java_language_version=17\nbuild:remote --tool_java_language_version=17\n"; !strings.Contains(files["configs.bazelrc"], want) {
+		t.Errorf("configs.bazelrc did not contain %q, got:\n%s", want, files["configs.bazelrc"])
+	}
+}
+
+// TestRunWithJavaToolchainsBeforeBazel5 verifies Java toolchains aren't generated for Bazel
+// versions using the java_runtime rule.
+func TestRunWithJavaToolchainsBeforeBazel5(t *testing.T) {
+	dir := t.TempDir()
+	rt := &fakeRuntime{
+		image:       "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:         []string{"PATH=/bin", "JAVA_HOME=/usr/lib/jvm/java-8"},
+		javaVersion: "1.8.0_292",
+	}
+	o := Options{
+		BazelVersion:       "4.2.1",
+		BazelPath:          "/usr/bin/bazel",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      path.Join(dir, "configs.tar"),
+		GenJavaConfigs:     true,
+		GenJavaToolchains:  true,
+		TempWorkDir:        t.TempDir(),
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if err := o.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	files := readTarball(t, o.OutputTarball)
+	if got := files["java/BUILD"]; strings.Contains(got, "default_java_toolchain") || !strings.Contains(got, "java_runtime(\n") {
+		t.Errorf("java/BUILD got:\n%s\nwant a java_runtime without Java toolchains", got)
+	}
+	if want := "build:remote --java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8\n"; !strings.Contains(files["configs.bazelrc"], want) {
+		t.Errorf("configs.bazelrc did not contain %q, got:\n%s", want, files["configs.bazelrc"])
+	}
+}
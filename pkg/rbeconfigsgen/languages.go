@@ -0,0 +1,140 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"text/template"
+)
+
+// languageGenerator generates the toolchain configs of a single language, e.g., the Java configs
+// in the java directory of the generated configs. Every language is implemented in its own file
+// and registered in languageGenerators.
+type languageGenerator interface {
+	// name is the name of the language used in logs and as the key of its entries in the
+	// manifest, e.g., "java".
+	name() string
+	// enabled returns whether configs are generated for the language with the given options.
+	enabled(o *Options) bool
+	// generate detects the toolchain of the language installed in the running toolchain container
+	// and returns the configs generated for it.
+	generate(d *dockerRunner, o *Options) (*languageConfigs, error)
+	// bazelrc returns the section of the .bazelrc fragment with the flags needed to use the configs
+	// generated for the given options or nil if no flags are needed. Unlike generate, it doesn't
+	// need the toolchain container because the flags only reference the generated configs by
+	// label, which allows generating the .bazelrc fragment without generating the configs, e.g.,
+	// for configs generated earlier. Details detected by generate may be used if available.
+	bazelrc(o *Options) (*bazelrcSection, error)
+}
+
+// languageConfigs are the configs generated by a languageGenerator.
+type languageConfigs struct {
+	// language is the name of the languageGenerator that generated the configs.
+	language string
+	// files are the generated files with names relative to the root of the configs, e.g.,
+	// "java/BUILD".
+	files []generatedFile
+	// manifest are the details about the detected toolchain added to the manifest, e.g., the
+	// version of the compiler.
+	manifest map[string]string
+}
+
+// bazelrcSection is a section of the generated .bazelrc fragment with the flags needed to use the
+// configs of a language.
+type bazelrcSection struct {
+	// Title is the title of the section, e.g., "Java toolchain configuration".
+	Title string
+	// Flags are the flags in the section without the "build:remote" prefix.
+	Flags []string
+}
+
+// languageTemplate is the template of a file generated for a language.
+type languageTemplate struct {
+	// name is the name of the generated file relative to the root of the configs.
+	name string
+	tmpl *template.Template
+}
+
+var (
+	// languageGenerators are the generators of the configs of every supported language in the
+	// order the configs are generated & written.
+	languageGenerators = []languageGenerator{
+		cppGenerator{},
+		javaGenerator{},
+		pythonGenerator{},
+		goGenerator{},
+		rustGenerator{},
+	}
+)
+
+// enabledLanguages returns the generators of the languages configs are generated for with the
+// given options.
+func enabledLanguages(o *Options) []languageGenerator {
+	var result []languageGenerator
+	for _, g := range languageGenerators {
+		if g.enabled(o) {
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+// genLanguageConfigs generates the configs of every enabled language in the running toolchain
+// container represented by the given docker runner.
+func genLanguageConfigs(d *dockerRunner, o *Options) ([]*languageConfigs, error) {
+	var result []*languageConfigs
+	for _, g := range enabledLanguages(o) {
+		log.Printf("Generating %s configs.", g.name())
+		lc, err := g.generate(d, o)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate %s configs: %w", g.name(), err)
+		}
+		lc.language = g.name()
+		result = append(result, lc)
+	}
+	return result, nil
+}
+
+// languageBazelrcSections returns the sections of the .bazelrc fragment with the flags needed to
+// use the configs of every enabled language.
+func languageBazelrcSections(o *Options) ([]*bazelrcSection, error) {
+	var result []*bazelrcSection
+	for _, g := range enabledLanguages(o) {
+		s, err := g.bazelrc(o)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine the flags needed to use the %s configs: %w", g.name(), err)
+		}
+		if s != nil {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// executeLanguageTemplates returns the files generated by executing the given templates with the
+// given parameters.
+func executeLanguageTemplates(templates []languageTemplate, params interface{}) ([]generatedFile, error) {
+	var result []generatedFile
+	for _, t := range templates {
+		buf := bytes.NewBuffer(nil)
+		if err := t.tmpl.Execute(buf, params); err != nil {
+			return nil, fmt.Errorf("failed to generate the contents of %s: %w", t.name, err)
+		}
+		result = append(result, generatedFile{name: t.name, contents: buf.Bytes()})
+	}
+	return result, nil
+}
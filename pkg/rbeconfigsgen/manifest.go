@@ -0,0 +1,334 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ManifestSchemaVersion is the version of the schema of the manifests written by this package.
+	// Version 1 manifests didn't specify a schema version and only had the Bazel version, the
+	// toolchain container, the image digest, the exec OS & the configs tarball digest.
+	ManifestSchemaVersion = 2
+
+	// generatorModule is the path of the Go module this package is part of.
+	generatorModule = "github.com/bazelbuild/bazel-toolchains"
+)
+
+var (
+	// GeneratorVersion is the version of the config generator recorded in manifests. It can be set
+	// at link time with -ldflags "-X <package path>.GeneratorVersion=<version>" and defaults to the
+	// version of the Go module this package was built from.
+	GeneratorVersion = ""
+
+	// timeNow returns the current time recorded as the generation time in manifests. Overridden in
+	// tests.
+	timeNow = time.Now
+)
+
+// Manifest contains metadata about the configs generated by this package.
+type Manifest struct {
+	// SchemaVersion is the version of the schema of the manifest. Manifests without a schema
+	// version are read as version 1 manifests.
+	SchemaVersion        int    `json:"schema_version,omitempty"`
+	BazelVersion         string `json:"bazel_version"`
+	ToolchainContainer   string `json:"toolchain_container"`
+	ImageDigest          string `json:"image_digest"`
+	ExecOS               string `json:"exec_os"`
+	ConfigsTarballDigest string `json:"configs_tarball_digest"`
+
+	// The following fields were added in schema version 2.
+	// TargetOS & OSFamily are the target OS & the OSFamily exec property of the generated
+	// platform. Version 1 manifests recorded the OS family as the exec OS.
+	TargetOS string `json:"target_os,omitempty"`
+	OSFamily string `json:"os_family,omitempty"`
+	// ExecConstraints & TargetConstraints are the constraints the generated toolchains are
+	// registered for.
+	ExecConstraints   []string `json:"exec_constraints,omitempty"`
+	TargetConstraints []string `json:"target_constraints,omitempty"`
+	// GeneratorVersion is the version of the config generator that generated the configs.
+	GeneratorVersion string `json:"generator_version,omitempty"`
+	// GeneratedAt is the time the configs were generated in the RFC 3339 format in UTC.
+	GeneratedAt string `json:"generated_at,omitempty"`
+	// Options are the options the configs were generated with.
+	Options *ManifestOptions `json:"options,omitempty"`
+	// Files are the sha256 digests of every generated file sorted by path.
+	Files []ManifestFile `json:"files,omitempty"`
+	// ConfigsTarballFormat is the format of the output tarball with the digest ConfigsTarballDigest,
+	// e.g., "tar.zst". Manifests without a format describe uncompressed tarballs.
+	ConfigsTarballFormat string `json:"configs_tarball_format,omitempty"`
+	// Toolchains maps the name of every language configs were generated for, e.g., "java", to
+	// details about the toolchain detected in the toolchain container, e.g., the "java_version" &
+	// "java_home" of the default JDK or the "compiler_version" of the C++ compiler.
+	Toolchains map[string]map[string]string `json:"toolchains,omitempty"`
+}
+
+// ManifestOptions are the options affecting the contents of the generated configs recorded in a
+// manifest. The keys match the keys of the corresponding fields in a config file.
+type ManifestOptions struct {
+	ExecArch            string            `json:"exec_arch,omitempty"`
+	TargetArch          string            `json:"target_arch,omitempty"`
+	DockerPlatform      string            `json:"docker_platform,omitempty"`
+	ContainerRuntime    string            `json:"container_runtime,omitempty"`
+	BazelPath           string            `json:"bazel_path,omitempty"`
+	OutputMode          string            `json:"output_mode,omitempty"`
+	OutputConfigPath    string            `json:"output_config_path,omitempty"`
+	ConfigsRepoName     string            `json:"configs_repo_name,omitempty"`
+	PlatformParent      string            `json:"platform_parent,omitempty"`
+	ExtraConstraints    []string          `json:"extra_constraint_values,omitempty"`
+	ExecProperties      map[string]string `json:"exec_properties,omitempty"`
+	PlatformVariants    []PlatformVariant `json:"platform_variants,omitempty"`
+	GenCPPConfigs       bool              `json:"generate_cpp_configs"`
+	CppEnv              map[string]string `json:"cpp_env,omitempty"`
+	CppEnvJSON          string            `json:"cpp_env_json,omitempty"`
+	CppToolchainTarget  string            `json:"cpp_toolchain_target,omitempty"`
+	CppConfigMode       string            `json:"cpp_config_mode,omitempty"`
+	CppSymlinkMode      string            `json:"cpp_symlink_mode,omitempty"`
+	CppConfigTargets    []string          `json:"cpp_config_targets,omitempty"`
+	CppConfigRepo       string            `json:"cpp_config_repo,omitempty"`
+	CppBazelCmd         string            `json:"cpp_bazel_cmd,omitempty"`
+	GenJavaConfigs      bool              `json:"generate_java_configs"`
+	JavaUseLocalRuntime bool              `json:"java_use_local_runtime,omitempty"`
+	GenJavaToolchains   bool              `json:"generate_java_toolchains,omitempty"`
+	JavaHomeGlobs       []string          `json:"java_home_globs,omitempty"`
+	JavaDefaultVersion  string            `json:"java_default_version,omitempty"`
+	GenPythonConfigs    bool              `json:"generate_python_configs,omitempty"`
+	GenGoConfigs        bool              `json:"generate_go_configs,omitempty"`
+	GenRustConfigs      bool              `json:"generate_rust_configs,omitempty"`
+	TemplateDir         string            `json:"template_dir,omitempty"`
+}
+
+// ManifestFile is the digest of a generated file recorded in a manifest.
+type ManifestFile struct {
+	// Path is the path of the file relative to the root of the configs, e.g., "java/BUILD".
+	Path string `json:"path"`
+	// SHA256 is the digest of the contents of the file or of the path it points to if the file is
+	// a symlink.
+	SHA256 string `json:"sha256"`
+}
+
+// ToJSONFile writes the given manifest to a JSON file at the given path.
+func (m *Manifest) ToJSONFile(filePath string) error {
+	blob, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return fmt.Errorf("unable to generate JSON for given manifest: %w", err)
+	}
+	if err := ioutil.WriteFile(filePath, blob, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to write the given manifest as JSON to %q: %w", filePath, err)
+	}
+	return nil
+}
+
+// ManifestFromJSONFile reads the manifest from the JSON file at the given path.
+func ManifestFromJSONFile(filePath string) (*Manifest, error) {
+	blob, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the contents of JSON manifest file %q: %w", filePath, err)
+	}
+	m, err := ParseManifest(blob)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the contents of %q as a JSON manifest: %w", filePath, err)
+	}
+	return m, nil
+}
+
+// ParseManifest parses the given JSON manifest of any schema version up to ManifestSchemaVersion.
+// Version 1 manifests are upgraded to the current schema, i.e., the OS family they recorded as
+// the exec OS is moved to OSFamily and the exec OS is derived from it.
+func ParseManifest(blob []byte) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.Unmarshal(blob, m); err != nil {
+		return nil, err
+	}
+	switch {
+	case m.SchemaVersion > ManifestSchemaVersion:
+		return nil, fmt.Errorf("manifest has schema version %d but only versions up to %d are supported", m.SchemaVersion, ManifestSchemaVersion)
+	case m.SchemaVersion < 2:
+		m.SchemaVersion = 1
+		if m.OSFamily == "" {
+			m.OSFamily = m.ExecOS
+		}
+		m.ExecOS = strings.ToLower(m.ExecOS)
+	}
+	return m, nil
+}
+
+// digestFile returns the sha256 digest of the contents of the given file.
+func digestFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to open file %q: %w", filePath, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error while hashing the contents of %q: %w", filePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// manifestFiles returns the digests of the given generated files sorted by path.
+func manifestFiles(files []generatedFile) []ManifestFile {
+	var result []ManifestFile
+	for _, g := range files {
+		d := sha256.Sum256(g.contents)
+		result = append(result, ManifestFile{Path: g.name, SHA256: hex.EncodeToString(d[:])})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+// generatorVersion returns the version of the config generator recorded in manifests, i.e.,
+// GeneratorVersion if set or the version of the Go module this package was built from.
+func generatorVersion() string {
+	if GeneratorVersion != "" {
+		return GeneratorVersion
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if bi.Main.Path == generatorModule {
+		return bi.Main.Version
+	}
+	for _, d := range bi.Deps {
+		if d.Path == generatorModule {
+			return d.Version
+		}
+	}
+	return "unknown"
+}
+
+// newManifestOptions returns the options recorded in the manifest of the configs generated with
+// the given options.
+func newManifestOptions(o *Options) *ManifestOptions {
+	return &ManifestOptions{
+		ExecArch:            o.ExecArch,
+		TargetArch:          o.TargetArch,
+		DockerPlatform:      o.DockerPlatform,
+		ContainerRuntime:    o.ContainerRuntime,
+		BazelPath:           o.BazelPath,
+		OutputMode:          o.OutputMode,
+		OutputConfigPath:    o.OutputConfigPath,
+		ConfigsRepoName:     o.ConfigsRepoName,
+		PlatformParent:      o.PlatformParams.Parent,
+		ExtraConstraints:    o.PlatformParams.ExtraConstraints,
+		ExecProperties:      o.PlatformParams.ExecProperties,
+		PlatformVariants:    o.PlatformParams.Variants,
+		GenCPPConfigs:       o.GenCPPConfigs,
+		CppEnv:              o.CppGenEnv,
+		CppEnvJSON:          o.CppGenEnvJSON,
+		CppToolchainTarget:  o.CPPToolchainTargetName,
+		CppConfigMode:       o.CppConfigMode,
+		CppSymlinkMode:      o.CppSymlinkMode,
+		CppConfigTargets:    o.CPPConfigTargets,
+		CppConfigRepo:       o.CPPConfigRepo,
+		CppBazelCmd:         o.CppBazelCmd,
+		GenJavaConfigs:      o.GenJavaConfigs,
+		JavaUseLocalRuntime: o.JavaUseLocalRuntime,
+		GenJavaToolchains:   o.GenJavaToolchains,
+		JavaHomeGlobs:       o.JavaHomeGlobs,
+		JavaDefaultVersion:  o.JavaDefaultVersion,
+		GenPythonConfigs:    o.GenPythonConfigs,
+		GenGoConfigs:        o.GenGoConfigs,
+		GenRustConfigs:      o.GenRustConfigs,
+		TemplateDir:         o.TemplateDir,
+	}
+}
+
+// newManifest returns the manifest with information about the configs generated for the toolchain
+// container in the given options represented by 'oc'. The digests of the given files, i.e., the
+// generated files that aren't part of 'oc' like the LICENSE, are recorded along with the digests
+// of the configs. The digest of the configs tarball isn't populated.
+func newManifest(o *Options, oc outputConfigs, files ...generatedFile) (*Manifest, error) {
+	m := &Manifest{
+		SchemaVersion:      ManifestSchemaVersion,
+		BazelVersion:       o.BazelVersion,
+		ToolchainContainer: o.ToolchainContainer,
+		ExecOS:             o.ExecOS,
+		TargetOS:           o.TargetOS,
+		OSFamily:           o.PlatformParams.OSFamily,
+		ExecConstraints:    o.PlatformParams.ExecConstraints,
+		TargetConstraints:  o.PlatformParams.TargetConstraints,
+		GeneratorVersion:   generatorVersion(),
+		GeneratedAt:        timeNow().UTC().Format(time.RFC3339),
+		Options:            newManifestOptions(o),
+		Files:              manifestFiles(append(files, oc.configFiles()...)),
+	}
+	// Extract the sha256 digest from the image name to be included in the manifest.
+	s := imageDigestRegexp.FindStringSubmatch(o.PlatformParams.ToolchainContainer)
+	if len(s) != 2 {
+		return nil, fmt.Errorf("failed to extract sha256 digest using regex from image name %q, got %d substrings, want 2", o.PlatformParams.ToolchainContainer, len(s))
+	}
+	m.ImageDigest = s[1]
+	for _, lc := range oc.languages {
+		if len(lc.manifest) == 0 {
+			continue
+		}
+		if m.Toolchains == nil {
+			m.Toolchains = make(map[string]map[string]string)
+		}
+		m.Toolchains[lc.language] = lc.manifest
+	}
+	return m, nil
+}
+
+// createManifest writes a manifest JSON file containing information about the generated configs
+// represented by 'oc' if the given options specified a manifest file.
+func createManifest(o *Options, oc outputConfigs) error {
+	if len(o.OutputManifest) == 0 {
+		return nil
+	}
+	if o.DryRun {
+		log.Printf("Dry run: Not writing manifest %q.", o.OutputManifest)
+		return nil
+	}
+	files := []generatedFile{oc.license}
+	if o.OutputMode == OutputModeBzlmod {
+		files = append(files, oc.module)
+	}
+	m, err := newManifest(o, oc, files...)
+	if err != nil {
+		return err
+	}
+	// Include the sha256 digest of the configs tarball if output tarball generation was enabled by
+	// actually hashing the contents of the output tarball.
+	if len(o.OutputTarball) != 0 {
+		d, err := digestFile(o.OutputTarball)
+		if err != nil {
+			return fmt.Errorf("unable to compute the sha256 digest of the output tarball file for the output manifest: %w", err)
+		}
+		m.ConfigsTarballDigest = d
+		m.ConfigsTarballFormat = o.OutputFormat
+	}
+	if err := m.ToJSONFile(o.OutputManifest); err != nil {
+		return fmt.Errorf("error writing manifest file: %w", err)
+	}
+	log.Printf("Wrote JSON manifest to %q.", o.OutputManifest)
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		blob    string
+		want    Manifest
+		wantErr bool
+	}{
+		{
+			name: "Version1",
+			blob: `{"bazel_version":"4.0.0","toolchain_container":"gcr.io/foo/bar@sha256:abc","image_digest":"abc","exec_os":"Linux","configs_tarball_digest":"def"}`,
+			want: Manifest{
+				SchemaVersion:        1,
+				BazelVersion:         "4.0.0",
+				ToolchainContainer:   "gcr.io/foo/bar@sha256:abc",
+				ImageDigest:          "abc",
+				ExecOS:               "linux",
+				OSFamily:             "Linux",
+				ConfigsTarballDigest: "def",
+			},
+		},
+		{
+			name: "Version2",
+			blob: `{"schema_version":2,"bazel_version":"6.0.0","exec_os":"windows","target_os":"windows","os_family":"Windows","files":[{"path":"BUILD","sha256":"abc"}],"toolchains":{"java":{"java_version":"17"}}}`,
+			want: Manifest{
+				SchemaVersion: 2,
+				BazelVersion:  "6.0.0",
+				ExecOS:        OSWindows,
+				TargetOS:      OSWindows,
+				OSFamily:      "Windows",
+				Files:         []ManifestFile{{Path: "BUILD", SHA256: "abc"}},
+				Toolchains:    map[string]map[string]string{"java": {"java_version": "17"}},
+			},
+		},
+		{
+			name:    "FutureVersion",
+			blob:    `{"schema_version":3}`,
+			wantErr: true,
+		},
+		{
+			name:    "InvalidJSON",
+			blob:    `{`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseManifest([]byte(tc.blob))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("ParseManifest(%s)=%+v, want error", tc.blob, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseManifest(%s) failed: %v", tc.blob, err)
+			}
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("ParseManifest(%s)=%+v, want %+v", tc.blob, *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseCppCompiler(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want map[string]string
+	}{
+		{
+			name: "GCC",
+			out:  "/usr/bin/gcc\ngcc (Debian 12.2.0-14) 12.2.0\n",
+			want: map[string]string{
+				"compiler":         "gcc",
+				"compiler_path":    "/usr/bin/gcc",
+				"compiler_version": "gcc (Debian 12.2.0-14) 12.2.0",
+			},
+		},
+		{
+			name: "Clang",
+			out:  "/usr/bin/clang\nDebian clang version 14.0.6\n",
+			want: map[string]string{
+				"compiler":         "clang",
+				"compiler_path":    "/usr/bin/clang",
+				"compiler_version": "Debian clang version 14.0.6",
+			},
+		},
+		{
+			name: "NotFound",
+			out:  "",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := parseCppCompiler(tc.out); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseCppCompiler(%q)=%v, want %v", tc.out, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunManifest(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 30, 0, 0, time.FixedZone("PDT", -7*60*60))
+	oldTimeNow := timeNow
+	timeNow = func() time.Time { return now }
+	defer func() {
+		timeNow = oldTimeNow
+	}()
+
+	dir := t.TempDir()
+	rt := &fakeRuntime{
+		image: "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:   []string{"PATH=/bin"},
+		goSDK: []string{"/usr/local/go/bin/go", "/usr/local/go", "go1.21.5", "linux", "amd64"},
+	}
+	o := Options{
+		BazelVersion:       "6.0.0",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputSourceRoot:   dir,
+		OutputConfigPath:   "configs",
+		OutputManifest:     path.Join(dir, "manifest.json"),
+		GenGoConfigs:       true,
+		TempWorkDir:        t.TempDir(),
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	m, err := ManifestFromJSONFile(o.OutputManifest)
+	if err != nil {
+		t.Fatalf("ManifestFromJSONFile failed: %v", err)
+	}
+	if m.SchemaVersion != ManifestSchemaVersion {
+		t.Errorf("Manifest got schema version %d, want %d", m.SchemaVersion, ManifestSchemaVersion)
+	}
+	if m.ExecOS != OSLinux || m.TargetOS != OSLinux || m.OSFamily != "Linux" {
+		t.Errorf("Manifest got exec OS %q, target OS %q & OS family %q, want %q, %q & %q", m.ExecOS, m.TargetOS, m.OSFamily, OSLinux, OSLinux, "Linux")
+	}
+	if want := "2021-06-01T19:30:00Z"; m.GeneratedAt != want {
+		t.Errorf("Manifest got generation time %q, want %q", m.GeneratedAt, want)
+	}
+	if m.GeneratorVersion == "" {
+		t.Errorf("Manifest didn't record the generator version")
+	}
+	if m.Options == nil || !m.Options.GenGoConfigs || m.Options.OutputConfigPath != "configs" {
+		t.Errorf("Manifest got options %+v, want the Go config generation & output config path options", m.Options)
+	}
+	want := []string{"LICENSE", "config/BUILD", "configs.bazelrc", "go/BUILD", "go/sdk.bzl"}
+	var got []string
+	for _, f := range m.Files {
+		got = append(got, f.Path)
+		contents, err := ioutil.ReadFile(path.Join(dir, "configs", f.Path))
+		if err != nil {
+			t.Fatalf("Unable to read %s listed in the manifest: %v", f.Path, err)
+		}
+		d := sha256.Sum256(contents)
+		if hex.EncodeToString(d[:]) != f.SHA256 {
+			t.Errorf("Manifest got sha256 digest %q for %s which doesn't match its contents", f.SHA256, f.Path)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Manifest got files %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BazelVersionPlaceholder is substituted with the Bazel version in the output paths of the
+	// options of jobs expanded by ExpandMatrix.
+	BazelVersionPlaceholder = "{bazel_version}"
+)
+
+var (
+	// unsafeJobNameChars matches characters in job names that are replaced to derive the name of
+	// the temporary working directory of a job.
+	unsafeJobNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// MatrixJob is a single config generation job in a matrix.
+type MatrixJob struct {
+	// Name identifies the job in logs & reports.
+	Name string
+	// Options are the options to generate configs for this job. TempWorkDir & Cleanup are
+	// determined by the MatrixOptions instead.
+	Options Options
+}
+
+// MatrixOptions are the options to run several config generation jobs concurrently.
+type MatrixOptions struct {
+	// Jobs are the config generation jobs to run.
+	Jobs []MatrixJob
+	// Parallelism is the maximum number of jobs to run concurrently. Defaults to 1.
+	Parallelism int
+	// OutputReport is an optional path where a JSON file with the result of every job will be
+	// written to.
+	OutputReport string
+	// TempWorkDir is a temporary directory in which every job gets its own temporary working
+	// directory. If unspecified, a temporary directory will be requested from the OS.
+	TempWorkDir string
+	// Cleanup determines whether the running containers & intermediate files will be deleted once
+	// config generation is done.
+	Cleanup bool
+}
+
+// MatrixResult is the result of a single job in a matrix.
+type MatrixResult struct {
+	// Name is the name of the job.
+	Name string `json:"name"`
+	// Success is true if configs were generated successfully.
+	Success bool `json:"success"`
+	// Error is the error message if the job failed.
+	Error string `json:"error,omitempty"`
+	// DurationSeconds is how long the job took.
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// ExpandMatrix returns a job for every combination of the given jobs & Bazel versions. The name of
+// each expanded job is the name of the original job with the Bazel version appended and
+// BazelVersionPlaceholder in OutputTarball, OutputConfigPath & OutputManifest is replaced by the
+// Bazel version.
+func ExpandMatrix(jobs []MatrixJob, bazelVersions []string) []MatrixJob {
+	var result []MatrixJob
+	for _, j := range jobs {
+		for _, v := range bazelVersions {
+			o := j.Options
+			o.BazelVersion = v
+			o.OutputTarball = strings.ReplaceAll(o.OutputTarball, BazelVersionPlaceholder, v)
+			o.OutputConfigPath = strings.ReplaceAll(o.OutputConfigPath, BazelVersionPlaceholder, v)
+			o.OutputManifest = strings.ReplaceAll(o.OutputManifest, BazelVersionPlaceholder, v)
+			result = append(result, MatrixJob{
+				Name:    fmt.Sprintf("%s@%s", j.Name, v),
+				Options: o,
+			})
+		}
+	}
+	return result
+}
+
+// Validate verifies the matrix options & the options of every job. Default values for the ExecOS
+// of each job are applied to jobs whose PlatformParams weren't initialized. Jobs must have unique
+// names & outputs.
+func (m *MatrixOptions) Validate() error {
+	if len(m.Jobs) == 0 {
+		return fmt.Errorf("no jobs were specified")
+	}
+	if m.Parallelism == 0 {
+		m.Parallelism = 1
+	}
+	if m.Parallelism < 0 {
+		return fmt.Errorf("Parallelism must be positive, got %d", m.Parallelism)
+	}
+	names := make(map[string]bool)
+	outputs := make(map[string]string)
+	for i := range m.Jobs {
+		j := &m.Jobs[i]
+		if j.Name == "" {
+			return fmt.Errorf("job %d didn't specify a name", i)
+		}
+		if names[j.Name] {
+			return fmt.Errorf("got multiple jobs named %q, names must be unique", j.Name)
+		}
+		names[j.Name] = true
+		if j.Options.PlatformParams == nil {
+			if err := j.Options.ApplyDefaults(j.Options.ExecOS); err != nil {
+				return fmt.Errorf("failed to apply default options to job %q: %w", j.Name, err)
+			}
+		}
+		j.Options.TempWorkDir = ""
+		j.Options.Cleanup = m.Cleanup
+		if err := j.Options.Validate(); err != nil {
+			return fmt.Errorf("invalid options for job %q: %w", j.Name, err)
+		}
+		var jobOutputs []string
+		if j.Options.OutputTarball != "" {
+			jobOutputs = append(jobOutputs, filepath.Clean(j.Options.OutputTarball))
+		}
+		if j.Options.OutputSourceRoot != "" {
+			jobOutputs = append(jobOutputs, filepath.Join(j.Options.OutputSourceRoot, j.Options.OutputConfigPath))
+		}
+		if j.Options.OutputManifest != "" {
+			jobOutputs = append(jobOutputs, filepath.Clean(j.Options.OutputManifest))
+		}
+		for _, out := range jobOutputs {
+			if other, ok := outputs[out]; ok {
+				return fmt.Errorf("jobs %q and %q both write to %q", other, j.Name, out)
+			}
+			outputs[out] = j.Name
+		}
+	}
+	return nil
+}
+
+// pullCache makes sure every toolchain container image is pulled at most once across the jobs of
+// a matrix.
+type pullCache struct {
+	mu    sync.Mutex
+	pulls map[string]*pullResult
+}
+
+// pullResult is the result of pulling an image shared between all jobs using the image.
+type pullResult struct {
+	once sync.Once
+	err  error
+}
+
+// pull pulls the toolchain container image of the given options using the given runtime unless it
+// was already pulled by another job.
+func (c *pullCache) pull(o *Options, rt ContainerRuntime) error {
+	key := strings.Join([]string{o.ContainerRuntime, o.DockerPlatform, o.ToolchainContainer}, "|")
+	c.mu.Lock()
+	r, ok := c.pulls[key]
+	if !ok {
+		r = &pullResult{}
+		c.pulls[key] = r
+	}
+	c.mu.Unlock()
+	r.once.Do(func() {
+		r.err = rt.Pull(o.ToolchainContainer, o.DockerPlatform)
+	})
+	return r.err
+}
+
+// RunMatrix runs the config generation jobs in the given matrix options concurrently with at most
+// Parallelism jobs running at once. The matrix options are expected to have been validated.
+// Each job gets an isolated temporary working directory & its own container but images are
+// only pulled once and shared between jobs. Returns the result of every job in the order of the
+// jobs. An error is returned if any job failed.
+func RunMatrix(m MatrixOptions) ([]MatrixResult, error) {
+	return runMatrix(m, containerRuntimeForOptions)
+}
+
+// runMatrix runs the jobs in the given matrix options using the given function to create the
+// container runtime for each job.
+func runMatrix(m MatrixOptions, newRuntime func(*Options) (ContainerRuntime, error)) ([]MatrixResult, error) {
+	dir, err := initTempDir(m.TempWorkDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize a local temporary working directory to store intermediate files: %w", err)
+	}
+	m.TempWorkDir = dir
+	parallelism := m.Parallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	cache := &pullCache{pulls: make(map[string]*pullResult)}
+	results := make([]MatrixResult, len(m.Jobs))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				start := time.Now()
+				err := runMatrixJob(&m, i, cache, newRuntime)
+				results[i] = MatrixResult{
+					Name:            m.Jobs[i].Name,
+					Success:         err == nil,
+					DurationSeconds: time.Since(start).Seconds(),
+				}
+				if err != nil {
+					results[i].Error = err.Error()
+					log.Printf("Job %q failed: %v", m.Jobs[i].Name, err)
+					continue
+				}
+				log.Printf("Job %q succeeded.", m.Jobs[i].Name)
+			}
+		}()
+	}
+	for i := range m.Jobs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if m.Cleanup {
+		if err := os.RemoveAll(m.TempWorkDir); err != nil {
+			log.Printf("Warning: Unable to delete temporary working directory %q: %v", m.TempWorkDir, err)
+		}
+	}
+	if err := writeMatrixReport(m.OutputReport, results); err != nil {
+		return results, err
+	}
+	var failed []string
+	for _, r := range results {
+		if !r.Success {
+			failed = append(failed, r.Name)
+		}
+	}
+	log.Printf("%d/%d jobs succeeded.", len(results)-len(failed), len(results))
+	if len(failed) != 0 {
+		return results, fmt.Errorf("%d jobs failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return results, nil
+}
+
+// runMatrixJob runs the job at index i in the given matrix options in its own temporary working
+// directory.
+func runMatrixJob(m *MatrixOptions, i int, cache *pullCache, newRuntime func(*Options) (ContainerRuntime, error)) error {
+	j := m.Jobs[i]
+	o := j.Options
+	// Jobs may share the platform params of the options they were created from and run() modifies
+	// them.
+	o.PlatformParams = new(PlatformToolchainsTemplateParams)
+	*o.PlatformParams = *j.Options.PlatformParams
+	o.TempWorkDir = path.Join(m.TempWorkDir, fmt.Sprintf("%d_%s", i, unsafeJobNameChars.ReplaceAllString(j.Name, "_")))
+	if err := os.MkdirAll(o.TempWorkDir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create temporary working directory %q: %w", o.TempWorkDir, err)
+	}
+	rt, err := newRuntime(&o)
+	if err != nil {
+		return fmt.Errorf("unable to initialize the container runtime: %w", err)
+	}
+	// The rootfs runtime unpacks the image into a rootfs private to the runtime when pulling so the
+	// pull can't be shared.
+	if o.ContainerRuntime != RuntimeRootfs {
+		if err := cache.pull(&o, rt); err != nil {
+			return fmt.Errorf("%s was unable to pull the toolchain container image %q: %w", rt.Name(), o.ToolchainContainer, err)
+		}
+		o.imagePulled = true
+	}
+	log.Printf("Running job %q.", j.Name)
+	return run(o, rt)
+}
+
+// writeMatrixReport writes the given job results as JSON to the given path if one was specified.
+func writeMatrixReport(reportPath string, results []MatrixResult) error {
+	if reportPath == "" {
+		return nil
+	}
+	blob, err := json.MarshalIndent(results, "", " ")
+	if err != nil {
+		return fmt.Errorf("unable to generate JSON for the matrix report: %w", err)
+	}
+	if err := ioutil.WriteFile(reportPath, blob, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to write the matrix report to %q: %w", reportPath, err)
+	}
+	log.Printf("Wrote matrix report to %q.", reportPath)
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRunMatrixWithFakeRuntime(t *testing.T) {
+	dir := t.TempDir()
+	job := func(name, image string) MatrixJob {
+		return MatrixJob{
+			Name: name,
+			Options: Options{
+				BazelPath:          "/usr/bin/bazel",
+				ToolchainContainer: image,
+				ExecOS:             OSLinux,
+				TargetOS:           OSLinux,
+				GenJavaConfigs:     true,
+				OutputTarball:      path.Join(dir, name+"_"+BazelVersionPlaceholder+".tar"),
+			},
+		}
+	}
+	m := MatrixOptions{
+		Jobs: ExpandMatrix([]MatrixJob{
+			job("ubuntu", "gcr.io/foo/ubuntu:latest"),
+			job("nojava", "gcr.io/foo/nojava:latest"),
+		}, []string{"5.4.0", "6.0.0", "7.0.0"}),
+		Parallelism:  4,
+		OutputReport: path.Join(dir, "report.json"),
+		TempWorkDir:  t.TempDir(),
+		Cleanup:      true,
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	var pulls int32
+	newRuntime := func(o *Options) (ContainerRuntime, error) {
+		rt := &fakeRuntime{
+			image:       "gcr.io/foo/ubuntu@sha256:" + strings.Repeat("a", 64),
+			javaVersion: "11.0.10",
+			pulls:       &pulls,
+		}
+		if strings.Contains(o.ToolchainContainer, "ubuntu") {
+			rt.env = []string{"JAVA_HOME=/jdk"}
+		}
+		return rt, nil
+	}
+	results, err := runMatrix(m, newRuntime)
+	if err == nil {
+		t.Errorf("runMatrix succeeded even though jobs for an image without JAVA_HOME should have failed")
+	}
+	if pulls != 2 {
+		t.Errorf("Got %d image pulls, want 2 (one per image)", pulls)
+	}
+	if len(results) != 6 {
+		t.Fatalf("Got %d results, want 6", len(results))
+	}
+	for i, r := range results {
+		if r.Name != m.Jobs[i].Name {
+			t.Errorf("Result %d was for job %q, want %q", i, r.Name, m.Jobs[i].Name)
+		}
+		wantSuccess := strings.HasPrefix(r.Name, "ubuntu@")
+		if r.Success != wantSuccess {
+			t.Errorf("Job %q got success=%v, want %v (error=%q)", r.Name, r.Success, wantSuccess, r.Error)
+		}
+		if !r.Success && r.Error == "" {
+			t.Errorf("Failed job %q didn't report an error", r.Name)
+		}
+	}
+	for _, v := range []string{"5.4.0", "6.0.0", "7.0.0"} {
+		files := readTarball(t, path.Join(dir, "ubuntu_"+v+".tar"))
+		if _, ok := files["java/BUILD"]; !ok {
+			t.Errorf("Output tarball for Bazel %s did not contain java/BUILD, got files %v", v, files)
+		}
+	}
+
+	blob, err := ioutil.ReadFile(m.OutputReport)
+	if err != nil {
+		t.Fatalf("Failed to read the matrix report: %v", err)
+	}
+	var report []MatrixResult
+	if err := json.Unmarshal(blob, &report); err != nil {
+		t.Fatalf("Failed to parse the matrix report: %v", err)
+	}
+	if len(report) != len(results) {
+		t.Errorf("Matrix report had %d results, want %d", len(report), len(results))
+	}
+}
+
+func TestMatrixValidate(t *testing.T) {
+	job := func(name, output string) MatrixJob {
+		return MatrixJob{
+			Name: name,
+			Options: Options{
+				BazelVersion:       "6.0.0",
+				ToolchainContainer: "gcr.io/foo/bar:latest",
+				ExecOS:             OSLinux,
+				TargetOS:           OSLinux,
+				GenJavaConfigs:     true,
+				OutputTarball:      output,
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		m       MatrixOptions
+		wantErr bool
+	}{
+		{
+			name: "Valid",
+			m:    MatrixOptions{Jobs: []MatrixJob{job("a", "a.tar"), job("b", "b.tar")}},
+		},
+		{
+			name:    "No jobs",
+			m:       MatrixOptions{},
+			wantErr: true,
+		},
+		{
+			name:    "Duplicate names",
+			m:       MatrixOptions{Jobs: []MatrixJob{job("a", "a.tar"), job("a", "b.tar")}},
+			wantErr: true,
+		},
+		{
+			name:    "Duplicate outputs",
+			m:       MatrixOptions{Jobs: []MatrixJob{job("a", "out.tar"), job("b", "out.tar")}},
+			wantErr: true,
+		},
+		{
+			name:    "Negative parallelism",
+			m:       MatrixOptions{Jobs: []MatrixJob{job("a", "a.tar")}, Parallelism: -1},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			err := tc.m.Validate()
+			if tc.wantErr && err == nil {
+				t.Errorf("Validate succeeded, want error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("Validate failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,498 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// whiteoutPrefix is the prefix of files in image layers that mark the file without the prefix
+	// as deleted.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque is the name of the file in image layers that marks the directory containing it
+	// as opaque, i.e., contents of the directory from lower layers are deleted.
+	whiteoutOpaque = ".wh..wh..opq"
+	// maxSymlinkHops is the maximum number of symlinks followed when resolving a path inside an
+	// unpacked image rootfs or a tarball.
+	maxSymlinkHops = 255
+)
+
+// ociDescriptor is an OCI content descriptor.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform,omitempty"`
+}
+
+// ociIndex is an OCI image index or a docker manifest list.
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest is an OCI image manifest or a docker v2 schema 2 manifest.
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// dockerSaveManifest is the manifest.json file at the root of a tarball produced by 'docker save'.
+type dockerSaveManifest []struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// imageConfig is the subset of the OCI image config used here.
+type imageConfig struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Config       struct {
+		Env []string `json:"Env"`
+	} `json:"config"`
+}
+
+// localImage is a container image read from an OCI image layout or a 'docker save' tarball.
+type localImage struct {
+	// manifestDigest is the digest of the image manifest as "sha256:<hex>". Blank if the image
+	// was read from a 'docker save' tarball which doesn't record the manifest digest.
+	manifestDigest string
+	// config is the image config.
+	config imageConfig
+	// layers are the paths to the layer tarballs of the image from the lowest to the highest layer.
+	layers []string
+}
+
+// isIndexMediaType returns whether the given media type is an OCI image index or a docker manifest
+// list.
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == "application/vnd.oci.image.index.v1+json" || mediaType == "application/vnd.docker.distribution.manifest.list.v2+json"
+}
+
+// ociBlobPath returns the path of the blob with the given digest in the OCI image layout at 'dir'.
+func ociBlobPath(dir, digest string) (string, error) {
+	split := strings.SplitN(digest, ":", 2)
+	if len(split) != 2 || strings.Contains(split[1], "/") || strings.Contains(split[0], "/") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(dir, "blobs", split[0], split[1]), nil
+}
+
+// readJSONFile parses the JSON file at the given path into 'v'.
+func readJSONFile(filePath string, v interface{}) error {
+	blob, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("unable to read %q: %w", filePath, err)
+	}
+	if err := json.Unmarshal(blob, v); err != nil {
+		return fmt.Errorf("unable to parse %q as JSON: %w", filePath, err)
+	}
+	return nil
+}
+
+// platformMatches returns whether the platform of the given descriptor matches the given platform
+// specified as os/arch[/variant]. Descriptors without a platform never match.
+func platformMatches(d ociDescriptor, platform string) bool {
+	if d.Platform == nil {
+		return false
+	}
+	split := strings.Split(platform, "/")
+	if len(split) < 2 || split[0] != d.Platform.OS || split[1] != d.Platform.Architecture {
+		return false
+	}
+	return len(split) < 3 || split[2] == d.Platform.Variant
+}
+
+// resolveOCIManifest follows the given descriptor in the OCI image layout at 'dir' through image
+// indexes until an image manifest for the given platform is found and returns the descriptor of
+// that manifest.
+func resolveOCIManifest(dir string, d ociDescriptor, platform string) (ociDescriptor, error) {
+	for i := 0; isIndexMediaType(d.MediaType); i++ {
+		if i > 8 {
+			return ociDescriptor{}, fmt.Errorf("image indexes nested too deeply")
+		}
+		p, err := ociBlobPath(dir, d.Digest)
+		if err != nil {
+			return ociDescriptor{}, err
+		}
+		idx := ociIndex{}
+		if err := readJSONFile(p, &idx); err != nil {
+			return ociDescriptor{}, err
+		}
+		found := false
+		for _, m := range idx.Manifests {
+			if len(idx.Manifests) == 1 || platformMatches(m, platform) {
+				d = m
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ociDescriptor{}, fmt.Errorf("image index %s had no manifest for platform %q", d.Digest, platform)
+		}
+	}
+	return d, nil
+}
+
+// loadOCILayout reads the image for the given platform from the OCI image layout at 'dir'.
+func loadOCILayout(dir, platform string) (*localImage, error) {
+	idx := ociIndex{}
+	if err := readJSONFile(filepath.Join(dir, "index.json"), &idx); err != nil {
+		return nil, err
+	}
+	if len(idx.Manifests) == 0 {
+		return nil, fmt.Errorf("OCI image layout %q had no images in index.json", dir)
+	}
+	// index.json isn't a blob, so pick the manifest from it directly and only then follow nested
+	// indexes.
+	d := idx.Manifests[0]
+	if len(idx.Manifests) > 1 {
+		found := false
+		for _, m := range idx.Manifests {
+			if platformMatches(m, platform) {
+				d = m
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("OCI image layout %q has %d images but none for platform %q", dir, len(idx.Manifests), platform)
+		}
+	}
+	d, err := resolveOCIManifest(dir, d, platform)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ociBlobPath(dir, d.Digest)
+	if err != nil {
+		return nil, err
+	}
+	m := ociManifest{}
+	if err := readJSONFile(p, &m); err != nil {
+		return nil, err
+	}
+	result := &localImage{manifestDigest: d.Digest}
+	configPath, err := ociBlobPath(dir, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := readJSONFile(configPath, &result.config); err != nil {
+		return nil, err
+	}
+	for _, l := range m.Layers {
+		lp, err := ociBlobPath(dir, l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		result.layers = append(result.layers, lp)
+	}
+	return result, nil
+}
+
+// loadDockerSave reads the image from the extracted 'docker save' tarball at 'dir'.
+func loadDockerSave(dir string) (*localImage, error) {
+	m := dockerSaveManifest{}
+	if err := readJSONFile(filepath.Join(dir, "manifest.json"), &m); err != nil {
+		return nil, err
+	}
+	if len(m) != 1 {
+		return nil, fmt.Errorf("'docker save' tarball contained %d images, want exactly 1", len(m))
+	}
+	result := &localImage{}
+	if err := readJSONFile(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+m[0].Config))), &result.config); err != nil {
+		return nil, err
+	}
+	for _, l := range m[0].Layers {
+		result.layers = append(result.layers, filepath.Join(dir, filepath.FromSlash(path.Clean("/"+l))))
+	}
+	return result, nil
+}
+
+// extractArchive extracts the regular files & directories in the tarball at 'src' to the directory
+// 'dst'. Used to extract image tarballs which don't contain links.
+func extractArchive(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("unable to open %q: %w", src, err)
+	}
+	defer f.Close()
+	t := tar.NewReader(f)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading tarball %q: %w", src, err)
+		}
+		p := filepath.Join(dst, filepath.FromSlash(path.Clean("/"+h.Name)))
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return fmt.Errorf("unable to create directory %q: %w", p, err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return fmt.Errorf("unable to create directory %q: %w", filepath.Dir(p), err)
+			}
+			o, err := os.Create(p)
+			if err != nil {
+				return fmt.Errorf("unable to create %q: %w", p, err)
+			}
+			_, err = io.Copy(o, t)
+			o.Close()
+			if err != nil {
+				return fmt.Errorf("error while extracting %q from %q: %w", h.Name, src, err)
+			}
+		}
+	}
+}
+
+// loadImage reads the image for the given platform from the OCI image layout directory or tarball
+// or 'docker save' tarball at 'archive'. Tarballs are extracted into 'scratchDir'.
+func loadImage(archive, platform, scratchDir string) (*localImage, error) {
+	s, err := os.Stat(archive)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access image archive %q: %w", archive, err)
+	}
+	dir := archive
+	if !s.IsDir() {
+		dir = filepath.Join(scratchDir, "image")
+		if err := extractArchive(archive, dir); err != nil {
+			return nil, fmt.Errorf("unable to extract image tarball %q: %w", archive, err)
+		}
+	}
+	// Newer versions of docker save both an OCI image layout & a manifest.json. The OCI image
+	// layout is preferred because it records the manifest digest.
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		return loadOCILayout(dir, platform)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		return loadDockerSave(dir)
+	}
+	return nil, fmt.Errorf("%q is neither an OCI image layout nor a 'docker save' tarball", archive)
+}
+
+// resolveInRoot returns the path of 'name' inside the directory 'root' resolving symlinks as if
+// 'root' was the filesystem root, i.e., absolute symlinks and '..' never escape 'root'. If
+// followLast is false, the last path component isn't resolved if it's a symlink.
+func resolveInRoot(root, name string, followLast bool) (string, error) {
+	clean := path.Clean("/" + filepath.ToSlash(name))
+	if clean == "/" {
+		return root, nil
+	}
+	pending := strings.Split(clean[1:], "/")
+	last := ""
+	if !followLast {
+		last = pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+	}
+	current := "/"
+	hops := 0
+	for len(pending) > 0 {
+		c := pending[0]
+		pending = pending[1:]
+		if c == "" || c == "." {
+			continue
+		}
+		if c == ".." {
+			current = path.Dir(current)
+			continue
+		}
+		next := path.Join(current, c)
+		s, err := os.Lstat(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil || s.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %q", name)
+		}
+		target, err := os.Readlink(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil {
+			return "", fmt.Errorf("unable to read symlink %q: %w", next, err)
+		}
+		if path.IsAbs(target) {
+			current = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(root, filepath.FromSlash(current), last), nil
+}
+
+// layerReader returns a reader for the uncompressed contents of the given layer tarball which may
+// be gzip or zstd compressed. The returned reader must be closed to release the decompressor.
+func layerReader(f *os.File) (io.ReadCloser, error) {
+	b := bufio.NewReader(f)
+	magic, err := b.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(b)
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		d, err := zstd.NewReader(b, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(b), nil
+}
+
+// applyLayer applies the layer tarball at 'layerPath' on top of the rootfs at 'root' processing
+// whiteouts. Ownership of files is ignored and device files are skipped because the rootfs is
+// unpacked by an unprivileged user.
+func applyLayer(root, layerPath string) error {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return fmt.Errorf("unable to open layer %q: %w", layerPath, err)
+	}
+	defer f.Close()
+	r, err := layerReader(f)
+	if err != nil {
+		return fmt.Errorf("unable to decompress layer %q: %w", layerPath, err)
+	}
+	defer r.Close()
+	t := tar.NewReader(r)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading layer %q: %w", layerPath, err)
+		}
+		name := path.Clean("/" + h.Name)
+		if name == "/" {
+			continue
+		}
+		base := path.Base(name)
+		p, err := resolveInRoot(root, name, false)
+		if err != nil {
+			return err
+		}
+		if base == whiteoutOpaque {
+			dir := filepath.Dir(p)
+			children, err := ioutil.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("unable to list %q to process opaque whiteout: %w", dir, err)
+			}
+			for _, c := range children {
+				if err := forceRemoveAll(filepath.Join(dir, c.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			if err := forceRemoveAll(filepath.Join(filepath.Dir(p), strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return fmt.Errorf("unable to create directory %q: %w", filepath.Dir(p), err)
+		}
+		// Entries in higher layers replace entries in lower layers except for directories which
+		// are merged.
+		if s, err := os.Lstat(p); err == nil && !(s.IsDir() && h.Typeflag == tar.TypeDir) {
+			if err := forceRemoveAll(p); err != nil {
+				return err
+			}
+		}
+		// Always keep files & directories writable by the owner so that later layers can modify
+		// them & the rootfs can be deleted.
+		mode := os.FileMode(h.Mode).Perm() | 0600
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, mode|0700); err != nil {
+				return fmt.Errorf("unable to create directory %q: %w", p, err)
+			}
+			if err := os.Chmod(p, mode|0700); err != nil {
+				return fmt.Errorf("unable to set permissions of directory %q: %w", p, err)
+			}
+		case tar.TypeReg:
+			o, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return fmt.Errorf("unable to create %q: %w", p, err)
+			}
+			_, err = io.Copy(o, t)
+			o.Close()
+			if err != nil {
+				return fmt.Errorf("error while extracting %q from layer %q: %w", h.Name, layerPath, err)
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(h.Linkname, p); err != nil {
+				return fmt.Errorf("unable to create symlink %q: %w", p, err)
+			}
+		case tar.TypeLink:
+			target, err := resolveInRoot(root, h.Linkname, false)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(target, p); err != nil {
+				return fmt.Errorf("unable to create hard link %q to %q: %w", p, target, err)
+			}
+		}
+	}
+}
+
+// unpackImage unpacks the layers of the given image into the directory 'root'.
+func unpackImage(img *localImage, root string) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return fmt.Errorf("unable to create rootfs directory %q: %w", root, err)
+	}
+	for _, l := range img.layers {
+		if err := applyLayer(root, l); err != nil {
+			return fmt.Errorf("failed to apply layer %q: %w", l, err)
+		}
+	}
+	return nil
+}
+
+// forceRemoveAll deletes the given path like os.RemoveAll but first makes all directories under
+// the path writable so that read-only directories don't prevent deleting their contents.
+func forceRemoveAll(p string) error {
+	filepath.Walk(p, func(walkPath string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(walkPath, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(p); err != nil {
+		return fmt.Errorf("unable to delete %q: %w", p, err)
+	}
+	return nil
+}
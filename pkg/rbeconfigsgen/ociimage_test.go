@@ -0,0 +1,212 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// tarEntry is an entry in a tarball created by tests.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	contents string
+	linkname string
+	// mode is the mode of the entry. Defaults to 0644 for files & 0755 for directories.
+	mode int64
+}
+
+// makeTarball returns a tarball with the given entries.
+func makeTarball(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.contents)),
+		}
+		if e.typeflag == tar.TypeDir {
+			h.Mode = 0755
+		}
+		if e.mode != 0 {
+			h.Mode = e.mode
+		}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatalf("Failed to write tar header for %q: %v", e.name, err)
+		}
+		if _, err := w.Write([]byte(e.contents)); err != nil {
+			t.Fatalf("Failed to write %q to tarball: %v", e.name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to finish writing tarball: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// writeBlob writes the given blob to the OCI image layout at 'dir' and returns its digest.
+func writeBlob(t *testing.T, dir string, blob []byte) string {
+	t.Helper()
+	h := sha256.Sum256(blob)
+	d := hex.EncodeToString(h[:])
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		t.Fatalf("Failed to create blobs directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", d), blob, 0644); err != nil {
+		t.Fatalf("Failed to write blob: %v", err)
+	}
+	return "sha256:" + d
+}
+
+func writeJSONBlob(t *testing.T, dir string, v interface{}) string {
+	t.Helper()
+	blob, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Failed to encode JSON: %v", err)
+	}
+	return writeBlob(t, dir, blob)
+}
+
+func gzipBlob(t *testing.T, blob []byte) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(blob); err != nil {
+		t.Fatalf("Failed to gzip blob: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to gzip blob: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBlob(t *testing.T, blob []byte) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	w, err := zstd.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("Failed to create zstd writer: %v", err)
+	}
+	if _, err := w.Write(blob); err != nil {
+		t.Fatalf("Failed to zstd compress blob: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to zstd compress blob: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnpackOCILayout(t *testing.T) {
+	layout := t.TempDir()
+	layer1 := makeTarball(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/a", typeflag: tar.TypeReg, contents: "a"},
+		{name: "etc/b", typeflag: tar.TypeReg, contents: "b"},
+		{name: "usr/lib/", typeflag: tar.TypeDir},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "/usr/lib"},
+	})
+	layer2 := makeTarball(t, []tarEntry{
+		{name: "etc/.wh.a", typeflag: tar.TypeReg},
+		// Written through an absolute symlink which must resolve inside the rootfs.
+		{name: "lib/x", typeflag: tar.TypeReg, contents: "x"},
+		{name: "../../escape", typeflag: tar.TypeReg, contents: "escape"},
+	})
+	layer3 := makeTarball(t, []tarEntry{
+		{name: "etc/c", typeflag: tar.TypeReg, contents: "c"},
+	})
+	config := writeJSONBlob(t, layout, map[string]interface{}{
+		"os":           "linux",
+		"architecture": "amd64",
+		"config":       map[string]interface{}{"Env": []string{"JAVA_HOME=/jdk"}},
+	})
+	manifest := writeJSONBlob(t, layout, map[string]interface{}{
+		"config": map[string]string{"digest": config},
+		"layers": []map[string]string{
+			{"digest": writeBlob(t, layout, gzipBlob(t, layer1))},
+			{"digest": writeBlob(t, layout, layer2)},
+			{"digest": writeBlob(t, layout, zstdBlob(t, layer3))},
+		},
+	})
+	index, err := json.Marshal(map[string]interface{}{
+		"manifests": []map[string]string{{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest":    manifest,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode index.json: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(layout, "index.json"), index, 0644); err != nil {
+		t.Fatalf("Failed to write index.json: %v", err)
+	}
+
+	img, err := loadImage(layout, defaultRootfsPlatform, t.TempDir())
+	if err != nil {
+		t.Fatalf("loadImage failed: %v", err)
+	}
+	if img.manifestDigest != manifest {
+		t.Errorf("loadImage got manifest digest %q, want %q", img.manifestDigest, manifest)
+	}
+	if len(img.config.Config.Env) != 1 || img.config.Config.Env[0] != "JAVA_HOME=/jdk" {
+		t.Errorf("loadImage got image env %v, want [JAVA_HOME=/jdk]", img.config.Config.Env)
+	}
+	parent := t.TempDir()
+	root := filepath.Join(parent, "rootfs")
+	if err := unpackImage(img, root); err != nil {
+		t.Fatalf("unpackImage failed: %v", err)
+	}
+	for _, f := range []string{"etc/b", "etc/c", "usr/lib/x", "escape"} {
+		if _, err := os.Stat(filepath.Join(root, f)); err != nil {
+			t.Errorf("Expected %q to exist in the rootfs: %v", f, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "etc/a")); !os.IsNotExist(err) {
+		t.Errorf("Expected etc/a to be deleted by a whiteout, got err=%v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(parent, "escape")); !os.IsNotExist(err) {
+		t.Errorf("Layer entry escaped the rootfs, got err=%v", err)
+	}
+
+	r := &rootfsRuntime{image: img}
+	got, err := r.ResolveImage("gcr.io/foo/bar:latest")
+	if err != nil {
+		t.Fatalf("ResolveImage failed: %v", err)
+	}
+	if want := "gcr.io/foo/bar@" + manifest; got != want {
+		t.Errorf("ResolveImage got %q, want %q", got, want)
+	}
+}
+
+func TestRootfsRuntimeExecWithoutPull(t *testing.T) {
+	r := NewRootfsRuntime(t.TempDir(), "")
+	if _, err := r.Exec("/rootfs", "", nil, "true"); err == nil {
+		t.Errorf("Exec succeeded without an unpacked image, want error")
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"log"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/bazelbuild/bazelisk/core"
@@ -38,21 +40,48 @@ type Options struct {
 	ToolchainContainer string
 	// Specify --platform when executing docker create.
 	DockerPlatform string
+	// ContainerRuntime is the name of the container runtime (docker|podman|nerdctl|docker-api|rootfs)
+	// used to run the toolchain container. Defaults to rootfs if ImageArchive is specified and
+	// docker otherwise.
+	ContainerRuntime string
+	// ImageArchive is the path to an OCI image layout directory or tarball or a 'docker save'
+	// tarball containing the toolchain container image. If specified, the image is unpacked into a
+	// local rootfs and no container daemon is needed. ToolchainContainer is still required to
+	// reference the image in the generated platform.
+	ImageArchive string
 	// ExecOS is the OS of the toolchain container image or the OS in which the build actions will
 	// execute.
 	ExecOS string
 	// TargetOS is the OS to be used as the target platform in the generated platform rule. This
 	// is the OS that artifacts built by Bazel will be executed on.
 	TargetOS string
+	// ExecArch is the CPU architecture (x86_64|aarch64) of the toolchain container image or the
+	// architecture on which the build actions will execute. Defaults to x86_64.
+	ExecArch string
+	// TargetArch is the CPU architecture (x86_64|aarch64) to be used as the target platform in the
+	// generated platform rule. Defaults to ExecArch. Must be the same as ExecArch when generating C++
+	// configs.
+	TargetArch string
 	// OutputTarball is the path at with a tarball will be generated containing the C++/Java
 	// configs.
 	OutputTarball string
+	// OutputFormat is the format (tar|tar.gz|tar.zst|zip) of OutputTarball. Defaults to the format
+	// matching the extension of OutputTarball, e.g., tar.zst for ".tar.zst", or tar.
+	OutputFormat string
 	// OutputSourceRoot is the path where the root of the source repository where generated configs
 	// should be copied to. This directory is expected to have a Bazel WORKSPACE file.
 	OutputSourceRoot string
 	// OutputConfigPath is the path relative to OutputSourceRoot where the generated configs will
 	// be copied to.
 	OutputConfigPath string
+	// ConfigsRepoName is the name of the external repository the generated configs are expected to
+	// be extracted into when they aren't copied into a source repository. This determines the
+	// labels used in the generated .bazelrc fragment. Defaults to rbe_default.
+	ConfigsRepoName string
+	// OutputMode determines how the generated configs are expected to be consumed (workspace|bzlmod).
+	// In the bzlmod mode, a MODULE.bazel is generated at the root of the configs to consume them as a
+	// module named ConfigsRepoName. Defaults to workspace.
+	OutputMode string
 	// OutputManifest is a path where a text file containing details about the generated configs.
 	// The manifest aims to be easily parseable by shell utilities like grep/sed.
 	OutputManifest string
@@ -87,6 +116,15 @@ type Options struct {
 	CppGenEnvJSON string
 	// CPPToolchainTarget is the toolchain to be used by the cpp configs.
 	CPPToolchainTargetName string
+	// CppConfigMode determines how C++ configs are generated (bazel|static). bazel runs Bazel's C++
+	// toolchain autodetection inside the toolchain container. static inspects the compiler, include
+	// directories & libc installed in the unpacked image rootfs without running any commands inside
+	// the image and requires ContainerRuntime rootfs. Defaults to bazel.
+	CppConfigMode string
+	// CppSymlinkMode determines how symlinks in the C++ configs generated by Bazel are written to
+	// the output (preserve|inline). preserve re-creates them as relative symlinks. inline replaces
+	// them with copies of the files they point to. Defaults to inline.
+	CppSymlinkMode string
 
 	// Java config generation options.
 	// GenJavaConfigs determines whether Java configs are generated.
@@ -95,12 +133,63 @@ type Options struct {
 	// rule instead of java_runtime. Otherwise, the Bazel version will be used to infer which rule
 	// to use. Older Bazel versions use java_runtime.
 	JavaUseLocalRuntime bool
+	// GenJavaToolchains determines whether a Java toolchain using the runtime of each JDK as its
+	// compilation runtime is generated & registered for the exec & target constraints of the
+	// platform. Otherwise, Bazel's default Java toolchains are used. Ignored for Bazel versions
+	// using java_runtime, which keep using Bazel's toolchain_hostjdk8, unless JavaUseLocalRuntime
+	// is set.
+	GenJavaToolchains bool
+	// JavaHomeGlobs are glob patterns of JDK installation directories in the toolchain container,
+	// e.g., /usr/lib/jvm/*. A Java runtime is generated for every matching directory with a
+	// bin/java executable in addition to the JDK in the JAVA_HOME of the toolchain image. Only the
+	// JDK in JAVA_HOME is used if no globs are specified.
+	JavaHomeGlobs []string
+	// JavaDefaultVersion is the Java major version of the JDK the generated jdk alias points to,
+	// e.g., 17. Defaults to the JDK in JAVA_HOME or to the newest JDK if JAVA_HOME isn't set.
+	JavaDefaultVersion string
+
+	// Python config generation options.
+	// GenPythonConfigs determines whether Python configs are generated, i.e., a py_runtime for every
+	// python3 interpreter installed in the toolchain container & a Python toolchain using the
+	// python3 in the PATH of the container.
+	GenPythonConfigs bool
+
+	// Go & Rust config generation options.
+	// GenGoConfigs determines whether Go configs are generated, i.e., a .bzl file declaring the Go
+	// SDK installed in the toolchain container with rules_go.
+	GenGoConfigs bool
+	// GenRustConfigs determines whether Rust configs are generated, i.e., a .bzl file declaring a
+	// rules_rust toolchain for the Rust toolchain installed in the toolchain container.
+	GenRustConfigs bool
+
+	// TemplateDir is an optional directory with templates overriding the compiled-in templates of
+	// the generated BUILD files. config/BUILD.tmpl overrides the crosstool top/platform BUILD file
+	// & is executed with PlatformToolchainsTemplateParams. java/BUILD.tmpl overrides the Java
+	// toolchain BUILD file & is executed with the JavaHome & JavaVersion of the default JDK, the
+	// Runtimes of every JDK & the name of the DefaultRuntime. python/BUILD.tmpl overrides the
+	// Python toolchain BUILD file & is executed with the Interpreters found in the toolchain
+	// container, the name of the DefaultRuntime & the ExecConstraints & TargetConstraints.
+	TemplateDir string
+
 	// TempWorkDir is a temporary directory that will be used by this tool to store intermediate
 	// files. If unspecified, a temporary directory will be requested from the OS.
 	TempWorkDir string
 	// Cleanup determines whether the running container & intermediate files will be deleted once
 	// config generation is done. Setting it to false is useful for debugging intermediate state.
 	Cleanup bool
+	// DryRun determines whether the files that would be added, updated & removed in the output
+	// directory are only logged instead of written. Neither the output tarball nor the manifest are
+	// written either.
+	DryRun bool
+
+	// imagePulled is set when the toolchain container image was already pulled, e.g., by the
+	// matrix runner, in which case it isn't pulled again.
+	imagePulled bool
+	// defaultJavaRuntime is the default Java runtime once Java configs were generated.
+	defaultJavaRuntime *javaRuntime
+	// modulePath is the path of the generated configs relative to the root of the module they're
+	// part of in the Bzlmod output mode, e.g., the name of the entry in a configs bundle.
+	modulePath string
 }
 
 // DefaultOptions are some option values that are populated as default values for certain fields
@@ -114,6 +203,21 @@ type DefaultOptions struct {
 	CPPToolchainTargetName string
 }
 
+const (
+	// CppConfigModeBazel generates C++ configs by running Bazel inside the toolchain container.
+	CppConfigModeBazel = "bazel"
+	// CppConfigModeStatic generates C++ configs by statically inspecting the unpacked rootfs of the
+	// toolchain image.
+	CppConfigModeStatic = "static"
+)
+
+const (
+	// CppSymlinkModePreserve writes symlinks in the C++ configs as relative symlinks.
+	CppSymlinkModePreserve = "preserve"
+	// CppSymlinkModeInline writes copies of the files symlinks in the C++ configs point to.
+	CppSymlinkModeInline = "inline"
+)
+
 const (
 	// OSLinux represents Linux when selecting platforms.
 	OSLinux = "linux"
@@ -121,14 +225,35 @@ const (
 	OSWindows = "windows"
 )
 
+const (
+	// ArchX86_64 represents the x86_64 (amd64) CPU architecture when selecting platforms.
+	ArchX86_64 = "x86_64"
+	// ArchAarch64 represents the aarch64 (arm64) CPU architecture when selecting platforms.
+	ArchAarch64 = "aarch64"
+)
+
 var (
 	validOS = []string{
 		OSLinux,
 		OSWindows,
 	}
 
+	validArchs = []string{
+		ArchX86_64,
+		ArchAarch64,
+	}
+
+	// repoNameRegexp matches valid names of Bazel external repositories.
+	repoNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+	// dockerArchs maps CPU architectures to the architecture names used by docker platforms.
+	dockerArchs = map[string]string{
+		ArchX86_64:  "amd64",
+		ArchAarch64: "arm64",
+	}
+
 	// DefaultExecOptions is a map from the ExecOS to default values for certain fields in Options
-	// that vary based on the execution environment.
+	// that vary based on the execution environment when the ExecArch is x86_64.
 	DefaultExecOptions = map[string]DefaultOptions{
 		OSLinux: {
 			PlatformParams: PlatformToolchainsTemplateParams{
@@ -177,6 +302,49 @@ var (
 			CPPToolchainTargetName: "cc-compiler-x64_windows",
 		},
 	}
+
+	// DefaultArchExecOptions is a map from the ExecArch to a map from the ExecOS to default values
+	// for certain fields in Options that vary based on the execution environment.
+	DefaultArchExecOptions = map[string]map[string]DefaultOptions{
+		ArchX86_64: DefaultExecOptions,
+		ArchAarch64: {
+			OSLinux: {
+				PlatformParams: PlatformToolchainsTemplateParams{
+					ExecConstraints: []string{
+						"@platforms//os:linux",
+						"@platforms//cpu:aarch64",
+						"@bazel_tools//tools/cpp:clang",
+					},
+					TargetConstraints: []string{
+						"@platforms//os:linux",
+						"@platforms//cpu:aarch64",
+					},
+					OSFamily: "Linux",
+				},
+				CPPConfigTargets: []string{"@local_config_cc//..."},
+				CPPConfigRepo:    "local_config_cc",
+				CppBazelCmd:      "build",
+				// The ABI & libc values are the same as on x86_64 on purpose. Bazel only records them
+				// as the abi_version, abi_libc_version & target_libc of the generated C++ toolchain to
+				// identify it and doesn't check them against the toolchain container. Like on x86_64,
+				// CC requires clang in the toolchain container, matching the clang exec constraint.
+				// Containers with another compiler or libc need --cpp_env_json, or the static
+				// cpp_config_mode which detects the compiler & libc in the image instead.
+				CppGenEnv: map[string]string{
+					"ABI_LIBC_VERSION":    "glibc_2.19",
+					"ABI_VERSION":         "clang",
+					"BAZEL_COMPILER":      "clang",
+					"BAZEL_HOST_SYSTEM":   "aarch64-unknown-linux-gnu",
+					"BAZEL_TARGET_CPU":    "aarch64",
+					"BAZEL_TARGET_LIBC":   "glibc_2.19",
+					"BAZEL_TARGET_SYSTEM": "aarch64-unknown-linux-gnu",
+					"CC":                  "clang",
+					"CC_TOOLCHAIN_NAME":   "linux_gnu_aarch64",
+				},
+				CPPToolchainTargetName: "cc-compiler-aarch64",
+			},
+		},
+	}
 )
 
 func strListContains(l []string, s string) bool {
@@ -189,14 +357,43 @@ func strListContains(l []string, s string) bool {
 }
 
 // ApplyDefaults applies platform specific default values to the given options for the given
-// OS.
+// OS and the ExecArch specified in the options (x86_64 if unspecified).
 func (o *Options) ApplyDefaults(os string) error {
-	dopts, ok := DefaultExecOptions[os]
+	arch := o.ExecArch
+	if arch == "" {
+		arch = ArchX86_64
+	}
+	return o.ApplyArchDefaults(os, arch)
+}
+
+// ApplyArchDefaults applies platform specific default values to the given options for the given
+// OS & CPU architecture. If the options specify a TargetArch different from the given
+// architecture, the CPU constraint of the target platform is changed to the TargetArch.
+func (o *Options) ApplyArchDefaults(os, arch string) error {
+	archOpts, ok := DefaultArchExecOptions[arch]
 	if !ok {
-		return fmt.Errorf("got unknown OS %q, want one of %s", os, strings.Join(validOS, ", "))
+		return fmt.Errorf("got unknown CPU architecture %q, want one of %s", arch, strings.Join(validArchs, ", "))
+	}
+	dopts, ok := archOpts[os]
+	if !ok {
+		if !strListContains(validOS, os) {
+			return fmt.Errorf("got unknown OS %q, want one of %s", os, strings.Join(validOS, ", "))
+		}
+		return fmt.Errorf("OS %q isn't supported on CPU architecture %q", os, arch)
 	}
 	o.PlatformParams = new(PlatformToolchainsTemplateParams)
 	*o.PlatformParams = dopts.PlatformParams
+	if o.TargetArch != "" && o.TargetArch != arch {
+		// Copy the target constraints to avoid modifying the defaults.
+		var tc []string
+		for _, c := range dopts.PlatformParams.TargetConstraints {
+			if c == cpuConstraint(arch) {
+				c = cpuConstraint(o.TargetArch)
+			}
+			tc = append(tc, c)
+		}
+		o.PlatformParams.TargetConstraints = tc
+	}
 	o.CPPConfigTargets = dopts.CPPConfigTargets
 	o.CPPConfigRepo = dopts.CPPConfigRepo
 	o.CppBazelCmd = dopts.CppBazelCmd
@@ -211,6 +408,11 @@ func (o *Options) ApplyDefaults(os string) error {
 	return nil
 }
 
+// cpuConstraint returns the label of the CPU constraint value for the given architecture.
+func cpuConstraint(arch string) string {
+	return fmt.Sprintf("@platforms//cpu:%s", arch)
+}
+
 // latestBazelVersion uses Bazelisk to determine the latest available Bazel version.
 func latestBazelVersion() (string, error) {
 	r := core.CreateRepositories(&repositories.GCSRepo{}, nil, nil, nil, false)
@@ -234,6 +436,24 @@ func (o *Options) Validate() error {
 	if o.ToolchainContainer == "" {
 		return fmt.Errorf("ToolchainContainer was not specified")
 	}
+	if o.ContainerRuntime == "" {
+		o.ContainerRuntime = RuntimeDocker
+		if o.ImageArchive != "" {
+			o.ContainerRuntime = RuntimeRootfs
+		}
+	}
+	if !strListContains(validRuntimes, o.ContainerRuntime) {
+		return fmt.Errorf("invalid ContainerRuntime, got %q, want one of %s", o.ContainerRuntime, strings.Join(validRuntimes, ", "))
+	}
+	if o.ContainerRuntime == RuntimeRootfs && o.ImageArchive == "" {
+		return fmt.Errorf("ImageArchive is required because ContainerRuntime was %q", RuntimeRootfs)
+	}
+	if o.ContainerRuntime != RuntimeRootfs && o.ImageArchive != "" {
+		return fmt.Errorf("ImageArchive can only be specified with ContainerRuntime %q, got %q", RuntimeRootfs, o.ContainerRuntime)
+	}
+	if o.ContainerRuntime == RuntimeRootfs && o.ExecOS != OSLinux {
+		return fmt.Errorf("ContainerRuntime %q only supports ExecOS %q, got %q", RuntimeRootfs, OSLinux, o.ExecOS)
+	}
 	if o.ExecOS == "" {
 		return fmt.Errorf("ExecOS was not specified")
 	}
@@ -246,20 +466,76 @@ func (o *Options) Validate() error {
 	if !strListContains(validOS, o.TargetOS) {
 		return fmt.Errorf("invalid TargetOS, got %q, want one of %s", o.TargetOS, strings.Join(validOS, ", "))
 	}
+	// Derive the platform of the image to run from the exec architecture only if an architecture was
+	// explicitly requested to preserve the runtime's native platform selection otherwise.
+	if o.ExecArch != "" && strListContains(validArchs, o.ExecArch) {
+		p := fmt.Sprintf("%s/%s", o.ExecOS, dockerArchs[o.ExecArch])
+		if o.DockerPlatform == "" {
+			o.DockerPlatform = p
+		} else if !strings.HasPrefix(o.DockerPlatform+"/", p+"/") {
+			return fmt.Errorf("DockerPlatform %q doesn't match ExecOS %q & ExecArch %q, want %q", o.DockerPlatform, o.ExecOS, o.ExecArch, p)
+		}
+	}
+	if o.ExecArch == "" {
+		o.ExecArch = ArchX86_64
+	}
+	if !strListContains(validArchs, o.ExecArch) {
+		return fmt.Errorf("invalid ExecArch, got %q, want one of %s", o.ExecArch, strings.Join(validArchs, ", "))
+	}
+	if o.TargetArch == "" {
+		o.TargetArch = o.ExecArch
+	}
+	if !strListContains(validArchs, o.TargetArch) {
+		return fmt.Errorf("invalid TargetArch, got %q, want one of %s", o.TargetArch, strings.Join(validArchs, ", "))
+	}
+	// The C++ toolchain is detected by running the compiler in the toolchain container which only
+	// produces code for the ExecArch.
+	if o.GenCPPConfigs && o.TargetArch != o.ExecArch {
+		return fmt.Errorf("TargetArch %q must be the same as ExecArch %q when GenCPPConfigs is true because cross compiling C++ toolchains aren't supported", o.TargetArch, o.ExecArch)
+	}
 	if o.OutputTarball == "" && o.OutputSourceRoot == "" {
 		return fmt.Errorf("atleast one of OutputTarball or OutputSourceRoot must be specified or this tool won't generate any output")
 	}
+	if err := resolveOutputFormat(o.OutputTarball, &o.OutputFormat); err != nil {
+		return err
+	}
 	if o.OutputSourceRoot == "" && o.OutputConfigPath != "" {
 		return fmt.Errorf("OutputSourceRoot is required because OutputConfigPath was specified")
 	}
 	if path.IsAbs(o.OutputConfigPath) {
 		return fmt.Errorf("OutputConfigPath should be a relative path")
 	}
+	if o.ConfigsRepoName != "" && !repoNameRegexp.MatchString(o.ConfigsRepoName) {
+		return fmt.Errorf("invalid ConfigsRepoName %q, repository names must match %s", o.ConfigsRepoName, repoNameRegexp)
+	}
+	if o.OutputMode == "" {
+		o.OutputMode = OutputModeWorkspace
+	}
+	if !strListContains(validOutputModes, o.OutputMode) {
+		return fmt.Errorf("invalid OutputMode, got %q, want one of %s", o.OutputMode, strings.Join(validOutputModes, ", "))
+	}
+	if o.OutputMode == OutputModeBzlmod {
+		if err := validateBzlmod(o); err != nil {
+			return err
+		}
+	}
 	if o.PlatformParams == nil {
 		return fmt.Errorf("PlatformParams was not initialized")
 	}
-	if !o.GenCPPConfigs && !o.GenJavaConfigs {
-		return fmt.Errorf("both GenCPPConfigs & GenJavaConfigs were set to false which means there's no configs to generate")
+	if err := validatePlatformParams(o.PlatformParams); err != nil {
+		return fmt.Errorf("invalid PlatformParams: %w", err)
+	}
+	if len(enabledLanguages(o)) == 0 {
+		return fmt.Errorf("GenCPPConfigs, GenJavaConfigs, GenPythonConfigs, GenGoConfigs & GenRustConfigs were all set to false which means there's no configs to generate")
+	}
+	if o.GenPythonConfigs && o.ExecOS != OSLinux {
+		return fmt.Errorf("GenPythonConfigs is only supported when ExecOS is %q, got %q", OSLinux, o.ExecOS)
+	}
+	if o.GenGoConfigs && o.ExecOS != OSLinux {
+		return fmt.Errorf("GenGoConfigs is only supported when ExecOS is %q, got %q", OSLinux, o.ExecOS)
+	}
+	if o.GenRustConfigs && o.ExecOS != OSLinux {
+		return fmt.Errorf("GenRustConfigs is only supported when ExecOS is %q, got %q", OSLinux, o.ExecOS)
 	}
 	if o.GenCPPConfigs && len(o.CPPConfigTargets) == 0 {
 		return fmt.Errorf("GenCPPConfigs was true but CppConfigTargets was not specified")
@@ -267,18 +543,61 @@ func (o *Options) Validate() error {
 	if o.GenCPPConfigs && len(o.CppBazelCmd) == 0 {
 		return fmt.Errorf("GenCPPConfigs was true but CppBazelCmd was not specified")
 	}
+	if o.CppConfigMode == "" {
+		o.CppConfigMode = CppConfigModeBazel
+	}
+	if o.CppConfigMode != CppConfigModeBazel && o.CppConfigMode != CppConfigModeStatic {
+		return fmt.Errorf("invalid CppConfigMode, got %q, want one of %s, %s", o.CppConfigMode, CppConfigModeBazel, CppConfigModeStatic)
+	}
+	if o.CppConfigMode == CppConfigModeStatic && o.ContainerRuntime != RuntimeRootfs {
+		return fmt.Errorf("CppConfigMode %q requires ContainerRuntime %q, got %q", CppConfigModeStatic, RuntimeRootfs, o.ContainerRuntime)
+	}
+	if o.CppSymlinkMode == "" {
+		o.CppSymlinkMode = CppSymlinkModeInline
+	}
+	if o.CppSymlinkMode != CppSymlinkModePreserve && o.CppSymlinkMode != CppSymlinkModeInline {
+		return fmt.Errorf("invalid CppSymlinkMode, got %q, want one of %s, %s", o.CppSymlinkMode, CppSymlinkModePreserve, CppSymlinkModeInline)
+	}
 	if len(o.CppGenEnv) != 0 && len(o.CppGenEnvJSON) != 0 {
 		return fmt.Errorf("only one of CppGenEnv=%v or CppGenEnvJSON=%q must be specified", o.CppGenEnv, o.CppGenEnvJSON)
 	}
+	if o.GenJavaToolchains && !o.GenJavaConfigs {
+		return fmt.Errorf("GenJavaToolchains requires GenJavaConfigs")
+	}
+	if len(o.JavaHomeGlobs) != 0 && o.ExecOS != OSLinux {
+		return fmt.Errorf("JavaHomeGlobs=%v can only be specified when ExecOS is %q, got %q", o.JavaHomeGlobs, OSLinux, o.ExecOS)
+	}
+	for _, g := range o.JavaHomeGlobs {
+		if err := validateJavaHomeGlob(g); err != nil {
+			return fmt.Errorf("invalid JavaHomeGlobs: %w", err)
+		}
+	}
+	if o.JavaDefaultVersion != "" {
+		if _, err := strconv.Atoi(o.JavaDefaultVersion); err != nil {
+			return fmt.Errorf("JavaDefaultVersion must be a Java major version like 17, got %q", o.JavaDefaultVersion)
+		}
+	}
+	if o.TemplateDir != "" {
+		if err := validateTemplateDir(o.TemplateDir); err != nil {
+			return fmt.Errorf("invalid TemplateDir: %w", err)
+		}
+	}
 	log.Printf("rbeconfigsgen.Options:")
 	log.Printf("BazelVersion=%q", o.BazelVersion)
 	log.Printf("ToolchainContainer=%q", o.ToolchainContainer)
 	log.Printf("ExecOS=%q", o.ExecOS)
 	log.Printf("TargetOS=%q", o.TargetOS)
+	log.Printf("ExecArch=%q", o.ExecArch)
+	log.Printf("TargetArch=%q", o.TargetArch)
 	log.Printf("DockerPlatform=%q", o.DockerPlatform)
+	log.Printf("ContainerRuntime=%q", o.ContainerRuntime)
+	log.Printf("ImageArchive=%q", o.ImageArchive)
 	log.Printf("OutputTarball=%q", o.OutputTarball)
+	log.Printf("OutputFormat=%q", o.OutputFormat)
 	log.Printf("OutputSourceRoot=%q", o.OutputSourceRoot)
 	log.Printf("OutputConfigPath=%q", o.OutputConfigPath)
+	log.Printf("ConfigsRepoName=%q", o.ConfigsRepoName)
+	log.Printf("OutputMode=%q", o.OutputMode)
 	log.Printf("OutputManifest=%q", o.OutputManifest)
 	log.Printf("PlatformParams=%v", *o.PlatformParams)
 	log.Printf("GenCPPConfigs=%v", o.GenCPPConfigs)
@@ -287,9 +606,19 @@ func (o *Options) Validate() error {
 	log.Printf("CppBazelCmd=%q", o.CppBazelCmd)
 	log.Printf("CppGenEnv=%v", o.CppGenEnv)
 	log.Printf("CppGenEnvJSON=%q", o.CppGenEnvJSON)
+	log.Printf("CppConfigMode=%q", o.CppConfigMode)
+	log.Printf("CppSymlinkMode=%q", o.CppSymlinkMode)
 	log.Printf("GenJavaConfigs=%v", o.GenJavaConfigs)
 	log.Printf("JavaUseLocalRuntime=%v", o.JavaUseLocalRuntime)
+	log.Printf("GenJavaToolchains=%v", o.GenJavaToolchains)
+	log.Printf("JavaHomeGlobs=%v", o.JavaHomeGlobs)
+	log.Printf("JavaDefaultVersion=%q", o.JavaDefaultVersion)
+	log.Printf("GenPythonConfigs=%v", o.GenPythonConfigs)
+	log.Printf("GenGoConfigs=%v", o.GenGoConfigs)
+	log.Printf("GenRustConfigs=%v", o.GenRustConfigs)
+	log.Printf("TemplateDir=%q", o.TemplateDir)
 	log.Printf("TempWorkDir=%q", o.TempWorkDir)
 	log.Printf("Cleanup=%v", o.Cleanup)
+	log.Printf("DryRun=%v", o.DryRun)
 	return nil
 }
@@ -0,0 +1,299 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// outputDirChanges are the changes needed to update an output directory to the generated configs.
+// Paths are relative to the output directory.
+type outputDirChanges struct {
+	// added are the generated files that don't exist in the output directory.
+	added []string
+	// updated are the generated files whose contents, executable bit or type, i.e., whether they're
+	// symlinks, differ from the existing files in the output directory.
+	updated []string
+	// removed are the previously generated files in the output directory that are no longer
+	// generated.
+	removed []string
+}
+
+// planOutputDir returns the changes needed to update the output directory 'dir' to contain the
+// given generated files. 'previous' are the paths of the files generated into the output directory
+// earlier, e.g., as recorded in a manifest. Only those files are removed if they are no longer
+// generated such that other files in the output directory are never touched.
+func planOutputDir(dir string, files []generatedFile, previous []string) (outputDirChanges, error) {
+	var c outputDirChanges
+	generated := make(map[string]bool)
+	for _, g := range files {
+		generated[g.name] = true
+		existing, err := readGeneratedFile(dir, g.name)
+		if os.IsNotExist(err) {
+			c.added = append(c.added, g.name)
+			continue
+		}
+		if err != nil {
+			return outputDirChanges{}, fmt.Errorf("unable to read %q: %w", path.Join(dir, g.name), err)
+		}
+		if !bytes.Equal(existing.contents, g.contents) || existing.mode() != g.mode() {
+			c.updated = append(c.updated, g.name)
+		}
+	}
+	for _, p := range previous {
+		// Never delete files outside the output directory, e.g., because of a corrupted manifest.
+		if generated[p] || path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "..") {
+			continue
+		}
+		if _, err := os.Lstat(path.Join(dir, p)); err == nil {
+			c.removed = append(c.removed, p)
+		}
+	}
+	sort.Strings(c.added)
+	sort.Strings(c.updated)
+	sort.Strings(c.removed)
+	return c, nil
+}
+
+// onlyKnownFiles returns whether every file in the directory 'dir' is one of the given files.
+func onlyKnownFiles(dir string, known map[string]bool) (bool, error) {
+	errUnknown := fmt.Errorf("found a file that isn't known")
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if !known[filepath.ToSlash(rel)] {
+			return errUnknown
+		}
+		return nil
+	})
+	if err == errUnknown {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to list the files in %q: %w", dir, err)
+	}
+	return true, nil
+}
+
+// writeOutputDir updates the output directory 'dir' to contain exactly the given generated files
+// in addition to any file that wasn't previously generated, i.e., isn't in 'previous' (see
+// planOutputDir). The files are first written to a staging directory such that a failure while
+// writing them leaves the output directory untouched. If replaceDir is true, the staging directory
+// is created next to the output directory & atomically replaces it if it doesn't exist or only has
+// generated files. Otherwise, the staging directory is created inside the output directory, each
+// generated file atomically replaces the existing one & previously generated files that are no
+// longer generated are deleted. replaceDir must be false if the output directory is the root of
+// the source repository. If dryRun is true, the changes are only logged.
+func writeOutputDir(dir string, files []generatedFile, previous []string, replaceDir, dryRun bool) error {
+	c, err := planOutputDir(dir, files, previous)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		for _, p := range c.added {
+			log.Printf("Dry run: Would add %q.", path.Join(dir, p))
+		}
+		for _, p := range c.updated {
+			log.Printf("Dry run: Would update %q.", path.Join(dir, p))
+		}
+		for _, p := range c.removed {
+			log.Printf("Dry run: Would remove %q.", path.Join(dir, p))
+		}
+		log.Printf("Dry run: %d files would be added, %d updated & %d removed in %q.", len(c.added), len(c.updated), len(c.removed), dir)
+		return nil
+	}
+
+	dir = path.Clean(dir)
+	stagingParent := dir
+	if replaceDir {
+		stagingParent = path.Dir(dir)
+	}
+	if err := os.MkdirAll(stagingParent, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create directory %q: %w", stagingParent, err)
+	}
+	tmp, err := ioutil.TempDir(stagingParent, "."+path.Base(dir)+".staging-")
+	if err != nil {
+		return fmt.Errorf("unable to create a staging directory in %q: %w", stagingParent, err)
+	}
+	defer os.RemoveAll(tmp)
+	// Temporary directories are only accessible by the current user, so the staging directory that
+	// may replace the output directory is created in the temporary directory with the default
+	// permissions.
+	staging := path.Join(tmp, path.Base(dir))
+	if err := os.Mkdir(staging, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create the staging directory %q: %w", staging, err)
+	}
+	for _, g := range files {
+		if err := writeGeneratedFile(staging, g); err != nil {
+			return fmt.Errorf("unable to write %q to the staging directory %q: %w", g.name, staging, err)
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, g := range files {
+		known[g.name] = true
+	}
+	for _, p := range previous {
+		known[p] = true
+	}
+	swap := replaceDir
+	if _, err := os.Stat(dir); err == nil && swap {
+		if swap, err = onlyKnownFiles(dir, known); err != nil {
+			return err
+		}
+	}
+	if swap {
+		err = swapDir(dir, staging)
+	} else {
+		err = replaceFiles(dir, staging, files, c.removed)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Updated %q: %d files added, %d updated & %d removed.", dir, len(c.added), len(c.updated), len(c.removed))
+	return nil
+}
+
+// swapDir atomically replaces the directory 'dir', if it exists, with the directory 'staging'. The
+// previous contents of 'dir' are deleted but its permissions are kept.
+func swapDir(dir, staging string) error {
+	s, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		if err := os.Rename(staging, dir); err != nil {
+			return fmt.Errorf("unable to move the staging directory %q to %q: %w", staging, dir, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to stat %q: %w", dir, err)
+	}
+	if err := os.Chmod(staging, s.Mode().Perm()); err != nil {
+		return fmt.Errorf("unable to set the permissions of the staging directory %q: %w", staging, err)
+	}
+	old := staging + ".old"
+	if err := os.Rename(dir, old); err != nil {
+		return fmt.Errorf("unable to move %q out of the way: %w", dir, err)
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		if rerr := os.Rename(old, dir); rerr != nil {
+			log.Printf("Warning: Unable to restore %q from %q: %v", dir, old, rerr)
+		}
+		return fmt.Errorf("unable to move the staging directory %q to %q: %w", staging, dir, err)
+	}
+	if err := os.RemoveAll(old); err != nil {
+		log.Printf("Warning: Unable to delete the previous contents of %q moved to %q: %v", dir, old, err)
+	}
+	return nil
+}
+
+// replaceFiles atomically replaces each of the given generated files in the directory 'dir' with
+// the corresponding file in the directory 'staging' & deletes the given files that are no longer
+// generated along with directories left empty by their deletion.
+func replaceFiles(dir, staging string, files []generatedFile, removed []string) error {
+	for _, g := range files {
+		dst := path.Join(dir, g.name)
+		if err := os.MkdirAll(path.Dir(dst), os.ModePerm); err != nil {
+			return fmt.Errorf("unable to create directory %q: %w", path.Dir(dst), err)
+		}
+		if err := os.Rename(path.Join(staging, g.name), dst); err != nil {
+			return fmt.Errorf("unable to move %q from the staging directory %q to %q: %w", g.name, staging, dst, err)
+		}
+	}
+	for _, p := range removed {
+		if err := os.Remove(path.Join(dir, p)); err != nil {
+			return fmt.Errorf("unable to delete %q which is no longer generated: %w", path.Join(dir, p), err)
+		}
+		// Fails & stops at the first directory that isn't empty.
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			if err := os.Remove(path.Join(dir, d)); err != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// previousManifestFiles returns the paths of the files recorded in the manifest at the given path
+// written when configs were previously generated into the configs directory. Returns nil if the
+// manifest doesn't exist or doesn't list the generated files.
+func previousManifestFiles(manifestPath string, configPath string) []string {
+	if manifestPath == "" {
+		return nil
+	}
+	if _, err := os.Stat(manifestPath); err != nil {
+		return nil
+	}
+	m, err := ManifestFromJSONFile(manifestPath)
+	if err != nil {
+		log.Printf("Warning: Unable to read the previous manifest to delete configs that are no longer generated: %v", err)
+		return nil
+	}
+	if m.Options != nil && m.Options.OutputConfigPath != configPath {
+		log.Printf("Warning: Not deleting configs that are no longer generated because the previous manifest %q describes configs generated into %q instead of %q.", manifestPath, m.Options.OutputConfigPath, configPath)
+		return nil
+	}
+	var result []string
+	for _, f := range m.Files {
+		result = append(result, f.Path)
+	}
+	return result
+}
+
+// previousBundleManifestFiles returns the paths of the files recorded in the bundle manifest at
+// the given path written when a configs bundle was previously generated into the configs
+// directory. The configs of each entry are expected in the subdirectory of the configs directory
+// named after it. Returns nil if the manifest doesn't exist or doesn't list the generated files.
+func previousBundleManifestFiles(manifestPath string, configPath string) []string {
+	if manifestPath == "" {
+		return nil
+	}
+	blob, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil
+	}
+	m := BundleManifest{}
+	if err := json.Unmarshal(blob, &m); err != nil {
+		log.Printf("Warning: Unable to read the previous bundle manifest to delete configs that are no longer generated: %v", err)
+		return nil
+	}
+	var result []string
+	for _, f := range m.Files {
+		result = append(result, f.Path)
+	}
+	for _, e := range m.Configs {
+		if want := path.Join(configPath, e.Name); e.Options != nil && e.Options.OutputConfigPath != want {
+			log.Printf("Warning: Not deleting configs that are no longer generated because the previous bundle manifest %q describes configs generated into %q instead of %q.", manifestPath, e.Options.OutputConfigPath, want)
+			return nil
+		}
+		for _, f := range e.Files {
+			result = append(result, path.Join(e.Name, f.Path))
+		}
+	}
+	return result
+}
@@ -0,0 +1,353 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeTestFiles writes the given files mapping paths relative to the given directory to their
+// contents.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		if err := writeGeneratedFile(dir, generatedFile{name: name, contents: []byte(contents)}); err != nil {
+			t.Fatalf("Unable to write %q: %v", name, err)
+		}
+	}
+}
+
+// readTestFiles returns the files in the given directory mapping paths relative to the directory
+// to their contents.
+func readTestFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	result := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		result[filepath.ToSlash(rel)] = string(contents)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to read the files in %q: %v", dir, err)
+	}
+	return result
+}
+
+func TestWriteOutputDir(t *testing.T) {
+	generated := []generatedFile{
+		{name: "LICENSE", contents: []byte("license")},
+		{name: "cc/BUILD", contents: []byte("cc_toolchain()")},
+		{name: "cc/cc_wrapper.sh", contents: []byte("#!/bin/bash"), executable: true},
+	}
+	tests := []struct {
+		name string
+		// existing are the files in the output directory before it's written or nil if the
+		// directory doesn't exist.
+		existing map[string]string
+		previous []string
+		// sourceRoot determines whether the output directory is the source root & thus must not be
+		// replaced as a whole.
+		sourceRoot bool
+		dryRun     bool
+		want       map[string]string
+		// wantChanges are the changes planned for the output directory.
+		wantChanges outputDirChanges
+		// wantDeletedDirs are the directories left empty by the removed files that are deleted.
+		wantDeletedDirs []string
+	}{
+		{
+			name: "NewDir",
+			want: map[string]string{
+				"LICENSE":          "license",
+				"cc/BUILD":         "cc_toolchain()",
+				"cc/cc_wrapper.sh": "#!/bin/bash",
+			},
+			wantChanges: outputDirChanges{added: []string{"LICENSE", "cc/BUILD", "cc/cc_wrapper.sh"}},
+		},
+		{
+			name: "RemovesStaleFiles",
+			existing: map[string]string{
+				"LICENSE":           "license",
+				"cc/BUILD":          "old_cc_toolchain()",
+				"cc/armeabi/BUILD":  "old",
+				"cc/cc_wrapper.sh":  "#!/bin/bash",
+				"java/BUILD":        "java_runtime()",
+				"java/extra/README": "old",
+			},
+			previous: []string{"LICENSE", "cc/BUILD", "cc/armeabi/BUILD", "cc/cc_wrapper.sh", "java/BUILD", "java/extra/README"},
+			want: map[string]string{
+				"LICENSE":          "license",
+				"cc/BUILD":         "cc_toolchain()",
+				"cc/cc_wrapper.sh": "#!/bin/bash",
+			},
+			wantChanges: outputDirChanges{
+				updated: []string{"cc/BUILD", "cc/cc_wrapper.sh"},
+				removed: []string{"cc/armeabi/BUILD", "java/BUILD", "java/extra/README"},
+			},
+			wantDeletedDirs: []string{"cc/armeabi", "java"},
+		},
+		{
+			name: "SourceRoot",
+			existing: map[string]string{
+				"cc/BUILD":   "old_cc_toolchain()",
+				"java/BUILD": "java_runtime()",
+			},
+			previous:   []string{"cc/BUILD", "java/BUILD"},
+			sourceRoot: true,
+			want: map[string]string{
+				"LICENSE":          "license",
+				"cc/BUILD":         "cc_toolchain()",
+				"cc/cc_wrapper.sh": "#!/bin/bash",
+			},
+			wantChanges: outputDirChanges{
+				added:   []string{"LICENSE", "cc/cc_wrapper.sh"},
+				updated: []string{"cc/BUILD"},
+				removed: []string{"java/BUILD"},
+			},
+			wantDeletedDirs: []string{"java"},
+		},
+		{
+			name: "KeepsOtherFiles",
+			existing: map[string]string{
+				"WORKSPACE":        "workspace",
+				"cc/BUILD":         "old_cc_toolchain()",
+				"cc/armeabi/BUILD": "old",
+				"cc/custom.bzl":    "custom",
+				"java/BUILD":       "java_runtime()",
+			},
+			previous: []string{"LICENSE", "cc/BUILD", "cc/armeabi/BUILD", "java/BUILD", "../WORKSPACE"},
+			want: map[string]string{
+				"WORKSPACE":        "workspace",
+				"LICENSE":          "license",
+				"cc/BUILD":         "cc_toolchain()",
+				"cc/cc_wrapper.sh": "#!/bin/bash",
+				"cc/custom.bzl":    "custom",
+			},
+			wantChanges: outputDirChanges{
+				added:   []string{"LICENSE", "cc/cc_wrapper.sh"},
+				updated: []string{"cc/BUILD"},
+				removed: []string{"cc/armeabi/BUILD", "java/BUILD"},
+			},
+			wantDeletedDirs: []string{"cc/armeabi", "java"},
+		},
+		{
+			name: "DryRun",
+			existing: map[string]string{
+				"cc/BUILD":   "old_cc_toolchain()",
+				"java/BUILD": "java_runtime()",
+			},
+			previous: []string{"cc/BUILD", "java/BUILD"},
+			dryRun:   true,
+			want: map[string]string{
+				"cc/BUILD":   "old_cc_toolchain()",
+				"java/BUILD": "java_runtime()",
+			},
+			wantChanges: outputDirChanges{
+				added:   []string{"LICENSE", "cc/cc_wrapper.sh"},
+				updated: []string{"cc/BUILD"},
+				removed: []string{"java/BUILD"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			root := t.TempDir()
+			dir := path.Join(root, "configs")
+			// The permissions of an existing output directory are kept. Otherwise, the output
+			// directory is created with the default permissions.
+			wantPerm := os.FileMode(0750)
+			if tc.existing != nil {
+				writeTestFiles(t, dir, tc.existing)
+				if err := os.Chmod(dir, wantPerm); err != nil {
+					t.Fatalf("Unable to change the permissions of %q: %v", dir, err)
+				}
+			} else {
+				d := path.Join(t.TempDir(), "default")
+				if err := os.Mkdir(d, os.ModePerm); err != nil {
+					t.Fatalf("Unable to create %q: %v", d, err)
+				}
+				s, err := os.Stat(d)
+				if err != nil {
+					t.Fatalf("Unable to stat %q: %v", d, err)
+				}
+				wantPerm = s.Mode().Perm()
+			}
+			before, _ := os.Stat(dir)
+			c, err := planOutputDir(dir, generated, tc.previous)
+			if err != nil {
+				t.Fatalf("planOutputDir failed: %v", err)
+			}
+			if !reflect.DeepEqual(c, tc.wantChanges) {
+				t.Errorf("planOutputDir got changes %+v, want %+v", c, tc.wantChanges)
+			}
+			if err := writeOutputDir(dir, generated, tc.previous, !tc.sourceRoot, tc.dryRun); err != nil {
+				t.Fatalf("writeOutputDir failed: %v", err)
+			}
+			after, err := os.Stat(dir)
+			if err != nil && !tc.dryRun {
+				t.Fatalf("Unable to stat %q: %v", dir, err)
+			}
+			if err == nil && after.Mode().Perm() != wantPerm {
+				t.Errorf("writeOutputDir left %q with permissions %v, want %v", dir, after.Mode().Perm(), wantPerm)
+			}
+			if tc.sourceRoot && !os.SameFile(before, after) {
+				t.Errorf("writeOutputDir replaced the source root %q, want it to only replace files in it", dir)
+			}
+			if got := readTestFiles(t, dir); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("writeOutputDir wrote files %v, want %v", got, tc.want)
+			}
+			if !tc.dryRun {
+				s, err := os.Stat(path.Join(dir, "cc", "cc_wrapper.sh"))
+				if err != nil {
+					t.Fatalf("Unable to stat cc_wrapper.sh: %v", err)
+				}
+				if s.Mode()&0111 == 0 {
+					t.Errorf("writeOutputDir wrote cc_wrapper.sh with mode %v, want it to be executable", s.Mode())
+				}
+			}
+			for _, d := range tc.wantDeletedDirs {
+				if _, err := os.Stat(path.Join(dir, d)); !os.IsNotExist(err) {
+					t.Errorf("writeOutputDir didn't delete the empty directory %q, got stat error %v", d, err)
+				}
+			}
+			// The staging directory is always deleted.
+			entries, err := ioutil.ReadDir(root)
+			if err != nil {
+				t.Fatalf("Unable to list %q: %v", root, err)
+			}
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			if !reflect.DeepEqual(names, []string{"configs"}) {
+				t.Errorf("writeOutputDir left %v next to the output directory, want only configs", names)
+			}
+		})
+	}
+}
+
+func TestRunRemovesStaleConfigs(t *testing.T) {
+	root := t.TempDir()
+	newOptions := func(genRust bool) Options {
+		o := Options{
+			BazelVersion:       "6.0.0",
+			ToolchainContainer: "gcr.io/foo/bar:latest",
+			ExecOS:             OSLinux,
+			TargetOS:           OSLinux,
+			OutputSourceRoot:   root,
+			OutputConfigPath:   "configs",
+			OutputManifest:     path.Join(root, "manifest.json"),
+			GenGoConfigs:       true,
+			GenRustConfigs:     genRust,
+			TempWorkDir:        t.TempDir(),
+			Cleanup:            true,
+		}
+		if err := o.ApplyDefaults(o.ExecOS); err != nil {
+			t.Fatalf("ApplyDefaults failed: %v", err)
+		}
+		return o
+	}
+	rt := &fakeRuntime{
+		image:         "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:           []string{"PATH=/bin"},
+		goSDK:         []string{"/usr/local/go/bin/go", "/usr/local/go", "go1.21.5", "linux", "amd64"},
+		rustToolchain: rustProbeOutput,
+	}
+	if err := run(newOptions(true), rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	writeTestFiles(t, path.Join(root, "configs"), map[string]string{"rust/custom.bzl": "custom"})
+
+	// A dry run doesn't change anything.
+	o := newOptions(false)
+	o.DryRun = true
+	before := readTestFiles(t, root)
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if got := readTestFiles(t, root); !reflect.DeepEqual(got, before) {
+		t.Errorf("Dry run changed the output directory, got files %v, want %v", got, before)
+	}
+
+	if err := run(newOptions(false), rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	var got []string
+	for name := range readTestFiles(t, root) {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	want := []string{"configs/LICENSE", "configs/config/BUILD", "configs/configs.bazelrc", "configs/go/BUILD", "configs/go/sdk.bzl", "configs/rust/custom.bzl", "manifest.json"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Output directory got files %v after Rust configs were disabled, want %v", got, want)
+	}
+}
+
+func TestWriteOutputDirSymlinks(t *testing.T) {
+	dir := path.Join(t.TempDir(), "configs")
+	files := []generatedFile{
+		{name: "cc/cc_wrapper.sh", contents: []byte("#!/bin/bash"), executable: true},
+		{name: "cc/tools/cc_wrapper.sh", contents: []byte("../cc_wrapper.sh"), symlink: true},
+	}
+	if err := writeOutputDir(dir, files, nil, true, false); err != nil {
+		t.Fatalf("writeOutputDir failed: %v", err)
+	}
+	for _, want := range files {
+		got, err := readGeneratedFile(dir, want.name)
+		if err != nil {
+			t.Fatalf("Unable to read %q: %v", want.name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("writeOutputDir wrote %+v, want %+v", got, want)
+		}
+	}
+	c, err := planOutputDir(dir, files, nil)
+	if err != nil {
+		t.Fatalf("planOutputDir failed: %v", err)
+	}
+	if !reflect.DeepEqual(c, outputDirChanges{}) {
+		t.Errorf("planOutputDir got changes %+v for an up to date directory, want none", c)
+	}
+
+	// Replacing the symlink with a copy of the file it points to is a change even though the
+	// contents read through the symlink are the same.
+	inlined := []generatedFile{files[0], {name: "cc/tools/cc_wrapper.sh", contents: []byte("#!/bin/bash"), executable: true}}
+	c, err = planOutputDir(dir, inlined, nil)
+	if err != nil {
+		t.Fatalf("planOutputDir failed: %v", err)
+	}
+	if want := (outputDirChanges{updated: []string{"cc/tools/cc_wrapper.sh"}}); !reflect.DeepEqual(c, want) {
+		t.Errorf("planOutputDir got changes %+v after inlining the symlink, want %+v", c, want)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+const (
+	// templateOverrideSuffix is the suffix of the files in a template directory overriding the
+	// template of the generated file with the same path without the suffix, e.g., config/BUILD.tmpl
+	// overrides the template of config/BUILD.
+	templateOverrideSuffix = ".tmpl"
+)
+
+// templateOverridePath returns the path of the file in the given template directory overriding the
+// template of the file generated using the given registry.
+func templateOverridePath(dir string, r templateRegistry) string {
+	return filepath.Join(dir, filepath.FromSlash(r.file)+templateOverrideSuffix)
+}
+
+// loadTemplateOverride loads the template overriding the templates of the given registry from the
+// given template directory. Returns a nil template if the directory doesn't override the templates
+// of the given registry.
+func loadTemplateOverride(dir string, r templateRegistry) (*template.Template, error) {
+	p := templateOverridePath(dir, r)
+	blob, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read template override %q: %w", p, err)
+	}
+	t, err := template.New(r.file + templateOverrideSuffix).Parse(string(blob))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template override %q: %w", p, err)
+	}
+	if err := checkTemplateFields(t, r.params); err != nil {
+		return nil, fmt.Errorf("invalid template override %q: %w", p, err)
+	}
+	return t, nil
+}
+
+// templateFor returns the template used to generate the file of the given registry for the given
+// options, i.e., the template override in TemplateDir if there's one or the compiled-in template
+// for the Bazel version otherwise.
+func templateFor(o *Options, r templateRegistry) (*template.Template, error) {
+	if o.TemplateDir != "" {
+		t, err := loadTemplateOverride(o.TemplateDir, r)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			return t, nil
+		}
+	}
+	return r.lookup(o.BazelVersion)
+}
+
+// validateTemplateDir verifies every file in the given template directory overrides the template
+// of a generated file & only references fields of the parameters of that template.
+func validateTemplateDir(dir string) error {
+	s, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("unable to stat template directory %q: %w", dir, err)
+	}
+	if !s.IsDir() {
+		return fmt.Errorf("template directory %q isn't a directory", dir)
+	}
+	known := make(map[string]templateRegistry)
+	var names []string
+	for _, r := range overridableTemplateRegistries {
+		known[r.file+templateOverrideSuffix] = r
+		names = append(names, r.file+templateOverrideSuffix)
+	}
+	sort.Strings(names)
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return fmt.Errorf("unable to determine the path of %q relative to template directory %q: %w", p, dir, err)
+		}
+		r, ok := known[filepath.ToSlash(rel)]
+		if !ok {
+			return fmt.Errorf("%q in template directory %q doesn't override a known template, want one of %s", filepath.ToSlash(rel), dir, strings.Join(names, ", "))
+		}
+		_, err = loadTemplateOverride(dir, r)
+		return err
+	})
+}
+
+// checkTemplateFields verifies the given template only references fields that exist in the given
+// parameters type. Fields are checked wherever the type of dot can be determined statically, i.e.,
+// at the top level, in range loops over fields & in with blocks.
+func checkTemplateFields(t *template.Template, params reflect.Type) error {
+	c := &fieldChecker{tree: t.Tree, root: params}
+	if t.Tree != nil {
+		c.walk(t.Tree.Root, params)
+	}
+	if len(c.errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(c.errs, "; "))
+	}
+	return nil
+}
+
+// fieldChecker walks the parse tree of a template keeping track of the type of dot to find
+// references to unknown fields.
+type fieldChecker struct {
+	tree *parse.Tree
+	// root is the type of the parameters the template is executed with.
+	root reflect.Type
+	errs []string
+}
+
+func (c *fieldChecker) errorf(n parse.Node, format string, args ...interface{}) {
+	loc, _ := c.tree.ErrorContext(n)
+	c.errs = append(c.errs, fmt.Sprintf("%s: %s", loc, fmt.Sprintf(format, args...)))
+}
+
+// walk checks the given node where dot has the given type. A nil type means the type of dot is
+// unknown.
+func (c *fieldChecker) walk(n parse.Node, dot reflect.Type) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, m := range n.Nodes {
+			c.walk(m, dot)
+		}
+	case *parse.ActionNode:
+		c.pipe(n.Pipe, dot)
+	case *parse.IfNode:
+		c.pipe(n.Pipe, dot)
+		c.walk(n.List, dot)
+		c.walk(n.ElseList, dot)
+	case *parse.RangeNode:
+		t := c.pipe(n.Pipe, dot)
+		c.walk(n.List, elemType(t))
+		c.walk(n.ElseList, dot)
+	case *parse.WithNode:
+		t := c.pipe(n.Pipe, dot)
+		c.walk(n.List, t)
+		c.walk(n.ElseList, dot)
+	case *parse.TemplateNode:
+		c.pipe(n.Pipe, dot)
+	}
+}
+
+// pipe checks the given pipeline & returns the type of its result if it's a single field
+// reference or nil otherwise.
+func (c *fieldChecker) pipe(p *parse.PipeNode, dot reflect.Type) reflect.Type {
+	if p == nil {
+		return nil
+	}
+	var result reflect.Type
+	for _, cmd := range p.Cmds {
+		for _, arg := range cmd.Args {
+			t := c.arg(arg, dot)
+			if len(p.Cmds) == 1 && len(cmd.Args) == 1 {
+				result = t
+			}
+		}
+	}
+	return result
+}
+
+// arg checks the given argument of a command & returns its type if known.
+func (c *fieldChecker) arg(n parse.Node, dot reflect.Type) reflect.Type {
+	switch n := n.(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		return c.fields(n, n.Ident, dot)
+	case *parse.VariableNode:
+		// $ always refers to the parameters the template is executed with.
+		if n.Ident[0] == "$" {
+			return c.fields(n, n.Ident[1:], c.root)
+		}
+	case *parse.PipeNode:
+		return c.pipe(n, dot)
+	case *parse.ChainNode:
+		c.arg(n.Node, dot)
+	}
+	return nil
+}
+
+// fields resolves the given chain of fields starting at the given type & returns the resulting
+// type if known.
+func (c *fieldChecker) fields(n parse.Node, idents []string, t reflect.Type) reflect.Type {
+	for _, id := range idents {
+		if t == nil {
+			return nil
+		}
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if m, ok := reflect.PtrTo(t).MethodByName(id); ok {
+			if m.Type.NumOut() == 0 {
+				return nil
+			}
+			t = m.Type.Out(0)
+			continue
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			f, ok := t.FieldByName(id)
+			if !ok || f.PkgPath != "" {
+				c.errorf(n, "unknown field %s in %s", id, t.Name())
+				return nil
+			}
+			t = f.Type
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Interface:
+			return nil
+		default:
+			c.errorf(n, "can't evaluate field %s in type %s", id, t)
+			return nil
+		}
+	}
+	return t
+}
+
+// elemType returns the type of dot when ranging over a value of the given type if known.
+func elemType(t reflect.Type) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return t.Elem()
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTemplateDir creates a template directory with the given files mapping paths relative to
+// the directory to their contents.
+func writeTemplateDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			t.Fatalf("Failed to create directory for %q: %v", p, err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write %q: %v", p, err)
+		}
+	}
+	return dir
+}
+
+func TestTemplateOverrides(t *testing.T) {
+	dir := writeTemplateDir(t, map[string]string{
+		"config/BUILD.tmpl": `# Copyright Example Corp.
+load("//tools:defs.bzl", "internal_platform")
+
+internal_platform(
+    name = "platform",
+    container = "{{ .ToolchainContainer }}",
+    os = "{{ .OSFamily }}",
+{{ range .Variants }}    variant = "{{ .Name }}",
+{{ end }})
+`,
+		"java/BUILD.tmpl": `# Copyright Example Corp.
+java_runtime(name = "jdk", java_home = "{{ .JavaHome }}", version = "{{ $.JavaVersion }}")
+`,
+	})
+	if err := validateTemplateDir(dir); err != nil {
+		t.Fatalf("validateTemplateDir(%q) failed: %v", dir, err)
+	}
+	o := &Options{
+		TemplateDir: dir,
+		OutputMode:  OutputModeWorkspace,
+		PlatformParams: &PlatformToolchainsTemplateParams{
+			ToolchainContainer: "example.com/image@sha256:abc",
+			OSFamily:           "Linux",
+			Variants:           []PlatformVariant{{Name: "large"}},
+		},
+	}
+	f, err := genConfigBuild(o)
+	if err != nil {
+		t.Fatalf("genConfigBuild failed: %v", err)
+	}
+	want := `# Copyright Example Corp.
+load("//tools:defs.bzl", "internal_platform")
+
+internal_platform(
+    name = "platform",
+    container = "example.com/image@sha256:abc",
+    os = "Linux",
+    variant = "large",
+)
+`
+	if got := string(f.contents); got != want {
+		t.Errorf("genConfigBuild generated %s:\n%s\nwant:\n%s", f.name, got, want)
+	}
+
+	jt, err := getJavaTemplate(o)
+	if err != nil {
+		t.Fatalf("getJavaTemplate failed: %v", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := jt.Execute(buf, javaBuildTemplateParams{JavaHome: "/usr/lib/jvm", JavaVersion: "11"}); err != nil {
+		t.Fatalf("Failed to execute the Java template override: %v", err)
+	}
+	wantJava := `# Copyright Example Corp.
+java_runtime(name = "jdk", java_home = "/usr/lib/jvm", version = "11")
+`
+	if got := buf.String(); got != wantJava {
+		t.Errorf("Java template override generated:\n%s\nwant:\n%s", got, wantJava)
+	}
+}
+
+func TestTemplateOverridesFallBackToBuiltin(t *testing.T) {
+	dir := writeTemplateDir(t, map[string]string{
+		"java/BUILD.tmpl": "# {{ .JavaHome }}\n",
+	})
+	o := &Options{
+		TemplateDir:  dir,
+		BazelVersion: "7.0.0",
+	}
+	got, err := templateFor(o, configBuildTemplates)
+	if err != nil {
+		t.Fatalf("templateFor(%s) failed: %v", configBuildTemplates.file, err)
+	}
+	if got != platformsToolchainBuildTemplate {
+		t.Errorf("templateFor(%s) didn't return the built-in template for a directory without an override", configBuildTemplates.file)
+	}
+}
+
+func TestValidateTemplateDirErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name:    "UnknownField",
+			files:   map[string]string{"config/BUILD.tmpl": "{{ .ToolchainImage }}"},
+			wantErr: "unknown field ToolchainImage",
+		},
+		{
+			name:    "UnknownFieldInRange",
+			files:   map[string]string{"config/BUILD.tmpl": "{{ range .Variants }}{{ .Pool }}{{ end }}"},
+			wantErr: "unknown field Pool in PlatformVariant",
+		},
+		{
+			name:    "UnknownFieldInWith",
+			files:   map[string]string{"config/BUILD.tmpl": "{{ with .Variants }}{{ .Name }}{{ end }}"},
+			wantErr: "can't evaluate field Name",
+		},
+		{
+			name:    "UnknownRootField",
+			files:   map[string]string{"java/BUILD.tmpl": "{{ range $k, $v := .Foo }}{{ $.JavaRoot }}{{ end }}"},
+			wantErr: "unknown field Foo in javaBuildTemplateParams",
+		},
+		{
+			name:    "UnknownRootFieldInRange",
+			files:   map[string]string{"config/BUILD.tmpl": "{{ range .Variants }}{{ $.Pool }}{{ end }}"},
+			wantErr: "unknown field Pool in PlatformToolchainsTemplateParams",
+		},
+		{
+			name:    "UnknownFile",
+			files:   map[string]string{"cc/BUILD.tmpl": "# C++"},
+			wantErr: "doesn't override a known template",
+		},
+		{
+			name:    "ParseError",
+			files:   map[string]string{"java/BUILD.tmpl": "{{ .JavaHome "},
+			wantErr: "unable to parse template override",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := writeTemplateDir(t, tc.files)
+			err := validateTemplateDir(dir)
+			if err == nil {
+				t.Fatalf("validateTemplateDir(%v) succeeded, want error containing %q", tc.files, tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("validateTemplateDir(%v) got error %v, want error containing %q", tc.files, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	// pythonProbeScript prints the path, resolved path & version of every python3 interpreter in
+	// the toolchain container separated by tabs, starting with the python3 in the PATH.
+	pythonProbeScript = `for p in "$(command -v python3)" /usr/bin/python3* /usr/local/bin/python3* /opt/python*/bin/python3*; do
+  case "$(basename "$p")" in python3|python3.[0-9]|python3.[0-9][0-9]) ;; *) continue ;; esac
+  if [ -x "$p" ]; then
+    printf '%s\t%s\t%s\n' "$p" "$(readlink -f "$p")" "$("$p" -c 'import sys; print("%d.%d.%d" % sys.version_info[:3])' 2>/dev/null)"
+  fi
+done`
+)
+
+var (
+	// pythonBuildTemplate is the template for the BUILD file with the Python toolchain using the
+	// python3 interpreters installed in the toolchain container.
+	pythonBuildTemplate = template.Must(template.New("pythonBuild").Parse(buildHeader + `
+load("@bazel_tools//tools/python:toolchain.bzl", "py_runtime_pair")
+
+package(default_visibility = ["//visibility:public"])
+{{ range .Interpreters }}
+# Python {{ .Version }}.
+py_runtime(
+    name = "{{ .Name }}",
+    interpreter_path = "{{ .Path }}",
+    python_version = "PY3",
+)
+{{ end }}
+py_runtime_pair(
+    name = "py_runtime_pair",
+    py3_runtime = ":{{ .DefaultRuntime }}",
+)
+
+toolchain(
+    name = "py_toolchain",
+    exec_compatible_with = [
+{{ range .ExecConstraints }}        "{{ . }}",
+{{ end }}    ],
+    target_compatible_with = [
+{{ range .TargetConstraints }}        "{{ . }}",
+{{ end }}    ],
+    toolchain = ":py_runtime_pair",
+    toolchain_type = "@bazel_tools//tools/python:toolchain_type",
+)
+`))
+
+	// pythonVersionRegexp matches the versions printed by the probed python3 interpreters.
+	pythonVersionRegexp = regexp.MustCompile(`^3\.([0-9]+)\.[0-9]+$`)
+)
+
+// pythonInterpreter is a python3 interpreter installed in the toolchain container.
+type pythonInterpreter struct {
+	// Name is the name of the py_runtime target generated for the interpreter.
+	Name    string
+	Path    string
+	Version string
+}
+
+// pythonBuildTemplateParams is used as the input to the Python toolchain BUILD file template.
+type pythonBuildTemplateParams struct {
+	// Interpreters are all the python3 interpreters installed in the toolchain container.
+	Interpreters []pythonInterpreter
+	// DefaultRuntime is the name of the runtime used by the Python toolchain.
+	DefaultRuntime    string
+	ExecConstraints   []string
+	TargetConstraints []string
+}
+
+// parsePythonInterpreters returns the python3 interpreters in the given output of
+// pythonProbeScript. Interpreters resolving to the same path or with the same minor version as an
+// earlier interpreter are skipped.
+func parsePythonInterpreters(out string) []pythonInterpreter {
+	var result []pythonInterpreter
+	seenPaths := make(map[string]bool)
+	seenVersions := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		p, resolved, version := fields[0], fields[1], fields[2]
+		m := pythonVersionRegexp.FindStringSubmatch(version)
+		if m == nil {
+			log.Printf("Skipping Python interpreter %q because its version %q couldn't be determined.", p, version)
+			continue
+		}
+		if seenPaths[resolved] {
+			continue
+		}
+		seenPaths[resolved] = true
+		if seenVersions[m[1]] {
+			log.Printf("Skipping Python interpreter %q because an interpreter for Python 3.%s was already found.", p, m[1])
+			continue
+		}
+		seenVersions[m[1]] = true
+		result = append(result, pythonInterpreter{
+			Name:    fmt.Sprintf("rbe_python3_%s", m[1]),
+			Path:    p,
+			Version: version,
+		})
+	}
+	return result
+}
+
+// pythonGenerator generates the Python configs in the python directory, i.e., a py_runtime for
+// every python3 interpreter found in the toolchain container & a Python toolchain using the
+// python3 in the PATH of the container or the first interpreter found if python3 isn't in the
+// PATH.
+type pythonGenerator struct{}
+
+func (pythonGenerator) name() string {
+	return "python"
+}
+
+func (pythonGenerator) enabled(o *Options) bool {
+	return o.GenPythonConfigs
+}
+
+func (pythonGenerator) generate(d *dockerRunner, o *Options) (*languageConfigs, error) {
+	out, err := d.execCmd("sh", "-c", pythonProbeScript)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look for python3 interpreters in the toolchain container: %w", err)
+	}
+	interpreters := parsePythonInterpreters(out)
+	if len(interpreters) == 0 {
+		return nil, fmt.Errorf("no python3 interpreter was found in the toolchain container")
+	}
+	for _, i := range interpreters {
+		log.Printf("Found Python %s interpreter at %q.", i.Version, i.Path)
+	}
+	t, err := templateFor(o, pythonBuildTemplates)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := t.Execute(buf, &pythonBuildTemplateParams{
+		Interpreters:      interpreters,
+		DefaultRuntime:    interpreters[0].Name,
+		ExecConstraints:   o.PlatformParams.ExecConstraints,
+		TargetConstraints: o.PlatformParams.TargetConstraints,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to generate the contents of the BUILD file with the Python toolchain definition: %w", err)
+	}
+	return &languageConfigs{
+		files: []generatedFile{{
+			name:     "python/BUILD",
+			contents: buf.Bytes(),
+		}},
+		manifest: map[string]string{
+			"interpreter": interpreters[0].Path,
+			"version":     interpreters[0].Version,
+		},
+	}, nil
+}
+
+func (pythonGenerator) bazelrc(o *Options) (*bazelrcSection, error) {
+	// The Python toolchain is only selected by registering it.
+	if o.OutputMode == OutputModeBzlmod {
+		return nil, nil
+	}
+	return &bazelrcSection{
+		Title: "Python toolchain configuration",
+		Flags: []string{"--extra_toolchains=" + configLabel(o, "python", "py_toolchain")},
+	}, nil
+}
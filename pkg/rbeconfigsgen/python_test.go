@@ -0,0 +1,121 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParsePythonInterpreters(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []pythonInterpreter
+	}{
+		{
+			name: "Single",
+			out:  "/usr/bin/python3\t/usr/bin/python3.8\t3.8.10\n",
+			want: []pythonInterpreter{
+				{Name: "rbe_python3_8", Path: "/usr/bin/python3", Version: "3.8.10"},
+			},
+		},
+		{
+			name: "SymlinksAndSameMinorVersionSkipped",
+			out: strings.Join([]string{
+				"/usr/local/bin/python3\t/usr/local/bin/python3.11\t3.11.4",
+				"/usr/bin/python3\t/usr/bin/python3.8\t3.8.10",
+				"/usr/bin/python3.8\t/usr/bin/python3.8\t3.8.10",
+				"/usr/local/bin/python3.11\t/usr/local/bin/python3.11\t3.11.4",
+				"/opt/python3.11/bin/python3\t/opt/python3.11/bin/python3.11\t3.11.2",
+			}, "\n"),
+			want: []pythonInterpreter{
+				{Name: "rbe_python3_11", Path: "/usr/local/bin/python3", Version: "3.11.4"},
+				{Name: "rbe_python3_8", Path: "/usr/bin/python3", Version: "3.8.10"},
+			},
+		},
+		{
+			name: "UnknownVersionSkipped",
+			out:  "/usr/bin/python3.4\t/usr/bin/python3.4\t\n/usr/bin/python3\t/usr/bin/python3.9\t3.9.2\n",
+			want: []pythonInterpreter{
+				{Name: "rbe_python3_9", Path: "/usr/bin/python3", Version: "3.9.2"},
+			},
+		},
+		{
+			name: "None",
+			out:  "",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got := parsePythonInterpreters(tc.out)
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("parsePythonInterpreters(%q)=%v, want %v", tc.out, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunWithPythonConfigs(t *testing.T) {
+	dir := t.TempDir()
+	rt := &fakeRuntime{
+		image:       "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:         []string{"PATH=/bin", "JAVA_HOME=/jdk"},
+		javaVersion: "11.0.10",
+		pythonInterpreters: []string{
+			"/usr/bin/python3\t/usr/bin/python3.8\t3.8.10",
+			"/usr/bin/python3.11\t/usr/bin/python3.11\t3.11.4",
+		},
+	}
+	o := Options{
+		BazelVersion:       "6.0.0",
+		BazelPath:          "/usr/bin/bazel",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      path.Join(dir, "configs.tar"),
+		GenPythonConfigs:   true,
+		TempWorkDir:        t.TempDir(),
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	files := readTarball(t, o.OutputTarball)
+	for _, want := range []string{
+		"# Python 3.8.10.\npy_runtime(\n    name = \"rbe_python3_8\",\n    interpreter_path = \"/usr/bin/python3\",\n    python_version = \"PY3\",\n)\n",
+		"# Python 3.11.4.\npy_runtime(\n    name = \"rbe_python3_11\",\n    interpreter_path = \"/usr/bin/python3.11\",\n    python_version = \"PY3\",\n)\n",
+		"    py3_runtime = \":rbe_python3_8\",\n",
+		"    exec_compatible_with = [\n        \"@platforms//os:linux\",\n        \"@platforms//cpu:x86_64\",\n        \"@bazel_tools//tools/cpp:clang\",\n    ],\n",
+		"    toolchain_type = \"@bazel_tools//tools/python:toolchain_type\",\n",
+	} {
+		if !strings.Contains(files["python/BUILD"], want) {
+			t.Errorf("python/BUILD did not contain %q, got:\n%s", want, files["python/BUILD"])
+		}
+	}
+	if _, ok := files["java/BUILD"]; ok {
+		t.Errorf("Output tarball contained java/BUILD even though Java config generation was disabled")
+	}
+	if want := "build:remote --extra_toolchains=@rbe_default//python:py_toolchain\n"; !strings.Contains(files["configs.bazelrc"], want) {
+		t.Errorf("configs.bazelrc did not contain %q, got:\n%s", want, files["configs.bazelrc"])
+	}
+}
@@ -17,10 +17,7 @@ package rbeconfigsgen
 import (
 	"archive/tar"
 	"bytes"
-	"crypto/sha256"
 	_ "embed"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -29,16 +26,20 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"text/template"
-	"time"
-
-	"github.com/coreos/go-semver/semver"
 )
 
 const (
+	// defaultConfigsRepoName is the name of the external repository generated configs are assumed
+	// to be extracted into if they weren't copied into a source repository.
+	defaultConfigsRepoName = "rbe_default"
+
+	// bazeliskVersion is the version of Bazelisk installed into the toolchain container to run
+	// Bazel if no BazelPath was specified.
+	bazeliskVersion = "v1.10.1"
+
 	buildHeader = `# Copyright 2020 The Bazel Authors. All rights reserved.
 #
 # Licensed under the Apache License, Version 2.0 (the "License");
@@ -79,68 +80,26 @@ toolchain(
 
 platform(
     name = "platform",
-    parents = ["@local_config_platform//:host"],
+    parents = ["{{ .Parent }}"],
     constraint_values = [
 {{ range .ExecConstraints }}        "{{ . }}",
+{{ end }}{{ range .ExtraConstraints }}        "{{ . }}",
 {{ end }}    ],
     exec_properties = {
         "container-image": "docker://{{.ToolchainContainer}}",
         "OSFamily": "{{.OSFamily}}",
-    },
-)
-`))
-	// legacyJavaBuildTemplate is the Java toolchain config BUILD file template for Bazel versions
-	// <5.0.0 (tentative?).
-	legacyJavaBuildTemplate = template.Must(template.New("javaBuild").Parse(buildHeader + `
-package(default_visibility = ["//visibility:public"])
-
-java_runtime(
-    name = "jdk",
-    srcs = [],
-    java_home = "{{ .JavaHome }}",
-)
-`))
-
-	// javaBuildTemplateLt7 is the Java toolchain config BUILD file template for Bazel versions
-	// >=5.0.0 (tentative?) and < 7.0.0.
-	javaBuildTemplateLt7 = template.Must(template.New("javaBuild").Parse(buildHeader + `
-load("@bazel_tools//tools/jdk:local_java_repository.bzl", "local_java_runtime")
-
-package(default_visibility = ["//visibility:public"])
-
-alias(
-    name = "jdk",
-    actual = "rbe_jdk",
-)
-
-local_java_runtime(
-    name = "rbe_jdk",
-    java_home = "{{ .JavaHome }}",
-    version = "{{ .JavaVersion }}",
-)
-`))
-
-	// javaBuildTemplate is the Java toolchain config BUILD file template for Bazel versions
-	// >=7.0.0 (including pre-releases).
-	// The difference between the older template is directly referencing to @rules_java
-	// instead of the indirection via @bazel_tools
-	javaBuildTemplate = template.Must(template.New("javaBuild").Parse(buildHeader + `
-load("@rules_java//toolchains:local_java_repository.bzl", "local_java_runtime")
-
-package(default_visibility = ["//visibility:public"])
-
-alias(
-    name = "jdk",
-    actual = "rbe_jdk",
+{{ range $k, $v := .ExecProperties }}        {{ printf "%q" $k }}: {{ printf "%q" $v }},
+{{ end }}    },
 )
-
-local_java_runtime(
-    name = "rbe_jdk",
-    java_home = "{{ .JavaHome }}",
-    version = "{{ .JavaVersion }}",
+{{ range .Variants }}
+platform(
+    name = "{{ .Name }}",
+    parents = [":platform"],
+    exec_properties = {
+{{ range $k, $v := .ExecProperties }}        {{ printf "%q" $k }}: {{ printf "%q" $v }},
+{{ end }}    },
 )
-`))
-
+{{ end }}`))
 	// imageDigestRegexp is the regex to extract the sha256 digest from a docker image name
 	// referenced by its digest.
 	imageDigestRegexp = regexp.MustCompile("sha256:([a-f0-9]{64})$")
@@ -160,26 +119,44 @@ type PlatformToolchainsTemplateParams struct {
 	CppToolchainTarget string
 	ToolchainContainer string
 	OSFamily           string
+	// Parent is the label of the parent of the generated platform. Defaults to
+	// @local_config_platform//:host.
+	Parent string
+	// ExtraConstraints are constraint values added to the generated platform in addition to
+	// ExecConstraints. Unlike ExecConstraints, they don't restrict the generated C++ toolchain.
+	ExtraConstraints []string
+	// ExecProperties are exec properties added to the generated platform in addition to the
+	// container image & OS family, e.g., dockerNetwork, Pool or label:<name>.
+	ExecProperties map[string]string
+	// Variants are additional named platforms generated alongside the default platform.
+	Variants []PlatformVariant
+}
+
+// PlatformVariant is a platform that inherits the constraints & exec properties of the default
+// generated platform and overrides some of its exec properties, e.g., to route actions to a
+// different worker pool.
+type PlatformVariant struct {
+	// Name is the name of the platform target in the config package.
+	Name string `json:"name"`
+	// ExecProperties are the exec properties overriding the ones inherited from the default
+	// platform.
+	ExecProperties map[string]string `json:"exec_properties,omitempty"`
 }
 
 func (p PlatformToolchainsTemplateParams) String() string {
-	return fmt.Sprintf("{ExecConstraints: %v, TargetConstraints: %v, CppToolchainTarget: %q, ToolchainContainer: %q, OSFamily: %q}",
-		p.ExecConstraints, p.TargetConstraints, p.CppToolchainTarget, p.ToolchainContainer, p.OSFamily)
-}
-
-// javaBuildTemplateParams is used as the input to the Java toolchains BUILD file template.
-type javaBuildTemplateParams struct {
-	JavaHome    string
-	JavaVersion string
+	return fmt.Sprintf("{ExecConstraints: %v, TargetConstraints: %v, CppToolchainTarget: %q, ToolchainContainer: %q, OSFamily: %q, Parent: %q, ExtraConstraints: %v, ExecProperties: %v, Variants: %+v}",
+		p.ExecConstraints, p.TargetConstraints, p.CppToolchainTarget, p.ToolchainContainer, p.OSFamily, p.Parent, p.ExtraConstraints, p.ExecProperties, p.Variants)
 }
 
 // dockerRunner allows starting a container for a given docker image and subsequently running
 // arbitrary commands inside the container or extracting files from it.
-// dockerRunner uses the docker client to spin up & interact with containers.
+// dockerRunner uses a ContainerRuntime (docker by default) to spin up & interact with containers.
 type dockerRunner struct {
 	// Input arguments.
+	// runtime is the container runtime used to create & interact with the container.
+	runtime ContainerRuntime
 	// containerImage is the docker image to spin up as a running container. This could be a tagged
-	// or floating reference to a docker image but in a format acceptable to the docker client.
+	// or floating reference to a docker image but in a format acceptable to the container runtime.
 	containerImage string
 	// stopContainer determines if the running container will be deleted once we're done with it.
 	stopContainer bool
@@ -194,8 +171,6 @@ type dockerRunner struct {
 	env []string
 
 	// Populated by the runner.
-	// dockerPath is the path to the docker client.
-	dockerPath string
 	// containerID is the ID of the running docker container.
 	containerID string
 	// resolvedImage is the container image referenced by its sha256 digest.
@@ -207,6 +182,23 @@ type dockerRunner struct {
 type generatedFile struct {
 	name     string
 	contents []byte
+	// executable is whether the file is executable, e.g., a wrapper script generated by Bazel's
+	// C++ toolchain autoconfiguration.
+	executable bool
+	// symlink is whether the file is a symlink, in which case contents is the relative path it
+	// points to like symlinks in tarballs & zip archives.
+	symlink bool
+}
+
+// mode returns the mode of the generated file when written to a directory or archive.
+func (g generatedFile) mode() os.FileMode {
+	if g.symlink {
+		return os.ModeSymlink | 0777
+	}
+	if g.executable {
+		return 0755
+	}
+	return 0644
 }
 
 // outputConfigs represents input tarballs & files to be assembled into the output toolchain
@@ -217,17 +209,33 @@ type generatedFile struct {
 //  - cc- C++ configs (only if C++ config generation is enabled).
 //  - config- C++ crosstool top & default platform definitions.
 //  - java- Java toolchain definition.
+//  - python- Python toolchain definition (only if Python config generation is enabled).
+//  - go- Go SDK definition (only if Go config generation is enabled).
+//  - rust- Rust toolchain definition (only if Rust config generation is enabled).
+//  - configs.bazelrc- Flags to use the generated configs.
+//  - MODULE.bazel- Module definition (only in the Bzlmod output mode).
 type outputConfigs struct {
 	// licence will contain the OSS license applicable for the generated configs.
 	license generatedFile
-	// cppConfigsTarball is the path to the tarball file containing the C++ configs generated by
-	// Bazel inside the toolchain container.
-	cppConfigsTarball string
+	// languages are the configs generated for every enabled language.
+	languages []*languageConfigs
 	// configBuild represents the BUILD file containing the C++ crosstool top toolchain target
 	// and the default platform definition.
 	configBuild generatedFile
-	// javaBuild represents the BUILD file containing the java toolchain rule.
-	javaBuild generatedFile
+	// bazelrc represents the .bazelrc fragment with the flags needed to use the configs.
+	bazelrc generatedFile
+	// module represents the MODULE.bazel file generated in the Bzlmod output mode.
+	module generatedFile
+}
+
+// configFiles returns the configs of every language, the crosstool top/platform BUILD file & the
+// .bazelrc fragment, i.e., the generated files excluding the license & the module file.
+func (oc outputConfigs) configFiles() []generatedFile {
+	var result []generatedFile
+	for _, lc := range oc.languages {
+		result = append(result, lc.files...)
+	}
+	return append(result, oc.configBuild, oc.bazelrc)
 }
 
 // runCmd runs an arbitrary command in a shell, logs the exact command that was run and returns
@@ -258,76 +266,83 @@ func workdir(os string) string {
 }
 
 // BazeliskDownloadInfo returns the URL and name of the local downloaded file to use for downloading
-// bazelisk for the given OS.
+// bazelisk for the given OS on x86_64.
 func BazeliskDownloadInfo(os string) (string, string, error) {
-	switch os {
-	case OSLinux:
-		return "https://github.com/bazelbuild/bazelisk/releases/download/v1.10.1/bazelisk-linux-amd64", "bazelisk", nil
-	case OSWindows:
-		return "https://github.com/bazelbuild/bazelisk/releases/download/v1.10.1/bazelisk-windows-amd64.exe", "bazelisk.exe", nil
+	return BazeliskDownloadInfoForArch(os, ArchX86_64)
+}
+
+// BazeliskDownloadInfoForArch returns the URL and name of the local downloaded file to use for
+// downloading bazelisk for the given OS & CPU architecture.
+func BazeliskDownloadInfoForArch(os, arch string) (string, string, error) {
+	switch {
+	case os == OSLinux && arch == ArchX86_64:
+		return fmt.Sprintf("https://github.com/bazelbuild/bazelisk/releases/download/%s/bazelisk-linux-amd64", bazeliskVersion), "bazelisk", nil
+	case os == OSLinux && arch == ArchAarch64:
+		return fmt.Sprintf("https://github.com/bazelbuild/bazelisk/releases/download/%s/bazelisk-linux-arm64", bazeliskVersion), "bazelisk", nil
+	case os == OSWindows && arch == ArchX86_64:
+		return fmt.Sprintf("https://github.com/bazelbuild/bazelisk/releases/download/%s/bazelisk-windows-amd64.exe", bazeliskVersion), "bazelisk.exe", nil
 	}
-	return "", "", fmt.Errorf("invalid OS %q", os)
+	return "", "", fmt.Errorf("invalid OS %q & CPU architecture %q combination", os, arch)
 }
 
-// newDockerRunner creates a new running container of the given containerImage. stopContainer
-// determines if the cleanup function on the dockerRunner will stop the running container when
-// called.
-func newDockerRunner(containerImage string, dockerPlatform string, stopContainer bool) (*dockerRunner, error) {
+// newDockerRunner creates a new running container of the given containerImage using the given
+// container runtime. stopContainer determines if the cleanup function on the dockerRunner will stop
+// the running container when called. pull determines whether the image is pulled before creating
+// the container and can be false if the image was already pulled.
+func newDockerRunner(rt ContainerRuntime, containerImage string, dockerPlatform string, stopContainer, pull bool) (*dockerRunner, error) {
 	if containerImage == "" {
 		return nil, fmt.Errorf("container image was not specified")
 	}
 	d := &dockerRunner{
+		runtime:        rt,
 		containerImage: containerImage,
 		stopContainer:  stopContainer,
-		dockerPath:     "docker",
 	}
-	if _, err := runCmd(d.dockerPath, "pull", d.containerImage); err != nil {
-		return nil, fmt.Errorf("docker was unable to pull the toolchain container image %q: %w", d.containerImage, err)
+	if pull {
+		if err := d.runtime.Pull(d.containerImage, dockerPlatform); err != nil {
+			return nil, fmt.Errorf("%s was unable to pull the toolchain container image %q: %w", d.runtime.Name(), d.containerImage, err)
+		}
 	}
-	resolvedImage, err := runCmd(d.dockerPath, "inspect", "--format={{index .RepoDigests 0}}", d.containerImage)
+	resolvedImage, err := d.runtime.ResolveImage(d.containerImage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert toolchain container image %q into a fully qualified image name by digest: %w", d.containerImage, err)
 	}
-	resolvedImage = strings.TrimSpace(resolvedImage)
 	log.Printf("Resolved toolchain image %q to fully qualified reference %q.", d.containerImage, resolvedImage)
 	d.resolvedImage = resolvedImage
 
-	args := []string{"create", "--rm"}
-	if dockerPlatform != "" {
-		args = append(args, "--platform", dockerPlatform)
-	}
-	args = append(args, d.resolvedImage, "sleep", "infinity")
-
-	cid, err := runCmd(d.dockerPath, args...)
+	cid, err := d.runtime.Create(d.resolvedImage, dockerPlatform, "sleep", "infinity")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create a container with the toolchain container image: %w", err)
 	}
-	cid = strings.TrimSpace(cid)
-	if len(cid) != 64 {
-		return nil, fmt.Errorf("container ID %q extracted from the stdout of the container create command had unexpected length, got %d, want 64", cid, len(cid))
-	}
 	d.containerID = cid
 	log.Printf("Created container ID %v for toolchain container image %v.", d.containerID, d.resolvedImage)
-	if _, err := runCmd(d.dockerPath, "start", d.containerID); err != nil {
+	if err := d.runtime.Start(d.containerID); err != nil {
 		return nil, fmt.Errorf("failed to run the toolchain container: %w", err)
 	}
 	return d, nil
 }
 
-// execCmd runs the given command inside the docker container and returns the output with whitespace
-// trimmed from the edges.
-func (d *dockerRunner) execCmd(args ...string) (string, error) {
-	a := []string{"exec"}
-	if d.workdir != "" {
-		a = append(a, "-w", d.workdir)
+// execCmdResult runs the given command inside the docker container and returns its result. An
+// error is returned if the command couldn't be run or if it exited with a non-zero exit code in
+// which case the output of the command is logged.
+func (d *dockerRunner) execCmdResult(args ...string) (ExecResult, error) {
+	r, err := d.runtime.Exec(d.containerID, d.workdir, d.env, args...)
+	if err != nil {
+		return r, err
 	}
-	for _, e := range d.env {
-		a = append(a, "-e", e)
+	if r.ExitCode != 0 {
+		log.Printf("Stdout: %s", r.Stdout)
+		log.Printf("Stderr: %s", r.Stderr)
+		return r, fmt.Errorf("command '%s' exited with code %d", strings.Join(args, " "), r.ExitCode)
 	}
-	a = append(a, d.containerID)
-	a = append(a, args...)
-	o, err := runCmd(d.dockerPath, a...)
-	return strings.TrimSpace(o), err
+	return r, nil
+}
+
+// execCmd runs the given command inside the docker container and returns the stdout with whitespace
+// trimmed from the edges.
+func (d *dockerRunner) execCmd(args ...string) (string, error) {
+	r, err := d.execCmdResult(args...)
+	return strings.TrimSpace(r.Stdout), err
 }
 
 // cleanup stops the running container if stopContainer was true when the dockerRunner was created.
@@ -336,7 +351,7 @@ func (d *dockerRunner) cleanup() {
 		log.Printf("Not stopping container %v of image %v because the Cleanup option was set to false.", d.containerID, d.resolvedImage)
 		return
 	}
-	if _, err := runCmd(d.dockerPath, "stop", "-t", "0", d.containerID); err != nil {
+	if err := d.runtime.Stop(d.containerID); err != nil {
 		log.Printf("Failed to stop container %v of toolchain image %v but it's ok to ignore this error if config generation & extraction succeeded.", d.containerID, d.resolvedImage)
 	}
 }
@@ -344,17 +359,68 @@ func (d *dockerRunner) cleanup() {
 // copyToContainer copies the local file at 'src' to the container where 'dst' is the path inside
 // the container. d.workdir has no impact on this function.
 func (d *dockerRunner) copyToContainer(src, dst string) error {
-	if _, err := runCmd(d.dockerPath, "cp", src, fmt.Sprintf("%s:%s", d.containerID, dst)); err != nil {
-		return err
-	}
-	return nil
+	return d.runtime.CopyTo(d.containerID, src, dst)
 }
 
 // copyFromContainer extracts the file at 'src' from inside the container and copies it to the path
 // 'dst' locally. d.workdir has no impact on this function.
 func (d *dockerRunner) copyFromContainer(src, dst string) error {
-	if _, err := runCmd(d.dockerPath, "cp", fmt.Sprintf("%s:%s", d.containerID, src), dst); err != nil {
-		return err
+	return d.runtime.CopyFrom(d.containerID, src, dst)
+}
+
+// archiveDir archives the contents of the directory 'src' inside the container into a tarball at
+// the local path 'dst'. Entries in the tarball are relative to 'src'. If the container runtime can
+// stream archives directly, the directory is streamed out of the container. Otherwise, the
+// directory is archived using tar inside the container and the tarball is copied out. d.workdir
+// has no impact on this function.
+func (d *dockerRunner) archiveDir(src, dst string) error {
+	a, ok := d.runtime.(containerArchiver)
+	if !ok {
+		containerTarball := path.Join(path.Dir(src), path.Base(dst))
+		if _, err := d.execCmd("tar", "-cf", containerTarball, "-C", src, "."); err != nil {
+			return fmt.Errorf("failed to archive %q into a tarball inside the container: %w", src, err)
+		}
+		if err := d.copyFromContainer(containerTarball, dst); err != nil {
+			return fmt.Errorf("failed to copy tarball %q out of the container: %w", containerTarball, err)
+		}
+		return nil
+	}
+	r, err := a.ArchiveFrom(d.containerID, src)
+	if err != nil {
+		return fmt.Errorf("failed to stream %q out of the container as a tarball: %w", src, err)
+	}
+	defer r.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("unable to open %q for writing: %w", dst, err)
+	}
+	defer out.Close()
+	inTar := tar.NewReader(r)
+	outTar := tar.NewWriter(out)
+	// Strip the base name of the archived directory that prefixes every entry in the stream.
+	prefix := path.Base(src) + "/"
+	for {
+		h, err := inTar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading the tarball of %q streamed from the container: %w", src, err)
+		}
+		name := strings.TrimPrefix(h.Name, prefix)
+		if name == "" || name == path.Base(src) {
+			continue
+		}
+		h.Name = name
+		if err := outTar.WriteHeader(h); err != nil {
+			return fmt.Errorf("error while adding tar header for %q to %q: %w", name, dst, err)
+		}
+		if _, err := io.Copy(outTar, inTar); err != nil {
+			return fmt.Errorf("failed to copy the contents of %q to %q: %w", name, dst, err)
+		}
+	}
+	if err := outTar.Close(); err != nil {
+		return fmt.Errorf("error trying to finish writing tarball %q: %w", dst, err)
 	}
 	return nil
 }
@@ -366,16 +432,11 @@ func (d *dockerRunner) copyFromContainer(src, dst string) error {
 // specifies the same env key multiple times, later values supercede earlier ones.
 func (d *dockerRunner) getEnv() (map[string]string, error) {
 	result := make(map[string]string)
-	o, err := runCmd(d.dockerPath, "inspect", "-f", "{{range $i, $v := .Config.Env}}{{println $v}}{{end}}", d.resolvedImage)
+	env, err := d.runtime.ImageEnv(d.resolvedImage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to inspect the docker image to get environment variables: %w", err)
 	}
-	split := strings.Split(o, "\n")
-	for _, s := range split {
-		s = strings.TrimSpace(s)
-		if len(s) == 0 {
-			continue
-		}
+	for _, s := range env {
 		keyVal := strings.SplitN(s, "=", 2)
 		key := ""
 		val := ""
@@ -393,13 +454,13 @@ func (d *dockerRunner) getEnv() (map[string]string, error) {
 	return result, nil
 }
 
-// installBazelisk downloads bazelisk locally to the specified directory for the given os and copies
-// it into the running toolchain container.
+// installBazelisk downloads bazelisk locally to the specified directory for the given os & arch and
+// copies it into the running toolchain container.
 // Returns the path Bazelisk was installed to inside the running toolchain container.
-func installBazelisk(d *dockerRunner, downloadDir, execOS string) (string, error) {
-	url, filename, err := BazeliskDownloadInfo(execOS)
+func installBazelisk(d *dockerRunner, downloadDir, execOS, execArch string) (string, error) {
+	url, filename, err := BazeliskDownloadInfoForArch(execOS, execArch)
 	if err != nil {
-		return "", fmt.Errorf("unable to determine how to download Bazelisk for execution OS %q: %w", execOS, err)
+		return "", fmt.Errorf("unable to determine how to download Bazelisk for execution OS %q & architecture %q: %w", execOS, execArch, err)
 	}
 	resp, err := http.Get(url)
 	if err != nil {
@@ -427,275 +488,94 @@ func installBazelisk(d *dockerRunner, downloadDir, execOS string) (string, error
 	return bazeliskContainerPath, nil
 }
 
-// appendCppEnv appends environment variables set in the C++ environment map as well as variables
-// specified in the C++ environment JSON file to the given environment as "key=value".
-func appendCppEnv(env []string, o *Options) ([]string, error) {
-	for k, v := range o.CppGenEnv {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
-	}
-
-	if len(o.CppGenEnvJSON) == 0 {
-		return env, nil
-	}
-
-	blob, err := ioutil.ReadFile(o.CppGenEnvJSON)
+// processTempDir creates a local temporary working directory to store intermediate files.
+func processTempDir(o *Options) error {
+	dir, err := initTempDir(o.TempWorkDir)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read JSON file %q to read C++ config generation environment variables from: %w", o.CppGenEnvJSON, err)
-	}
-
-	e := map[string]string{}
-	if err := json.Unmarshal(blob, &e); err != nil {
-		return nil, fmt.Errorf("unable to parse file %q as a JSON string -> string dictionary: %w", o.CppGenEnvJSON, err)
-	}
-
-	for k, v := range e {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
+		return err
 	}
-
-	return env, nil
+	o.TempWorkDir = dir
+	return nil
 }
 
-// genCppConfigs generates C++ configs inside the running toolchain container represented by the
-// given docker runner according to the given options. bazelPath is the path to the Bazel
-// binary inside the running toolchain container.
-// The return value is the path to the C++ configs tarball copied out of the toolchain container.
-func genCppConfigs(d *dockerRunner, o *Options, bazelPath string) (string, error) {
-	if !o.GenCPPConfigs {
-		return "", nil
-	}
-
-	// Change the working directory to a dedicated empty directory for C++ configs for each
-	// command we run in this function.
-	cppProjDir := path.Join(d.workdir, "cpp_configs_project")
-	if _, err := d.execCmd("mkdir", cppProjDir); err != nil {
-		return "", fmt.Errorf("failed to create empty directory %q inside the toolchain container: %w", cppProjDir, err)
-	}
-	oldWorkDir := d.workdir
-	d.workdir = cppProjDir
-	defer func() {
-		d.workdir = oldWorkDir
-	}()
-
-	if _, err := d.execCmd("touch", "WORKSPACE", "BUILD.bazel"); err != nil {
-		return "", fmt.Errorf("failed to create empty build & workspace files in the container to initialize a blank Bazel repository: %w", err)
-	}
-
-	// Backup the current environment & restore it before returning.
-	oldEnv := d.env
-	defer func() {
-		d.env = oldEnv
-	}()
-
-	// Create a new environment for bazelisk commands used to specify the Bazel version to use to
-	// Bazelisk.
-	bazeliskEnv := []string{fmt.Sprintf("USE_BAZEL_VERSION=%s", o.BazelVersion)}
-	// Add the environment variables needed for the generation only and remove them immediately
-	// because they aren't necessary for the config extraction and add unnecessary noise to the
-	// logs.
-	generationEnv, err := appendCppEnv(bazeliskEnv, o)
-	if err != nil {
-		return "", fmt.Errorf("failed to add additional environment variables to the C++ config generation docker command: %w", err)
-	}
-	d.env = generationEnv
-
-	cmd := []string{
-		bazelPath,
-		o.CppBazelCmd,
-	}
-	cmd = append(cmd, o.CPPConfigTargets...)
-	if _, err := d.execCmd(cmd...); err != nil {
-		return "", fmt.Errorf("Bazel was unable to build the C++ config generation targets in the toolchain container: %w", err)
-	}
-
-	// Restore the env needed for Bazelisk.
-	d.env = bazeliskEnv
-	bazelOutputRoot, err := d.execCmd(bazelPath, "info", "output_base")
-	if err != nil {
-		return "", fmt.Errorf("unable to determine the build output directory where Bazel produced C++ configs in the toolchain container: %w", err)
-	}
-	cppConfigDir := path.Join(bazelOutputRoot, "external", o.CPPConfigRepo)
-	log.Printf("Extracting C++ config files generated by Bazel at %q from the toolchain container.", cppConfigDir)
-
-	// Restore the old env now that we're done with Bazelisk commands. This is purely to reduce
-	// noise in the logs.
-	d.env = oldEnv
-
-	// 1. Get a list of symlinks in the config output directory.
-	// 2. Harden each link.
-	// 3. Archive the contents of the config output directory into a tarball.
-	// 4. Copy the tarball from the container to the local temp directory.
-	var out string
-	if o.ExecOS == "windows" {
-		out, err = d.execCmd("cmd", "/r", "dir", filepath.Clean(cppConfigDir), "/a:l", "/b")
-	} else {
-		out, err = d.execCmd("find", cppConfigDir, "-type", "l")
-	}
-	if err != nil {
-		errMsg := fmt.Sprintf("unable to list symlinks in the C++ config generation build output directory: ")
-		// Windows `dir` has a non-zero exit status if no files are found.
-		// Linux just doesn't return any files but has a zero exit.
-		switch o.ExecOS {
-		case "windows":
-			out = ""
-			log.Printf("Ignoring error indicating no symlinks were found in the Bazel output directory: %v", err)
-		default:
-			return "", fmt.Errorf("%s%w", errMsg, err)
-		}
-	}
-	symlinks := strings.Split(out, "\n")
-	for _, s := range symlinks {
-		if s == "" {
-			continue
-		}
-		resolvedPath, err := d.execCmd("readlink", s)
+// initTempDir verifies the given temporary working directory exists if one was specified.
+// Otherwise, a new temporary directory is requested from the OS. Returns the temporary working
+// directory to use.
+func initTempDir(dir string) (string, error) {
+	if dir != "" {
+		s, err := os.Stat(dir)
 		if err != nil {
-			return "", fmt.Errorf("unable to determine what the symlink %q in %q in the toolchain container points to: %w", s, cppConfigDir, err)
+			return "", fmt.Errorf("got %q specified as option TempWorkDir but the path doesn't exist: %w", dir, err)
 		}
-		if _, err := d.execCmd("ln", "-f", resolvedPath, s); err != nil {
-			return "", fmt.Errorf("failed to harden symlink %q in %q pointing to %q: %w", s, cppConfigDir, resolvedPath, err)
+		if !s.IsDir() {
+			return "", fmt.Errorf("got %q specified as option TempWorkDir but the path doesn't point to a directory", dir)
 		}
+		return dir, nil
 	}
-
-	outputTarball := "cpp_configs.tar"
-	// Explicitly use absolute paths to avoid confusion on what's the working directory.
-	outputTarballPath := path.Join(o.TempWorkDir, outputTarball)
-	outputTarballContainerPath := path.Join(cppProjDir, outputTarball)
-	if _, err := d.execCmd("tar", "-cf", outputTarballContainerPath, "-C", cppConfigDir, "."); err != nil {
-		return "", fmt.Errorf("failed to archive the C++ configs into a tarball inside the toolchain container: %w", err)
-	}
-	if err := d.copyFromContainer(outputTarballContainerPath, outputTarballPath); err != nil {
-		return "", fmt.Errorf("failed to copy the C++ config tarball out of the toolchain container: %w", err)
-	}
-	log.Printf("Generated C++ configs at %s.", outputTarballPath)
-	return outputTarballPath, nil
-}
-
-// UsesLocalJavaRuntime returns whether the given bazel version string uses the local_java_runtime
-// rule for Java toolchains instead of java_runtime.
-// Bazel is expected to switch to local_java_runtime in Bazel 5.0.0. See:
-// https://github.com/bazelbuild/bazel-toolchains/pull/926.
-func UsesLocalJavaRuntime(bazelVersion string) (bool, error) {
-	bv, err := semver.NewVersion(bazelVersion)
+	dir, err := ioutil.TempDir("", "rbeconfigsgen_")
 	if err != nil {
-		return false, fmt.Errorf("unable to parse Bazel version %q as a semver: %w", bazelVersion, err)
+		return "", fmt.Errorf("failed to create a temporary local directory to write intermediate files: %w", err)
 	}
-	// Returns if bv >= 5.0.0.
-	return !bv.LessThan(*semver.New("5.0.0")), nil
+	return dir, nil
 }
 
-func getJavaTemplate(o *Options) (*template.Template, error) {
-  usesNewJavaRule := o.JavaUseLocalRuntime
-	if !usesNewJavaRule {
-  	var err error
-		usesNewJavaRule, err = UsesLocalJavaRuntime(o.BazelVersion)
-    if (err != nil) {
-      return nil, fmt.Errorf("unable to determine what Java toolchain rule to use for Bazel %q: %w", o.BazelVersion, err)
-    }
-	}
-  if !usesNewJavaRule {
-    return legacyJavaBuildTemplate, nil
-	}
-	// use latest template if BazelVersion is unspecified
-  if o.BazelVersion != "" && o.BazelVersion < "7" {
-    return javaBuildTemplateLt7, nil
-  }
-  return javaBuildTemplate, nil
+func genCppToolchainTarget(o *Options) string {
+	return packageLabel(o, "cc", o.CPPToolchainTargetName)
 }
 
-// genJavaConfigs returns a BUILD file containing a Java toolchain rule definition that contains
-// the following attributes determined by probing details about the JDK version installed in the
-// running toolchain container.
-// 1. Value of the JAVA_HOME environment variable set in the toolchain image.
-// 2. Value of the Java version as reported by the java binary installed in JAVA_HOME inside the
-//    running toolchain container.
-func genJavaConfigs(d *dockerRunner, o *Options) (generatedFile, error) {
-	if !o.GenJavaConfigs {
-		return generatedFile{}, nil
-	}
-	imageEnv, err := d.getEnv()
-	if err != nil {
-		return generatedFile{}, fmt.Errorf("unable to get the environment of the toolchain image to determine JAVA_HOME: %w", err)
-	}
-	javaHome, ok := imageEnv["JAVA_HOME"]
-	if !ok {
-		return generatedFile{}, fmt.Errorf("toolchain image didn't specify environment value JAVA_HOME")
-	}
-	if len(javaHome) == 0 {
-		return generatedFile{}, fmt.Errorf("the value of the JAVA_HOME environment variable was blank in the toolchain image")
-	}
-	log.Printf("JAVA_HOME was %q.", javaHome)
-	javaBin := path.Join(javaHome, "bin/java")
-	// "-XshowSettings:properties" is actually what makes java output the version string we're
-	// looking for in a more deterministic format. "-version" is just a placeholder so that the
-	// command doesn't error out. Although it will likely print the same version string but with
-	// some non-deterministic prefix.
-	out, err := d.execCmd(javaBin, "-XshowSettings:properties", "-version")
-	if err != nil {
-		return generatedFile{}, fmt.Errorf("unable to determine the Java version installed in the toolchain container: %w", err)
-	}
-	javaVersion := ""
-	for _, line := range strings.Split(out, "\n") {
-		// We're looking for a line that looks like `java.version = <version>` and we want to
-		// extract <version>.
-		splitVersion := strings.SplitN(line, "=", 2)
-		if len(splitVersion) != 2 {
-			continue
-		}
-		key := strings.TrimSpace(splitVersion[0])
-		val := strings.TrimSpace(splitVersion[1])
-		if key != "java.version" {
-			continue
-		}
-		javaVersion = val
+// configsPackagePath returns the path of the generated configs relative to the root of the
+// repository they'll be part of. In the Bzlmod output mode, the configs are part of their own
+// module instead of the source repository they were copied into.
+func configsPackagePath(o *Options) string {
+	if o.OutputMode == OutputModeBzlmod {
+		return o.modulePath
 	}
-	if len(javaVersion) == 0 {
-		return generatedFile{}, fmt.Errorf("unable to determine the java version installed in the container by running 'java -XshowSettings:properties' in the container because it didn't return a line that looked like java.version = <version>")
-	}
-	log.Printf("Java version: '%s'.", javaVersion)
+	return strings.ReplaceAll(o.OutputConfigPath, "\\", "/")
+}
 
-	t, err := getJavaTemplate(o)
-  if err != nil {
-    return generatedFile{}, err
-  }
+// packageLabel returns the label of the given target in the given subpackage of the generated
+// configs relative to the root of the repository the configs are part of.
+func packageLabel(o *Options, pkg, target string) string {
+	return fmt.Sprintf("//%s:%s", path.Join(configsPackagePath(o), pkg), target)
+}
 
-	buf := bytes.NewBuffer(nil)
-	if err := t.Execute(buf, &javaBuildTemplateParams{
-		JavaHome:    javaHome,
-		JavaVersion: javaVersion,
-	}); err != nil {
-		return generatedFile{}, fmt.Errorf("failed to generate the contents of the BUILD file with the Java toolchain definition: %w", err)
+// configsRepoName returns the name of the external repository the configs generated for the
+// given options are expected to be extracted into.
+func configsRepoName(o *Options) string {
+	if o.ConfigsRepoName != "" {
+		return o.ConfigsRepoName
 	}
-	return generatedFile{
-		name:     "java/BUILD",
-		contents: buf.Bytes(),
-	}, nil
+	return defaultConfigsRepoName
 }
 
-// processTempDir creates a local temporary working directory to store intermediate files.
-func processTempDir(o *Options) error {
-	if o.TempWorkDir != "" {
-		s, err := os.Stat(o.TempWorkDir)
-		if err != nil {
-			return fmt.Errorf("got %q specified as option TempWorkDir but the path doesn't exist: %w", o.TempWorkDir, err)
-		}
-		if !s.IsDir() {
-			return fmt.Errorf("got %q specified as option TempWorkDir but the path doesn't point to a directory", o.TempWorkDir)
-		}
-		return nil
+// configLabel returns the label of the given target in the given subpackage of the generated
+// configs. Generated configs not copied into a source repository or generated in the Bzlmod output
+// mode are expected to be used as an external repository named ConfigsRepoName.
+func configLabel(o *Options, pkg, target string) string {
+	repo := "@" + configsRepoName(o)
+	if o.OutputSourceRoot != "" && o.OutputMode != OutputModeBzlmod {
+		repo = ""
 	}
-	dir, err := ioutil.TempDir("", "rbeconfigsgen_")
-	if err != nil {
-		return fmt.Errorf("failed to create a temporary local directory to write intermediate files: %w", err)
+	return repo + packageLabel(o, pkg, target)
+}
+
+// platformLabels returns the labels of the default platform & the platform variants generated for
+// the given options.
+func platformLabels(o *Options) []string {
+	labels := []string{configLabel(o, "config", "platform")}
+	for _, v := range o.PlatformParams.Variants {
+		labels = append(labels, configLabel(o, "config", v.Name))
 	}
-	o.TempWorkDir = dir
-	return nil
+	return labels
 }
 
-func genCppToolchainTarget(o *Options) string {
-	if o.OutputConfigPath != "" {
-		return fmt.Sprintf("//%s/cc:%s", strings.ReplaceAll(o.OutputConfigPath, "\\", "/"), o.CPPToolchainTargetName)
+// logPlatformsUsage logs how to register the platforms generated for the given options with Bazel.
+func logPlatformsUsage(o *Options) {
+	if o.OutputMode == OutputModeBzlmod {
+		log.Printf("The generated platforms %s are registered by module %q. Use them with bazel_dep(name = %q) and a local_path_override or archive_override in your MODULE.bazel.", strings.Join(platformLabels(o), ","), configsRepoName(o), configsRepoName(o))
+		return
 	}
-	return fmt.Sprintf("//cc:%s", o.CPPToolchainTargetName)
+	log.Printf("Register the generated platforms with Bazel using --extra_execution_platforms=%s", strings.Join(platformLabels(o), ","))
 }
 
 // genConfigBuild generates the contents of a BUILD file with a toolchain target pointing to the
@@ -711,9 +591,16 @@ func genConfigBuild(o *Options) (generatedFile, error) {
 		o.PlatformParams.CppToolchainTarget = ""
 		log.Printf("Not generating a toolchain target to be used for the C++ Crosstool top because C++ config generation is disabled.")
 	}
+	if o.PlatformParams.Parent == "" {
+		o.PlatformParams.Parent = platformParentForOptions(o)
+	}
+	t, err := templateFor(o, configBuildTemplates)
+	if err != nil {
+		return generatedFile{}, err
+	}
 	buf := bytes.NewBuffer(nil)
 	log.Printf("Fully resolved platform params=%v", o.PlatformParams)
-	if err := platformsToolchainBuildTemplate.Execute(buf, o.PlatformParams); err != nil {
+	if err := t.Execute(buf, o.PlatformParams); err != nil {
 		return generatedFile{}, fmt.Errorf("failed to generate platform BUILD file: %w", err)
 	}
 	return generatedFile{
@@ -722,146 +609,28 @@ func genConfigBuild(o *Options) (generatedFile, error) {
 	}, nil
 }
 
-// copyCppConfigsToTarball copies the C++ configs generated by Bazel from the local filesystem at
-// 'inTarPath' to the output tarball represented by `outTar`.
-func copyCppConfigsToTarball(inTarPath string, outTar *tar.Writer) error {
-	in, err := os.Open(inTarPath)
-	if err != nil {
-		return fmt.Errorf("unable to open input tarball %q for reading: %w", inTarPath, err)
-	}
-	defer in.Close()
-	inTar := tar.NewReader(in)
-	pathPrefix := "cc"
-
-	for {
-		h, err := inTar.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error while reading input tarball %q: %w", inTarPath, err)
-		}
-		switch h.Typeflag {
-		case tar.TypeDir:
-			break
-		case tar.TypeReg:
-			if strings.HasSuffix(h.Name, "WORKSPACE") {
-				break
-			}
-			outH := *h
-			// Update the name to be in a 'cc' directory and set the mod time to epoch because:
-			// 1. The output becomes deterministic.
-			// 2. The mod times of the files archived inside the toolchain container sometimes
-			//    seem to be well into the future and I didn't bother figuring out why. Maybe it
-			//    only happens on my machine (shrug).
-			outH.Name = path.Join(pathPrefix, h.Name)
-			outH.ModTime = time.Unix(0, 0)
-			if err := outTar.WriteHeader(&outH); err != nil {
-				return fmt.Errorf("error while adding tar header for %q from input tarball to output tarball: %w", h.Name, err)
-			}
-			if _, err := io.Copy(outTar, inTar); err != nil {
-				return fmt.Errorf("failed to copy the contents of %q from intput tarball to the output tarball: %w", h.Name, err)
-			}
-		default:
-			return fmt.Errorf("got unexpected entry with name %q of type %v in tarball %q: %w", h.Name, h.Typeflag, inTarPath, err)
-		}
-	}
-	return nil
-}
-
-// writeGeneratedFileToTarball writes the given generatedFile 'g' to the given output tarball
-// 'outTar'.
-func writeGeneratedFileToTarball(g generatedFile, outTar *tar.Writer) error {
-	if err := outTar.WriteHeader(&tar.Header{
-		Name:    g.name,
-		Size:    int64(len(g.contents)),
-		Mode:    int64(os.ModePerm),
-		ModTime: time.Unix(0, 0),
-	}); err != nil {
-		return fmt.Errorf("failed to write tar header for %q: %w", g.name, err)
-	}
-	if _, err := io.Copy(outTar, bytes.NewBuffer(g.contents)); err != nil {
-		return fmt.Errorf("failed to copy the contents of %q to the output tarball: %w", g.name, err)
-	}
-	return nil
+// withPrefix returns a copy of the given generatedFile with its name prefixed by the given
+// directory.
+func withPrefix(g generatedFile, prefix string) generatedFile {
+	g.name = path.Join(prefix, g.name)
+	return g
 }
 
 // assembleConfigTarball combines the C++/Java configs represented by 'oc' into a single output
 // tarball if requested in the given options.
 func assembleConfigTarball(o *Options, oc outputConfigs) error {
-	out, err := os.Create(o.OutputTarball)
-	if err != nil {
-		return fmt.Errorf("unable to open output tarball %q for writing: %w", o.OutputTarball, err)
-	}
-	outTar := tar.NewWriter(out)
-
-	// Always write the LICENSE first.
-	if err := writeGeneratedFileToTarball(oc.license, outTar); err != nil {
-		return fmt.Errorf("unable to write the %q file to the output tarball %q: %w", oc.license.name, o.OutputTarball, err)
+	// The output format is only resolved by Validate.
+	if o.OutputFormat == "" {
+		o.OutputFormat = outputFormatForPath(o.OutputTarball)
 	}
-
-	if o.GenCPPConfigs {
-		if err := copyCppConfigsToTarball(oc.cppConfigsTarball, outTar); err != nil {
-			return fmt.Errorf("unable to copy C++ configs from the C++ config tarball %q to the output tarball %q: %w", oc.cppConfigsTarball, o.OutputTarball, err)
-		}
-	}
-	if o.GenJavaConfigs {
-		if err := writeGeneratedFileToTarball(oc.javaBuild, outTar); err != nil {
-			return fmt.Errorf("unable to write the BUILD file %q containing the Java toolchain definition to the output tarball %q: %w", oc.javaBuild.name, o.OutputTarball, err)
-		}
+	files := []generatedFile{oc.license}
+	if o.OutputMode == OutputModeBzlmod {
+		files = append(files, oc.module)
 	}
-	if err := writeGeneratedFileToTarball(oc.configBuild, outTar); err != nil {
-		return fmt.Errorf("unable to write the crosstool top/platform BUILD file %q to the output tarball %q: %w", oc.configBuild.name, o.OutputTarball, err)
-	}
-
-	// Can't ignore failures when closing the output tarball because it writes metadata without which
-	// the tarball is invalid.
-	if err := outTar.Close(); err != nil {
-		return fmt.Errorf("error trying to finish writing the output tarball %q: %w", o.OutputTarball, err)
-	}
-
-	log.Printf("Generated Bazel toolchain configs output tarball %q.", o.OutputTarball)
-	return nil
-}
-
-// copyCppConfigsToOutputDir extracts the contents of the C++ config tarball at `cppConfigsTarball`
-// to the directory at 'outDir'. The C++ config tarball is assumed to contain only regular files,
-// i.e., all non-regular files (directories, links, etc) are ignored during the extraction
-// process.
-func copyCppConfigsToOutputDir(outDir string, cppConfigsTarball string) error {
-	in, err := os.Open(cppConfigsTarball)
-	if err != nil {
-		return fmt.Errorf("unable to open input tarball %q for reading: %w", cppConfigsTarball, err)
-	}
-	defer in.Close()
-	inTar := tar.NewReader(in)
-
-	outDir = path.Join(outDir, "cc")
-	for {
-		h, err := inTar.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error while reading input tarball %q: %w", cppConfigsTarball, err)
-		}
-		if h.Typeflag != tar.TypeReg {
-			continue
-		}
-		filePath := path.Join(outDir, h.Name)
-		dirPath := path.Dir(filePath)
-		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
-			return fmt.Errorf("unable to create directory %q to extract file %q from the C++ config tarball %q: %w", dirPath, h.Name, cppConfigsTarball, err)
-		}
-		o, err := os.Create(filePath)
-		if err != nil {
-			return fmt.Errorf("failed to create file %q for writing %q from the C++ config tarball %q: %w", filePath, h.Name, cppConfigsTarball, err)
-		}
-		if _, err := io.Copy(o, inTar); err != nil {
-			return fmt.Errorf("error while extracting %q from %q to %q: %w", h.Name, cppConfigsTarball, filePath, err)
-		}
-		o.Close()
+	if err := writeArchive(o.OutputTarball, o.OutputFormat, append(files, oc.configFiles()...)); err != nil {
+		return fmt.Errorf("unable to write configs to the output tarball: %w", err)
 	}
+	log.Printf("Generated Bazel toolchain configs output %s archive %q.", o.OutputFormat, o.OutputTarball)
 	return nil
 }
 
@@ -873,38 +642,59 @@ func writeGeneratedFile(outDir string, g generatedFile) error {
 	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
 		return fmt.Errorf("unable to create directory %q to write %q in directory %q: %w", dirPath, g.name, outDir, err)
 	}
-	if err := ioutil.WriteFile(fullPath, g.contents, os.ModePerm); err != nil {
+	if g.symlink {
+		if err := os.Symlink(string(g.contents), fullPath); err != nil {
+			return fmt.Errorf("unable to create symlink %q pointing to %q: %w", fullPath, string(g.contents), err)
+		}
+		return nil
+	}
+	if err := ioutil.WriteFile(fullPath, g.contents, g.mode()); err != nil {
 		return fmt.Errorf("unable to write file %q: %w", fullPath, err)
 	}
 	return nil
 }
 
+// readGeneratedFile returns the file 'name' in the directory 'dir' as a generated file. Symlinks
+// aren't followed.
+func readGeneratedFile(dir, name string) (generatedFile, error) {
+	p := path.Join(dir, name)
+	s, err := os.Lstat(p)
+	if err != nil {
+		return generatedFile{}, err
+	}
+	if s.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return generatedFile{}, err
+		}
+		return generatedFile{name: name, contents: []byte(target), symlink: true}, nil
+	}
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		return generatedFile{}, err
+	}
+	return generatedFile{name: name, contents: contents, executable: s.Mode()&0111 != 0}, nil
+}
+
 // copyConfigsToOutputDir copies the C++/Java configs represented by 'oc' to an output directory
 // if one was specified in the given options. This involves extracting C++ configs and generating
-// BUILD files for the Java & toolchain entrypoint & platform targets.
+// BUILD files for the Java & toolchain entrypoint & platform targets. Configs listed in the
+// previous manifest that are no longer generated are deleted. See writeOutputDir.
 func copyConfigsToOutputDir(o *Options, oc outputConfigs) error {
 	configsRootDir := path.Join(o.OutputSourceRoot, o.OutputConfigPath)
-	if err := os.MkdirAll(configsRootDir, os.ModePerm); err != nil {
-		return fmt.Errorf("unable to create directory %q for writing configs: %w", configsRootDir, err)
-	}
-	// Always write the LICENSE first.
-	if err := writeGeneratedFile(configsRootDir, oc.license); err != nil {
-		return fmt.Errorf("unable to write the %q file to the output directory %q: %w", oc.license.name, configsRootDir, err)
-	}
-	if o.GenCPPConfigs {
-		if err := copyCppConfigsToOutputDir(configsRootDir, oc.cppConfigsTarball); err != nil {
-			return fmt.Errorf("unable to extract C++ configs into output directory %q: %w", configsRootDir, err)
-		}
-	}
-	if o.GenJavaConfigs {
-		if err := writeGeneratedFile(configsRootDir, oc.javaBuild); err != nil {
-			return fmt.Errorf("unable to write Java configs into output directory %q: %w", configsRootDir, err)
-		}
+	files := []generatedFile{oc.license}
+	if o.OutputMode == OutputModeBzlmod {
+		files = append(files, oc.module)
+	}
+	previous := previousManifestFiles(o.OutputManifest, o.OutputConfigPath)
+	// The output directory is only replaced as a whole if it's a subdirectory of the source root.
+	replaceDir := path.Clean(o.OutputConfigPath) != "."
+	if err := writeOutputDir(configsRootDir, append(files, oc.configFiles()...), previous, replaceDir, o.DryRun); err != nil {
+		return err
 	}
-	if err := writeGeneratedFile(configsRootDir, oc.configBuild); err != nil {
-		return fmt.Errorf("unable to write the crostool top/platform BUILD file into output directory %q: %w", configsRootDir, err)
+	if !o.DryRun {
+		log.Printf("Copied generated configs to directory %q.", configsRootDir)
 	}
-	log.Printf("Copied generated configs to directory %q.", configsRootDir)
 	return nil
 }
 
@@ -913,7 +703,9 @@ func copyConfigsToOutputDir(o *Options, oc outputConfigs) error {
 // 1. Generate a single output tarball.
 // 2. Copy all configs into a specified directory.
 func assembleConfigs(o *Options, oc outputConfigs) error {
-	if len(o.OutputTarball) != 0 {
+	if len(o.OutputTarball) != 0 && o.DryRun {
+		log.Printf("Dry run: Not generating output tarball %q.", o.OutputTarball)
+	} else if len(o.OutputTarball) != 0 {
 		if err := assembleConfigTarball(o, oc); err != nil {
 			return fmt.Errorf("failed to assemble configs into a tarball: %w", err)
 		}
@@ -926,159 +718,103 @@ func assembleConfigs(o *Options, oc outputConfigs) error {
 	return nil
 }
 
-// digestFile returns the sha256 digest of the contents of the given file.
-func digestFile(filePath string) (string, error) {
-	f, err := os.Open(filePath)
+// Run is the main entrypoint to generate Bazel toolchain configs according to the options
+// specified in the given command line arguments.
+// The file structure of the generated configs will be as follows:
+// <config root>
+// |
+//  - cc-  C++ configs as generated by Bazel's internal C++ toolchain detection logic.
+//  - config- Toolchain entrypoint target for cc_crosstool_top & the auto-generated platform target.
+//  - java- Java toolchain definition.
+//  - python- Python toolchain definition.
+//  - go- Go SDK definition.
+//  - rust- Rust toolchain definition.
+//  - configs.bazelrc- .bazelrc fragment with the flags to use the generated configs.
+//  - MODULE.bazel- Module registering the platforms & toolchains (only in the Bzlmod output mode).
+func Run(o Options) error {
+	rt, err := containerRuntimeForOptions(&o)
 	if err != nil {
-		return "", fmt.Errorf("unable to open file %q: %w", filePath, err)
+		return fmt.Errorf("unable to initialize the container runtime: %w", err)
 	}
-	defer f.Close()
-
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", fmt.Errorf("error while hashing the contents of %q: %w", filePath, err)
-	}
-	return hex.EncodeToString(h.Sum(nil)), nil
-}
-
-// Manifest contains metadata about the configs generated by this package.
-type Manifest struct {
-	BazelVersion         string `json:"bazel_version"`
-	ToolchainContainer   string `json:"toolchain_container"`
-	ImageDigest          string `json:"image_digest"`
-	ExecOS               string `json:"exec_os"`
-	ConfigsTarballDigest string `json:"configs_tarball_digest"`
+	return run(o, rt)
 }
 
-// ToJSONFile writes the given manifest to a JSON file at the given path.
-func (m *Manifest) ToJSONFile(filePath string) error {
-	blob, err := json.MarshalIndent(m, "", " ")
+// run generates Bazel toolchain configs according to the given options using the given container
+// runtime to run the toolchain container.
+func run(o Options, rt ContainerRuntime) error {
+	if err := processTempDir(&o); err != nil {
+		return fmt.Errorf("unable to initialize a local temporary working directory to store intermediate files: %w", err)
+	}
+	oc, err := generateConfigs(&o, rt)
 	if err != nil {
-		return fmt.Errorf("unable to generate JSON for given manifest: %w", err)
+		return err
 	}
-	if err := ioutil.WriteFile(filePath, blob, os.ModePerm); err != nil {
-		return fmt.Errorf("unable to write the given manifest as JSON to %q: %w", filePath, err)
+	if o.OutputMode == OutputModeBzlmod {
+		if oc.module, err = genModuleFile(configsRepoName(&o), []*Options{&o}); err != nil {
+			return fmt.Errorf("unable to generate the module file: %w", err)
+		}
 	}
-	return nil
-}
-
-// ManifestFromJSONFile reads the manifest from the JSON file at the given path.
-func ManifestFromJSONFile(filePath string) (*Manifest, error) {
-	blob, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read the contents of JSON manifest file %q: %w", filePath, err)
+	if err := assembleConfigs(&o, oc); err != nil {
+		return fmt.Errorf("unable to assemble C++/Java/Crosstool top/Platform definitions to generate the final toolchain configs output: %w", err)
 	}
 
-	m := &Manifest{}
-	if err := json.Unmarshal(blob, m); err != nil {
-		return nil, fmt.Errorf("unable to parse the contents of %q as a JSON manifest: %w", filePath, err)
+	if err := createManifest(&o, oc); err != nil {
+		return fmt.Errorf("unable to create the manifest file: %w", err)
 	}
+	logPlatformsUsage(&o)
 
-	return m, nil
-}
-
-// createManifest writes a manifest JSON file containing information about the generated configs if
-// the given options specified a manifest file.
-func createManifest(o *Options) error {
-	if len(o.OutputManifest) == 0 {
-		return nil
-	}
-	m := Manifest{
-		BazelVersion:       o.BazelVersion,
-		ToolchainContainer: o.ToolchainContainer,
-		ExecOS:             o.PlatformParams.OSFamily,
-	}
-	// Extract the sha256 digest from the image name to be included in the manifest.
-	s := imageDigestRegexp.FindStringSubmatch(o.PlatformParams.ToolchainContainer)
-	if len(s) != 2 {
-		return fmt.Errorf("failed to extract sha256 digest using regex from image name %q, got %d substrings, want 2", o.PlatformParams.ToolchainContainer, len(s))
-	}
-	m.ImageDigest = s[1]
-	// Include the sha256 digest of the configs tarball if output tarball generation was enabled by
-	// actually hashing the contents of the output tarball.
-	if len(o.OutputTarball) != 0 {
-		d, err := digestFile(o.OutputTarball)
-		if err != nil {
-			return fmt.Errorf("unable to compute the sha256 digest of the output tarball file for the output manifest: %w", err)
+	if o.Cleanup {
+		if err := os.RemoveAll(o.TempWorkDir); err != nil {
+			log.Printf("Warning: Unable to delete temporary working directory %q: %v", o.TempWorkDir, err)
 		}
-		m.ConfigsTarballDigest = d
-	}
-	if err := m.ToJSONFile(o.OutputManifest); err != nil {
-		return fmt.Errorf("error writing manifest file: %w", err)
 	}
-	log.Printf("Wrote JSON manifest to %q.", o.OutputManifest)
+
 	return nil
 }
 
-// Run is the main entrypoint to generate Bazel toolchain configs according to the options
-// specified in the given command line arguments.
-// The file structure of the generated configs will be as follows:
-// <config root>
-// |
-//  - cc-  C++ configs as generated by Bazel's internal C++ toolchain detection logic.
-//  - config- Toolchain entrypoint target for cc_crosstool_top & the auto-generated platform target.
-//  - java- Java toolchain definition.
-func Run(o Options) error {
-	if err := processTempDir(&o); err != nil {
-		return fmt.Errorf("unable to initialize a local temporary working directory to store intermediate files: %w", err)
-	}
-	d, err := newDockerRunner(o.ToolchainContainer, o.DockerPlatform, o.Cleanup)
+// generateConfigs generates the configs of every enabled language & the crosstool top/platform BUILD file for the
+// toolchain container in the given options using the given container runtime. Intermediate files
+// are written to the TempWorkDir in the options which must already exist.
+func generateConfigs(o *Options, rt ContainerRuntime) (outputConfigs, error) {
+	d, err := newDockerRunner(rt, o.ToolchainContainer, o.DockerPlatform, o.Cleanup, !o.imagePulled)
 	if err != nil {
-		return fmt.Errorf("failed to initialize a docker container: %w", err)
+		return outputConfigs{}, fmt.Errorf("failed to initialize a %s container: %w", rt.Name(), err)
 	}
 	defer d.cleanup()
 
 	o.PlatformParams.ToolchainContainer = d.resolvedImage
 
-	if _, err := d.execCmd("mkdir", workdir(o.ExecOS)); err != nil {
-		return fmt.Errorf("failed to create an empty working directory in the container")
-	}
-	d.workdir = workdir(o.ExecOS)
-
-	bazelPath := o.BazelPath
-	if bazelPath == "" {
-		bazelPath, err = installBazelisk(d, o.TempWorkDir, o.ExecOS)
-		if err != nil {
-			return fmt.Errorf("failed to install Bazelisk into the toolchain container: %w", err)
+	// Static C++ config generation doesn't run any commands in the toolchain container and the
+	// toolchain image may not even have a shell.
+	if o.CppConfigMode != CppConfigModeStatic {
+		if _, err := d.execCmd("mkdir", workdir(o.ExecOS)); err != nil {
+			return outputConfigs{}, fmt.Errorf("failed to create an empty working directory in the container")
 		}
+		d.workdir = workdir(o.ExecOS)
 	}
 
-	cppConfigsTarball, err := genCppConfigs(d, &o, bazelPath)
+	languages, err := genLanguageConfigs(d, o)
 	if err != nil {
-		return fmt.Errorf("failed to generate C++ configs: %w", err)
+		return outputConfigs{}, err
 	}
-	javaBuild, err := genJavaConfigs(d, &o)
+
+	configBuild, err := genConfigBuild(o)
 	if err != nil {
-		return fmt.Errorf("failed to extract information about the installed JDK version in the toolchain container needed to generate Java configs: %w", err)
+		return outputConfigs{}, fmt.Errorf("unable to generate the BUILD file with the C++ crosstool and/or the default platform definition: %w", err)
 	}
 
-	configBuild, err := genConfigBuild(&o)
+	bazelrc, err := genBazelrc(o)
 	if err != nil {
-		return fmt.Errorf("unable to generate the BUILD file with the C++ crosstool and/or the default platform definition: %w", err)
+		return outputConfigs{}, fmt.Errorf("unable to generate the .bazelrc fragment: %w", err)
 	}
 
-	oc := outputConfigs{
+	return outputConfigs{
 		license: generatedFile{
 			name:     "LICENSE",
 			contents: licenseBlob,
 		},
-		cppConfigsTarball: cppConfigsTarball,
-		configBuild:       configBuild,
-		javaBuild:         javaBuild,
-	}
-	if err := assembleConfigs(&o, oc); err != nil {
-		return fmt.Errorf("unable to assemble C++/Java/Crosstool top/Platform definitions to generate the final toolchain configs output: %w", err)
-	}
-
-	if err := createManifest(&o); err != nil {
-		return fmt.Errorf("unable to create the manifest file: %w", err)
-	}
-
-	if o.Cleanup {
-		if err := os.RemoveAll(o.TempWorkDir); err != nil {
-			log.Printf("Warning: Unable to delete temporary working directory %q: %v", o.TempWorkDir, err)
-		}
-	}
-
-	return nil
+		languages:   languages,
+		configBuild: configBuild,
+		bazelrc:     bazelrc,
+	}, nil
 }
@@ -15,8 +15,17 @@
 package rbeconfigsgen
 
 import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
-  "text/template"
+	"text/template"
 )
 
 func TestGenCppToolchainTarget(t *testing.T) {
@@ -51,6 +60,13 @@ func TestGenCppToolchainTarget(t *testing.T) {
 				ExecOS:           "linux",
 				OutputConfigPath: "configs/foo/bar",
 			},
+		}, {
+			name: "No options, linux aarch64, choose default",
+			want: "//cc:cc-compiler-aarch64",
+			opt: &Options{
+				ExecOS:   "linux",
+				ExecArch: "aarch64",
+			},
 		}, {
 			name: "Windows pick output path and compiler",
 			want: "//configs/fizz/buzz/cc:foobar-cc-good",
@@ -96,75 +112,96 @@ func TestGetJavaTemplate(t *testing.T) {
 			name: "bazel 4, choose legacy",
 			want: legacyJavaBuildTemplate,
 			opt: &Options{
-        BazelVersion: "4.0.0",
-      },
+				BazelVersion: "4.0.0",
+			},
 		},
 		{
 			name: "bazel 5, choose BazelLt7",
 			want: javaBuildTemplateLt7,
 			opt: &Options{
-        BazelVersion: "5.0.0",
+				BazelVersion: "5.0.0",
 			},
 		},
 		{
 			name: "bazel 7, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-        BazelVersion: "7.0.0",
+				BazelVersion: "7.0.0",
 			},
 		},
 		{
 			name: "bazel 7-pre, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-        BazelVersion: "7.0.0-pre.20230724.1",
+				BazelVersion: "7.0.0-pre.20230724.1",
+			},
+		},
+		{
+			name: "bazel 5-pre, choose BazelLt7",
+			want: javaBuildTemplateLt7,
+			opt: &Options{
+				BazelVersion: "5.0.0-pre.20210708.4",
+			},
+		},
+		{
+			name: "bazel 7rc, choose latest",
+			want: javaBuildTemplate,
+			opt: &Options{
+				BazelVersion: "7.0.0rc2",
+			},
+		},
+		{
+			name: "bazel 10, choose latest",
+			want: javaBuildTemplate,
+			opt: &Options{
+				BazelVersion: "10.0.0",
 			},
 		},
 		{
 			name: "useLocalRuntime forced, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-			  JavaUseLocalRuntime: true,
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 4, choose BazelLt7",
 			want: javaBuildTemplateLt7,
 			opt: &Options{
-			  BazelVersion: "4.0.0",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "4.0.0",
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 5, choose BazelLt7",
 			want: javaBuildTemplateLt7,
 			opt: &Options{
-			  BazelVersion: "5.0.0",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "5.0.0",
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 6, choose BazelLt7",
 			want: javaBuildTemplateLt7,
 			opt: &Options{
-			  BazelVersion: "6.0.0",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "6.0.0",
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 7, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-			  BazelVersion: "7.0.0",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "7.0.0",
+				JavaUseLocalRuntime: true,
 			},
 		},
 		{
 			name: "useLocalRuntime forced, bazel 7-pre, choose latest",
 			want: javaBuildTemplate,
 			opt: &Options{
-			  BazelVersion: "7.0.0-pre.20200202",
-			  JavaUseLocalRuntime: true,
+				BazelVersion:        "7.0.0-pre.20200202",
+				JavaUseLocalRuntime: true,
 			},
 		},
 	}
@@ -175,12 +212,443 @@ func TestGetJavaTemplate(t *testing.T) {
 			t.Parallel()
 			// We skip validation since we don't set all options required for
 			// regular execution.
-			got, err := getJavaTemplate(tc.opt);
+			got, err := getJavaTemplate(tc.opt)
 			if err != nil {
-			  t.Fatalf("getJavaTemplate failed: %v, wanted: %v", err, tc.want)
+				t.Fatalf("getJavaTemplate failed: %v, wanted: %v", err, tc.want)
 			} else if got != tc.want {
 				t.Fatalf("getJavaTemplate: %v, wanted %v", got, tc.want)
 			}
 		})
 	}
 }
+
+func TestApplyArchDefaults(t *testing.T) {
+	tests := []struct {
+		name            string
+		opt             *Options
+		wantExec        []string
+		wantTarget      []string
+		wantTargetCPU   string
+		wantBazeliskURL string
+		wantErr         bool
+	}{
+		{
+			name:            "Linux x86_64",
+			opt:             &Options{ExecOS: "linux"},
+			wantExec:        []string{"@platforms//os:linux", "@platforms//cpu:x86_64", "@bazel_tools//tools/cpp:clang"},
+			wantTarget:      []string{"@platforms//os:linux", "@platforms//cpu:x86_64"},
+			wantTargetCPU:   "k8",
+			wantBazeliskURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.10.1/bazelisk-linux-amd64",
+		},
+		{
+			name:            "Linux aarch64",
+			opt:             &Options{ExecOS: "linux", ExecArch: "aarch64"},
+			wantExec:        []string{"@platforms//os:linux", "@platforms//cpu:aarch64", "@bazel_tools//tools/cpp:clang"},
+			wantTarget:      []string{"@platforms//os:linux", "@platforms//cpu:aarch64"},
+			wantTargetCPU:   "aarch64",
+			wantBazeliskURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.10.1/bazelisk-linux-arm64",
+		},
+		{
+			name:            "Linux aarch64 targeting x86_64",
+			opt:             &Options{ExecOS: "linux", ExecArch: "aarch64", TargetArch: "x86_64"},
+			wantExec:        []string{"@platforms//os:linux", "@platforms//cpu:aarch64", "@bazel_tools//tools/cpp:clang"},
+			wantTarget:      []string{"@platforms//os:linux", "@platforms//cpu:x86_64"},
+			wantTargetCPU:   "aarch64",
+			wantBazeliskURL: "https://github.com/bazelbuild/bazelisk/releases/download/v1.10.1/bazelisk-linux-arm64",
+		},
+		{
+			name:    "Windows aarch64 is unsupported",
+			opt:     &Options{ExecOS: "windows", ExecArch: "aarch64"},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown arch",
+			opt:     &Options{ExecOS: "linux", ExecArch: "riscv64"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			err := tc.opt.ApplyDefaults(tc.opt.ExecOS)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("ApplyDefaults succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyDefaults failed: %v", err)
+			}
+			if got := fmt.Sprint(tc.opt.PlatformParams.ExecConstraints); got != fmt.Sprint(tc.wantExec) {
+				t.Errorf("ApplyDefaults got exec constraints %v, want %v", got, tc.wantExec)
+			}
+			if got := fmt.Sprint(tc.opt.PlatformParams.TargetConstraints); got != fmt.Sprint(tc.wantTarget) {
+				t.Errorf("ApplyDefaults got target constraints %v, want %v", got, tc.wantTarget)
+			}
+			if got := tc.opt.CppGenEnv["BAZEL_TARGET_CPU"]; got != tc.wantTargetCPU {
+				t.Errorf("ApplyDefaults got BAZEL_TARGET_CPU=%q, want %q", got, tc.wantTargetCPU)
+			}
+			arch := tc.opt.ExecArch
+			if arch == "" {
+				arch = ArchX86_64
+			}
+			url, _, err := BazeliskDownloadInfoForArch(tc.opt.ExecOS, arch)
+			if err != nil {
+				t.Fatalf("BazeliskDownloadInfoForArch failed: %v", err)
+			}
+			if url != tc.wantBazeliskURL {
+				t.Errorf("BazeliskDownloadInfoForArch got URL %q, want %q", url, tc.wantBazeliskURL)
+			}
+		})
+	}
+	// The defaults must not be modified by options targeting a different architecture.
+	if got := DefaultArchExecOptions[ArchAarch64][OSLinux].PlatformParams.TargetConstraints[1]; got != "@platforms//cpu:aarch64" {
+		t.Errorf("Default aarch64 target constraints were modified, got %q", got)
+	}
+}
+
+func TestValidateDockerPlatform(t *testing.T) {
+	tests := []struct {
+		name         string
+		execArch     string
+		platform     string
+		wantPlatform string
+		wantErr      bool
+	}{
+		{
+			name: "No arch keeps the native platform",
+		},
+		{
+			name:         "Derived from arch",
+			execArch:     "aarch64",
+			wantPlatform: "linux/arm64",
+		},
+		{
+			name:         "Explicit platform with variant",
+			execArch:     "aarch64",
+			platform:     "linux/arm64/v8",
+			wantPlatform: "linux/arm64/v8",
+		},
+		{
+			name:     "Conflicting platform",
+			execArch: "x86_64",
+			platform: "linux/arm64",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			o := &Options{
+				BazelVersion:       "4.0.0",
+				ToolchainContainer: "gcr.io/foo/bar:latest",
+				ExecOS:             "linux",
+				TargetOS:           "linux",
+				ExecArch:           tc.execArch,
+				DockerPlatform:     tc.platform,
+				OutputTarball:      "configs.tar",
+				GenJavaConfigs:     true,
+			}
+			if err := o.ApplyDefaults(o.ExecOS); err != nil {
+				t.Fatalf("ApplyDefaults failed: %v", err)
+			}
+			err := o.Validate()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Validate succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate failed: %v", err)
+			}
+			if o.DockerPlatform != tc.wantPlatform {
+				t.Errorf("Validate got DockerPlatform %q, want %q", o.DockerPlatform, tc.wantPlatform)
+			}
+		})
+	}
+}
+
+func TestValidateTargetArch(t *testing.T) {
+	tests := []struct {
+		name       string
+		targetArch string
+		genCPP     bool
+		wantErr    bool
+	}{
+		{
+			name:   "Same as exec arch with C++",
+			genCPP: true,
+		},
+		{
+			name:       "Differs from exec arch without C++",
+			targetArch: "x86_64",
+		},
+		{
+			name:       "Differs from exec arch with C++",
+			targetArch: "x86_64",
+			genCPP:     true,
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			o := &Options{
+				BazelVersion:       "4.0.0",
+				ToolchainContainer: "gcr.io/foo/bar:latest",
+				ExecOS:             "linux",
+				TargetOS:           "linux",
+				ExecArch:           "aarch64",
+				TargetArch:         tc.targetArch,
+				OutputTarball:      "configs.tar",
+				GenCPPConfigs:      tc.genCPP,
+				GenJavaConfigs:     true,
+			}
+			if err := o.ApplyDefaults(o.ExecOS); err != nil {
+				t.Fatalf("ApplyDefaults failed: %v", err)
+			}
+			err := o.Validate()
+			if tc.wantErr && err == nil {
+				t.Fatalf("Validate succeeded, want error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("Validate failed: %v", err)
+			}
+		})
+	}
+}
+
+// fakeRuntime is a ContainerRuntime that doesn't run any containers and instead returns canned
+// responses to the commands run during config generation.
+type fakeRuntime struct {
+	// image is the image reference by digest the fake runtime resolves every image to.
+	image string
+	// env is the environment of the image.
+	env []string
+	// javaVersion is the version reported by running java in the container.
+	javaVersion string
+	// javaHomes maps the JDK installation directories found when looking for JDKs in the container
+	// to the Java version reported by their java binary.
+	javaHomes map[string]string
+	// pythonInterpreters are the lines printed when looking for python3 interpreters in the
+	// container.
+	pythonInterpreters []string
+	// goSDK & rustToolchain are the lines printed when looking for the Go SDK & the Rust toolchain
+	// in the container.
+	goSDK         []string
+	rustToolchain []string
+	// execs records the commands executed inside the container.
+	execs [][]string
+	// stopped is set when the container is stopped.
+	stopped bool
+	// pulls counts the number of images pulled if set.
+	pulls *int32
+}
+
+func (f *fakeRuntime) Name() string {
+	return "fake"
+}
+
+func (f *fakeRuntime) Pull(image, platform string) error {
+	if f.pulls != nil {
+		atomic.AddInt32(f.pulls, 1)
+	}
+	return nil
+}
+
+func (f *fakeRuntime) ResolveImage(image string) (string, error) {
+	return f.image, nil
+}
+
+func (f *fakeRuntime) ImageEnv(image string) ([]string, error) {
+	return f.env, nil
+}
+
+func (f *fakeRuntime) Create(image, platform string, cmd ...string) (string, error) {
+	return "fake-container", nil
+}
+
+func (f *fakeRuntime) Start(containerID string) error {
+	return nil
+}
+
+func (f *fakeRuntime) CopyTo(containerID, src, dst string) error {
+	return nil
+}
+
+func (f *fakeRuntime) CopyFrom(containerID, src, dst string) error {
+	return fmt.Errorf("copying files out of the fake container is not supported")
+}
+
+func (f *fakeRuntime) Stop(containerID string) error {
+	f.stopped = true
+	return nil
+}
+
+func (f *fakeRuntime) Exec(containerID, workdir string, env []string, args ...string) (ExecResult, error) {
+	f.execs = append(f.execs, args)
+	if strings.HasSuffix(args[0], "bin/java") {
+		v := f.javaVersion
+		if hv, ok := f.javaHomes[strings.TrimSuffix(args[0], "/bin/java")]; ok {
+			v = hv
+		}
+		return ExecResult{
+			Stderr: fmt.Sprintf("Property settings:\n    java.home = /jdk\n    java.version = %s\n", v),
+		}, nil
+	}
+	if args[0] == "sh" && strings.Contains(args[2], "python3") {
+		return ExecResult{Stdout: strings.Join(f.pythonInterpreters, "\n")}, nil
+	}
+	if args[0] == "sh" && args[2] == goProbeScript {
+		return ExecResult{Stdout: strings.Join(f.goSDK, "\n")}, nil
+	}
+	if args[0] == "sh" && args[2] == rustProbeScript {
+		return ExecResult{Stdout: strings.Join(f.rustToolchain, "\n")}, nil
+	}
+	if args[0] == "sh" && len(f.javaHomes) != 0 {
+		var dirs []string
+		for d := range f.javaHomes {
+			dirs = append(dirs, d)
+		}
+		sort.Strings(dirs)
+		var out []string
+		for _, d := range dirs {
+			out = append(out, d+"\t"+d)
+		}
+		return ExecResult{Stdout: strings.Join(out, "\n") + "\n"}, nil
+	}
+	return ExecResult{}, nil
+}
+
+// readTarball returns the contents of the regular files in the tarball at the given path.
+func readTarball(t *testing.T, tarPath string) map[string]string {
+	t.Helper()
+	f, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatalf("Failed to open tarball %q: %v", tarPath, err)
+	}
+	defer f.Close()
+	result := make(map[string]string)
+	r := tar.NewReader(f)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tarball %q: %v", tarPath, err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Failed to read %q from tarball %q: %v", h.Name, tarPath, err)
+		}
+		result[h.Name] = string(b)
+	}
+	return result
+}
+
+// TestRunWithoutValidate verifies Run defaults to the docker CLI when called with options that
+// weren't validated & thus don't specify a container runtime.
+func TestRunWithoutValidate(t *testing.T) {
+	bin := t.TempDir()
+	argsFile := path.Join(bin, "args")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\necho 'fake docker failure' >&2\nexit 1\n", argsFile)
+	if err := ioutil.WriteFile(path.Join(bin, "docker"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake docker CLI: %v", err)
+	}
+	oldPath := os.Getenv("PATH")
+	if err := os.Setenv("PATH", bin+string(os.PathListSeparator)+oldPath); err != nil {
+		t.Fatalf("Failed to set PATH: %v", err)
+	}
+	defer os.Setenv("PATH", oldPath)
+
+	o := Options{
+		BazelVersion:       "7.0.0",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      path.Join(t.TempDir(), "configs.tar"),
+		GenJavaConfigs:     true,
+		TempWorkDir:        t.TempDir(),
+	}
+	err := Run(o)
+	if err == nil {
+		t.Fatalf("Run succeeded with a failing docker CLI, want error")
+	}
+	if strings.Contains(err.Error(), "unknown container runtime") {
+		t.Fatalf("Run didn't default to the docker container runtime: %v", err)
+	}
+	got, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("Run didn't invoke the docker CLI: %v", err)
+	}
+	if want := "pull gcr.io/foo/bar:latest\n"; string(got) != want {
+		t.Errorf("Run invoked the docker CLI with %q, want %q", got, want)
+	}
+}
+
+func TestRunWithFakeRuntime(t *testing.T) {
+	dir := t.TempDir()
+	workDir := t.TempDir()
+	rt := &fakeRuntime{
+		image:       "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:         []string{"PATH=/bin", "JAVA_HOME=/jdk"},
+		javaVersion: "11.0.10",
+	}
+	o := Options{
+		BazelVersion:       "6.0.0",
+		BazelPath:          "/usr/bin/bazel",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputTarball:      path.Join(dir, "configs.tar"),
+		OutputManifest:     path.Join(dir, "manifest.json"),
+		GenJavaConfigs:     true,
+		TempWorkDir:        workDir,
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if !rt.stopped {
+		t.Errorf("run did not stop the container even though Cleanup was true")
+	}
+
+	files := readTarball(t, o.OutputTarball)
+	for _, f := range []string{"LICENSE", "java/BUILD", "config/BUILD", "configs.bazelrc"} {
+		if _, ok := files[f]; !ok {
+			t.Errorf("Output tarball did not contain %q, got files %v", f, files)
+		}
+	}
+	if want := `version = "11.0.10"`; !strings.Contains(files["java/BUILD"], want) {
+		t.Errorf("java/BUILD did not contain %q, got:\n%s", want, files["java/BUILD"])
+	}
+	if want := `"container-image": "docker://` + rt.image + `"`; !strings.Contains(files["config/BUILD"], want) {
+		t.Errorf("config/BUILD did not contain %q, got:\n%s", want, files["config/BUILD"])
+	}
+	if want := "build:remote --extra_toolchains=@rbe_default//java:all\n"; !strings.Contains(files["configs.bazelrc"], want) {
+		t.Errorf("configs.bazelrc did not contain %q, got:\n%s", want, files["configs.bazelrc"])
+	}
+
+	m, err := ManifestFromJSONFile(o.OutputManifest)
+	if err != nil {
+		t.Fatalf("Failed to read the output manifest: %v", err)
+	}
+	if m.ImageDigest != strings.Repeat("a", 64) {
+		t.Errorf("Manifest had image digest %q, want %q", m.ImageDigest, strings.Repeat("a", 64))
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// RuntimeRootfs selects unpacking the toolchain image from a local image archive into a rootfs
+	// and running commands inside it with a bubblewrap user namespace sandbox. This doesn't need a
+	// container daemon.
+	RuntimeRootfs = "rootfs"
+	// defaultRootfsPlatform is the platform picked from multi-platform image archives if no
+	// platform was specified.
+	defaultRootfsPlatform = "linux/amd64"
+)
+
+// rootfsRuntime is a ContainerRuntime that doesn't need a container daemon. Instead, the image is
+// read from an OCI image layout or a 'docker save' tarball & its layers are unpacked into a local
+// rootfs directory. Commands are run inside the rootfs using bubblewrap (bwrap) in an unprivileged
+// user namespace. The "container" is the unpacked rootfs and no process keeps running between
+// commands.
+type rootfsRuntime struct {
+	// archive is the path to the OCI image layout directory or tarball or 'docker save' tarball.
+	archive string
+	// platform selects the image from multi-platform image archives as os/arch[/variant].
+	platform string
+	// bwrapPath is the path to the bubblewrap binary.
+	bwrapPath string
+
+	// Populated by Pull.
+	// scratchDir is the local directory containing the extracted image archive & unpacked rootfs.
+	scratchDir string
+	// image is the image read from the archive.
+	image *localImage
+	// rootfs is the directory the image layers were unpacked into.
+	rootfs string
+}
+
+// NewRootfsRuntime returns a daemonless container runtime that unpacks the image in the given OCI
+// image layout directory or tarball or 'docker save' tarball into a rootfs & runs commands in it
+// using bubblewrap. platform is optional and selects the image from multi-platform image archives
+// as os/arch[/variant].
+func NewRootfsRuntime(archive, platform string) ContainerRuntime {
+	if platform == "" {
+		platform = defaultRootfsPlatform
+	}
+	return &rootfsRuntime{
+		archive:   archive,
+		platform:  platform,
+		bwrapPath: "bwrap",
+	}
+}
+
+func (r *rootfsRuntime) Name() string {
+	return RuntimeRootfs
+}
+
+// Pull reads the image from the image archive & unpacks its layers into a local rootfs. 'image' is
+// only used to identify the image and the archive is expected to contain it. The image is selected
+// from multi-platform archives using the platform given to NewRootfsRuntime if 'platform' is empty.
+func (r *rootfsRuntime) Pull(image, platform string) error {
+	if platform != "" {
+		r.platform = platform
+	}
+	dir, err := ioutil.TempDir("", "rbeconfigsgen_rootfs_")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary directory to unpack the image into: %w", err)
+	}
+	r.scratchDir = dir
+	img, err := loadImage(r.archive, r.platform, dir)
+	if err != nil {
+		return fmt.Errorf("unable to read image %q from %q: %w", image, r.archive, err)
+	}
+	r.image = img
+	r.rootfs = filepath.Join(dir, "rootfs")
+	log.Printf("Unpacking %d layers of image %q from %q into %q.", len(img.layers), image, r.archive, r.rootfs)
+	if err := unpackImage(img, r.rootfs); err != nil {
+		return fmt.Errorf("unable to unpack image %q: %w", image, err)
+	}
+	return nil
+}
+
+// ResolveImage returns the image as is if it's already referenced by digest. Otherwise, the digest
+// of the image manifest in the archive is appended to the image repository. 'docker save' tarballs
+// don't record the manifest digest, so the image must be referenced by digest in that case.
+func (r *rootfsRuntime) ResolveImage(image string) (string, error) {
+	if imageDigestRegexp.MatchString(image) {
+		return image, nil
+	}
+	if r.image == nil || r.image.manifestDigest == "" {
+		return "", fmt.Errorf("the manifest digest of image %q is unknown because %q isn't an OCI image layout, specify the image by digest instead", image, r.archive)
+	}
+	repo := image
+	// Strip the tag if there's one, i.e., a ':' after the last '/'.
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	return fmt.Sprintf("%s@%s", repo, r.image.manifestDigest), nil
+}
+
+func (r *rootfsRuntime) ImageEnv(image string) ([]string, error) {
+	if r.image == nil {
+		return nil, fmt.Errorf("image %q wasn't unpacked", image)
+	}
+	return r.image.config.Config.Env, nil
+}
+
+// Create returns the path to the unpacked rootfs as the container ID. The command & platform are
+// ignored because the rootfs doesn't run any process until commands are executed in it.
+func (r *rootfsRuntime) Create(image, platform string, cmd ...string) (string, error) {
+	if r.rootfs == "" {
+		return "", fmt.Errorf("image %q wasn't unpacked", image)
+	}
+	return r.rootfs, nil
+}
+
+func (r *rootfsRuntime) Start(containerID string) error {
+	return nil
+}
+
+// Exec runs the given command inside the rootfs using bubblewrap. bubblewrap is only required if
+// commands are run, i.e., the rootfs can be inspected statically without it.
+func (r *rootfsRuntime) Exec(containerID, workdir string, env []string, args ...string) (ExecResult, error) {
+	if r.image == nil {
+		return ExecResult{}, fmt.Errorf("unable to run %v in %q because no image was unpacked", args, containerID)
+	}
+	if _, err := exec.LookPath(r.bwrapPath); err != nil {
+		return ExecResult{}, fmt.Errorf("bubblewrap is required to run commands in the unpacked image without a container daemon: %w", err)
+	}
+	a := []string{
+		"--unshare-user",
+		"--uid", "0",
+		"--gid", "0",
+		"--unshare-pid",
+		"--unshare-ipc",
+		"--unshare-uts",
+		"--die-with-parent",
+		"--bind", containerID, "/",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--ro-bind-try", "/etc/resolv.conf", "/etc/resolv.conf",
+		"--clearenv",
+	}
+	// The image environment is applied first so that the given env can override it.
+	hasHome := false
+	for _, e := range append(append([]string{}, r.image.config.Config.Env...), env...) {
+		keyVal := strings.SplitN(e, "=", 2)
+		if len(keyVal) != 2 || keyVal[0] == "" {
+			continue
+		}
+		if keyVal[0] == "HOME" {
+			hasHome = true
+		}
+		a = append(a, "--setenv", keyVal[0], keyVal[1])
+	}
+	if !hasHome {
+		a = append(a, "--setenv", "HOME", "/root")
+	}
+	if workdir != "" {
+		a = append(a, "--chdir", workdir)
+	}
+	a = append(a, "--")
+	a = append(a, args...)
+	return runCmdResult(r.bwrapPath, a...)
+}
+
+// RootfsDir returns the unpacked rootfs which is also the container ID.
+func (r *rootfsRuntime) RootfsDir(containerID string) (string, error) {
+	if containerID == "" {
+		return "", fmt.Errorf("image wasn't unpacked")
+	}
+	return containerID, nil
+}
+
+func (r *rootfsRuntime) CopyTo(containerID, src, dst string) error {
+	p, err := resolveInRoot(containerID, dst, false)
+	if err != nil {
+		return err
+	}
+	blob, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("unable to read %q: %w", src, err)
+	}
+	s, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("unable to stat %q: %w", src, err)
+	}
+	if err := ioutil.WriteFile(p, blob, s.Mode().Perm()); err != nil {
+		return fmt.Errorf("unable to write %q: %w", p, err)
+	}
+	return nil
+}
+
+func (r *rootfsRuntime) CopyFrom(containerID, src, dst string) error {
+	p, err := resolveInRoot(containerID, src, true)
+	if err != nil {
+		return err
+	}
+	blob, err := ioutil.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("unable to read %q from the rootfs: %w", src, err)
+	}
+	if err := ioutil.WriteFile(dst, blob, 0644); err != nil {
+		return fmt.Errorf("unable to write %q: %w", dst, err)
+	}
+	return nil
+}
+
+// ArchiveFrom archives the directory 'src' in the rootfs directly without running tar inside the
+// rootfs.
+func (r *rootfsRuntime) ArchiveFrom(containerID, src string) (io.ReadCloser, error) {
+	dir, err := resolveInRoot(containerID, src, true)
+	if err != nil {
+		return nil, err
+	}
+	if s, err := os.Stat(dir); err != nil || !s.IsDir() {
+		return nil, fmt.Errorf("%q isn't a directory in the rootfs", src)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archiveLocalDir(dir, path.Base(src), pw))
+	}()
+	return pr, nil
+}
+
+// archiveLocalDir writes the contents of the local directory 'dir' as a tarball with entries
+// prefixed by 'prefix' to 'w'. Symlinks are archived as symlinks.
+func archiveLocalDir(dir, prefix string, w io.Writer) error {
+	t := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		h, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		h.Name = path.Join(prefix, filepath.ToSlash(rel))
+		if info.IsDir() {
+			h.Name += "/"
+		}
+		if err := t.WriteHeader(h); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(t, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to archive %q: %w", dir, err)
+	}
+	return t.Close()
+}
+
+// Stop deletes the extracted image archive & the unpacked rootfs.
+func (r *rootfsRuntime) Stop(containerID string) error {
+	if r.scratchDir == "" {
+		return nil
+	}
+	return forceRemoveAll(r.scratchDir)
+}
@@ -0,0 +1,283 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// RuntimeDocker selects the docker CLI as the container runtime.
+	RuntimeDocker = "docker"
+	// RuntimePodman selects the podman CLI as the container runtime.
+	RuntimePodman = "podman"
+	// RuntimeNerdctl selects the nerdctl CLI (containerd) as the container runtime.
+	RuntimeNerdctl = "nerdctl"
+	// RuntimeDockerAPI selects the Docker Engine API accessed over the docker daemon's unix socket
+	// as the container runtime.
+	RuntimeDockerAPI = "docker-api"
+)
+
+var (
+	validRuntimes = []string{
+		RuntimeDocker,
+		RuntimePodman,
+		RuntimeNerdctl,
+		RuntimeDockerAPI,
+		RuntimeRootfs,
+	}
+)
+
+// ExecResult is the result of running a command inside a container.
+type ExecResult struct {
+	// ExitCode is the exit code of the command.
+	ExitCode int
+	// Stdout is the standard output of the command.
+	Stdout string
+	// Stderr is the standard error of the command.
+	Stderr string
+}
+
+// ContainerRuntime is the interface to a container engine that can pull the toolchain container
+// image, spin up a container from it and run commands inside the running container. Config
+// generation only interacts with the toolchain container via a ContainerRuntime.
+type ContainerRuntime interface {
+	// Name returns the name of the container runtime used in logs & error messages.
+	Name() string
+	// Pull pulls the given image so that containers can be created from it. platform is optional
+	// and if specified, selects the platform of the image to pull if the image is multi-platform.
+	Pull(image, platform string) error
+	// ResolveImage returns the fully qualified name of the given image referenced by its sha256
+	// digest.
+	ResolveImage(image string) (string, error)
+	// ImageEnv returns the environment variables specified in the config of the given image as
+	// KEY=VALUE strings in the order they were specified.
+	ImageEnv(image string) ([]string, error)
+	// Create creates a container of the given image that'll run the given command once started
+	// and returns the ID of the created container. platform is optional and if specified, selects
+	// the platform of the image if the image is multi-platform.
+	Create(image, platform string, cmd ...string) (string, error)
+	// Start starts the created container with the given ID.
+	Start(containerID string) error
+	// Exec runs the given command inside the running container with the given ID and returns the
+	// result of the command. workdir is the working directory for the command and env are
+	// additional environment variables specified as KEY=VALUE strings. workdir is optional.
+	// A non-zero exit code of the command isn't an error and is reported in the returned result.
+	Exec(containerID, workdir string, env []string, args ...string) (ExecResult, error)
+	// CopyTo copies the local file at 'src' to the path 'dst' inside the container.
+	CopyTo(containerID, src, dst string) error
+	// CopyFrom copies the file at path 'src' inside the container to the local path 'dst'.
+	CopyFrom(containerID, src, dst string) error
+	// Stop stops & deletes the container with the given ID.
+	Stop(containerID string) error
+}
+
+// containerArchiver is implemented by container runtimes that can directly stream the contents of
+// a directory inside a container as a tarball. Runtimes that don't implement this interface require
+// the directory to be archived using tar inside the container before being copied out.
+type containerArchiver interface {
+	// ArchiveFrom returns a tar stream of the directory 'src' inside the container with the given
+	// ID. Entries in the tar stream are prefixed with the base name of 'src'.
+	ArchiveFrom(containerID, src string) (io.ReadCloser, error)
+}
+
+// rootfsAccessor is implemented by container runtimes whose containers are backed by a rootfs
+// directory on the local filesystem which can be inspected without running commands inside the
+// container.
+type rootfsAccessor interface {
+	// RootfsDir returns the local directory with the rootfs of the container with the given ID.
+	RootfsDir(containerID string) (string, error)
+}
+
+// NewContainerRuntime returns the container runtime with the given name. The name is expected to be
+// one of RuntimeDocker, RuntimePodman, RuntimeNerdctl or RuntimeDockerAPI. An empty name selects
+// RuntimeDocker. Use NewRootfsRuntime for RuntimeRootfs.
+func NewContainerRuntime(name string) (ContainerRuntime, error) {
+	switch name {
+	case "", RuntimeDocker:
+		return &cliRuntime{name: RuntimeDocker, path: "docker", autoRemove: true}, nil
+	case RuntimePodman:
+		return &cliRuntime{name: RuntimePodman, path: "podman", autoRemove: true}, nil
+	case RuntimeNerdctl:
+		// nerdctl doesn't support auto removal of created (as opposed to run) containers, so the
+		// container is explicitly deleted when it's stopped.
+		return &cliRuntime{name: RuntimeNerdctl, path: "nerdctl", autoRemove: false}, nil
+	case RuntimeDockerAPI:
+		return newDockerAPIRuntime(dockerSocket()), nil
+	case RuntimeRootfs:
+		return nil, fmt.Errorf("the %s container runtime requires an image archive, use NewRootfsRuntime instead", RuntimeRootfs)
+	}
+	return nil, fmt.Errorf("unknown container runtime %q, want one of %s", name, strings.Join(validRuntimes, ", "))
+}
+
+// runCmdResult runs an arbitrary command, logs the exact command that was run and returns the
+// exit code of the command with the stdout & stderr captured separately. A non-zero exit code
+// isn't considered an error.
+func runCmdResult(cmd string, args ...string) (ExecResult, error) {
+	log.Printf("Running: '%s'", strings.Join(append([]string{cmd}, args...), " "))
+	c := exec.Command(cmd, args...)
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	c.Stdout = stdout
+	c.Stderr = stderr
+	err := c.Run()
+	r := ExecResult{
+		Stdout: stdout.String(),
+		Stderr: stderr.String(),
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		r.ExitCode = exitErr.ExitCode()
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// containerRuntimeForOptions returns the container runtime selected by the given options.
+func containerRuntimeForOptions(o *Options) (ContainerRuntime, error) {
+	if o.ContainerRuntime == RuntimeRootfs {
+		return NewRootfsRuntime(o.ImageArchive, o.DockerPlatform), nil
+	}
+	return NewContainerRuntime(o.ContainerRuntime)
+}
+
+// cliRuntime is a ContainerRuntime that shells out to a docker compatible CLI client. docker,
+// podman & nerdctl all accept the subset of the docker CLI used here.
+type cliRuntime struct {
+	// name is the name of the runtime.
+	name string
+	// path is the path to the CLI client.
+	path string
+	// autoRemove determines whether containers are created with --rm. If false, containers are
+	// explicitly deleted when stopped.
+	autoRemove bool
+}
+
+func (c *cliRuntime) Name() string {
+	return c.name
+}
+
+func (c *cliRuntime) Pull(image, platform string) error {
+	args := []string{"pull"}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	args = append(args, image)
+	if _, err := runCmd(c.path, args...); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *cliRuntime) ResolveImage(image string) (string, error) {
+	o, err := runCmd(c.path, "image", "inspect", "--format={{index .RepoDigests 0}}", image)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(o), nil
+}
+
+func (c *cliRuntime) ImageEnv(image string) ([]string, error) {
+	o, err := runCmd(c.path, "image", "inspect", "-f", "{{range $i, $v := .Config.Env}}{{println $v}}{{end}}", image)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, s := range strings.Split(o, "\n") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+func (c *cliRuntime) Create(image, platform string, cmd ...string) (string, error) {
+	args := []string{"create"}
+	if c.autoRemove {
+		args = append(args, "--rm")
+	}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	args = append(args, image)
+	args = append(args, cmd...)
+	cid, err := runCmd(c.path, args...)
+	if err != nil {
+		return "", err
+	}
+	cid = strings.TrimSpace(cid)
+	if len(cid) != 64 {
+		return "", fmt.Errorf("container ID %q extracted from the stdout of the container create command had unexpected length, got %d, want 64", cid, len(cid))
+	}
+	return cid, nil
+}
+
+func (c *cliRuntime) Start(containerID string) error {
+	if _, err := runCmd(c.path, "start", containerID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *cliRuntime) Exec(containerID, workdir string, env []string, args ...string) (ExecResult, error) {
+	a := []string{"exec"}
+	if workdir != "" {
+		a = append(a, "-w", workdir)
+	}
+	for _, e := range env {
+		a = append(a, "-e", e)
+	}
+	a = append(a, containerID)
+	a = append(a, args...)
+	return runCmdResult(c.path, a...)
+}
+
+func (c *cliRuntime) CopyTo(containerID, src, dst string) error {
+	if _, err := runCmd(c.path, "cp", src, fmt.Sprintf("%s:%s", containerID, dst)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *cliRuntime) CopyFrom(containerID, src, dst string) error {
+	if _, err := runCmd(c.path, "cp", fmt.Sprintf("%s:%s", containerID, src), dst); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *cliRuntime) Stop(containerID string) error {
+	if _, err := runCmd(c.path, "stop", "-t", "0", containerID); err != nil {
+		return err
+	}
+	if c.autoRemove {
+		return nil
+	}
+	if _, err := runCmd(c.path, "rm", "-f", containerID); err != nil {
+		return err
+	}
+	return nil
+}
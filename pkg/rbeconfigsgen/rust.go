@@ -0,0 +1,243 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+)
+
+const (
+	// rustProbeScript prints the path & sysroot of the rustc in the PATH of the toolchain container
+	// or in a well known installation directory followed by its verbose version information & the
+	// version of the cargo installed next to it, one "key: value" per line.
+	rustProbeScript = `for r in "$(command -v rustc)" /usr/local/cargo/bin/rustc "$HOME/.cargo/bin/rustc"; do
+  if [ -x "$r" ]; then
+    echo "rustc: $r"
+    echo "sysroot: $("$r" --print sysroot)"
+    "$r" -vV
+    c="$(dirname "$r")/cargo"
+    if [ -x "$c" ]; then echo "cargo: $("$c" --version)"; fi
+    exit 0
+  fi
+done`
+)
+
+var (
+	// rustBuildTemplate is the template for the BUILD file of the package with the Rust toolchain
+	// definition.
+	rustBuildTemplate = template.Must(template.New("rustBuild").Parse(buildHeader + `
+package(default_visibility = ["//visibility:public"])
+
+exports_files(["toolchain.bzl"])
+`))
+
+	// rustToolchainTemplate is the template for the .bzl file declaring a rules_rust toolchain for
+	// the Rust toolchain installed in the toolchain container.
+	rustToolchainTemplate = template.Must(template.New("rustToolchain").Parse(buildHeader + `
+"""Rust {{ .Version }} installed in the toolchain container at {{ .Sysroot }}."""
+
+RUST_SYSROOT = "{{ .Sysroot }}"
+RUSTC_VERSION = "{{ .Version }}"
+CARGO_VERSION = "{{ .CargoVersion }}"
+RUST_HOST_TRIPLE = "{{ .Host }}"
+
+_BUILD_FILE = """
+load("@rules_rust//rust:toolchain.bzl", "rust_stdlib_filegroup", "rust_toolchain")
+
+package(default_visibility = ["//visibility:public"])
+
+rust_stdlib_filegroup(
+    name = "rust_std",
+    srcs = glob(["sysroot/lib/rustlib/{{ .Host }}/lib/*"]),
+)
+
+filegroup(
+    name = "rustc_lib",
+    srcs = glob(
+        [
+            "sysroot/lib/librustc_driver-*.so",
+            "sysroot/lib/libstd-*.so",
+            "sysroot/lib/libLLVM*.so*",
+        ],
+        allow_empty = True,
+    ),
+)
+
+rust_toolchain(
+    name = "rust_toolchain",
+    binary_ext = "",
+{{ if .CargoVersion }}    cargo = "sysroot/bin/cargo",
+{{ end }}    default_edition = "{edition}",
+    dylib_ext = ".so",
+    exec_triple = "{{ .Host }}",
+    rust_doc = "sysroot/bin/rustdoc",
+    rust_std = ":rust_std",
+    rustc = "sysroot/bin/rustc",
+    rustc_lib = ":rustc_lib",
+    staticlib_ext = ".a",
+    stdlib_linkflags = [
+        "-lpthread",
+        "-ldl",
+    ],
+    target_triple = "{{ .Host }}",
+)
+
+toolchain(
+    name = "toolchain",
+    exec_compatible_with = [
+        "@platforms//os:linux",
+        "{{ .CPUConstraint }}",
+    ],
+    target_compatible_with = [
+        "@platforms//os:linux",
+        "{{ .CPUConstraint }}",
+    ],
+    toolchain = ":rust_toolchain",
+    toolchain_type = "@rules_rust//rust:toolchain_type",
+)
+"""
+
+def _rbe_rust_toolchain_repository_impl(repository_ctx):
+    sysroot = repository_ctx.path(RUST_SYSROOT)
+    if not sysroot.exists:
+        fail("The Rust sysroot %s of the toolchain container doesn't exist on the machine running Bazel" % RUST_SYSROOT)
+    repository_ctx.symlink(sysroot, "sysroot")
+    repository_ctx.file("BUILD.bazel", _BUILD_FILE.format(edition = repository_ctx.attr.edition))
+
+_rbe_rust_toolchain_repository = repository_rule(
+    implementation = _rbe_rust_toolchain_repository_impl,
+    attrs = {
+        "edition": attr.string(default = "2021"),
+    },
+    local = True,
+)
+
+def rbe_rust_register_toolchains(name = "rbe_rust_toolchain", edition = "2021"):
+    """Declares the Rust toolchain installed in the toolchain container & registers it.
+
+    rules_rust reads the files of the toolchain in RUST_SYSROOT on the machine running Bazel &
+    sends them as inputs of remote actions which run them in the toolchain container. Bazel has to
+    run where the Rust toolchain of the toolchain container is installed at RUST_SYSROOT, e.g., in
+    the toolchain container.
+
+    Args:
+        name: The name of the Rust toolchain repository.
+        edition: The default Rust edition of the toolchain.
+    """
+    _rbe_rust_toolchain_repository(name = name, edition = edition)
+    native.register_toolchains("@%s//:toolchain" % name)
+`))
+)
+
+// rustToolchain is a Rust toolchain installed in the toolchain container.
+type rustToolchain struct {
+	// Rustc is the path of the rustc binary of the toolchain.
+	Rustc   string
+	Sysroot string
+	// Version is the release of rustc, e.g., 1.75.0.
+	Version string
+	// Host is the target triple of the host rustc was built for, e.g., x86_64-unknown-linux-gnu.
+	Host string
+	// CargoVersion is the version of the cargo installed next to rustc if any.
+	CargoVersion string
+}
+
+// CPUConstraint returns the label of the CPU constraint value of the host of the toolchain.
+func (r *rustToolchain) CPUConstraint() string {
+	return cpuConstraint(strings.SplitN(r.Host, "-", 2)[0])
+}
+
+// parseRustToolchain returns the Rust toolchain in the given output of rustProbeScript.
+func parseRustToolchain(out string) (*rustToolchain, error) {
+	info := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), ": ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		info[kv[0]] = strings.TrimSpace(kv[1])
+	}
+	if info["rustc"] == "" {
+		return nil, fmt.Errorf("no Rust toolchain was found in the toolchain container")
+	}
+	r := &rustToolchain{
+		Rustc:   info["rustc"],
+		Sysroot: info["sysroot"],
+		Version: info["release"],
+		Host:    info["host"],
+	}
+	if r.Sysroot == "" || r.Version == "" {
+		return nil, fmt.Errorf("unable to determine the sysroot & version of %s", r.Rustc)
+	}
+	// cargo prints its version as "cargo <version> (<commit> <date>)".
+	if f := strings.Fields(info["cargo"]); len(f) >= 2 {
+		r.CargoVersion = f[1]
+	}
+	return r, nil
+}
+
+// rustGenerator generates the Rust configs in the rust directory, i.e., a .bzl file declaring a
+// rules_rust toolchain for the sysroot of the rustc installed in the toolchain container along
+// with constants describing the installed toolchain. The toolchain is declared in a repository
+// symlinking the sysroot, so it has to be registered in the WORKSPACE file instead of with flags.
+type rustGenerator struct{}
+
+func (rustGenerator) name() string {
+	return "rust"
+}
+
+func (rustGenerator) enabled(o *Options) bool {
+	return o.GenRustConfigs
+}
+
+func (rustGenerator) generate(d *dockerRunner, o *Options) (*languageConfigs, error) {
+	out, err := d.execCmd("sh", "-c", rustProbeScript)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look for the Rust toolchain in the toolchain container: %w", err)
+	}
+	r, err := parseRustToolchain(out)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Found Rust %s with sysroot %q.", r.Version, r.Sysroot)
+	if r.CargoVersion == "" {
+		log.Printf("Warning: cargo wasn't found next to %q.", r.Rustc)
+	}
+	lc := &languageConfigs{
+		manifest: map[string]string{
+			"rustc":         r.Rustc,
+			"sysroot":       r.Sysroot,
+			"version":       r.Version,
+			"host":          r.Host,
+			"cargo_version": r.CargoVersion,
+		},
+	}
+	files, err := executeLanguageTemplates([]languageTemplate{
+		{name: "rust/BUILD", tmpl: rustBuildTemplate},
+		{name: "rust/toolchain.bzl", tmpl: rustToolchainTemplate},
+	}, r)
+	if err != nil {
+		return nil, err
+	}
+	lc.files = files
+	return lc, nil
+}
+
+func (rustGenerator) bazelrc(o *Options) (*bazelrcSection, error) {
+	return nil, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+// rustProbeOutput is the output of rustProbeScript for a rustup installation of Rust 1.75.0.
+var rustProbeOutput = []string{
+	"rustc: /usr/local/cargo/bin/rustc",
+	"sysroot: /usr/local/rustup/toolchains/1.75.0-x86_64-unknown-linux-gnu",
+	"rustc 1.75.0 (82e1608df 2023-12-21)",
+	"binary: rustc",
+	"commit-hash: 82e1608dfa6e0b5569232559e3d385fea5a93112",
+	"commit-date: 2023-12-21",
+	"host: x86_64-unknown-linux-gnu",
+	"release: 1.75.0",
+	"LLVM version: 17.0.6",
+	"cargo: cargo 1.75.0 (1d8b05cdd 2023-11-20)",
+}
+
+func TestParseRustToolchain(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    rustToolchain
+		wantErr bool
+	}{
+		{
+			name: "Found",
+			out:  strings.Join(rustProbeOutput, "\n"),
+			want: rustToolchain{
+				Rustc:        "/usr/local/cargo/bin/rustc",
+				Sysroot:      "/usr/local/rustup/toolchains/1.75.0-x86_64-unknown-linux-gnu",
+				Version:      "1.75.0",
+				Host:         "x86_64-unknown-linux-gnu",
+				CargoVersion: "1.75.0",
+			},
+		},
+		{
+			name: "NoCargo",
+			out:  "rustc: /usr/bin/rustc\nsysroot: /usr\nrelease: 1.70.0\nhost: aarch64-unknown-linux-gnu\n",
+			want: rustToolchain{
+				Rustc:   "/usr/bin/rustc",
+				Sysroot: "/usr",
+				Version: "1.70.0",
+				Host:    "aarch64-unknown-linux-gnu",
+			},
+		},
+		{
+			name:    "NotFound",
+			out:     "",
+			wantErr: true,
+		},
+		{
+			name:    "NoVersion",
+			out:     "rustc: /usr/bin/rustc\nsysroot: /usr\n",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseRustToolchain(tc.out)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseRustToolchain(%q)=%+v, want error", tc.out, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRustToolchain(%q) failed: %v", tc.out, err)
+			}
+			if *got != tc.want {
+				t.Errorf("parseRustToolchain(%q)=%+v, want %+v", tc.out, *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunWithRustConfigs(t *testing.T) {
+	dir := t.TempDir()
+	rt := &fakeRuntime{
+		image:         "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64),
+		env:           []string{"PATH=/bin", "JAVA_HOME=/jdk"},
+		javaVersion:   "11.0.10",
+		rustToolchain: rustProbeOutput,
+	}
+	o := Options{
+		BazelVersion:       "6.0.0",
+		ToolchainContainer: "gcr.io/foo/bar:latest",
+		ExecOS:             OSLinux,
+		TargetOS:           OSLinux,
+		OutputSourceRoot:   dir,
+		OutputConfigPath:   "configs",
+		GenJavaConfigs:     true,
+		GenRustConfigs:     true,
+		TempWorkDir:        t.TempDir(),
+		Cleanup:            true,
+	}
+	if err := o.ApplyDefaults(o.ExecOS); err != nil {
+		t.Fatalf("ApplyDefaults failed: %v", err)
+	}
+	if err := run(o, rt); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	for name, want := range map[string]string{
+		"rust/toolchain.bzl": "RUSTC_VERSION = \"1.75.0\"\nCARGO_VERSION = \"1.75.0\"\nRUST_HOST_TRIPLE = \"x86_64-unknown-linux-gnu\"\n",
+		"rust/BUILD":         "exports_files([\"toolchain.bzl\"])\n",
+		"java/BUILD":         "java_home = \"/jdk\"",
+	} {
+		blob, err := ioutil.ReadFile(path.Join(dir, "configs", name))
+		if err != nil {
+			t.Fatalf("Failed to read generated file %s: %v", name, err)
+		}
+		if got := string(blob); !strings.Contains(got, want) {
+			t.Errorf("%s did not contain %q, got:\n%s", name, want, got)
+		}
+	}
+	blob, err := ioutil.ReadFile(path.Join(dir, "configs", "rust/toolchain.bzl"))
+	if err != nil {
+		t.Fatalf("Failed to read generated file rust/toolchain.bzl: %v", err)
+	}
+	for _, want := range []string{
+		"RUST_SYSROOT = \"/usr/local/rustup/toolchains/1.75.0-x86_64-unknown-linux-gnu\"\n",
+		"    rustc = \"sysroot/bin/rustc\",\n",
+		"    cargo = \"sysroot/bin/cargo\",\n",
+		"    srcs = glob([\"sysroot/lib/rustlib/x86_64-unknown-linux-gnu/lib/*\"]),\n",
+		"        \"@platforms//cpu:x86_64\",\n",
+		"    repository_ctx.symlink(sysroot, \"sysroot\")\n",
+	} {
+		if !strings.Contains(string(blob), want) {
+			t.Errorf("rust/toolchain.bzl did not contain %q, got:\n%s", want, blob)
+		}
+	}
+}
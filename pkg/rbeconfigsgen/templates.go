@@ -0,0 +1,220 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"text/template"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+var (
+	// bazelVersionRegexp matches Bazel versions. Besides semver pre-releases like
+	// 7.0.0-pre.20230724.1, Bazel release candidates use the non-semver format 7.0.0rc1.
+	bazelVersionRegexp = regexp.MustCompile(`^([0-9]+)\.([0-9]+)\.([0-9]+)(rc[0-9]+|[-+].*)?$`)
+
+	// localJavaRuntimeVersions are the Bazel versions using the local_java_runtime rule for Java
+	// toolchains instead of java_runtime. See:
+	// https://github.com/bazelbuild/bazel-toolchains/pull/926.
+	localJavaRuntimeVersions = versionRange{Min: "5.0.0"}
+	// cppToolchainResolutionVersions are the Bazel versions resolving C++ toolchains using
+	// platforms by default, i.e., --crosstool_top is no longer needed.
+	cppToolchainResolutionVersions = versionRange{Min: "7.0.0"}
+	// bzlmodVersions are the Bazel versions supporting registering toolchains & platforms from
+	// modules.
+	bzlmodVersions = versionRange{Min: "6.0.0"}
+	// hostPlatformModuleVersions are the Bazel versions where @local_config_platform is deprecated
+	// in favor of @platforms//host.
+	hostPlatformModuleVersions = versionRange{Min: "7.0.0"}
+
+	// javaBuildTemplates are the templates of the Java toolchain config BUILD file. Bazel versions
+	// before localJavaRuntimeVersions use the java_runtime rule.
+	javaBuildTemplates = templateRegistry{
+		file:   "java/BUILD",
+		params: reflect.TypeOf(javaBuildTemplateParams{}),
+		templates: []versionedTemplate{
+			{versions: versionRange{Max: "5.0.0"}, tmpl: legacyJavaBuildTemplate},
+			{versions: versionRange{Min: "5.0.0", Max: "7.0.0"}, tmpl: javaBuildTemplateLt7},
+			{versions: versionRange{Min: "7.0.0"}, tmpl: javaBuildTemplate},
+		},
+	}
+	// configBuildTemplates are the templates of the crosstool top/platform BUILD file.
+	configBuildTemplates = templateRegistry{
+		file:   "config/BUILD",
+		params: reflect.TypeOf(PlatformToolchainsTemplateParams{}),
+		templates: []versionedTemplate{
+			{tmpl: platformsToolchainBuildTemplate},
+		},
+	}
+	// pythonBuildTemplates are the templates of the Python toolchain config BUILD file.
+	pythonBuildTemplates = templateRegistry{
+		file:   "python/BUILD",
+		params: reflect.TypeOf(pythonBuildTemplateParams{}),
+		templates: []versionedTemplate{
+			{tmpl: pythonBuildTemplate},
+		},
+	}
+	// bazelrcTemplates are the templates of the .bazelrc fragment.
+	bazelrcTemplates = templateRegistry{
+		file:   bazelrcFileName,
+		params: reflect.TypeOf(bazelrcTemplateParams{}),
+		templates: []versionedTemplate{
+			{tmpl: bazelrcTemplate},
+		},
+	}
+	// moduleTemplates are the templates of the MODULE.bazel file generated in the Bzlmod output
+	// mode.
+	moduleTemplates = templateRegistry{
+		file:   moduleFileName,
+		params: reflect.TypeOf(moduleTemplateParams{}),
+		templates: []versionedTemplate{
+			{versions: bzlmodVersions, tmpl: moduleTemplate},
+		},
+	}
+
+	// templateRegistries are all the template registries. Used to verify the version ranges of
+	// every registry.
+	templateRegistries = []templateRegistry{
+		javaBuildTemplates,
+		configBuildTemplates,
+		pythonBuildTemplates,
+		bazelrcTemplates,
+		moduleTemplates,
+	}
+	// overridableTemplateRegistries are the registries of the generated BUILD files whose templates
+	// can be overridden by a template directory.
+	overridableTemplateRegistries = []templateRegistry{
+		configBuildTemplates,
+		javaBuildTemplates,
+		pythonBuildTemplates,
+	}
+)
+
+// parseBazelVersion parses the given Bazel version as a semver ignoring any pre-release, release
+// candidate or build suffix, i.e., pre-releases & release candidates of a Bazel version are
+// treated like the release itself.
+func parseBazelVersion(bazelVersion string) (*semver.Version, error) {
+	m := bazelVersionRegexp.FindStringSubmatch(bazelVersion)
+	if m == nil {
+		return nil, fmt.Errorf("unable to parse Bazel version %q as a semver", bazelVersion)
+	}
+	bv, err := semver.NewVersion(fmt.Sprintf("%s.%s.%s", m[1], m[2], m[3]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse Bazel version %q as a semver: %w", bazelVersion, err)
+	}
+	return bv, nil
+}
+
+// versionRange is a range of Bazel versions including Min & excluding Max. An empty Min or Max
+// leaves the range unbounded on that side.
+type versionRange struct {
+	Min string
+	Max string
+}
+
+// contains returns whether the given Bazel version is in the range. An empty Bazel version is
+// treated as the latest Bazel version.
+func (r versionRange) contains(bazelVersion string) (bool, error) {
+	if bazelVersion == "" {
+		return r.Max == "", nil
+	}
+	bv, err := parseBazelVersion(bazelVersion)
+	if err != nil {
+		return false, err
+	}
+	if r.Min != "" && bv.LessThan(*semver.New(r.Min)) {
+		return false, nil
+	}
+	if r.Max != "" && !bv.LessThan(*semver.New(r.Max)) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (r versionRange) String() string {
+	switch {
+	case r.Min == "" && r.Max == "":
+		return "all versions"
+	case r.Min == "":
+		return fmt.Sprintf("<%s", r.Max)
+	case r.Max == "":
+		return fmt.Sprintf(">=%s", r.Min)
+	}
+	return fmt.Sprintf(">=%s, <%s", r.Min, r.Max)
+}
+
+// versionedTemplate is the template used to generate a file for a range of Bazel versions.
+type versionedTemplate struct {
+	versions versionRange
+	tmpl     *template.Template
+}
+
+// templateRegistry lists the templates used to generate a file for each range of Bazel versions.
+// Changes in the behavior of newer Bazel versions are supported by adding a template for the
+// range of Bazel versions they apply to.
+type templateRegistry struct {
+	// file is the name of the generated file.
+	file string
+	// params is the type of the parameters the templates are executed with.
+	params reflect.Type
+	// templates are the templates for each range of Bazel versions in ascending order. The ranges
+	// must not overlap.
+	templates []versionedTemplate
+}
+
+// lookup returns the template used to generate the file for the given Bazel version.
+func (r templateRegistry) lookup(bazelVersion string) (*template.Template, error) {
+	for _, t := range r.templates {
+		ok, err := t.versions.contains(bazelVersion)
+		if err != nil {
+			return nil, fmt.Errorf("unable to pick the template to generate %s: %w", r.file, err)
+		}
+		if ok {
+			return t.tmpl, nil
+		}
+	}
+	return nil, fmt.Errorf("%s can't be generated for Bazel %q", r.file, bazelVersion)
+}
+
+// verify checks the bounds of every version range in the registry are valid semvers and that the
+// ranges are in ascending order without overlapping.
+func (r templateRegistry) verify() error {
+	var prevMax *semver.Version
+	for i, t := range r.templates {
+		var min, max *semver.Version
+		var err error
+		if t.versions.Min != "" {
+			if min, err = semver.NewVersion(t.versions.Min); err != nil {
+				return fmt.Errorf("%s: invalid lower bound of range %d: %w", r.file, i, err)
+			}
+		}
+		if t.versions.Max != "" {
+			if max, err = semver.NewVersion(t.versions.Max); err != nil {
+				return fmt.Errorf("%s: invalid upper bound of range %d: %w", r.file, i, err)
+			}
+		}
+		if min != nil && max != nil && !min.LessThan(*max) {
+			return fmt.Errorf("%s: range %d (%v) is empty", r.file, i, t.versions)
+		}
+		if i > 0 && (prevMax == nil || min == nil || min.LessThan(*prevMax)) {
+			return fmt.Errorf("%s: range %d (%v) overlaps with the range before it", r.file, i, t.versions)
+		}
+		prevMax = max
+	}
+	return nil
+}
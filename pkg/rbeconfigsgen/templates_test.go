@@ -0,0 +1,177 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"testing"
+	"text/template"
+)
+
+func TestVersionRangeContains(t *testing.T) {
+	r := versionRange{Min: "5.0.0", Max: "7.0.0"}
+	tests := []struct {
+		version string
+		want    bool
+		wantErr bool
+	}{
+		{version: "4.2.2", want: false},
+		{version: "5.0.0", want: true},
+		{version: "5.0.0-pre.20210708.4", want: true},
+		{version: "6.5.0", want: true},
+		{version: "6.99.99rc1", want: true},
+		{version: "7.0.0", want: false},
+		{version: "7.0.0rc1", want: false},
+		{version: "7.0.0-pre.20230724.1", want: false},
+		{version: "10.0.0", want: false},
+		// An unspecified version is the latest version.
+		{version: "", want: false},
+		{version: "7", wantErr: true},
+		{version: "latest", wantErr: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.version, func(t *testing.T) {
+			t.Parallel()
+			got, err := r.contains(tc.version)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("contains(%q) got error %v, want error=%v", tc.version, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("%v contains(%q)=%v, want %v", r, tc.version, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTemplateRegistriesVerify(t *testing.T) {
+	for _, r := range templateRegistries {
+		if err := r.verify(); err != nil {
+			t.Errorf("Template registry for %s is invalid: %v", r.file, err)
+		}
+	}
+	deps := templateRegistry{file: "module dependencies"}
+	for _, d := range moduleDeps {
+		deps.templates = append(deps.templates, versionedTemplate{versions: d.Versions})
+	}
+	if err := deps.verify(); err != nil {
+		t.Errorf("Module dependencies are invalid: %v", err)
+	}
+}
+
+func TestTemplateRegistryVerifyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []versionRange
+	}{
+		{
+			name:   "Overlap",
+			ranges: []versionRange{{Max: "7.0.0"}, {Min: "6.0.0"}},
+		},
+		{
+			name:   "Unbounded",
+			ranges: []versionRange{{}, {Min: "6.0.0"}},
+		},
+		{
+			name:   "Empty",
+			ranges: []versionRange{{Min: "7.0.0", Max: "7.0.0"}},
+		},
+		{
+			name:   "InvalidBound",
+			ranges: []versionRange{{Min: "7"}},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			r := templateRegistry{file: "BUILD"}
+			for _, v := range tc.ranges {
+				r.templates = append(r.templates, versionedTemplate{versions: v})
+			}
+			if err := r.verify(); err == nil {
+				t.Errorf("verify succeeded for ranges %v, want error", tc.ranges)
+			}
+		})
+	}
+}
+
+func TestTemplateRegistryLookup(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry templateRegistry
+		version  string
+		want     *template.Template
+		wantErr  bool
+	}{
+		{name: "Java/3.7.2", registry: javaBuildTemplates, version: "3.7.2", want: legacyJavaBuildTemplate},
+		{name: "Java/4.2.1", registry: javaBuildTemplates, version: "4.2.1", want: legacyJavaBuildTemplate},
+		{name: "Java/5.0.0-pre", registry: javaBuildTemplates, version: "5.0.0-pre.20210708.4", want: javaBuildTemplateLt7},
+		{name: "Java/5.0.0", registry: javaBuildTemplates, version: "5.0.0", want: javaBuildTemplateLt7},
+		{name: "Java/6.4.0", registry: javaBuildTemplates, version: "6.4.0", want: javaBuildTemplateLt7},
+		{name: "Java/7.0.0rc1", registry: javaBuildTemplates, version: "7.0.0rc1", want: javaBuildTemplate},
+		{name: "Java/7.0.0-pre", registry: javaBuildTemplates, version: "7.0.0-pre.20230724.1", want: javaBuildTemplate},
+		{name: "Java/10.0.0", registry: javaBuildTemplates, version: "10.0.0", want: javaBuildTemplate},
+		{name: "Java/Latest", registry: javaBuildTemplates, version: "", want: javaBuildTemplate},
+		{name: "Java/Invalid", registry: javaBuildTemplates, version: "7.x", wantErr: true},
+		{name: "Config/4.0.0", registry: configBuildTemplates, version: "4.0.0", want: platformsToolchainBuildTemplate},
+		{name: "Config/8.0.0", registry: configBuildTemplates, version: "8.0.0", want: platformsToolchainBuildTemplate},
+		{name: "Bazelrc/4.0.0", registry: bazelrcTemplates, version: "4.0.0", want: bazelrcTemplate},
+		{name: "Bazelrc/8.0.0", registry: bazelrcTemplates, version: "8.0.0", want: bazelrcTemplate},
+		{name: "Module/5.4.0", registry: moduleTemplates, version: "5.4.0", wantErr: true},
+		{name: "Module/6.0.0-pre", registry: moduleTemplates, version: "6.0.0-pre.20220630.1", want: moduleTemplate},
+		{name: "Module/8.0.0", registry: moduleTemplates, version: "8.0.0", want: moduleTemplate},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := tc.registry.lookup(tc.version)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("lookup(%q) for %s got error %v, want error=%v", tc.version, tc.registry.file, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("lookup(%q) for %s returned the wrong template %v, want %v", tc.version, tc.registry.file, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestModuleDepsForBazel(t *testing.T) {
+	tests := []struct {
+		version       string
+		wantRulesJava string
+		wantErr       bool
+	}{
+		{version: "5.4.0", wantErr: true},
+		{version: "6.0.0", wantRulesJava: "6.5.2"},
+		{version: "7.0.0rc1", wantRulesJava: "7.6.1"},
+		{version: "7.4.1", wantRulesJava: "7.6.1"},
+		{version: "8.0.0-pre.20240101.1", wantRulesJava: "8.6.1"},
+		{version: "10.0.0", wantRulesJava: "8.6.1"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.version, func(t *testing.T) {
+			t.Parallel()
+			got, err := moduleDepsForBazel(tc.version)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("moduleDepsForBazel(%q) got error %v, want error=%v", tc.version, err, tc.wantErr)
+			}
+			if got.RulesJava != tc.wantRulesJava {
+				t.Errorf("moduleDepsForBazel(%q) picked rules_java %q, want %q", tc.version, got.RulesJava, tc.wantRulesJava)
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// diffContextLines is the number of unchanged lines around every change in the unified diffs
+	// printed by Verify.
+	diffContextLines = 3
+	// maxDiffEdits is the maximum number of added & removed lines in the diffs printed by Verify.
+	// Computing a diff takes memory quadratic in the number of edits, so files with more changes
+	// are only reported as different.
+	maxDiffEdits = 1000
+)
+
+// Verify regenerates the configs for the given options into a temporary directory and compares
+// them with the configs previously generated into OutputConfigPath under OutputSourceRoot & the
+// manifest at OutputManifest, if specified. A unified diff of every difference is written to w.
+// Returns whether the existing configs are up to date. OutputTarball is ignored.
+// The options are expected to have been validated.
+func Verify(o Options, w io.Writer) (bool, error) {
+	rt, err := containerRuntimeForOptions(&o)
+	if err != nil {
+		return false, fmt.Errorf("unable to initialize the container runtime: %w", err)
+	}
+	return verify(o, rt, w)
+}
+
+// verify verifies the configs for the given options are up to date using the given container
+// runtime to run the toolchain container.
+func verify(o Options, rt ContainerRuntime, w io.Writer) (bool, error) {
+	if o.OutputSourceRoot == "" {
+		return false, fmt.Errorf("OutputSourceRoot is required to verify previously generated configs")
+	}
+	dir, err := ioutil.TempDir("", "rbeconfigsgen_verify_")
+	if err != nil {
+		return false, fmt.Errorf("failed to create a temporary local directory to regenerate configs into: %w", err)
+	}
+	if o.Cleanup {
+		defer os.RemoveAll(dir)
+	}
+	existingDir := path.Join(o.OutputSourceRoot, o.OutputConfigPath)
+	existingManifest := o.OutputManifest
+
+	gen := o
+	gen.OutputTarball = ""
+	gen.OutputSourceRoot = dir
+	gen.DryRun = false
+	if existingManifest != "" {
+		gen.OutputManifest = filepath.Join(dir, "manifest.json")
+	}
+	log.Printf("Regenerating configs into %q to compare with %q.", dir, existingDir)
+	if err := run(gen, rt); err != nil {
+		return false, fmt.Errorf("failed to regenerate configs: %w", err)
+	}
+	var m *Manifest
+	if existingManifest != "" {
+		m, err = ManifestFromJSONFile(gen.OutputManifest)
+	} else {
+		// The manifest is only needed to list the regenerated files.
+		m, err = newManifestForDir(path.Join(dir, o.OutputConfigPath))
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to read the manifest of the regenerated configs: %w", err)
+	}
+
+	upToDate := true
+	var old *Manifest
+	if existingManifest != "" {
+		// A missing manifest is reported as a difference.
+		if _, err := os.Stat(existingManifest); err == nil {
+			if old, err = ManifestFromJSONFile(existingManifest); err != nil {
+				return false, fmt.Errorf("unable to read the manifest of the existing configs: %w", err)
+			}
+		}
+		d, err := diffManifests(existingManifest, old, m, w)
+		if err != nil {
+			return false, err
+		}
+		upToDate = !d
+	}
+	d, err := diffConfigDirs(existingDir, path.Join(dir, o.OutputConfigPath), m, old, w)
+	if err != nil {
+		return false, err
+	}
+	upToDate = upToDate && !d
+	if upToDate {
+		log.Printf("Configs in %q are up to date.", existingDir)
+	} else {
+		log.Printf("Configs in %q are out of date.", existingDir)
+	}
+	return upToDate, nil
+}
+
+// newManifestForDir returns a manifest listing every file in the given directory.
+func newManifestForDir(dir string) (*Manifest, error) {
+	var files []generatedFile
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		g, err := readGeneratedFile(dir, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		files = append(files, g)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the files in %q: %w", dir, err)
+	}
+	return &Manifest{Files: manifestFiles(files)}, nil
+}
+
+// diffManifests writes a unified diff of the given existing manifest read from the given path,
+// which is nil if it doesn't exist, & the given manifest of the regenerated configs to w. Fields
+// expected to change every time configs are generated, e.g., the generation time, are ignored.
+// Returns whether the manifests differ.
+func diffManifests(existingPath string, existing, regenerated *Manifest, w io.Writer) (bool, error) {
+	var want []byte
+	if existing != nil {
+		var err error
+		if want, err = normalizedManifestJSON(existing); err != nil {
+			return false, err
+		}
+	}
+	got, err := normalizedManifestJSON(regenerated)
+	if err != nil {
+		return false, err
+	}
+	return writeUnifiedDiff(w, existingPath, "regenerated/manifest.json", want, got)
+}
+
+// normalizedManifestJSON returns the JSON of the given manifest without the fields expected to
+// change every time configs are generated or between machines generating the same configs, e.g.,
+// the container runtime or the local paths of Bazel & the templates.
+func normalizedManifestJSON(m *Manifest) ([]byte, error) {
+	n := *m
+	n.GeneratorVersion = ""
+	n.GeneratedAt = ""
+	// Verify never generates a tarball.
+	n.ConfigsTarballDigest = ""
+	n.ConfigsTarballFormat = ""
+	if m.Options != nil {
+		opts := *m.Options
+		opts.ContainerRuntime = ""
+		opts.BazelPath = ""
+		opts.DockerPlatform = ""
+		opts.TemplateDir = ""
+		opts.CppEnvJSON = ""
+		n.Options = &opts
+	}
+	blob, err := json.MarshalIndent(n, "", " ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate JSON for the manifest: %w", err)
+	}
+	return append(blob, '\n'), nil
+}
+
+// diffConfigDirs writes a unified diff of every file listed in either of the given manifests of
+// the existing & regenerated configs that differs between the given directories to w. The
+// manifest of the existing configs is optional and used to detect files that are no longer
+// generated. Returns whether any file differs.
+func diffConfigDirs(existingDir, regeneratedDir string, regenerated, existing *Manifest, w io.Writer) (bool, error) {
+	names := make(map[string]bool)
+	for _, f := range regenerated.Files {
+		names[f.Path] = true
+	}
+	if existing != nil {
+		for _, f := range existing.Files {
+			names[f.Path] = true
+		}
+	}
+	var sorted []string
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	differ := false
+	for _, n := range sorted {
+		want, err := readFileIfExists(path.Join(existingDir, n))
+		if err != nil {
+			return false, err
+		}
+		got, err := readFileIfExists(path.Join(regeneratedDir, n))
+		if err != nil {
+			return false, err
+		}
+		d, err := writeUnifiedDiff(w, path.Join("a", n), path.Join("b", n), want, got)
+		if err != nil {
+			return false, err
+		}
+		differ = differ || d
+	}
+	return differ, nil
+}
+
+// readFileIfExists returns the contents of the given file, or the path it points to if it's a
+// symlink, or nil if it doesn't exist.
+func readFileIfExists(p string) ([]byte, error) {
+	g, err := readGeneratedFile(path.Dir(p), path.Base(p))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %q: %w", p, err)
+	}
+	return g.contents, nil
+}
+
+// writeUnifiedDiff writes a unified diff turning 'a' into 'b' to w. Missing files are represented
+// by nil contents & named /dev/null in the diff. Only a note that the contents differ is written if
+// the diff would have more than maxDiffEdits added & removed lines. Returns whether the contents
+// differ.
+func writeUnifiedDiff(w io.Writer, aName, bName string, a, b []byte) (bool, error) {
+	if a != nil && b != nil && string(a) == string(b) {
+		return false, nil
+	}
+	if a == nil && b == nil {
+		return false, nil
+	}
+	if a == nil {
+		aName = "/dev/null"
+	}
+	if b == nil {
+		bName = "/dev/null"
+	}
+	ops, ok := diffLines(splitLines(string(a)), splitLines(string(b)), maxDiffEdits)
+	var err error
+	if ok {
+		_, err = fmt.Fprintf(w, "--- %s\n+++ %s\n%s", aName, bName, unifiedDiffHunks(ops))
+	} else {
+		_, err = fmt.Fprintf(w, "Files %s and %s differ in more than %d lines\n", aName, bName, maxDiffEdits)
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to write the diff of %q: %w", bName, err)
+	}
+	return true, nil
+}
+
+// splitLines splits the given text into lines keeping the trailing newlines.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffOp is a line of a diff. kind is ' ' for a line in both inputs, '-' for a line only in the
+// first input & '+' for a line only in the second input.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the shortest edit script turning the lines in 'a' into the lines in 'b'
+// using Myers' diff algorithm or false if the script has more than maxEdits added & removed lines.
+// The memory used is linear in the number of lines & quadratic in maxEdits.
+func diffLines(a, b []string, maxEdits int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	// v maps every diagonal k in [-max, max] offset by max+1 to the furthest x reached on it.
+	v := make([]int, 2*max+3)
+	off := max + 1
+	// trace[d] are the furthest x reached on the diagonals [-d-1, d+1] before the d-th step. Only
+	// these diagonals are read when walking the trace backwards.
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		if d > maxEdits {
+			return nil, false
+		}
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+		if done {
+			break
+		}
+	}
+
+	// Walk the trace backwards to collect the edits in reverse order.
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		// The offset of diagonal 0 in trace[d].
+		off := d + 1
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{kind: ' ', line: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{kind: '+', line: b[y-1]})
+			} else {
+				ops = append(ops, diffOp{kind: '-', line: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, true
+}
+
+// unifiedDiffHunks returns the hunks of a unified diff of the given edit script with
+// diffContextLines lines of context around every change.
+func unifiedDiffHunks(ops []diffOp) string {
+	var sb strings.Builder
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk over every change separated by at most 2*diffContextLines unchanged
+		// lines from the previous one.
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContextLines {
+				break
+			}
+		}
+		end += diffContextLines
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		aStart, bStart := 1, 1
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				aStart++
+			}
+			if op.kind != '-' {
+				bStart++
+			}
+		}
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		// Empty ranges are numbered after the line preceding them.
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return sb.String()
+}
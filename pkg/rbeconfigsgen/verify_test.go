@@ -0,0 +1,212 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rbeconfigsgen
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []byte
+		b    []byte
+		want string
+	}{
+		{
+			name: "Equal",
+			a:    []byte("a\nb\n"),
+			b:    []byte("a\nb\n"),
+			want: "",
+		},
+		{
+			name: "Changed",
+			a:    []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"),
+			b:    []byte("1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"),
+			want: "--- a/f\n+++ b/f\n" +
+				"@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n" +
+				"@@ -10,3 +10,4 @@\n 10\n 11\n 12\n+13\n",
+		},
+		{
+			name: "NearbyChangesShareHunk",
+			a:    []byte("1\n2\n3\n4\n5\n6\n7\n8\n"),
+			b:    []byte("one\n2\n3\n4\n5\n6\n7\neight\n"),
+			want: "--- a/f\n+++ b/f\n@@ -1,8 +1,8 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n",
+		},
+		{
+			name: "Added",
+			b:    []byte("a\nb\n"),
+			want: "--- /dev/null\n+++ b/f\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "Removed",
+			a:    []byte("a\n"),
+			want: "--- a/f\n+++ /dev/null\n@@ -1,1 +0,0 @@\n-a\n",
+		},
+		{
+			name: "TooManyChanges",
+			a:    []byte(strings.Repeat("a\n", maxDiffEdits)),
+			b:    []byte(strings.Repeat("b\n", maxDiffEdits)),
+			want: fmt.Sprintf("Files a/f and b/f differ in more than %d lines\n", maxDiffEdits),
+		},
+		{
+			name: "NoTrailingNewline",
+			a:    []byte("a\nb"),
+			b:    []byte("a\nb\n"),
+			want: "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			buf := bytes.NewBuffer(nil)
+			differ, err := writeUnifiedDiff(buf, "a/f", "b/f", tc.a, tc.b)
+			if err != nil {
+				t.Fatalf("writeUnifiedDiff failed: %v", err)
+			}
+			if differ != (tc.want != "") {
+				t.Errorf("writeUnifiedDiff(%q, %q)=%v, want %v", tc.a, tc.b, differ, tc.want != "")
+			}
+			if got := buf.String(); got != tc.want {
+				t.Errorf("writeUnifiedDiff(%q, %q) wrote:\n%s\nwant:\n%s", tc.a, tc.b, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	image := "gcr.io/foo/bar@sha256:" + strings.Repeat("a", 64)
+	newOptions := func(root string) Options {
+		o := Options{
+			BazelVersion:       "6.0.0",
+			ToolchainContainer: "gcr.io/foo/bar:latest",
+			ExecOS:             OSLinux,
+			TargetOS:           OSLinux,
+			OutputSourceRoot:   root,
+			OutputConfigPath:   "configs",
+			OutputManifest:     path.Join(root, "manifest.json"),
+			GenGoConfigs:       true,
+			TempWorkDir:        t.TempDir(),
+			Cleanup:            true,
+		}
+		if err := o.ApplyDefaults(o.ExecOS); err != nil {
+			t.Fatalf("ApplyDefaults failed: %v", err)
+		}
+		return o
+	}
+	newRuntime := func(image, goVersion string) *fakeRuntime {
+		return &fakeRuntime{
+			image: image,
+			env:   []string{"PATH=/bin"},
+			goSDK: []string{"/usr/local/go/bin/go", "/usr/local/go", goVersion, "linux", "amd64"},
+		}
+	}
+	tests := []struct {
+		name string
+		// rt is the runtime of the toolchain container when verifying the configs.
+		rt *fakeRuntime
+		// verifyOptions modifies the options used to verify the configs if specified.
+		verifyOptions func(o *Options)
+		// modify modifies the configs generated in the given root directory before verifying them.
+		modify    func(t *testing.T, root string)
+		wantDiffs []string
+	}{
+		{
+			name: "UpToDate",
+			rt:   newRuntime(image, "go1.21.5"),
+		},
+		{
+			name: "OtherHost",
+			rt:   newRuntime(image, "go1.21.5"),
+			verifyOptions: func(o *Options) {
+				o.ContainerRuntime = RuntimePodman
+				o.BazelPath = "/opt/bazel/bin/bazel"
+				o.DockerPlatform = "linux/amd64"
+			},
+		},
+		{
+			name: "NewImage",
+			rt:   newRuntime("gcr.io/foo/bar@sha256:"+strings.Repeat("b", 64), "go1.21.6"),
+			wantDiffs: []string{
+				"-   \"version\": \"1.21.5\"\n+   \"version\": \"1.21.6\"\n",
+				"--- a/config/BUILD\n+++ b/config/BUILD\n",
+				"--- a/go/sdk.bzl\n+++ b/go/sdk.bzl\n",
+				"-GO_VERSION = \"1.21.5\"\n+GO_VERSION = \"1.21.6\"\n",
+			},
+		},
+		{
+			name: "EditedFile",
+			rt:   newRuntime(image, "go1.21.5"),
+			modify: func(t *testing.T, root string) {
+				if err := ioutil.WriteFile(path.Join(root, "configs", "go", "BUILD"), []byte("edited\n"), 0644); err != nil {
+					t.Fatalf("Unable to edit go/BUILD: %v", err)
+				}
+			},
+			wantDiffs: []string{
+				"--- a/go/BUILD\n+++ b/go/BUILD\n",
+				"-edited\n",
+			},
+		},
+		{
+			name: "MissingManifest",
+			rt:   newRuntime(image, "go1.21.5"),
+			modify: func(t *testing.T, root string) {
+				if err := os.Remove(path.Join(root, "manifest.json")); err != nil {
+					t.Fatalf("Unable to delete the manifest: %v", err)
+				}
+			},
+			wantDiffs: []string{
+				"--- /dev/null\n+++ regenerated/manifest.json\n",
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := run(newOptions(root), newRuntime(image, "go1.21.5")); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if tc.modify != nil {
+				tc.modify(t, root)
+			}
+			o := newOptions(root)
+			if tc.verifyOptions != nil {
+				tc.verifyOptions(&o)
+			}
+			buf := bytes.NewBuffer(nil)
+			upToDate, err := verify(o, tc.rt, buf)
+			if err != nil {
+				t.Fatalf("verify failed: %v", err)
+			}
+			diff := buf.String()
+			if upToDate != (len(tc.wantDiffs) == 0) {
+				t.Errorf("verify returned up to date %v, want %v, diff:\n%s", upToDate, len(tc.wantDiffs) == 0, diff)
+			}
+			for _, want := range tc.wantDiffs {
+				if !strings.Contains(diff, want) {
+					t.Errorf("verify diff did not contain %q, got:\n%s", want, diff)
+				}
+			}
+		})
+	}
+}
@@ -30,10 +30,10 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -98,10 +98,13 @@ func downloadManifest(u string) (*rbeconfigsgen.Manifest, error) {
 	}
 	defer resp.Body.Close()
 
-	result := &rbeconfigsgen.Manifest{}
-	um := json.NewDecoder(resp.Body)
-	if err := um.Decode(result); err != nil {
-		return nil, fmt.Errorf("failed to download/parse the manifest from %q: %w", u, err)
+	blob, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the manifest from %q: %w", u, err)
+	}
+	result, err := rbeconfigsgen.ParseManifest(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the manifest downloaded from %q: %w", u, err)
 	}
 	if len(result.BazelVersion) == 0 {
 		return nil, fmt.Errorf("manifest downloaded from %q did not specify a Bazel version", u)
@@ -229,35 +232,20 @@ build:remote --remote_timeout=3600
 # default. You can use --google_credentials=some_file.json to use a service
 # account credential instead.
 build:remote --google_default_credentials=true
-
-# C++ toolchain & default platform configuration.
-build:remote --crosstool_top=@rbe_default//cc:toolchain
-build:remote --action_env=BAZEL_DO_NOT_DETECT_CPP_TOOLCHAIN=1
-build:remote --extra_toolchains=@rbe_default//config:cc-toolchain
-build:remote --extra_execution_platforms=@rbe_default//config:platform
-build:remote --host_platform=@rbe_default//config:platform
-build:remote --platforms=@rbe_default//config:platform
 `)
-	// The Java toolchain rules used by Bazel are expected to change in a certain Bazel version
-	// that affects the bazelrc file.
-	u, err := rbeconfigsgen.UsesLocalJavaRuntime(m.BazelVersion)
+	// The flags needed to use the configs depend on the Bazel version the configs were generated
+	// for and are generated the same way as the .bazelrc fragment shipped with the configs.
+	flags, err := rbeconfigsgen.Bazelrc(&rbeconfigsgen.Options{
+		BazelVersion:       m.BazelVersion,
+		ToolchainContainer: m.ToolchainContainer,
+		PlatformParams:     &rbeconfigsgen.PlatformToolchainsTemplateParams{},
+		GenCPPConfigs:      true,
+		GenJavaConfigs:     true,
+	})
 	if err != nil {
-		return fmt.Errorf("unable to determine type of Java toolchain rules used by Bazel %q: %w", m.BazelVersion, err)
-	}
-	if u {
-		fmt.Fprint(o, `
-build:remote --java_runtime_version=rbe_jdk
-build:remote --tool_java_runtime_version=rbe_jdk
-build:remote --extra_toolchains=@rbe_default//java:all
-`)
-	} else {
-		fmt.Fprint(o, `
-build:remote --host_javabase=@rbe_default//java:jdk
-build:remote --javabase=@rbe_default//java:jdk
-build:remote --host_java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8
-build:remote --java_toolchain=@bazel_tools//tools/jdk:toolchain_hostjdk8
-`)
+		return fmt.Errorf("unable to generate the flags to use the configs for Bazel %q: %w", m.BazelVersion, err)
 	}
+	fmt.Fprintf(o, "\n%s", flags)
 	log.Printf("Generated .bazelrc file in %q.", outputDir)
 	return nil
 }